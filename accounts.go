@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Prefixes of account credentials, so leaked ones are easy to recognize.
+const (
+	accountKeyPrefix   = "ask_"
+	accountLoginPrefix = "asl_"
+)
+
+// Signup and login attempts allowed per client IP and minute.
+const accountAttemptsPerMinute = 10
+
+var accountIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{1,31}$`)
+
+// dummyPasswordHash is compared against on logins to unknown accounts, so
+// they take as long as wrong passwords.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("askllm"), bcrypt.DefaultCost)
+
+// accountKeyView is an account key as shown to its owner.
+type accountKeyView struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name,omitempty"`
+	Prefix    string     `json:"prefix"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func viewKey(k *AccountKey) accountKeyView {
+	return accountKeyView{ID: k.ID, Name: k.Name, Prefix: k.Prefix, CreatedAt: k.CreatedAt, ExpiresAt: k.ExpiresAt}
+}
+
+// accountView is an account without its credentials.
+type accountView struct {
+	ID        string           `json:"id"`
+	Role      string           `json:"role"`
+	CreatedAt time.Time        `json:"created_at"`
+	Keys      []accountKeyView `json:"keys"`
+}
+
+func viewAccount(acc *Account) accountView {
+	v := accountView{ID: acc.ID, Role: roleOf(&ClientConfig{Role: acc.Role}), CreatedAt: acc.CreatedAt, Keys: []accountKeyView{}}
+	for _, k := range acc.apiKeys() {
+		v.Keys = append(v.Keys, viewKey(k))
+	}
+	return v
+}
+
+// credentialsRequest is the body of signup and login requests.
+type credentialsRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// hashKey returns the stored form of an account credential.
+func hashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAccountKey makes a credential with the given prefix and returns it
+// with its secret, which is shown once and not stored.
+func newAccountKey(prefix, name string, expires *time.Time) (*AccountKey, string) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	secret := prefix + hex.EncodeToString(b)
+	return &AccountKey{
+		ID:        newID(),
+		Name:      name,
+		Hash:      hashKey(secret),
+		Prefix:    secret[:len(prefix)+6],
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expires,
+	}, secret
+}
+
+// accountClient returns the client of the account holding the bearer
+// secret, or nil if there is none.
+func (s *server) accountClient(secret string) *ClientConfig {
+	if s.cfg.Accounts == nil {
+		return nil
+	}
+	acc, ok := s.store.AccountByKey(hashKey(secret), time.Now())
+	if !ok {
+		return nil
+	}
+	return &ClientConfig{ID: acc.ID, Quota: s.cfg.Accounts.Quota, Role: acc.Role, account: true}
+}
+
+// limitAccountAttempts rejects callers making too many signup or login
+// attempts.
+func (s *server) limitAccountAttempts(c *gin.Context) {
+	if ok, _, reset := s.accountAttempts.allow(c.ClientIP()); !ok {
+		auditNote(c, "rate limited: account attempts")
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(reset).Seconds()))))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts. Please try again later."})
+		return
+	}
+	c.Next()
+}
+
+// requireAccount rejects callers that are not signed-up users.
+func requireAccount(c *gin.Context) {
+	if cl := clientFrom(c); cl == nil || !cl.account {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required: send an account API key or login token."})
+		return
+	}
+	c.Next()
+}
+
+// createAccount validates credentials and stores a new account with a
+// first API key. It responds with an error and returns false on failure.
+func (s *server) createAccount(c *gin.Context) (*Account, string, bool) {
+	var req credentialsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body."})
+		return nil, "", false
+	}
+	id := strings.ToLower(strings.TrimSpace(req.Username))
+	if !accountIDPattern.MatchString(id) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Usernames have 2 to 32 letters, digits, dots, dashes or underscores."})
+		return nil, "", false
+	}
+	if len(req.Password) < 8 || len(req.Password) > 72 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Passwords have 8 to 72 bytes."})
+		return nil, "", false
+	}
+	// Configured client IDs are taken: accounts share their usage records.
+	if id == "anonymous" || s.clients.Load().byID[id] != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username is taken."})
+		return nil, "", false
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("Error hashing password: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return nil, "", false
+	}
+	key, secret := newAccountKey(accountKeyPrefix, "default", nil)
+	acc := &Account{ID: id, PasswordHash: string(hash), Keys: []*AccountKey{key}, CreatedAt: time.Now().UTC()}
+	err = s.store.CreateAccount(acc)
+	if errors.Is(err, errAccountExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username is taken."})
+		return nil, "", false
+	}
+	if err != nil {
+		log.Printf("Error saving account %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return nil, "", false
+	}
+	auditNote(c, "created account %s", id)
+	return acc, secret, true
+}
+
+// handleSignup creates an account if self-service signup is open.
+func (s *server) handleSignup(c *gin.Context) {
+	if !s.cfg.Accounts.Signup {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Signup is closed. Ask an operator for an account."})
+		return
+	}
+	if acc, secret, ok := s.createAccount(c); ok {
+		c.JSON(http.StatusCreated, gin.H{"user": acc.ID, "key": secret})
+	}
+}
+
+// handleLogin checks a username and password and returns a login token.
+func (s *server) handleLogin(c *gin.Context) {
+	var req credentialsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body."})
+		return
+	}
+	acc, err := s.store.Account(strings.ToLower(strings.TrimSpace(req.Username)))
+	hash := dummyPasswordHash
+	if err == nil {
+		hash = []byte(acc.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(req.Password)) != nil || acc == nil {
+		auditNote(c, "rejected: invalid login")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password."})
+		return
+	}
+
+	expires := time.Now().UTC().Add(s.cfg.Accounts.LoginTTL.Duration)
+	key, secret := newAccountKey(accountLoginPrefix, "", &expires)
+	if err := s.store.AddAccountKey(acc.ID, key, s.cfg.Accounts.MaxKeys); err != nil {
+		log.Printf("Error saving login of %s: %v", acc.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": acc.ID, "token": secret, "expires_at": expires})
+}
+
+// handleGetAccount returns the caller's account and API keys.
+func (s *server) handleGetAccount(c *gin.Context) {
+	acc, err := s.store.Account(ownerFor(c))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found."})
+		return
+	}
+	c.JSON(http.StatusOK, viewAccount(acc))
+}
+
+// createKeyRequest names a new API key.
+type createKeyRequest struct {
+	Name string `json:"name"`
+}
+
+// handleCreateAccountKey adds an API key to the caller's account.
+func (s *server) handleCreateAccountKey(c *gin.Context) {
+	var req createKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body."})
+		return
+	}
+	key, secret := newAccountKey(accountKeyPrefix, truncateRunes(strings.TrimSpace(req.Name), 100), nil)
+	err := s.store.AddAccountKey(ownerFor(c), key, s.cfg.Accounts.MaxKeys)
+	if errors.Is(err, errTooManyKeys) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Key limit reached: delete a key first."})
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving key of %s: %v", ownerFor(c), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	auditNote(c, "created key %s", key.ID)
+	c.JSON(http.StatusCreated, gin.H{"key": secret, "info": viewKey(key)})
+}
+
+// handleDeleteAccountKey revokes one of the caller's API keys or login
+// tokens.
+func (s *server) handleDeleteAccountKey(c *gin.Context) {
+	err := s.store.DeleteAccountKey(ownerFor(c), c.Param("id"))
+	if errors.Is(err, errKeyNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key not found."})
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting key of %s: %v", ownerFor(c), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	auditNote(c, "deleted key %s", c.Param("id"))
+	c.Status(http.StatusNoContent)
+}
+
+// handleAccountUsage returns a page of the caller's daily usage records.
+func (s *server) handleAccountUsage(c *gin.Context) {
+	q, ok := usageQuery(c)
+	if !ok {
+		return
+	}
+	q.Client = ownerFor(c)
+	s.listUsage(c, q)
+}
+
+// handleAdminListAccounts returns every account.
+func (s *server) handleAdminListAccounts(c *gin.Context) {
+	accounts := []accountView{}
+	for _, acc := range s.store.Accounts() {
+		accounts = append(accounts, viewAccount(acc))
+	}
+	c.JSON(http.StatusOK, gin.H{"accounts": accounts})
+}
+
+// handleAdminCreateAccount creates an account on a user's behalf, also
+// when signup is closed.
+func (s *server) handleAdminCreateAccount(c *gin.Context) {
+	if acc, secret, ok := s.createAccount(c); ok {
+		c.JSON(http.StatusCreated, gin.H{"user": acc.ID, "key": secret})
+	}
+}
+
+// updateAccountRequest changes an account as an admin.
+type updateAccountRequest struct {
+	Role string `json:"role"`
+}
+
+// handleAdminUpdateAccount changes the role of an account.
+func (s *server) handleAdminUpdateAccount(c *gin.Context) {
+	var req updateAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !slices.Contains(roles, req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be admin, operator, user or read-only."})
+		return
+	}
+	err := s.store.SetAccountRole(c.Param("id"), req.Role)
+	if errors.Is(err, errAccountNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found."})
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving account %s: %v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	auditNote(c, "set role of account %s to %s", c.Param("id"), req.Role)
+	acc, _ := s.store.Account(c.Param("id"))
+	c.JSON(http.StatusOK, viewAccount(acc))
+}
+
+// handleAdminDeleteAccount deletes an account and its keys. Its sessions
+// and usage are kept; DELETE /admin/users/:id/data purges the former.
+func (s *server) handleAdminDeleteAccount(c *gin.Context) {
+	err := s.store.DeleteAccount(c.Param("id"))
+	if errors.Is(err, errAccountNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found."})
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting account %s: %v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	auditNote(c, "deleted account %s", c.Param("id"))
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// activityMinutes is how many minutes of request counts are kept, and
+// activityErrors how many failed requests.
+const (
+	activityMinutes = 60
+	activityErrors  = 50
+)
+
+// requestRecord is the outcome of one request.
+type requestRecord struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	LatencyMS int64     `json:"latency_ms"`
+	IP        string    `json:"ip"`
+	Client    string    `json:"client,omitempty"`
+	ErrorCode string    `json:"error_code,omitempty"`
+	Trace     string    `json:"trace,omitempty"`
+}
+
+// activity counts requests per minute and keeps the latest failed ones
+// for the dashboard, and passes every request on to the log streams.
+type activity struct {
+	mu      sync.Mutex
+	minutes [activityMinutes]minuteCount
+	errors  []requestRecord
+
+	// subscribers receive every record. A subscriber that falls behind
+	// misses records rather than slowing requests down.
+	subscribers map[chan requestRecord]struct{}
+}
+
+// minuteCount holds the requests of one minute since the Unix epoch.
+type minuteCount struct {
+	Minute   int64 `json:"minute"`
+	Requests int   `json:"requests"`
+	Errors   int   `json:"errors"`
+}
+
+var recentActivity = &activity{}
+
+// recordActivity records every request except the dashboard's own polling.
+func recordActivity(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	if strings.HasPrefix(c.Request.URL.Path, "/admin/dashboard") {
+		return
+	}
+
+	r := requestRecord{
+		Time:      start,
+		Method:    c.Request.Method,
+		Path:      c.Request.URL.Path,
+		Status:    c.Writer.Status(),
+		LatencyMS: time.Since(start).Milliseconds(),
+		IP:        c.ClientIP(),
+		ErrorCode: c.Writer.Header().Get("X-Error-Code"),
+	}
+	if cl := clientFrom(c); cl != nil {
+		r.Client = cl.ID
+	}
+	if id, ok := c.Get(traceContextKey); ok {
+		r.Trace = id.(string)
+	}
+	recentActivity.add(r)
+}
+
+// add counts r, keeping it as well when it failed. Requests with a status
+// of 400 or more count as errors.
+func (a *activity) add(r requestRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for ch := range a.subscribers {
+		select {
+		case ch <- r:
+		default:
+		}
+	}
+
+	minute := r.Time.Unix() / 60
+	m := &a.minutes[minute%activityMinutes]
+	if m.Minute != minute {
+		*m = minuteCount{Minute: minute}
+	}
+	m.Requests++
+	if r.Status < 400 {
+		return
+	}
+	m.Errors++
+	if len(a.errors) == activityErrors {
+		a.errors = a.errors[1:]
+	}
+	a.errors = append(a.errors, r)
+}
+
+// snapshot returns the counts of the last activityMinutes minutes, oldest
+// first and including those without requests, and the failed requests,
+// newest first.
+func (a *activity) snapshot(now time.Time) (minutes []minuteCount, errors []requestRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	current := now.Unix() / 60
+	for minute := current - activityMinutes + 1; minute <= current; minute++ {
+		m := a.minutes[minute%activityMinutes]
+		if m.Minute != minute {
+			m = minuteCount{Minute: minute}
+		}
+		minutes = append(minutes, m)
+	}
+	for i := len(a.errors) - 1; i >= 0; i-- {
+		errors = append(errors, a.errors[i])
+	}
+	return minutes, errors
+}
+
+// subscribe returns a channel receiving the records of requests from now
+// on, and a function ending the subscription.
+func (a *activity) subscribe() (<-chan requestRecord, func()) {
+	ch := make(chan requestRecord, 64)
+	a.mu.Lock()
+	if a.subscribers == nil {
+		a.subscribers = map[chan requestRecord]struct{}{}
+	}
+	a.subscribers[ch] = struct{}{}
+	a.mu.Unlock()
+	return ch, func() {
+		a.mu.Lock()
+		delete(a.subscribers, ch)
+		a.mu.Unlock()
+	}
+}
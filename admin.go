@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleSetProviderKey replaces a provider's API key at runtime. Requests
+// in flight finish with the old key. With ?tenant= the tenant's own provider
+// of that name is changed.
+func (s *server) handleSetProviderKey(c *gin.Context) {
+	providers := s.providers
+	if id := c.Query("tenant"); id != "" {
+		t, ok := s.tenants[id]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found."})
+			return
+		}
+		providers = t.providers
+	}
+	p, ok := providers[c.Param("name")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Provider not found."})
+		return
+	}
+
+	var req struct {
+		APIKey string `json:"api_key"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.APIKey == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Please provide a JSON body with a non-empty 'api_key' field."})
+		return
+	}
+
+	changed := p.setKey(req.APIKey)
+	if changed {
+		log.Printf("API key for provider %s replaced via admin API", p.name)
+		go s.warmupProvider(context.Background(), p)
+	}
+	c.JSON(http.StatusOK, gin.H{"provider": p.name, "changed": changed})
+}
+
+// handleReload re-reads provider keys and clients from their sources and
+// knowledge base index files.
+func (s *server) handleReload(c *gin.Context) {
+	changed := s.reloadSecrets(c.Request.Context())
+	s.reloadKnowledgeBases()
+	c.JSON(http.StatusOK, gin.H{"updated_providers": changed})
+}
+
+// reloadOnSignal reloads secrets and knowledge base index files whenever
+// the process receives SIGHUP.
+func (s *server) reloadOnSignal(ctx context.Context) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+			log.Println("SIGHUP received, reloading secrets")
+			s.reloadSecrets(ctx)
+			s.reloadKnowledgeBases()
+		}
+	}
+}
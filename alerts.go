@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Alert events sent to operators.
+const (
+	alertProviderDown     = "provider_down"
+	alertProviderUp       = "provider_up"
+	alertKeyRejected      = "key_rejected"
+	alertKeyRefreshFailed = "key_refresh_failed"
+	alertCanaryRolledBack = "canary_rolled_back"
+	alertSpendExceeded    = "spend_exceeded"
+	alertTest             = "test"
+)
+
+// defaultAlertCooldown is how long an alert is not repeated by default.
+const defaultAlertCooldown = 15 * time.Minute
+
+// alertEvents are the events alert webhooks may subscribe to.
+var alertEvents = []string{alertProviderDown, alertProviderUp, alertKeyRejected, alertKeyRefreshFailed, alertCanaryRolledBack, alertSpendExceeded, alertTest}
+
+// Webhook payload formats.
+const (
+	alertFormatGeneric = "generic"
+	alertFormatSlack   = "slack"
+	alertFormatDiscord = "discord"
+)
+
+// alerter posts operator alerts to the configured webhooks. The same event
+// for the same subject is sent at most once per cooldown, so a flapping
+// endpoint or a burst of rejected requests yields a single message. A nil
+// alerter sends nothing.
+type alerter struct {
+	cfg  *AlertsConfig
+	urls []string
+
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+func newAlerter(cfg *AlertsConfig) (*alerter, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	a := &alerter{cfg: cfg, sent: map[string]time.Time{}}
+	for i, wc := range cfg.Webhooks {
+		url := wc.URL
+		if wc.URLEnv != "" {
+			var err error
+			if url, err = getenvSecret(wc.URLEnv); err != nil {
+				return nil, err
+			}
+			if url == "" {
+				return nil, fmt.Errorf("webhooks[%d]: neither %s nor %s_FILE is set", i, wc.URLEnv, wc.URLEnv)
+			}
+		}
+		a.urls = append(a.urls, url)
+	}
+	return a, nil
+}
+
+// raise sends an alert about subject, e.g. a provider name, in the
+// background unless the same one was sent within the cooldown.
+func (a *alerter) raise(event, subject, message string) {
+	if a == nil {
+		return
+	}
+	now := time.Now()
+	key := event + "\x00" + subject
+	a.mu.Lock()
+	if last, ok := a.sent[key]; ok && now.Sub(last) < a.cfg.Cooldown.Duration {
+		a.mu.Unlock()
+		return
+	}
+	a.sent[key] = now
+	a.mu.Unlock()
+
+	log.Printf("Alert %s: %s", event, message)
+	go a.send(context.Background(), event, subject, message, now)
+}
+
+// send posts the alert to every webhook subscribed to event and returns
+// the failures.
+func (a *alerter) send(ctx context.Context, event, subject, message string, at time.Time) []error {
+	var errs []error
+	for i, wc := range a.cfg.Webhooks {
+		if len(wc.Events) > 0 && !slices.Contains(wc.Events, event) {
+			continue
+		}
+		var payload any
+		switch wc.Format {
+		case alertFormatSlack:
+			payload = gin.H{"text": "[askllm] " + message}
+		case alertFormatDiscord:
+			payload = gin.H{"content": "[askllm] " + message}
+		default:
+			payload = gin.H{"event": event, "subject": subject, "message": message, "time": at.UTC()}
+		}
+		if err := postJSON(ctx, a.urls[i], payload); err != nil {
+			log.Printf("Error sending %s alert to webhook %d: %v", event, i, err)
+			errs = append(errs, fmt.Errorf("webhook %d: %w", i, err))
+		}
+	}
+	return errs
+}
+
+// setHealth records whether ep is healthy and raises provider_down when
+// the last healthy endpoint of p fails and provider_up when one recovers.
+func (p *provider) setHealth(ep *endpoint, healthy bool) (changed bool) {
+	if ep.healthy.Swap(healthy) == healthy {
+		return false
+	}
+	up := slices.ContainsFunc(p.endpoints, func(ep *endpoint) bool { return ep.healthy.Load() })
+	if p.down.Swap(!up) == up {
+		if up {
+			p.alerts.raise(alertProviderUp, p.name, fmt.Sprintf("Provider %s is reachable again.", p.name))
+		} else {
+			p.alerts.raise(alertProviderDown, p.name, fmt.Sprintf("Provider %s is down: none of its %d endpoints is reachable.", p.name, len(p.endpoints)))
+		}
+	}
+	return true
+}
+
+// checkKey raises key_rejected when the upstream refuses p's API key,
+// typically because it expired or was revoked.
+func (p *provider) checkKey(status int) {
+	if status == http.StatusUnauthorized {
+		p.alerts.raise(alertKeyRejected, p.name, fmt.Sprintf("Provider %s rejected its API key (status %d); it may have expired or been revoked.", p.name, status))
+	}
+}
+
+// handleTestAlert sends a test alert to every webhook subscribed to it,
+// bypassing the cooldown, and reports failures.
+func (s *server) handleTestAlert(c *gin.Context) {
+	errs := s.alerts.send(c.Request.Context(), alertTest, "askllm", "This is a test alert.", time.Now())
+	if len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"errors": msgs})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
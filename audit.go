@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// auditContextKey is the gin context key holding the request's *auditEntry.
+const auditContextKey = "askllm.audit"
+
+// auditEntry is one record of the audit log. Hash covers the record with
+// Hash empty, including Prev, the hash of the record before it, so editing
+// or removing any record breaks the chain from there on.
+type auditEntry struct {
+	Seq    int64     `json:"seq"`
+	Time   time.Time `json:"time"`
+	Client string    `json:"client,omitempty"`
+	Tenant string    `json:"tenant,omitempty"`
+	IP     string    `json:"ip"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Status int       `json:"status"`
+	Trace  string    `json:"trace,omitempty"`
+
+	// Models are the provider/model pairs the request was routed to.
+	Models           []string `json:"models,omitempty"`
+	PromptTokens     int      `json:"prompt_tokens"`
+	CompletionTokens int      `json:"completion_tokens"`
+
+	// Decisions are the policy decisions taken on the request.
+	Decisions []string `json:"decisions,omitempty"`
+
+	Prev string `json:"prev"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// auditLog is the append-only, hash-chained audit log file.
+type auditLog struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	seq  int64
+	last string
+}
+
+// openAuditLog opens the log at path for appending, continuing the chain of
+// the records already in it.
+func openAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{path: path}
+	err := a.scan(func(e *auditEntry) error {
+		a.seq, a.last = e.Seq, e.Hash
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if a.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600); err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	return a, nil
+}
+
+// scan calls fn with every record of the log, in order.
+func (a *auditLog) scan(fn func(*auditEntry) error) error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("parse audit log: %w", err)
+		}
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// append chains e to the log and writes it.
+func (a *auditLog) append(e *auditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.seq++
+	e.Seq, e.Prev, e.Hash = a.seq, a.last, ""
+	e.Hash = e.digest()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	a.last = e.Hash
+	return nil
+}
+
+// digest returns the hash of e with its Hash field cleared.
+func (e auditEntry) digest() string {
+	e.Hash = ""
+	raw, _ := json.Marshal(e)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// audit records every request in the audit log once it has been answered.
+func (s *server) audit(c *gin.Context) {
+	e := &auditEntry{Time: time.Now().UTC(), IP: c.ClientIP(), Method: c.Request.Method, Path: c.Request.URL.Path}
+	c.Set(auditContextKey, e)
+	ctx, meter := withUsageMeter(c.Request.Context())
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	e.Status = c.Writer.Status()
+	e.Trace = traceIDFrom(c)
+	if cl := clientFrom(c); cl != nil {
+		e.Client = cl.ID
+	}
+	if t := tenantFrom(c); t != nil {
+		e.Tenant = t.cfg.ID
+	}
+	usage := meter.total()
+	e.PromptTokens, e.CompletionTokens = usage.PromptTokens, usage.CompletionTokens
+	if err := s.auditLog.append(e); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+}
+
+// auditNote records a policy decision on the request, when auditing is on.
+func auditNote(c *gin.Context, format string, args ...any) {
+	if v, ok := c.Get(auditContextKey); ok {
+		e := v.(*auditEntry)
+		e.Decisions = append(e.Decisions, fmt.Sprintf(format, args...))
+	}
+}
+
+// auditTarget records where the request was routed, when auditing is on.
+func auditTarget(c *gin.Context, tgt target) {
+	if v, ok := c.Get(auditContextKey); ok {
+		e := v.(*auditEntry)
+		e.Models = append(e.Models, tgt.provider.name+"/"+tgt.model)
+	}
+}
+
+// handleExportAudit streams the audit log as JSON Lines, starting after
+// the record numbered by the 'after' query parameter.
+func (s *server) handleExportAudit(c *gin.Context) {
+	after, _ := strconv.ParseInt(c.Query("after"), 10, 64)
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	enc := json.NewEncoder(c.Writer)
+	err := s.auditLog.scan(func(e *auditEntry) error {
+		if e.Seq <= after {
+			return nil
+		}
+		return enc.Encode(e)
+	})
+	if err != nil {
+		log.Printf("Error exporting audit log: %v", err)
+	}
+}
+
+// handleVerifyAudit checks the hash chain of the whole audit log and reports
+// the first record that does not match.
+func (s *server) handleVerifyAudit(c *gin.Context) {
+	prev := ""
+	var count int64
+	var broken *auditEntry
+	err := s.auditLog.scan(func(e *auditEntry) error {
+		if e.Prev != prev || e.digest() != e.Hash {
+			broken = e
+			return errChainBroken
+		}
+		prev = e.Hash
+		count++
+		return nil
+	})
+	switch {
+	case broken != nil:
+		c.JSON(http.StatusOK, gin.H{"valid": false, "records": count, "broken_at": broken.Seq})
+	case err != nil:
+		log.Printf("Error verifying audit log: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read the audit log."})
+	default:
+		c.JSON(http.StatusOK, gin.H{"valid": true, "records": count, "head": prev})
+	}
+}
+
+var errChainBroken = errors.New("audit chain broken")
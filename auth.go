@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// clientContextKey is the gin context key holding the authenticated *ClientConfig.
+const clientContextKey = "askllm.client"
+
+// clientIndex finds configured clients by id, bearer key or certificate subject.
+type clientIndex struct {
+	byID      map[string]*ClientConfig
+	byKey     map[string]*ClientConfig
+	bySubject map[string]*ClientConfig
+}
+
+func newClientIndex(clients []*ClientConfig) *clientIndex {
+	idx := &clientIndex{
+		byID:      map[string]*ClientConfig{},
+		byKey:     map[string]*ClientConfig{},
+		bySubject: map[string]*ClientConfig{},
+	}
+	for _, cl := range clients {
+		idx.byID[cl.ID] = cl
+		if cl.APIKey != "" {
+			idx.byKey[cl.APIKey] = cl
+		}
+		for _, subject := range cl.CertSubjects {
+			idx.bySubject[subject] = cl
+		}
+	}
+	return idx
+}
+
+// fromCert maps a verified client certificate to a client by its full
+// subject DN (e.g. "CN=build-bot,O=Acme") or by its common name alone.
+func (idx *clientIndex) fromCert(cs *tls.ConnectionState) *ClientConfig {
+	if cs == nil || len(cs.VerifiedChains) == 0 {
+		return nil
+	}
+	subject := cs.VerifiedChains[0][0].Subject
+	if cl, ok := idx.bySubject[subject.String()]; ok {
+		return cl
+	}
+	return idx.bySubject[subject.CommonName]
+}
+
+// authenticate identifies the caller by client certificate, request
+// signature or bearer key and stores the client in the context. An unknown
+// bearer key or a bad signature is rejected; anonymous callers are rejected
+// only when require_auth is set.
+func (s *server) authenticate(c *gin.Context) {
+	cl := s.clients.Load().fromCert(c.Request.TLS)
+
+	if cl == nil && c.GetHeader("X-Signature") != "" {
+		var err error
+		if cl, err = s.verifySignature(c); errors.Is(err, errSignatureBody) {
+			auditNote(c, "rejected: signed body too large")
+			c.Header("Connection", "close")
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Signed request bodies are limited to %d bytes.", maxSignedBody)})
+			return
+		} else if err != nil {
+			auditNote(c, "rejected: invalid signature")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": localize(c, "invalid_signature", err)})
+			return
+		}
+	}
+
+	if cl == nil {
+		if key, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+			key = strings.TrimSpace(key)
+			if cl = s.clients.Load().byKey[key]; cl == nil {
+				cl = s.accountClient(key)
+			}
+			if cl == nil {
+				auditNote(c, "rejected: invalid API key")
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": localize(c, "invalid_api_key")})
+				return
+			}
+		}
+	}
+
+	if cl == nil && s.cfg.RequireAuth {
+		auditNote(c, "rejected: unauthenticated")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": localize(c, "auth_required")})
+		return
+	}
+	if cl != nil {
+		c.Set(clientContextKey, cl)
+		c.Request = c.Request.WithContext(withClientID(c.Request.Context(), cl.ID))
+	}
+	c.Next()
+}
+
+// requireClient rejects anonymous callers.
+func requireClient(c *gin.Context) {
+	if clientFrom(c) == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": localize(c, "auth_required")})
+		return
+	}
+	c.Next()
+}
+
+// clientFrom returns the authenticated client, or nil for anonymous callers.
+func clientFrom(c *gin.Context) *ClientConfig {
+	if v, ok := c.Get(clientContextKey); ok {
+		return v.(*ClientConfig)
+	}
+	return nil
+}
+
+// serverTLSConfig builds the listener TLS settings, including client
+// certificate verification when a client CA is configured.
+func (lc *ListenTLSConfig) serverTLSConfig() (*tls.Config, error) {
+	c := &tls.Config{MinVersion: tls.VersionTLS12}
+	if lc.ClientCAFile == "" {
+		return c, nil
+	}
+
+	pem, err := os.ReadFile(lc.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA bundle %s", lc.ClientCAFile)
+	}
+	c.ClientCAs = pool
+
+	switch lc.ClientAuth {
+	case "", "optional":
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client_auth %q", lc.ClientAuth)
+	}
+	return c, nil
+}
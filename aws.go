@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// awsSecrets reads secrets from AWS Secrets Manager and SSM Parameter Store,
+// using the standard AWS credential chain (environment, shared config,
+// instance or task role).
+type awsSecrets struct {
+	sm  *secretsmanager.Client
+	ssm *ssm.Client
+}
+
+func newAWSSecrets(ctx context.Context, ac *AWSConfig) (*awsSecrets, error) {
+	var opts []func(*awsconfig.LoadOptions) error
+	if ac.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(ac.Region))
+	}
+	conf, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("aws: loading configuration: %w", err)
+	}
+	return &awsSecrets{sm: secretsmanager.NewFromConfig(conf), ssm: ssm.NewFromConfig(conf)}, nil
+}
+
+// read resolves a secret reference:
+//
+//	secretsmanager:<secret id>[#<json field>]
+//	ssm:<parameter name>
+//
+// Secrets Manager values that are JSON objects can be narrowed to one
+// field; SSM SecureString parameters are decrypted.
+func (a *awsSecrets) read(ctx context.Context, ref string) (string, error) {
+	service, name, ok := strings.Cut(ref, ":")
+	if !ok {
+		return "", fmt.Errorf("aws: secret reference %q must start with secretsmanager: or ssm:", ref)
+	}
+
+	switch service {
+	case "secretsmanager":
+		id, field, hasField := strings.Cut(name, "#")
+		out, err := a.sm.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(id)})
+		if err != nil {
+			return "", fmt.Errorf("aws: reading secret %s: %w", id, err)
+		}
+		value := aws.ToString(out.SecretString)
+		if !hasField {
+			return value, nil
+		}
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(value), &fields); err != nil {
+			return "", fmt.Errorf("aws: secret %s is not a JSON object: %w", id, err)
+		}
+		v, ok := fields[field].(string)
+		if !ok || v == "" {
+			return "", fmt.Errorf("aws: secret %s has no string field %q", id, field)
+		}
+		return v, nil
+
+	case "ssm":
+		out, err := a.ssm.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(name), WithDecryption: aws.Bool(true)})
+		if err != nil {
+			return "", fmt.Errorf("aws: reading parameter %s: %w", name, err)
+		}
+		return aws.ToString(out.Parameter.Value), nil
+
+	default:
+		return "", fmt.Errorf("aws: unknown secret service %q", service)
+	}
+}
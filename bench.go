@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultBenchPrompt is sent when no prompts are given.
+const defaultBenchPrompt = "Explain in about 200 words how a hash table works."
+
+// benchSample is the outcome of one benchmark request.
+type benchSample struct {
+	ttft, latency time.Duration
+	usage         UsageInfo
+	err           error
+}
+
+// benchReport summarizes the requests sent to one model.
+type benchReport struct {
+	Model        string  `json:"model"`
+	Requests     int     `json:"requests"`
+	Errors       int     `json:"errors"`
+	ErrorRate    float64 `json:"error_rate"`
+	TTFTMS       gin.H   `json:"ttft_ms"`
+	LatencyMS    gin.H   `json:"latency_ms"`
+	TokensPerSec float64 `json:"tokens_per_sec"`
+	PromptTokens int     `json:"prompt_tokens"`
+	OutputTokens int     `json:"completion_tokens"`
+	Cost         float64 `json:"cost"`
+	Priced       bool    `json:"priced"`
+	WallSeconds  float64 `json:"wall_seconds"`
+}
+
+// runBench streams prompts at models concurrently and reports time to first
+// token, latency, generation speed, error rate and cost for each.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	models := fs.String("models", "", "comma-separated models to benchmark (default: the model catalog, else the default model)")
+	prompt := fs.String("prompt", defaultBenchPrompt, "prompt to send")
+	promptFile := fs.String("prompts", "", "file with one prompt per line, sent in turn")
+	requests := fs.Int("requests", 20, "requests per model")
+	concurrency := fs.Int("concurrency", 4, "requests in flight per model")
+	maxTokens := fs.Int("max-tokens", 256, "completion tokens per request")
+	asJSON := fs.Bool("json", false, "print results as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	prompts := []string{*prompt}
+	if *promptFile != "" {
+		data, err := os.ReadFile(*promptFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading prompts: %v\n", err)
+			return 2
+		}
+		prompts = nil
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				prompts = append(prompts, line)
+			}
+		}
+		if len(prompts) == 0 {
+			fmt.Fprintf(os.Stderr, "Error: %s has no prompts\n", *promptFile)
+			return 2
+		}
+	}
+
+	ctx := context.Background()
+	cfg, providers, err := loadCommandConfig(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		return 2
+	}
+	var targets []target
+	switch {
+	case *models != "":
+		for _, name := range strings.Split(*models, ",") {
+			targets = append(targets, commandTarget(cfg, providers, strings.TrimSpace(name)))
+		}
+	case len(cfg.Models) > 0:
+		for _, m := range cfg.Models {
+			if p := providers[m.Provider]; p != nil {
+				targets = append(targets, target{provider: p, model: m.Model})
+			}
+		}
+	default:
+		targets = append(targets, commandTarget(cfg, providers, ""))
+	}
+
+	var reports []*benchReport
+	for _, tgt := range targets {
+		if !*asJSON {
+			fmt.Fprintf(os.Stderr, "Benchmarking %s/%s...\n", tgt.provider.name, tgt.model)
+		}
+		reports = append(reports, bench(ctx, cfg, tgt, prompts, *requests, max(*concurrency, 1), *maxTokens))
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(gin.H{"results": reports})
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MODEL\tREQUESTS\tERRORS\tTTFT P50\tTTFT P90\tLATENCY P50\tLATENCY P90\tTOKENS/S\tCOST")
+	for _, r := range reports {
+		cost := "-"
+		if r.Priced {
+			cost = fmt.Sprintf("%.4f", r.Cost)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d (%.0f%%)\t%s\t%s\t%s\t%s\t%.1f\t%s\n", r.Model, r.Requests, r.Errors, r.ErrorRate*100,
+			msOf(r.TTFTMS, "p50"), msOf(r.TTFTMS, "p90"), msOf(r.LatencyMS, "p50"), msOf(r.LatencyMS, "p90"), r.TokensPerSec, cost)
+	}
+	w.Flush()
+	return 0
+}
+
+// bench sends n streaming requests to tgt, concurrency at a time.
+func bench(ctx context.Context, cfg *Config, tgt target, prompts []string, n, concurrency, maxTokens int) *benchReport {
+	samples := make([]benchSample, n)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	start := time.Now()
+	for i := range samples {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(s *benchSample, prompt string) {
+			defer func() { <-sem; wg.Done() }()
+			payload := newPayload([]Message{{Role: "user", Content: prompt}})
+			payload.MaxTokens = maxTokens
+			tgt.prepare(&payload)
+
+			reqCtx, meter := withUsageMeter(ctx)
+			sent := time.Now()
+			_, _, s.err = tgt.provider.completeStream(reqCtx, payload, func(string) error {
+				if s.ttft == 0 {
+					s.ttft = time.Since(sent)
+				}
+				return nil
+			})
+			s.latency = time.Since(sent)
+			s.usage = meter.total()
+		}(&samples[i], prompts[i%len(prompts)])
+	}
+	wg.Wait()
+
+	r := &benchReport{Model: tgt.provider.name + "/" + tgt.model, Requests: n, WallSeconds: time.Since(start).Seconds()}
+	price := cfg.priceOf(tgt.provider.name, tgt.model)
+	var ttfts, latencies []time.Duration
+	var speeds float64
+	var timed int
+	for _, s := range samples {
+		r.PromptTokens += s.usage.PromptTokens
+		r.OutputTokens += s.usage.CompletionTokens
+		if price != nil {
+			r.Cost += price.cost(s.usage.PromptTokens, s.usage.CompletionTokens)
+		}
+		if s.err != nil {
+			r.Errors++
+			continue
+		}
+		latencies = append(latencies, s.latency)
+		if s.ttft > 0 {
+			ttfts = append(ttfts, s.ttft)
+			if gen := s.latency - s.ttft; gen > 0 && s.usage.CompletionTokens > 1 {
+				speeds += float64(s.usage.CompletionTokens-1) / gen.Seconds()
+				timed++
+			}
+		}
+	}
+	r.ErrorRate = float64(r.Errors) / float64(n)
+	r.TTFTMS = percentiles(ttfts)
+	r.LatencyMS = percentiles(latencies)
+	if timed > 0 {
+		r.TokensPerSec = speeds / float64(timed)
+	}
+	r.Priced = price != nil
+	return r
+}
+
+// msOf formats a percentile from percentiles, or "-" when there is none.
+func msOf(p gin.H, key string) string {
+	if p == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%dms", p[key])
+}
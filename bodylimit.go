@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// limitBody rejects request bodies larger than max_body_size with 413
+// before any handler reads them.
+func (s *server) limitBody(c *gin.Context) {
+	limit := s.cfg.MaxBodySize
+	if c.Request.Body == nil || c.Request.Body == http.NoBody {
+		c.Next()
+		return
+	}
+	if c.Request.ContentLength > limit {
+		s.rejectBody(c)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, limit+1))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Could not read request body."})
+		return
+	}
+	if int64(len(body)) > limit {
+		s.rejectBody(c)
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	c.Next()
+}
+
+func (s *server) rejectBody(c *gin.Context) {
+	// The connection carries the unread rest of the body; don't reuse it.
+	c.Header("Connection", "close")
+	c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{
+		"error": fmt.Sprintf("Request body is too large; the limit is %d bytes.", s.cfg.MaxBodySize),
+	})
+}
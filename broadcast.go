@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sessionStreamPing is how often an idle session stream sends a comment,
+// so proxies do not close it.
+const sessionStreamPing = 15 * time.Second
+
+// sessionEvent is an event of the live feed of a session: "message" with a
+// new user message, then "token"s of the answer and "done" or "error".
+type sessionEvent struct {
+	name string
+	data gin.H
+}
+
+// sessionFeed fans the events of one session out to its viewers. While an
+// answer is being generated, message and answer hold the turn so far, to
+// catch up viewers who attach in the middle of it.
+type sessionFeed struct {
+	viewers    map[chan sessionEvent]struct{}
+	inProgress bool
+	message    gin.H
+	answer     strings.Builder
+}
+
+// sessionFeeds are the live feeds of the sessions being answered or
+// watched.
+type sessionFeeds struct {
+	mu    sync.Mutex
+	feeds map[string]*sessionFeed
+}
+
+var liveSessions = &sessionFeeds{}
+
+// publish sends ev to the viewers of session id. A viewer that falls too
+// far behind is disconnected, as a gap would garble the answer it shows.
+func (f *sessionFeeds) publish(id string, ev sessionEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	feed := f.feeds[id]
+	if feed == nil {
+		if ev.name != "message" {
+			return
+		}
+		if f.feeds == nil {
+			f.feeds = map[string]*sessionFeed{}
+		}
+		feed = &sessionFeed{viewers: map[chan sessionEvent]struct{}{}}
+		f.feeds[id] = feed
+	}
+	switch ev.name {
+	case "message":
+		feed.inProgress, feed.message = true, ev.data
+		feed.answer.Reset()
+	case "token":
+		content, _ := ev.data["content"].(string)
+		feed.answer.WriteString(content)
+	default:
+		feed.inProgress, feed.message = false, nil
+		feed.answer.Reset()
+	}
+	for ch := range feed.viewers {
+		select {
+		case ch <- ev:
+		default:
+			delete(feed.viewers, ch)
+			close(ch)
+		}
+	}
+	if !feed.inProgress && len(feed.viewers) == 0 {
+		delete(f.feeds, id)
+	}
+}
+
+// watch attaches a viewer to session id. It returns the events that catch
+// the viewer up on the answer in progress, if any, the channel of the
+// following events, which is closed when the viewer falls behind, and a
+// function that detaches the viewer.
+func (f *sessionFeeds) watch(id string) ([]sessionEvent, <-chan sessionEvent, func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.feeds == nil {
+		f.feeds = map[string]*sessionFeed{}
+	}
+	feed := f.feeds[id]
+	if feed == nil {
+		feed = &sessionFeed{viewers: map[chan sessionEvent]struct{}{}}
+		f.feeds[id] = feed
+	}
+	var backlog []sessionEvent
+	if feed.inProgress {
+		backlog = append(backlog, sessionEvent{"message", feed.message})
+		if feed.answer.Len() > 0 {
+			backlog = append(backlog, sessionEvent{"token", gin.H{"content": feed.answer.String()}})
+		}
+	}
+	ch := make(chan sessionEvent, 256)
+	feed.viewers[ch] = struct{}{}
+	return backlog, ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := feed.viewers[ch]; ok {
+			delete(feed.viewers, ch)
+			close(ch)
+		}
+		if !feed.inProgress && len(feed.viewers) == 0 && f.feeds[id] == feed {
+			delete(f.feeds, id)
+		}
+	}
+}
+
+// handleSessionStream streams the activity of a session as server-sent
+// events until the client disconnects: every new user message and the
+// tokens of its answer as they are generated, for any number of viewers.
+// A viewer attaching during an answer first receives it so far.
+func (s *server) handleSessionStream(c *gin.Context) {
+	sess, err := s.store.Session(sessionScope(c), c.Param("id"))
+	if errors.Is(err, errSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found."})
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+
+	backlog, events, stop := liveSessions.watch(sess.ID)
+	defer stop()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	for _, ev := range backlog {
+		c.SSEvent(ev.name, ev.data)
+	}
+	c.Writer.Flush()
+
+	ping := time.NewTicker(sessionStreamPing)
+	defer ping.Stop()
+	ctx := c.Request.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ping.C:
+			c.Writer.WriteString(": ping\n\n")
+			c.Writer.Flush()
+		case ev, ok := <-events:
+			if !ok {
+				c.SSEvent("error", gin.H{"error": "The stream fell behind; reconnect to catch up."})
+				c.Writer.Flush()
+				return
+			}
+			c.SSEvent(ev.name, ev.data)
+			c.Writer.Flush()
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// promptBudget returns the estimated prompt tokens tgt's model accepts next
+// to a completion of maxTokens, or zero when truncate_context is off or the
+// model's context window is unknown.
+func (s *server) promptBudget(tgt target, maxTokens int) int {
+	if !s.cfg.TruncateContext || tgt.contextWindow <= 0 {
+		return 0
+	}
+	return max(tgt.contextWindow-maxTokens, 0)
+}
+
+// keepWithin returns, in order, the indices of the messages to send so that
+// their estimated tokens fit budget. System messages and the last message
+// are always kept; the other turns are kept newest first for as long as
+// they fit, and everything older than the first that does not is dropped.
+// The kept turns start with a user message, so no answer or tool result
+// is sent without what it answers.
+func keepWithin(messages []Message, budget int) []int {
+	keep := make([]bool, len(messages))
+	used := 0
+	for i, m := range messages {
+		if m.Role == "system" || i == len(messages)-1 {
+			keep[i] = true
+			used += estimateTokens(m.Content)
+		}
+	}
+	for i := len(messages) - 2; i >= 0; i-- {
+		if keep[i] {
+			continue
+		}
+		if used += estimateTokens(messages[i].Content); used > budget {
+			break
+		}
+		keep[i] = true
+	}
+	for i := 0; i < len(messages)-1; i++ {
+		if !keep[i] || messages[i].Role == "system" {
+			continue
+		}
+		if messages[i].Role == "user" {
+			break
+		}
+		keep[i] = false
+	}
+
+	var indices []int
+	for i, k := range keep {
+		if k {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// fitContext drops the oldest turns of payload that do not fit the prompt
+// budget of tgt's model.
+func (s *server) fitContext(tgt target, payload *DeepSeekRequestPayload) {
+	budget := s.promptBudget(tgt, payload.MaxTokens)
+	if budget <= 0 {
+		return
+	}
+	indices := keepWithin(payload.Messages, budget)
+	if len(indices) == len(payload.Messages) {
+		return
+	}
+	log.Printf("Dropped %d of %d messages to fit the context of %s", len(payload.Messages)-len(indices), len(payload.Messages), tgt.model)
+	kept := make([]Message, len(indices))
+	for j, i := range indices {
+		kept[j] = payload.Messages[i]
+	}
+	payload.Messages = kept
+}
+
+// fitRawContext is fitContext for a request body forwarded as is, whose
+// messages were extracted as messages. It reports whether fields changed.
+func (s *server) fitRawContext(tgt target, fields map[string]json.RawMessage, messages []Message) bool {
+	maxTokens := defaultMaxTokens
+	if raw, ok := fields["max_tokens"]; ok {
+		json.Unmarshal(raw, &maxTokens)
+	}
+	budget := s.promptBudget(tgt, maxTokens)
+	if budget <= 0 {
+		return false
+	}
+	var raw []json.RawMessage
+	if json.Unmarshal(fields["messages"], &raw) != nil || len(raw) != len(messages) {
+		return false
+	}
+	indices := keepWithin(messages, budget)
+	if len(indices) == len(raw) {
+		return false
+	}
+	log.Printf("Dropped %d of %d messages to fit the context of %s", len(raw)-len(indices), len(raw), tgt.model)
+	kept := make([]json.RawMessage, len(indices))
+	for j, i := range indices {
+		kept[j] = raw[i]
+	}
+	fields["messages"], _ = json.Marshal(kept)
+	return true
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// responseCache keeps recent answers to identical completion requests (same
+// provider, model, messages and parameters) for a TTL, evicting the least
+// recently used beyond its size. Expired answers are kept staleTTL longer
+// for when the provider fails.
+type responseCache struct {
+	ttl      time.Duration
+	staleTTL time.Duration
+	max      int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // of *cachedAnswer, most recently used first
+}
+
+// cachedAnswer is an answer in the cache. ETag identifies its content.
+type cachedAnswer struct {
+	key     string
+	answer  string
+	etag    string
+	stored  time.Time
+	expires time.Time
+	stale   time.Time
+}
+
+func newResponseCache(cfg *ResponseCacheConfig) *responseCache {
+	if cfg == nil {
+		return nil
+	}
+	return &responseCache{ttl: cfg.TTL.Duration, staleTTL: cfg.StaleTTL.Duration, max: cfg.MaxEntries, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+// cacheKey identifies a completion request to p.
+func cacheKey(p *provider, payload DeepSeekRequestPayload) string {
+	data, _ := json.Marshal(payload)
+	sum := sha256.Sum256(append([]byte(p.name+"\x00"), data...))
+	return string(sum[:])
+}
+
+// get returns the unexpired answer cached under key.
+func (rc *responseCache) get(key string) (*cachedAnswer, bool) {
+	a, ok := rc.lookup(key)
+	if !ok || time.Now().After(a.expires) {
+		return nil, false
+	}
+	return a, true
+}
+
+// getStale returns the answer cached under key, even if it expired, as
+// long as it is within the stale TTL.
+func (rc *responseCache) getStale(key string) (*cachedAnswer, bool) {
+	return rc.lookup(key)
+}
+
+// lookup returns the answer cached under key, dropping it once it is past
+// the stale TTL.
+func (rc *responseCache) lookup(key string) (*cachedAnswer, bool) {
+	if rc == nil {
+		return nil, false
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	el, ok := rc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	a := el.Value.(*cachedAnswer)
+	if time.Now().After(a.stale) {
+		rc.lru.Remove(el)
+		delete(rc.entries, key)
+		return nil, false
+	}
+	rc.lru.MoveToFront(el)
+	return a, true
+}
+
+// put caches answer under key and returns the entry.
+func (rc *responseCache) put(key, answer string) *cachedAnswer {
+	sum := sha256.Sum256([]byte(answer))
+	now := time.Now()
+	a := &cachedAnswer{key: key, answer: answer, etag: `"` + hex.EncodeToString(sum[:16]) + `"`, stored: now, expires: now.Add(rc.ttl), stale: now.Add(rc.ttl + rc.staleTTL)}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if el, ok := rc.entries[key]; ok {
+		rc.lru.Remove(el)
+	}
+	rc.entries[key] = rc.lru.PushFront(a)
+	for rc.lru.Len() > rc.max {
+		oldest := rc.lru.Back()
+		rc.lru.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*cachedAnswer).key)
+	}
+	return a
+}
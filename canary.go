@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Canary arms and states.
+const (
+	canaryStable = "stable"
+	canaryArm    = "canary"
+
+	canaryRunning    = "running"
+	canaryRolledBack = "rolled_back"
+)
+
+// canaries are the template canaries in progress, keyed by template name.
+type canaries struct {
+	mu     sync.Mutex
+	byName map[string]*canary
+}
+
+func newCanaries() *canaries {
+	return &canaries{byName: map[string]*canary{}}
+}
+
+// canary sends a share of a template's traffic to a new version of it and
+// rolls it back when its error rate or feedback score regresses against
+// the stable version.
+type canary struct {
+	name      string
+	settings  canaryRequest
+	candidate *Template
+	startedAt time.Time
+	alerts    *alerter
+
+	mu           sync.Mutex
+	stats        map[string]*armStats
+	state        string
+	reason       string
+	rolledBackAt time.Time
+}
+
+// canaryAssignment is the arm of a canary a request was placed in.
+type canaryAssignment struct {
+	canary *canary
+	arm    string
+}
+
+// canaryRequest starts a canary: the new version of the template, the
+// percentage of callers it is sent to and the regressions that roll it
+// back. The error rate is compared once the canary has MinRequests
+// requests, the average score once both versions have MinFeedback scores.
+type canaryRequest struct {
+	Template             TemplateConfig `json:"template"`
+	Percent              int            `json:"percent"`
+	MinRequests          int            `json:"min_requests"`
+	MaxErrorRateIncrease float64        `json:"max_error_rate_increase"`
+	MinFeedback          int            `json:"min_feedback"`
+	MaxScoreDrop         float64        `json:"max_score_drop"`
+}
+
+// assignCanary places a request running a template with a canary in one of
+// its arms. The same caller always lands in the same arm, as for
+// experiments.
+func (s *server) assignCanary(c *gin.Context, req routeRequest) *canaryAssignment {
+	if req.Template == "" {
+		return nil
+	}
+	s.canaries.mu.Lock()
+	cn := s.canaries.byName[req.Template]
+	s.canaries.mu.Unlock()
+	if cn == nil || !cn.running() {
+		return nil
+	}
+
+	arm := cn.armFor(c)
+	c.Header("X-Canary", cn.name+"="+arm)
+	return &canaryAssignment{canary: cn, arm: arm}
+}
+
+// armFor returns the arm of cn the caller of c is in.
+func (cn *canary) armFor(c *gin.Context) string {
+	h := fnv.New32a()
+	h.Write([]byte("canary\x00" + cn.name + "\x00" + callerKey(c)))
+	if int(h.Sum32()%100) < cn.settings.Percent {
+		return canaryArm
+	}
+	return canaryStable
+}
+
+// template returns the canary version of the named template for requests
+// in the canary arm of a running canary, or nil. It is safe on a nil
+// assignment.
+func (a *canaryAssignment) template(name string) *Template {
+	if a == nil || a.arm != canaryArm || a.canary.name != name || !a.canary.running() {
+		return nil
+	}
+	return a.canary.candidate
+}
+
+// observe records the outcome of a request. It is safe on a nil assignment.
+func (a *canaryAssignment) observe(latency time.Duration, answer string, err error) {
+	if a == nil {
+		return
+	}
+	cn := a.canary
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	st := cn.stats[a.arm]
+	st.Requests++
+	st.TotalLatency += latency
+	if err != nil {
+		st.Errors++
+	} else {
+		st.TotalChars += len([]rune(answer))
+	}
+	cn.check()
+}
+
+func (cn *canary) running() bool {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	return cn.state == canaryRunning
+}
+
+// check rolls the canary back if it regressed. The caller holds cn.mu.
+func (cn *canary) check() {
+	if cn.state != canaryRunning {
+		return
+	}
+	stable, canary := cn.stats[canaryStable], cn.stats[canaryArm]
+	if canary.Requests >= cn.settings.MinRequests {
+		if cr, sr := errorRate(canary), errorRate(stable); cr-sr > cn.settings.MaxErrorRateIncrease {
+			cn.rollBack(fmt.Sprintf("error rate %.1f%% against %.1f%% for the stable version", cr*100, sr*100))
+			return
+		}
+	}
+	if canary.Feedback >= cn.settings.MinFeedback && stable.Feedback >= cn.settings.MinFeedback {
+		cs, ss := canary.FeedbackTotal/float64(canary.Feedback), stable.FeedbackTotal/float64(stable.Feedback)
+		if ss-cs > cn.settings.MaxScoreDrop {
+			cn.rollBack(fmt.Sprintf("average score %.2f against %.2f for the stable version", cs, ss))
+		}
+	}
+}
+
+// rollBack stops sending traffic to the canary. The caller holds cn.mu.
+func (cn *canary) rollBack(reason string) {
+	cn.state = canaryRolledBack
+	cn.reason = reason
+	cn.rolledBackAt = time.Now().UTC()
+	log.Printf("Rolled back canary of template %s: %s", cn.name, reason)
+	cn.alerts.raise(alertCanaryRolledBack, cn.name, fmt.Sprintf("The canary of template %s was rolled back: %s.", cn.name, reason))
+}
+
+func errorRate(st *armStats) float64 {
+	if st.Requests == 0 {
+		return 0
+	}
+	return float64(st.Errors) / float64(st.Requests)
+}
+
+// summary describes the canary for the admin API.
+func (cn *canary) summary() gin.H {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	h := gin.H{
+		"template":   cn.name,
+		"state":      cn.state,
+		"percent":    cn.settings.Percent,
+		"started_at": cn.startedAt,
+		"arms": gin.H{
+			canaryStable: cn.stats[canaryStable].summary(),
+			canaryArm:    cn.stats[canaryArm].summary(),
+		},
+		"min_requests":            cn.settings.MinRequests,
+		"max_error_rate_increase": cn.settings.MaxErrorRateIncrease,
+		"min_feedback":            cn.settings.MinFeedback,
+		"max_score_drop":          cn.settings.MaxScoreDrop,
+	}
+	if cn.state == canaryRolledBack {
+		h["reason"] = cn.reason
+		h["rolled_back_at"] = cn.rolledBackAt
+	}
+	return h
+}
+
+// handleListCanaries reports every template canary and its statistics.
+func (s *server) handleListCanaries(c *gin.Context) {
+	s.canaries.mu.Lock()
+	list := make([]*canary, 0, len(s.canaries.byName))
+	for _, cn := range s.canaries.byName {
+		list = append(list, cn)
+	}
+	s.canaries.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+
+	out := make([]gin.H, 0, len(list))
+	for _, cn := range list {
+		out = append(out, cn.summary())
+	}
+	c.JSON(http.StatusOK, gin.H{"canaries": out})
+}
+
+// handleStartCanary starts a canary of a new version of the template in
+// the path, replacing any canary it had.
+func (s *server) handleStartCanary(c *gin.Context) {
+	name := c.Param("name")
+	if lookupTemplate(name) == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found."})
+		return
+	}
+	req := canaryRequest{Percent: 10, MinRequests: 20, MaxErrorRateIncrease: 0.05, MinFeedback: 10, MaxScoreDrop: 0.5}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Please provide a JSON body with the new 'template'."})
+		return
+	}
+	if req.Percent < 1 || req.Percent > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "percent must be between 1 and 100."})
+		return
+	}
+	if req.MinRequests <= 0 || req.MinFeedback <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "min_requests and min_feedback must be positive."})
+		return
+	}
+	req.Template.Name = name
+	candidate, err := parseTemplate(&req.Template)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cn := &canary{
+		name:      name,
+		settings:  req,
+		candidate: candidate,
+		startedAt: time.Now().UTC(),
+		alerts:    s.alerts,
+		stats:     map[string]*armStats{canaryStable: {}, canaryArm: {}},
+		state:     canaryRunning,
+	}
+	s.canaries.mu.Lock()
+	s.canaries.byName[name] = cn
+	s.canaries.mu.Unlock()
+	auditNote(c, "started canary of template %s at %d%%", name, req.Percent)
+	c.JSON(http.StatusCreated, cn.summary())
+}
+
+// handlePromoteCanary publishes the canary version of a template as its
+// next stored version, puts it in use and ends the canary.
+func (s *server) handlePromoteCanary(c *gin.Context) {
+	name := c.Param("name")
+	s.canaries.mu.Lock()
+	cn := s.canaries.byName[name]
+	if cn != nil && cn.running() {
+		delete(s.canaries.byName, name)
+	}
+	s.canaries.mu.Unlock()
+	if cn == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Canary not found."})
+		return
+	}
+	summary := cn.summary()
+	if summary["state"] != canaryRunning {
+		c.JSON(http.StatusConflict, gin.H{"error": "The canary was rolled back: " + cn.reason + "."})
+		return
+	}
+	v, err := s.publishTemplate(c, cn.settings.Template, "promoted from canary", true)
+	if err != nil {
+		log.Printf("Error saving template %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	summary["version"] = v.Version
+	c.JSON(http.StatusOK, summary)
+}
+
+// handleStopCanary ends the canary of a template, rolling it back if it is
+// still running.
+func (s *server) handleStopCanary(c *gin.Context) {
+	name := c.Param("name")
+	s.canaries.mu.Lock()
+	cn := s.canaries.byName[name]
+	delete(s.canaries.byName, name)
+	s.canaries.mu.Unlock()
+	if cn == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Canary not found."})
+		return
+	}
+	cn.mu.Lock()
+	if cn.state == canaryRunning {
+		cn.state = canaryRolledBack
+		cn.reason = "stopped through the admin API"
+		cn.rolledBackAt = time.Now().UTC()
+	}
+	cn.mu.Unlock()
+	auditNote(c, "stopped canary of template %s", name)
+	c.JSON(http.StatusOK, cn.summary())
+}
+
+// handleCanaryFeedback records a user score for the version of a template
+// with a canary the caller is in. Low canary scores can roll the canary
+// back.
+func (s *server) handleCanaryFeedback(c *gin.Context) {
+	s.canaries.mu.Lock()
+	cn := s.canaries.byName[c.Param("name")]
+	s.canaries.mu.Unlock()
+	if cn == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Canary not found."})
+		return
+	}
+	score, ok := feedbackScore(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Please provide a JSON body with a numeric 'score'."})
+		return
+	}
+
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	st := cn.stats[cn.armFor(c)]
+	st.Feedback++
+	st.FeedbackTotal += score
+	cn.check()
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Splitters of knowledge base documents.
+const (
+	splitParagraph = "paragraph"
+	splitSentence  = "sentence"
+	splitMarkdown  = "markdown"
+	splitCode      = "code"
+)
+
+// defaultChunkSize is the size of chunks in characters by default.
+const defaultChunkSize = 1500
+
+// splitDocument splits the text of a document into chunks as cc says.
+func splitDocument(text string, cc *ChunkingConfig) []string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	switch cc.Splitter {
+	case splitSentence:
+		return packChunks(sentences(text), " ", cc.Size, cc.Overlap)
+	case splitMarkdown:
+		return markdownChunks(text, cc)
+	case splitCode:
+		return packChunks(codeBlocks(text), "\n\n", cc.Size, cc.Overlap)
+	default:
+		return packChunks(paragraphs(text), "\n\n", cc.Size, cc.Overlap)
+	}
+}
+
+// paragraphs returns the non-blank paragraphs of text.
+func paragraphs(text string) []string {
+	var paras []string
+	for _, p := range strings.Split(text, "\n\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			paras = append(paras, p)
+		}
+	}
+	return paras
+}
+
+// sentences returns the sentences of text: runs ending in '.', '!' or '?'
+// before a space, or at a paragraph break.
+func sentences(text string) []string {
+	var list []string
+	for _, para := range paragraphs(text) {
+		runes := []rune(strings.Join(strings.Fields(para), " "))
+		start := 0
+		for i, r := range runes {
+			if (r == '.' || r == '!' || r == '?') && i+1 < len(runes) && unicode.IsSpace(runes[i+1]) {
+				list = append(list, strings.TrimSpace(string(runes[start:i+1])))
+				start = i + 1
+			}
+		}
+		if rest := strings.TrimSpace(string(runes[start:])); rest != "" {
+			list = append(list, rest)
+		}
+	}
+	return list
+}
+
+// codeBlocks returns the top-level blocks of source code: runs of lines
+// that start at a line that is not indented after a blank line, so a
+// function stays with its doc comment and body.
+func codeBlocks(text string) []string {
+	var blocks, cur []string
+	blank := true
+	flush := func() {
+		if block := strings.Trim(strings.Join(cur, "\n"), "\n"); strings.TrimSpace(block) != "" {
+			blocks = append(blocks, block)
+		}
+		cur = nil
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if blank && line != "" && !unicode.IsSpace(rune(line[0])) {
+			flush()
+		}
+		cur = append(cur, line)
+		blank = strings.TrimSpace(line) == ""
+	}
+	flush()
+	return blocks
+}
+
+// markdownChunks splits markdown at its headings. Each section is a chunk
+// of its own; longer sections are split into paragraphs, each chunk of
+// them led by the section's heading.
+func markdownChunks(text string, cc *ChunkingConfig) []string {
+	var sections [][]string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, "#") || len(sections) == 0 {
+			sections = append(sections, nil)
+		}
+		sections[len(sections)-1] = append(sections[len(sections)-1], line)
+	}
+
+	var chunks []string
+	for _, lines := range sections {
+		section := strings.TrimSpace(strings.Join(lines, "\n"))
+		if section == "" {
+			continue
+		}
+		if utf8.RuneCountInString(section) <= cc.Size {
+			chunks = append(chunks, section)
+			continue
+		}
+		heading, body := "", section
+		if strings.HasPrefix(lines[0], "#") {
+			heading = strings.TrimSpace(lines[0])
+			body = strings.Join(lines[1:], "\n")
+		}
+		size := max(cc.Size-utf8.RuneCountInString(heading)-2, cc.Size/2)
+		for _, chunk := range packChunks(paragraphs(body), "\n\n", size, cc.Overlap) {
+			if heading != "" {
+				chunk = heading + "\n\n" + chunk
+			}
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks
+}
+
+// packChunks joins units with sep into chunks of at most size characters,
+// each starting with the last overlap characters of the one before. Units
+// longer than size are split at lines, then words, then anywhere.
+func packChunks(units []string, sep string, size, overlap int) []string {
+	var chunks, cur []string
+	curLen, fresh := 0, false
+	flush := func() {
+		if !fresh {
+			return
+		}
+		chunk := strings.Join(cur, sep)
+		chunks = append(chunks, chunk)
+		cur, curLen, fresh = nil, 0, false
+		if overlap > 0 {
+			tail := lastRunes(chunk, overlap)
+			cur, curLen = []string{tail}, utf8.RuneCountInString(tail)
+		}
+	}
+	add := func(unit string, n int) {
+		if len(cur) > 0 && curLen+len(sep)+n > size {
+			flush()
+			if len(cur) > 0 && curLen+len(sep)+n > size {
+				cur, curLen = nil, 0
+			}
+		}
+		if len(cur) > 0 {
+			curLen += len(sep)
+		}
+		cur, curLen, fresh = append(cur, unit), curLen+n, true
+	}
+	for _, unit := range units {
+		n := utf8.RuneCountInString(unit)
+		if n <= size {
+			add(unit, n)
+			continue
+		}
+		for _, piece := range splitOversize(unit, size) {
+			add(piece, utf8.RuneCountInString(piece))
+		}
+	}
+	flush()
+	return chunks
+}
+
+// splitOversize splits a unit longer than size at its lines, words or,
+// failing those, every size characters.
+func splitOversize(unit string, size int) []string {
+	for _, sep := range []string{"\n", " "} {
+		if strings.Contains(unit, sep) {
+			return packChunks(strings.Split(unit, sep), sep, size, 0)
+		}
+	}
+	var pieces []string
+	runes := []rune(unit)
+	for len(runes) > size {
+		pieces, runes = append(pieces, string(runes[:size])), runes[size:]
+	}
+	return append(pieces, string(runes))
+}
+
+// lastRunes returns the last n characters of s, from the start of a word
+// when s has one in them.
+func lastRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	tail := string(runes[len(runes)-n:])
+	if i := strings.IndexAny(tail, " \n"); i >= 0 && i < len(tail)-1 {
+		tail = tail[i+1:]
+	}
+	return tail
+}
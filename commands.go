@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// commands are the subcommands of askllm. Without one it runs the server.
+var commands = map[string]func(args []string) int{
+	"bench":    runBench,
+	"eval":     runEval,
+	"loadtest": runLoadTest,
+	"reindex":  runReindex,
+}
+
+// runCommand runs the named subcommand and returns its exit code.
+func runCommand(name string, args []string) int {
+	cmd, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for n := range commands {
+			names = append(names, n)
+		}
+		slices.Sort(names)
+		fmt.Fprintf(os.Stderr, "Unknown command %q. Run askllm without arguments to start the server, or one of: %s.\n", name, strings.Join(names, ", "))
+		return 2
+	}
+	return cmd(args)
+}
+
+// loadCommandConfig loads the configuration, its templates and providers
+// for a subcommand, as the server would.
+func loadCommandConfig(ctx context.Context) (*Config, map[string]*provider, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading configuration: %w", err)
+	}
+	sc, err := newSecrets(ctx, cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("configuring secrets: %w", err)
+	}
+	if err := loadTemplates(cfg.Templates); err != nil {
+		return nil, nil, fmt.Errorf("loading templates: %w", err)
+	}
+	providers, err := startProviders(ctx, cfg, sc, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("configuring providers: %w", err)
+	}
+	return cfg, providers, nil
+}
+
+// commandTarget resolves a model named on the command line: a model
+// alias, "<provider>/<model>" for a configured provider, or else a model of
+// the default provider. An empty name is the default model.
+func commandTarget(cfg *Config, providers map[string]*provider, name string) target {
+	tgt := target{provider: providers[cfg.DefaultProvider], model: cfg.DefaultModel, sanitize: &cfg.Sanitize}
+	if alias, ok := cfg.ModelAliases[name]; ok {
+		tgt.model = alias.Model
+		if p := providers[alias.Provider]; p != nil {
+			tgt.provider = p
+		}
+		return tgt
+	}
+	if prefix, model, ok := strings.Cut(name, "/"); ok && providers[prefix] != nil {
+		tgt.provider, tgt.model = providers[prefix], model
+		return tgt
+	}
+	if name != "" {
+		tgt.model = name
+	}
+	return tgt
+}
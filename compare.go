@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxCompareModels bounds how many models one comparison may fan out to.
+const maxCompareModels = 8
+
+// compareRequest is the body accepted by POST /compare.
+type compareRequest struct {
+	Prompt string   `json:"prompt"`
+	Models []string `json:"models"`
+}
+
+// compareResult is one model's answer in a comparison.
+type compareResult struct {
+	ID               string  `json:"id,omitempty"`
+	Model            string  `json:"model"`
+	Provider         string  `json:"provider"`
+	Answer           string  `json:"answer,omitempty"`
+	Error            string  `json:"error,omitempty"`
+	LatencyMS        int64   `json:"latency_ms"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TokensPerSecond  float64 `json:"tokens_per_second"`
+}
+
+// handleCompare sends one prompt to several models at once and returns
+// their answers side by side. The models are the request's, else the
+// configured compare_models.
+func (s *server) handleCompare(c *gin.Context) {
+	var req compareRequest
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Prompt) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Please provide a JSON body with a non-empty 'prompt' field."})
+		return
+	}
+	if len(req.Models) == 0 {
+		req.Models = s.cfg.CompareModels
+	}
+	if len(req.Models) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Please list the 'models' to compare."})
+		return
+	}
+	if len(req.Models) > maxCompareModels {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d models can be compared at once.", maxCompareModels)})
+		return
+	}
+
+	messages := []Message{{Role: "user", Content: req.Prompt}}
+	results := make([]compareResult, len(req.Models))
+	var wg sync.WaitGroup
+	for i, model := range req.Models {
+		tgt, err := s.targetFor(c, routeRequest{Model: model, Messages: messages})
+		if err != nil {
+			results[i] = compareResult{Model: model}
+			results[i].Error, _ = classifyError(err)
+			continue
+		}
+		payload := newPayload(messages)
+		tgt.prepare(&payload)
+		results[i] = compareResult{Model: model, Provider: tgt.provider.name}
+
+		wg.Add(1)
+		go func(r *compareResult) {
+			defer wg.Done()
+			start := time.Now()
+			answer, usage, err := tgt.provider.completeUsage(c.Request.Context(), payload)
+			elapsed := time.Since(start)
+			r.LatencyMS = elapsed.Milliseconds()
+			r.PromptTokens = usage.PromptTokens
+			r.CompletionTokens = usage.CompletionTokens
+			r.TokensPerSecond = tokensPerSecond(usage.CompletionTokens, 0, elapsed)
+			if err != nil {
+				log.Printf("Error comparing model %s: %v", r.Model, err)
+				r.Error, _ = classifyError(err)
+				return
+			}
+			r.Answer = tgt.rewriteText(rewriteCompletion, answer)
+			if cp := s.newCompletion(c, tgt, req.Prompt); cp != nil {
+				cp.Usage = usage
+				s.saveCompletion(c, cp, r.Answer, start)
+				r.ID = cp.ID
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// storesCompletions reports whether answers are stored, for GET
+// /completions/:id or for permalinks.
+func (s *server) storesCompletions() bool {
+	return s.cfg.StoreCompletions || s.cfg.Permalinks
+}
+
+// newCompletion starts the record of a completion of tgt the request is
+// about to return. It returns nil when completions are not stored.
+func (s *server) newCompletion(c *gin.Context, tgt target, prompt string) *Completion {
+	if !s.storesCompletions() {
+		return nil
+	}
+	cp := &Completion{
+		ID:        newID(),
+		Namespace: namespaceFor(c),
+		Owner:     ownerFor(c),
+		Route:     c.Request.Method + " " + c.FullPath(),
+		Model:     tgt.provider.name + "/" + tgt.model,
+		Prompt:    prompt,
+		CreatedAt: time.Now().UTC(),
+	}
+	return cp
+}
+
+// shareCompletion makes cp, an answer of the ask route, public when there
+// are permalinks, unless the caller is a tenant, workspace or account. It
+// is a no-op on a nil cp.
+func (s *server) shareCompletion(c *gin.Context, cp *Completion) {
+	if cp != nil && s.cfg.Permalinks && namespaceFor(c) == "" {
+		cp.Public = true
+	}
+}
+
+// announceCompletion sends the ID of cp in X-Completion-ID, with a Link to
+// its permalink when it is public. It is a no-op on a nil cp.
+func (s *server) announceCompletion(c *gin.Context, cp *Completion) {
+	if cp == nil {
+		return
+	}
+	c.Header("X-Completion-ID", cp.ID)
+	if cp.Public {
+		c.Header("Link", "<"+permalinkPath(cp.ID)+`>; rel="bookmark"`)
+	}
+}
+
+// saveCompletion stores cp with its answer, for a completion started at
+// start, with the usage metered for the request unless cp has its own, and
+// the generation speed that makes. It is a no-op on a nil cp.
+func (s *server) saveCompletion(c *gin.Context, cp *Completion, answer string, start time.Time) {
+	if cp == nil {
+		return
+	}
+	cp.Answer = answer
+	cp.LatencyMS = time.Since(start).Milliseconds()
+	if cp.Usage.TotalTokens == 0 {
+		if m := meterFrom(c.Request.Context()); m != nil {
+			cp.Usage = m.total()
+		}
+	}
+	cp.TokensPerSecond = tokensPerSecond(cp.Usage.CompletionTokens, time.Duration(cp.TTFTMS)*time.Millisecond, time.Since(start))
+	if err := s.store.AddCompletion(cp); err != nil {
+		log.Printf("Error storing completion %s: %v", cp.ID, err)
+	}
+}
+
+// meterUsage meters the upstream calls of each request, for the usage of
+// stored completions.
+func meterUsage(c *gin.Context) {
+	ctx, _ := withUsageMeter(c.Request.Context())
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+}
+
+// handleGetCompletion returns the stored record of a completion: its
+// prompt, answer, usage, model and latency. Completions of a client are
+// only found by that client; anonymous ones by anyone with the ID.
+func (s *server) handleGetCompletion(c *gin.Context) {
+	cp, err := s.store.Completion(c.Param("id"))
+	if err == nil && (cp.Namespace != namespaceFor(c) || cp.Owner != "" && cp.Owner != ownerFor(c)) {
+		err = errCompletionNotFound
+	}
+	if errors.Is(err, errCompletionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Completion not found."})
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading completion: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	c.JSON(http.StatusOK, cp)
+}
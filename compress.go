@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultCompressMinSize is the smallest response compressed when
+// compression.min_size is not set.
+const defaultCompressMinSize = 1024
+
+// compressedTypes are the media types worth compressing. Event streams are
+// never compressed: their events must reach the client as they are written.
+var compressedTypes = []string{"application/json", "text/html", "text/plain"}
+
+// compress encodes large JSON, HTML and text responses with the best
+// encoding the client accepts.
+func (s *server) compress(c *gin.Context) {
+	cc := s.cfg.Compression
+	encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"), orDefault(cc.Encodings, []string{"br", "gzip"}))
+	if encoding == "" || c.Request.Method == "HEAD" {
+		c.Next()
+		return
+	}
+
+	minSize := cc.MinSize
+	if minSize <= 0 {
+		minSize = defaultCompressMinSize
+	}
+	cw := &compressWriter{ResponseWriter: c.Writer, encoding: encoding, minSize: minSize}
+	c.Writer = cw
+	c.Next()
+	cw.finish()
+}
+
+// compressWriter buffers the start of a response until it knows whether the
+// response is worth compressing, then either compresses or passes it on.
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	minSize  int
+
+	decided bool
+	buf     bytes.Buffer
+	enc     io.WriteCloser // nil when the response is passed on as is
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		if !w.compressible() {
+			w.decided = true
+			return w.ResponseWriter.Write(b)
+		}
+		w.buf.Write(b)
+		if w.buf.Len() < w.minSize {
+			return len(b), nil
+		}
+		if err := w.start(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush sends what has been compressed so far. A response still being
+// buffered stays buffered: only event streams need flushing, and those are
+// never compressed.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		return
+	}
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// compressible reports whether the response about to be written should be
+// compressed.
+func (w *compressWriter) compressible() bool {
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return slices.Contains(compressedTypes, mediaType)
+}
+
+// start switches to compressing and writes the buffered start of the body.
+func (w *compressWriter) start() error {
+	w.decided = true
+	h := w.Header()
+	h.Set("Content-Encoding", w.encoding)
+	h.Add("Vary", "Accept-Encoding")
+	h.Del("Content-Length")
+
+	if w.encoding == "br" {
+		w.enc = brotli.NewWriter(w.ResponseWriter)
+	} else {
+		w.enc = gzip.NewWriter(w.ResponseWriter)
+	}
+	_, err := w.enc.Write(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+// finish completes the response once the handler has returned: a response
+// too small to compress is written as is.
+func (w *compressWriter) finish() {
+	switch {
+	case !w.decided:
+		if w.buf.Len() > 0 {
+			w.ResponseWriter.Write(w.buf.Bytes())
+		}
+	case w.enc != nil:
+		w.enc.Close()
+	}
+}
+
+// negotiateEncoding picks the first of supported that the Accept-Encoding
+// header allows, or "".
+func negotiateEncoding(header string, supported []string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		accepted[strings.ToLower(name)] = q > 0
+	}
+	for _, enc := range supported {
+		if accepted[enc] {
+			return enc
+		}
+	}
+	return ""
+}
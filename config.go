@@ -0,0 +1,1602 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server settings. Defaults are used when the
+// ASKLLM_CONFIG environment variable does not name a JSON config file.
+type Config struct {
+	// Listen is the address the HTTP server binds to.
+	Listen string `json:"listen"`
+
+	// DataFile is where sessions are persisted. When empty, sessions are
+	// kept in memory only and lost on restart.
+	DataFile string `json:"data_file"`
+
+	// UsageRollupInterval is how often the usage of single requests is
+	// added up into the hourly and daily usage records.
+	UsageRollupInterval Duration `json:"usage_rollup_interval"`
+
+	// TitleModel is the model used to title new sessions; a small, cheap
+	// model is enough.
+	TitleModel string `json:"title_model"`
+
+	// UserMemory lets clients opt in to facts about them being remembered
+	// across sessions.
+	UserMemory *UserMemoryConfig `json:"user_memory"`
+
+	// SessionWindow, when positive, sends only the last SessionWindow
+	// exchanges of a session to the model, a lighter alternative to
+	// SessionSummary.
+	SessionWindow int `json:"session_window"`
+
+	// TruncateContext drops the oldest turns of conversations that would
+	// not fit the model's context window from the model catalog.
+	TruncateContext bool `json:"truncate_context"`
+
+	// SessionSummary folds the older turns of long sessions into a
+	// summary before they outgrow the model's context window.
+	SessionSummary *SessionSummaryConfig `json:"session_summary"`
+
+	// RetryBudget is the longest upstream Retry-After that is waited out
+	// before retrying a rate-limited request once. Zero disables the retry.
+	RetryBudget Duration `json:"retry_budget"`
+
+	// Providers are the upstream APIs, keyed by name.
+	Providers map[string]*ProviderConfig `json:"providers"`
+
+	// HealthCheckInterval is the probe interval of providers that set
+	// none; zero leaves them unprobed.
+	HealthCheckInterval Duration `json:"health_check_interval"`
+
+	// DefaultProvider names the provider used for all requests.
+	DefaultProvider string `json:"default_provider"`
+
+	// DefaultModel is used when a request names no model. It may be an alias.
+	DefaultModel string `json:"default_model"`
+
+	// ModelAliases map names clients may request, such as "fast" or
+	// "smart", to a concrete model, so the model behind a name can be
+	// swapped without changing callers.
+	ModelAliases map[string]*ModelAlias `json:"model_aliases"`
+
+	// Schedules are prompts run on cron schedules.
+	Schedules []*ScheduleConfig `json:"schedules"`
+
+	// SMTP and Telegram are used to deliver results by email and Telegram.
+	SMTP     *SMTPConfig     `json:"smtp"`
+	Telegram *TelegramConfig `json:"telegram"`
+
+	// Alerts notify operators of events such as provider outages.
+	Alerts *AlertsConfig `json:"alerts"`
+
+	// Personas are answered at GET /as/:persona, and at their own path if
+	// they have one, keyed by name.
+	Personas map[string]*PersonaConfig `json:"personas"`
+
+	// KnowledgeBases are FAQ answers and documents, keyed by name, that
+	// their routes consult before asking the model.
+	KnowledgeBases map[string]*KnowledgeBaseConfig `json:"knowledge_bases"`
+
+	// PromptWrappers wrap the user prompt of requests, keyed by route
+	// ("/chat", "/v1/chat/completions", ...) or "*" for routes without
+	// their own.
+	PromptWrappers map[string]*PromptWrapper `json:"prompt_wrappers"`
+
+	// Rewrites change prompts before dispatch and completions before they
+	// are returned, in order.
+	Rewrites []*RewriteRule `json:"rewrites"`
+
+	// Degradation replaces the built-in error responses, keyed by error
+	// code, or "*" for every failure of the providers.
+	Degradation map[string]*DegradationResponse `json:"degradation"`
+
+	// Sanitize controls how prompts are checked and cleaned before they
+	// are forwarded.
+	Sanitize SanitizeConfig `json:"sanitize"`
+
+	// Locale is the language of client-facing messages for callers whose
+	// Accept-Language names none with a catalog (default "en").
+	Locale string `json:"locale"`
+
+	// AllowedModels, when set, are the only models (or aliases) callers may
+	// ask for by query, body or the X-LLM-Model header.
+	AllowedModels []string `json:"allowed_models"`
+
+	// AllowedProviders are the providers callers may choose with the
+	// X-LLM-Provider header; without them the header is refused.
+	AllowedProviders []string `json:"allowed_providers"`
+
+	// RoutingRules choose the model for requests that name none; the first
+	// matching rule wins.
+	RoutingRules []*RoutingRule `json:"routing_rules"`
+
+	// RoutingPolicy is "default" (rules, then the default model) or "cost"
+	// (the cheapest suitable model of the catalog). Requests may override
+	// it with the route query parameter or X-Route header.
+	RoutingPolicy string `json:"routing_policy"`
+
+	// Experiments are the A/B tests in progress.
+	Experiments []*ExperimentConfig `json:"experiments"`
+
+	// HTTPClient tunes the connection pools used for upstream calls.
+	HTTPClient HTTPClientConfig `json:"http_client"`
+
+	// Warmup sends every provider a tiny completion at startup and after
+	// its key changes, and holds readiness until they succeed.
+	Warmup *WarmupConfig `json:"warmup"`
+
+	// LoadShedding rejects lower priority requests early while a provider
+	// is slow or its queue is long.
+	LoadShedding *LoadSheddingConfig `json:"load_shedding"`
+
+	// DedupeInflight makes identical completion requests (same provider,
+	// model, messages and parameters) made while one is in flight share
+	// its answer instead of calling the upstream again.
+	DedupeInflight bool `json:"dedupe_inflight"`
+
+	// ResponseCache answers repeated plain text prompts from a cache.
+	ResponseCache *ResponseCacheConfig `json:"response_cache"`
+
+	// CompareModels are the models POST /compare asks when the request
+	// lists none. They may be aliases.
+	CompareModels []string `json:"compare_models"`
+
+	// Shadow mirrors a sample of requests to a second provider.
+	Shadow *ShadowConfig `json:"shadow"`
+
+	// Templates add managed templates or replace built-in ones.
+	Templates []*TemplateConfig `json:"templates"`
+
+	// Models is the catalog of models with their capabilities and prices,
+	// used by the cost policy.
+	Models []*ModelInfo `json:"models"`
+
+	// Prices are the rates of models per million input and output tokens,
+	// keyed by model or provider/model, for the costs reported in headers,
+	// stream events and usage reports and for catalog entries without
+	// prices. Well-known models have defaults.
+	Prices map[string]*ModelPrice `json:"prices"`
+
+	// Proxy is an http, https or socks5 proxy URL for all upstream calls.
+	// When empty, HTTP_PROXY, HTTPS_PROXY and NO_PROXY are honored.
+	Proxy string `json:"proxy"`
+
+	// CORS lets browser frontends on other origins call the API.
+	CORS *CORSConfig `json:"cors"`
+
+	// TrustedProxies are the addresses or CIDR ranges of reverse proxies
+	// whose X-Forwarded-For header names the caller. Connections from
+	// anywhere else are taken at their own address.
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// ForwardHeaders are request headers passed on to upstream providers,
+	// besides the W3C traceparent, tracestate and baggage headers, which
+	// always are.
+	ForwardHeaders []string `json:"forward_headers"`
+
+	// IPAccess restricts the service to address ranges.
+	IPAccess *IPAccessConfig `json:"ip_access"`
+
+	// GeoIP admits and rate-limits callers by country.
+	GeoIP *GeoIPConfig `json:"geoip"`
+
+	// Retention deletes stored data once it is old enough.
+	Retention *RetentionConfig `json:"retention"`
+
+	// AuditLog is the path of the hash-chained audit log; empty disables
+	// auditing.
+	AuditLog string `json:"audit_log"`
+
+	// MaxBodySize is the largest request body accepted, in bytes; 0
+	// disables the limit.
+	MaxBodySize int64 `json:"max_body_size"`
+
+	// Compression encodes large responses for clients that accept it.
+	Compression *CompressionConfig `json:"compression"`
+
+	// ListenTLS serves HTTPS instead of plain HTTP, optionally verifying
+	// client certificates.
+	ListenTLS *ListenTLSConfig `json:"listen_tls"`
+
+	// Clients are the known API callers.
+	Clients []*ClientConfig `json:"clients"`
+
+	// RequireAuth rejects callers that are not a known client.
+	RequireAuth bool `json:"require_auth"`
+
+	// Accounts lets users sign up and manage their own API keys.
+	Accounts *AccountsConfig `json:"accounts"`
+
+	// Workspaces lets authenticated callers share sessions in teams.
+	Workspaces bool `json:"workspaces"`
+
+	// StreamResumeWindow keeps streamed answers this long after their
+	// client went away, so it can reconnect with Last-Event-ID; zero stops
+	// the generation as soon as the client is gone.
+	StreamResumeWindow Duration `json:"stream_resume_window"`
+
+	// StoreCompletions stores every answer with its prompt, usage and
+	// latency, for GET /completions/:id.
+	StoreCompletions bool `json:"store_completions"`
+
+	// Permalinks stores answers like StoreCompletions and shares them at
+	// /r/:id.
+	Permalinks bool `json:"permalinks"`
+
+	// ShareLinks lets the creators of sessions share them read-only at
+	// /s/:token.
+	ShareLinks bool `json:"share_links"`
+
+	// Plugins are WebAssembly modules run as middleware on API requests,
+	// in order.
+	Plugins []*PluginConfig `json:"plugins"`
+
+	// Pipeline declares the middleware stages of API routes.
+	Pipeline *PipelineConfig `json:"pipeline"`
+
+	// Hooks are expressions run at the pre_request, route and
+	// post_response extension points.
+	Hooks *HooksConfig `json:"hooks"`
+
+	// AnonymousLimits cap what each unauthenticated IP may use per day.
+	AnonymousLimits *AnonymousLimits `json:"anonymous_limits"`
+
+	// Tenants are the teams sharing this instance.
+	Tenants []*TenantConfig `json:"tenants"`
+
+	// TenantHeader, when set, names a request header selecting the tenant
+	// for callers whose client is not bound to one. Only enable it behind
+	// a gateway that sets the header itself.
+	TenantHeader string `json:"tenant_header"`
+
+	// SignatureWindow is how far a signed request's timestamp may be from
+	// the server clock.
+	SignatureWindow Duration `json:"signature_window"`
+
+	// IdempotencyWindow is how long the response to a POST request with
+	// an Idempotency-Key is replayed for retries of it.
+	IdempotencyWindow Duration `json:"idempotency_window"`
+
+	// Vault is the HashiCorp Vault server provider keys may be read from.
+	Vault *VaultConfig `json:"vault"`
+
+	// AWS enables reading secrets from Secrets Manager and SSM.
+	AWS *AWSConfig `json:"aws"`
+
+	// ClientsAWS names an AWS secret or parameter holding more clients, as
+	// a JSON array in the format of Clients.
+	ClientsAWS string `json:"clients_aws"`
+
+	// SecretsRefreshInterval is how often keys and clients from Vault or
+	// AWS are re-read.
+	SecretsRefreshInterval Duration `json:"secrets_refresh_interval"`
+}
+
+// AWSConfig holds the AWS settings; credentials come from the standard
+// AWS credential chain.
+type AWSConfig struct {
+	// Region defaults to AWS_REGION or the shared config.
+	Region string `json:"region"`
+}
+
+// VaultConfig locates a Vault KV version 2 secrets engine.
+type VaultConfig struct {
+	// Addr defaults to the VAULT_ADDR environment variable.
+	Addr string `json:"addr"`
+
+	// TokenEnv names the environment variable holding the Vault token
+	// (default VAULT_TOKEN), or <TokenEnv>_FILE naming a file with it.
+	TokenEnv string `json:"token_env"`
+
+	// Mount is the KV v2 mount path (default "secret").
+	Mount string `json:"mount"`
+
+	TLS *TLSConfig `json:"tls"`
+}
+
+// ListenTLSConfig holds the TLS settings of the listener.
+type ListenTLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	// ClientCAFile is a PEM bundle of CAs that sign client certificates.
+	// Setting it enables client certificate authentication.
+	ClientCAFile string `json:"client_ca_file"`
+
+	// ClientAuth is optional (default: verify a certificate when one is
+	// presented) or require (reject connections without one).
+	ClientAuth string `json:"client_auth"`
+}
+
+// ClientConfig identifies an API caller. A client authenticates with its
+// bearer API key or with a client certificate whose subject is listed.
+type ClientConfig struct {
+	ID     string `json:"id"`
+	APIKey string `json:"api_key"`
+
+	// CertSubjects are certificate subject DNs ("CN=build-bot,O=Acme") or
+	// common names mapped to this client.
+	CertSubjects []string `json:"cert_subjects"`
+
+	// HMACSecret lets the client authenticate by signing requests instead.
+	HMACSecret string `json:"hmac_secret"`
+
+	// Tenant is the id of the tenant the client belongs to, if any.
+	Tenant string `json:"tenant"`
+
+	// Priority is the client's tier when requests queue for a provider:
+	// "high", "normal" (the default) or "low".
+	Priority string `json:"priority"`
+
+	// Role is "admin", "operator", "user" (the default) or "read-only".
+	Role string `json:"role"`
+
+	// Quota caps what the client may use per day or month.
+	Quota *QuotaConfig `json:"quota"`
+
+	// account marks the clients of signed-up users.
+	account bool
+}
+
+// AccountsConfig enables user accounts, stored in data_file. With Signup
+// anyone may create one; otherwise operators create them. Logins last
+// LoginTTL (default 24 hours) and a user may hold up to MaxKeys API keys
+// (default 10). Quota applies to every user.
+type AccountsConfig struct {
+	Signup   bool         `json:"signup"`
+	LoginTTL Duration     `json:"login_ttl"`
+	MaxKeys  int          `json:"max_keys"`
+	Quota    *QuotaConfig `json:"quota"`
+}
+
+// PluginConfig loads a WebAssembly middleware module from Path. Each call
+// may take up to Timeout (default 100ms). A failing plugin rejects the
+// request unless FailOpen is set. Config is passed to the plugin with
+// every event.
+type PluginConfig struct {
+	Name     string          `json:"name"`
+	Path     string          `json:"path"`
+	Timeout  Duration        `json:"timeout"`
+	FailOpen bool            `json:"fail_open"`
+	Config   json.RawMessage `json:"config"`
+}
+
+// PipelineConfig declares the ordered middleware stages API requests pass
+// before their handler calls the provider. Routes, keyed by unversioned
+// route ("/chat", "/sessions/:id"), have their own stages; the others have
+// Default, or when it is empty every stage in the built-in order.
+type PipelineConfig struct {
+	Default []string            `json:"default"`
+	Routes  map[string][]string `json:"routes"`
+}
+
+// HooksConfig lists the hooks of each extension point. Pre-request hooks
+// run on API requests after plugins, route hooks choose a model for
+// requests that name none, and post-response hooks run when the response
+// status is known.
+type HooksConfig struct {
+	PreRequest   []*HookConfig `json:"pre_request"`
+	Route        []*HookConfig `json:"route"`
+	PostResponse []*HookConfig `json:"post_response"`
+}
+
+// HookConfig is one hook. If is an expr-lang condition; an empty one always
+// holds. When it holds, the hook logs Log, an expression yielding a string,
+// and sets SetHeaders on the request (pre_request) or response
+// (post_response). A pre_request hook with Reject answers with that error
+// and Status (default 403) instead; the first route hook that holds chooses
+// Model.
+type HookConfig struct {
+	If         string            `json:"if"`
+	Log        string            `json:"log"`
+	SetHeaders map[string]string `json:"set_headers"`
+	Reject     string            `json:"reject"`
+	Status     int               `json:"status"`
+	Model      string            `json:"model"`
+}
+
+// QuotaConfig is a client's allowance per Period, "day" or "month" (the
+// default), reset at the start of the next UTC day or month. Zero means no
+// limit. Webhook, if set, is notified when 80% and 100% are reached.
+type QuotaConfig struct {
+	Period   string `json:"period"`
+	Requests int    `json:"requests"`
+	Tokens   int    `json:"tokens"`
+	Webhook  string `json:"webhook"`
+}
+
+// CORSConfig controls cross-origin access from browsers. AllowedOrigins may
+// contain "*" unless AllowCredentials is set. Empty AllowedHeaders allow
+// whatever the browser asks for.
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	ExposedHeaders   []string `json:"exposed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           Duration `json:"max_age"`
+}
+
+// LoadSheddingConfig holds the thresholds of load shedding, checked per
+// provider; zero disables a threshold. RetryAfter is suggested to rejected
+// clients.
+type LoadSheddingConfig struct {
+	// LatencyP95 is the p95 of recent response times (time to first token
+	// for streams, including any wait in the queue) not to exceed.
+	LatencyP95 Duration `json:"latency_p95"`
+
+	// QueueDepth is the number of requests waiting for the provider's
+	// pool not to exceed.
+	QueueDepth int `json:"queue_depth"`
+
+	RetryAfter Duration `json:"retry_after"`
+}
+
+// SessionSummaryConfig controls session summarization. Once a session's
+// prompt exceeds Threshold (a share, default 0.75) of the context window,
+// all but the last KeepTurns exchanges (default 4) are summarized with
+// Model, by default the session's own. ContextWindow (default 8192) is
+// used for models without one in the catalog.
+type SessionSummaryConfig struct {
+	Threshold     float64 `json:"threshold"`
+	KeepTurns     int     `json:"keep_turns"`
+	Model         string  `json:"model"`
+	ContextWindow int     `json:"context_window"`
+}
+
+// UserMemoryConfig controls long-term user memory. Facts are extracted
+// from chats with ExtractModel (default: the session's model), embedded
+// with EmbeddingModel on Provider (default: default_provider), and the
+// TopK (default 5) scoring at least MinScore (default 0.5) against a new
+// message are added to its prompt. At most MaxFacts (default 200) are kept
+// per client.
+type UserMemoryConfig struct {
+	Provider       string  `json:"provider"`
+	EmbeddingModel string  `json:"embedding_model"`
+	ExtractModel   string  `json:"extract_model"`
+	TopK           int     `json:"top_k"`
+	MinScore       float64 `json:"min_score"`
+	MaxFacts       int     `json:"max_facts"`
+}
+
+// KnowledgeBaseConfig is a knowledge base consulted by Routes ("/" for the
+// ask route, "/chat") before the model. A prompt that matches a FAQ
+// question with at least AnswerScore similarity gets its canned answer
+// without a model call; otherwise the TopK FAQ entries and document chunks
+// with at least MinScore are sent to the model as context. Documents are
+// globs of text files, split as Chunking says. Texts are compared by their
+// embeddings from EmbeddingModel of Provider and, with "hybrid" Retrieval
+// (the default rather than "vector"), by BM25 for context too. With
+// IndexFile, the index is saved there and reused at startup while its
+// settings are unchanged. With Workspace, only requests made in that
+// workspace consult it, in place of the routes' other knowledge base.
+type KnowledgeBaseConfig struct {
+	Routes         []string       `json:"routes"`
+	Workspace      string         `json:"workspace"`
+	FAQ            []*FAQEntry    `json:"faq"`
+	Documents      []string       `json:"documents"`
+	Provider       string         `json:"provider"`
+	EmbeddingModel string         `json:"embedding_model"`
+	AnswerScore    float64        `json:"answer_score"`
+	MinScore       float64        `json:"min_score"`
+	TopK           int            `json:"top_k"`
+	Retrieval      string         `json:"retrieval"`
+	Chunking       ChunkingConfig `json:"chunking"`
+	IndexFile      string         `json:"index_file"`
+}
+
+// ChunkingConfig sets how documents are split: into chunks of up to Size
+// characters that repeat the last Overlap characters of the one before,
+// at paragraphs, sentences, markdown headings or top-level code blocks
+// (Splitter "paragraph", the default, "sentence", "markdown" or "code").
+type ChunkingConfig struct {
+	Splitter string `json:"splitter"`
+	Size     int    `json:"size"`
+	Overlap  int    `json:"overlap"`
+}
+
+// FAQEntry is a question with its canned answer.
+type FAQEntry struct {
+	Question string `json:"question"`
+	Answer   string `json:"answer"`
+}
+
+// RetentionConfig sets how long stored data is kept; zero keeps it forever.
+// Interval is how often expired data is purged.
+type RetentionConfig struct {
+	// Sessions are deleted this long after their last message.
+	Sessions Duration `json:"sessions"`
+
+	// Usage is how long usage records are kept.
+	Usage Duration `json:"usage"`
+
+	// UsageEvents is how long the usage of single requests is kept once
+	// it is rolled up; by default it is deleted right away.
+	UsageEvents Duration `json:"usage_events"`
+
+	// Completions are deleted this long after they were stored.
+	Completions Duration `json:"completions"`
+
+	Interval Duration `json:"interval"`
+}
+
+// HTTPClientConfig tunes the upstream HTTP clients. Zero values keep the
+// defaults; MaxConnsPerHost 0 means no limit.
+type HTTPClientConfig struct {
+	MaxIdleConns        int      `json:"max_idle_conns"`
+	MaxIdleConnsPerHost int      `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int      `json:"max_conns_per_host"`
+	IdleConnTimeout     Duration `json:"idle_conn_timeout"`
+	DialTimeout         Duration `json:"dial_timeout"`
+	KeepAlive           Duration `json:"keep_alive"`
+	TLSHandshakeTimeout Duration `json:"tls_handshake_timeout"`
+
+	// RequestTimeout bounds a whole non-streamed completion.
+	RequestTimeout Duration `json:"request_timeout"`
+}
+
+// WarmupConfig configures the warmup completions. Model defaults to the
+// default model.
+type WarmupConfig struct {
+	Model string `json:"model"`
+}
+
+// IPAccessConfig lists CIDR ranges or addresses allowed to use the service
+// and ranges denied it. Deny wins; an empty Allow admits everyone not
+// denied.
+type IPAccessConfig struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// GeoIPConfig sets country rules, using a MaxMind country (or city)
+// database. Countries are ISO 3166-1 alpha-2 codes. Deny wins; an empty
+// AllowCountries admits every country not denied.
+type GeoIPConfig struct {
+	Database       string   `json:"database"`
+	AllowCountries []string `json:"allow_countries"`
+	DenyCountries  []string `json:"deny_countries"`
+
+	// AllowUnknown admits addresses the database has no country for even
+	// when AllowCountries is set.
+	AllowUnknown bool `json:"allow_unknown"`
+
+	RateClasses []*RateClassConfig `json:"rate_classes"`
+}
+
+// RateClassConfig limits each caller IP from the listed countries ("*" for
+// all others) to RequestsPerMinute.
+type RateClassConfig struct {
+	Name              string   `json:"name"`
+	Countries         []string `json:"countries"`
+	RequestsPerMinute int      `json:"requests_per_minute"`
+}
+
+// CompressionConfig controls response compression. Encodings are tried in
+// order of preference and may be "br" and "gzip".
+type CompressionConfig struct {
+	// MinSize is the smallest body compressed, in bytes.
+	MinSize   int      `json:"min_size"`
+	Encodings []string `json:"encodings"`
+}
+
+// AnonymousLimits are daily ceilings for callers that are not
+// authenticated, tracked per IP and reset at midnight UTC. Zero means no
+// limit.
+type AnonymousLimits struct {
+	RequestsPerDay int `json:"requests_per_day"`
+	TokensPerDay   int `json:"tokens_per_day"`
+}
+
+// TenantConfig describes a team served by the instance with isolated
+// credentials, limits and data.
+type TenantConfig struct {
+	ID string `json:"id"`
+
+	// Providers replace the shared provider of the same name for this
+	// tenant. Fields left empty are taken from the shared provider, so
+	// usually only the API key source is given.
+	Providers map[string]*ProviderConfig `json:"providers"`
+
+	// DefaultProvider and DefaultModel default to the server's.
+	DefaultProvider string `json:"default_provider"`
+	DefaultModel    string `json:"default_model"`
+
+	// MaxTokens caps max_tokens on every request; zero means no cap.
+	MaxTokens int `json:"max_tokens"`
+
+	// RequestsPerMinute limits the tenant's request rate; zero means no limit.
+	RequestsPerMinute int `json:"requests_per_minute"`
+
+	// Namespace separates the tenant's stored sessions (default: the id).
+	Namespace string `json:"namespace"`
+}
+
+// ExperimentConfig splits traffic between two arms to compare models or
+// templates.
+type ExperimentConfig struct {
+	Name string `json:"name"`
+
+	// Percent of callers placed in the treatment arm.
+	Percent int `json:"percent"`
+
+	// Template limits the experiment to requests running this template,
+	// which the arms may swap for another one.
+	Template string `json:"template"`
+
+	Control   ExperimentArm `json:"control"`
+	Treatment ExperimentArm `json:"treatment"`
+}
+
+// ExperimentArm is what requests of an arm use; empty fields leave the
+// normal choice in place.
+type ExperimentArm struct {
+	Model    string `json:"model"`
+	Template string `json:"template"`
+}
+
+// ShadowConfig mirrors a sample of requests to a second provider in the
+// background, logging both answers to File without touching the response.
+type ShadowConfig struct {
+	Provider string `json:"provider"`
+
+	// Model replaces the request's model on the shadow provider.
+	Model string `json:"model"`
+
+	// Percent of requests mirrored.
+	Percent float64 `json:"percent"`
+
+	// File is the JSON Lines log of both answers.
+	File string `json:"file"`
+}
+
+// TemplateConfig defines a managed template, adding to or replacing the
+// built-in ones. User is a Go text/template.
+type TemplateConfig struct {
+	Name        string  `json:"name"`
+	System      string  `json:"system"`
+	User        string  `json:"user"`
+	MaxTokens   int     `json:"max_tokens"`
+	Temperature float64 `json:"temperature"`
+	PromptWrapper
+
+	// Examples are few-shot exchanges sent before the user message.
+	Examples []FewShotExample `json:"examples"`
+
+	// ContextBudget caps the estimated prompt tokens, examples included;
+	// zero leaves only the model's context window as the limit.
+	ContextBudget int `json:"context_budget"`
+}
+
+// FewShotExample is a sample question and the answer the model should
+// imitate.
+type FewShotExample struct {
+	User      string `json:"user"`
+	Assistant string `json:"assistant"`
+}
+
+// ScheduleConfig is a prompt run on a cron schedule: five fields (minute
+// first) or a descriptor such as "@daily", optionally prefixed with
+// "CRON_TZ=<zone> ". Prompt is a text/template receiving .Content, the text
+// of URL fetched before each run, and .Date.
+type ScheduleConfig struct {
+	Name   string `json:"name"`
+	Cron   string `json:"cron"`
+	Prompt string `json:"prompt"`
+	URL    string `json:"url"`
+
+	System    string `json:"system"`
+	Model     string `json:"model"`
+	MaxTokens int    `json:"max_tokens"`
+
+	// Deliver sends each result on, besides storing it.
+	Deliver *DeliveryConfig `json:"deliver"`
+	// Feed publishes the stored results as Atom and RSS feeds.
+	Feed *FeedConfig `json:"feed"`
+}
+
+// FeedConfig exposes a schedule's results at /feeds/<name>.atom and
+// /feeds/<name>.rss. Without Token the feed is public; with it, readers
+// pass it as the token query parameter. Title defaults to the schedule
+// name.
+type FeedConfig struct {
+	Title string `json:"title"`
+	Token string `json:"token"`
+}
+
+// DeliveryConfig lists where results are sent: a webhook receiving JSON,
+// email recipients and a Telegram chat ID. Failures are only delivered
+// with Failures set.
+type DeliveryConfig struct {
+	Webhook  string   `json:"webhook"`
+	Email    []string `json:"email"`
+	Telegram string   `json:"telegram"`
+	Failures bool     `json:"failures"`
+}
+
+// SMTPConfig is the mail server results are delivered through. Without
+// Username, mail is sent unauthenticated.
+type SMTPConfig struct {
+	Addr        string `json:"addr"`
+	From        string `json:"from"`
+	Username    string `json:"username"`
+	PasswordEnv string `json:"password_env"`
+}
+
+// TelegramConfig is the bot results are delivered with. BotTokenEnv
+// defaults to TELEGRAM_BOT_TOKEN.
+type TelegramConfig struct {
+	BotTokenEnv string `json:"bot_token_env"`
+	APIURL      string `json:"api_url"`
+}
+
+// SanitizeConfig relaxes or tightens input cleaning. By default requests
+// with invalid UTF-8 are rejected and control characters other than tab,
+// newline and carriage return are stripped from prompts.
+type SanitizeConfig struct {
+	// AllowInvalidUTF8 forwards invalid UTF-8 with U+FFFD in place of
+	// the bad bytes instead of rejecting the request.
+	AllowInvalidUTF8 bool `json:"allow_invalid_utf8"`
+
+	// KeepControlCharacters forwards control characters unchanged.
+	KeepControlCharacters bool `json:"keep_control_characters"`
+
+	// NFC normalizes prompts to Unicode Normalization Form C, so that
+	// composed and decomposed accents match in caches and filters.
+	NFC bool `json:"nfc"`
+
+	// StripZeroWidth removes zero-width and other invisible formatting
+	// characters: zero-width spaces and joiners, soft hyphens, byte order
+	// marks, variation selectors and bidirectional controls.
+	StripZeroWidth bool `json:"strip_zero_width"`
+
+	// Homoglyphs folds lookalike characters to plain ones: compatibility
+	// forms such as fullwidth and mathematical letters (NFKC), and Cyrillic
+	// and Greek letters mixed into Latin words.
+	Homoglyphs bool `json:"homoglyphs"`
+
+	// Routes replace these settings for the routes they name, such as
+	// "/chat".
+	Routes map[string]*SanitizeConfig `json:"routes"`
+}
+
+// DegradationResponse is what callers get instead of a built-in error
+// response: Status (default: the code's own) and Message (default: the
+// built-in one), or the body Template renders from the code, status,
+// Retry-After seconds and message, sent as ContentType (default
+// text/plain).
+type DegradationResponse struct {
+	Status      int    `json:"status"`
+	Message     string `json:"message"`
+	Template    string `json:"template"`
+	ContentType string `json:"content_type"`
+}
+
+// ResponseCacheConfig sizes the cache of answers: entries are kept for TTL
+// (default 10 minutes), and at most MaxEntries (default 1000) of them.
+// Answers past their TTL are kept StaleTTL longer and served, marked
+// stale, when the provider is down or fails; zero never serves them.
+type ResponseCacheConfig struct {
+	TTL        Duration `json:"ttl"`
+	MaxEntries int      `json:"max_entries"`
+	StaleTTL   Duration `json:"stale_ttl"`
+}
+
+// AlertsConfig lists the webhooks operator alerts are posted to. An event
+// is repeated for the same provider at most once per Cooldown (default 15
+// minutes).
+type AlertsConfig struct {
+	Cooldown Duration        `json:"cooldown"`
+	Webhooks []*AlertWebhook `json:"webhooks"`
+
+	// Spend raises spend_exceeded when the estimated spend of the day or
+	// month crosses a threshold.
+	Spend []*SpendThreshold `json:"spend"`
+}
+
+// SpendThreshold is an amount of estimated spend, in the currency of the
+// price table, that operators are alerted about once per Period ("day" or
+// "month") when it is reached: by Provider, or overall when it is empty.
+type SpendThreshold struct {
+	Period   string  `json:"period"`
+	Provider string  `json:"provider"`
+	Amount   float64 `json:"amount"`
+}
+
+// AlertWebhook is one alert destination. The URL is given directly or,
+// since Slack and Discord webhook URLs are credentials, read from URLEnv.
+// Format is "slack", "discord" or "generic" (the default); empty Events
+// subscribes to all of them.
+type AlertWebhook struct {
+	URL    string   `json:"url"`
+	URLEnv string   `json:"url_env"`
+	Format string   `json:"format"`
+	Events []string `json:"events"`
+}
+
+// PersonaConfig is a fixed assistant role: a system prompt and the model
+// settings that go with it. Unset fields use the server defaults.
+type PersonaConfig struct {
+	System      string   `json:"system"`
+	Model       string   `json:"model"`
+	Temperature *float64 `json:"temperature"`
+	MaxTokens   int      `json:"max_tokens"`
+
+	// Path, e.g. "/code", serves the persona as a preset route of its own.
+	Path string `json:"path"`
+}
+
+// PromptWrapper is text put before and after a user prompt, e.g.
+// formatting instructions or a refusal policy, each separated from the
+// prompt by a blank line.
+type PromptWrapper struct {
+	Prefix string `json:"prefix"`
+	Suffix string `json:"suffix"`
+}
+
+// RewriteRule rewrites the last user prompt ("prompt", applied after the
+// prompt wrapper) or the completion ("completion") of requests to Routes,
+// unversioned routes such as "/chat", or of every route when empty. Match,
+// a regular expression, is replaced by Replace, which may refer to
+// submatches as $1 or ${name}. Template, a text/template, then renders the
+// result as {{.Text}}.
+type RewriteRule struct {
+	Apply    string   `json:"apply"`
+	Routes   []string `json:"routes"`
+	Match    string   `json:"match"`
+	Replace  string   `json:"replace"`
+	Template string   `json:"template"`
+}
+
+// RoutingRule sends matching requests that name no model to Model. Every
+// condition that is set must hold.
+type RoutingRule struct {
+	// MinPromptTokens and MaxPromptTokens bound the estimated size of the
+	// messages sent.
+	MinPromptTokens int `json:"min_prompt_tokens"`
+	MaxPromptTokens int `json:"max_prompt_tokens"`
+
+	// Language is the ISO 639-1 code detected for the last user message.
+	Language string `json:"language"`
+
+	// Template is the name of the managed template being run.
+	Template string `json:"template"`
+
+	// Complexity matches the caller's hint, given as the complexity query
+	// parameter or X-Complexity header (e.g. "low", "high").
+	Complexity string `json:"complexity"`
+
+	// Model is the model or alias to use.
+	Model string `json:"model"`
+}
+
+// ModelInfo describes a model offered by a provider.
+type ModelInfo struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+
+	// ContextWindow is the model's context size in tokens; zero means unknown.
+	ContextWindow int `json:"context_window"`
+
+	// Tools and Vision tell whether the model supports tool calls and images.
+	Tools  bool `json:"tools"`
+	Vision bool `json:"vision"`
+
+	// InputPrice and OutputPrice are per million prompt and completion tokens.
+	InputPrice  float64 `json:"input_price"`
+	OutputPrice float64 `json:"output_price"`
+}
+
+// ModelAlias is the model a virtual model name stands for.
+type ModelAlias struct {
+	// Provider defaults to the caller's default provider.
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+}
+
+// ProviderConfig describes an OpenAI-compatible upstream API.
+type ProviderConfig struct {
+	// BaseURLs are the API roots of the provider's endpoints, e.g. several
+	// self-hosted vLLM replicas. Requests go to <base>/chat/completions.
+	BaseURLs []string `json:"base_urls"`
+
+	// Balance is round_robin (default) or least_connections.
+	Balance string `json:"balance"`
+
+	// APIKeyEnv names the environment variable holding the API key. The
+	// key may instead be read from the file named by <APIKeyEnv>_FILE.
+	APIKeyEnv string `json:"api_key_env"`
+
+	// APIKeyVault reads the API key from Vault instead, as
+	// "<path>#<field>" under the configured KV v2 mount.
+	APIKeyVault string `json:"api_key_vault"`
+
+	// APIKeyAWS reads the API key from AWS, as
+	// "secretsmanager:<id>[#<field>]" or "ssm:<parameter>".
+	APIKeyAWS string `json:"api_key_aws"`
+
+	// HealthCheckInterval is how often each endpoint is probed; zero
+	// disables probing. Unreachable endpoints are also marked unhealthy
+	// when a request to them fails.
+	HealthCheckInterval Duration `json:"health_check_interval"`
+
+	// Fallback is the model alias that requests for this provider go to
+	// while it is down, when the alias's provider is up.
+	Fallback string `json:"fallback"`
+
+	// Proxy overrides the global proxy for this provider.
+	Proxy string `json:"proxy"`
+
+	// TLS customizes certificate verification, e.g. for self-hosted
+	// inference servers with private certificates.
+	TLS *TLSConfig `json:"tls"`
+
+	// MaxConcurrency bounds the upstream requests in flight, e.g. to the
+	// provider's concurrency limit; zero means no bound. Requests beyond
+	// it wait in a queue of at most MaxQueue (zero: unbounded) for up to
+	// QueueTimeout (zero: until the caller gives up).
+	MaxConcurrency int      `json:"max_concurrency"`
+	MaxQueue       int      `json:"max_queue"`
+	QueueTimeout   Duration `json:"queue_timeout"`
+}
+
+// TLSConfig holds the TLS options for connections to an upstream.
+type TLSConfig struct {
+	// CAFile is a PEM bundle of CAs trusted instead of the system roots.
+	CAFile string `json:"ca_file"`
+
+	// InsecureSkipVerify disables certificate verification. Only for testing.
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+
+	// ServerName overrides the name sent in SNI and checked against the
+	// certificate.
+	ServerName string `json:"server_name"`
+
+	// CertFile and KeyFile are a PEM client certificate and key presented
+	// to upstreams that require mutual TLS.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// Duration is a time.Duration written as a Go duration string ("5s", "1m")
+// in the config file. Whole days may be written as "30d".
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\": %w", err)
+	}
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", v)
+		}
+		d.Duration = time.Duration(n) * 24 * time.Hour
+		return nil
+	}
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:      ":8080",
+		TitleModel:  defaultModel,
+		RetryBudget: Duration{5 * time.Second},
+		Providers: map[string]*ProviderConfig{
+			"chutes": {
+				BaseURLs:  []string{chutesBaseURL},
+				APIKeyEnv: "CHUTES_API_TOKEN",
+			},
+		},
+		DefaultProvider: "chutes",
+		DefaultModel:    defaultModel,
+		Prices:          defaultPrices(),
+		SignatureWindow: Duration{5 * time.Minute},
+		MaxBodySize:     1 << 20,
+
+		IdempotencyWindow: Duration{24 * time.Hour},
+
+		SecretsRefreshInterval: Duration{5 * time.Minute},
+
+		UsageRollupInterval: Duration{time.Minute},
+	}
+}
+
+// loadConfig returns the default configuration overlaid with the file named
+// by ASKLLM_CONFIG, if any.
+func loadConfig() (*Config, error) {
+	cfg := defaultConfig()
+
+	path := os.Getenv("ASKLLM_CONFIG")
+	if path == "" {
+		return cfg, cfg.validate()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// validate checks the configuration and fills in per-provider defaults.
+func (cfg *Config) validate() error {
+	if _, ok := cfg.Providers[cfg.DefaultProvider]; !ok {
+		return fmt.Errorf("default_provider %q is not defined in providers", cfg.DefaultProvider)
+	}
+	if vc := cfg.Vault; vc != nil {
+		if vc.Addr == "" {
+			vc.Addr = os.Getenv("VAULT_ADDR")
+		}
+		if vc.Addr == "" {
+			return fmt.Errorf("vault: addr is empty and VAULT_ADDR is not set")
+		}
+		if vc.TokenEnv == "" {
+			vc.TokenEnv = "VAULT_TOKEN"
+		}
+		if vc.Mount == "" {
+			vc.Mount = "secret"
+		}
+	}
+	for i, cl := range cfg.Clients {
+		if cl.ID == "" {
+			return fmt.Errorf("clients[%d]: id is empty", i)
+		}
+	}
+	for name, pc := range cfg.Providers {
+		if err := pc.validate(); err != nil {
+			return fmt.Errorf("provider %q: %w", name, err)
+		}
+		if pc.HealthCheckInterval.Duration == 0 {
+			pc.HealthCheckInterval = cfg.HealthCheckInterval
+		}
+		if pc.Fallback != "" {
+			alias, ok := cfg.ModelAliases[pc.Fallback]
+			if !ok {
+				return fmt.Errorf("provider %q: fallback %q is not a model alias", name, pc.Fallback)
+			}
+			if alias.Provider == "" || alias.Provider == name {
+				return fmt.Errorf("provider %q: fallback %q must name another provider", name, pc.Fallback)
+			}
+		}
+	}
+
+	for name, alias := range cfg.ModelAliases {
+		if alias.Model == "" {
+			return fmt.Errorf("model alias %q: model is empty", name)
+		}
+		if alias.Provider != "" && !cfg.providerDefined(alias.Provider) {
+			return fmt.Errorf("model alias %q: provider %q is not defined", name, alias.Provider)
+		}
+	}
+
+	for route := range cfg.PromptWrappers {
+		if route != "*" && !strings.HasPrefix(route, "/") {
+			return fmt.Errorf("prompt_wrappers: %q is not a route", route)
+		}
+	}
+
+	for i, rule := range cfg.Rewrites {
+		if rule.Apply != rewritePrompt && rule.Apply != rewriteCompletion {
+			return fmt.Errorf("rewrites[%d]: apply must be prompt or completion", i)
+		}
+		if rule.Match == "" && rule.Template == "" {
+			return fmt.Errorf("rewrites[%d]: match or template is required", i)
+		}
+		for _, route := range rule.Routes {
+			if !strings.HasPrefix(route, "/") {
+				return fmt.Errorf("rewrites[%d]: %q is not a route", i, route)
+			}
+		}
+	}
+
+	for _, name := range cfg.AllowedProviders {
+		if !cfg.providerDefined(name) {
+			return fmt.Errorf("allowed_providers: provider %q is not defined", name)
+		}
+	}
+
+	for i, rule := range cfg.RoutingRules {
+		if rule.Model == "" {
+			return fmt.Errorf("routing_rules[%d]: model is empty", i)
+		}
+	}
+
+	switch cfg.RoutingPolicy {
+	case "":
+		cfg.RoutingPolicy = policyDefault
+	case policyDefault, policyCost:
+	default:
+		return fmt.Errorf("unknown routing_policy %q", cfg.RoutingPolicy)
+	}
+	for model, p := range cfg.Prices {
+		if p == nil || p.Input < 0 || p.Output < 0 {
+			return fmt.Errorf("prices: %q must have input and output prices of zero or more", model)
+		}
+	}
+	for i, m := range cfg.Models {
+		if m.Model == "" {
+			return fmt.Errorf("models[%d]: model is empty", i)
+		}
+		if m.Provider == "" {
+			m.Provider = cfg.DefaultProvider
+		}
+		if !cfg.providerDefined(m.Provider) {
+			return fmt.Errorf("models[%d]: provider %q is not defined", i, m.Provider)
+		}
+		if p := cfg.tablePrice(m.Provider, m.Model); p != nil && m.InputPrice == 0 && m.OutputPrice == 0 {
+			m.InputPrice, m.OutputPrice = p.Input, p.Output
+		}
+	}
+
+	experiments := map[string]bool{}
+	for i, exp := range cfg.Experiments {
+		if exp.Name == "" {
+			return fmt.Errorf("experiments[%d]: name is empty", i)
+		}
+		if experiments[exp.Name] {
+			return fmt.Errorf("experiment %q is defined twice", exp.Name)
+		}
+		experiments[exp.Name] = true
+		if exp.Percent < 0 || exp.Percent > 100 {
+			return fmt.Errorf("experiment %q: percent must be between 0 and 100", exp.Name)
+		}
+	}
+
+	if sc := cfg.Shadow; sc != nil {
+		if _, ok := cfg.Providers[sc.Provider]; !ok {
+			return fmt.Errorf("shadow: provider %q is not defined in providers", sc.Provider)
+		}
+		if sc.Percent < 0 || sc.Percent > 100 {
+			return fmt.Errorf("shadow: percent must be between 0 and 100")
+		}
+		if sc.File == "" {
+			sc.File = "shadow.jsonl"
+		}
+	}
+
+	if gc := cfg.GeoIP; gc != nil {
+		if gc.Database == "" {
+			return fmt.Errorf("geoip: database is empty")
+		}
+		for i, rc := range gc.RateClasses {
+			if rc.RequestsPerMinute <= 0 {
+				return fmt.Errorf("geoip: rate_classes[%d]: requests_per_minute must be positive", i)
+			}
+		}
+	}
+
+	if cfg.UsageRollupInterval.Duration <= 0 {
+		return fmt.Errorf("usage_rollup_interval must be positive")
+	}
+	if rc := cfg.Retention; rc != nil && rc.Interval.Duration <= 0 {
+		rc.Interval.Duration = time.Hour
+	}
+
+	if cc := cfg.CORS; cc != nil && cc.AllowCredentials && slices.Contains(cc.AllowedOrigins, "*") {
+		// Echoing every origin with credentials would let any site act
+		// with the caller's cookies.
+		return fmt.Errorf("cors: allowed_origins cannot contain \"*\" with allow_credentials")
+	}
+
+	for _, name := range cfg.ForwardHeaders {
+		switch http.CanonicalHeaderKey(name) {
+		case "Authorization", "Cookie", "Host", "Content-Type", "Content-Length", "Connection":
+			return fmt.Errorf("forward_headers: %s cannot be forwarded", name)
+		}
+	}
+
+	schedules := map[string]bool{}
+	for i, sc := range cfg.Schedules {
+		if sc.Name == "" {
+			return fmt.Errorf("schedules[%d]: name is empty", i)
+		}
+		if schedules[sc.Name] {
+			return fmt.Errorf("schedule %q is defined twice", sc.Name)
+		}
+		schedules[sc.Name] = true
+		if err := validateCron(sc.Cron); err != nil {
+			return fmt.Errorf("schedule %q: %w", sc.Name, err)
+		}
+		if sc.Prompt == "" {
+			return fmt.Errorf("schedule %q: prompt is empty", sc.Name)
+		}
+		if dc := sc.Deliver; dc != nil {
+			if len(dc.Email) > 0 && cfg.SMTP == nil {
+				return fmt.Errorf("schedule %q: email delivery needs smtp", sc.Name)
+			}
+			if dc.Telegram != "" && cfg.Telegram == nil {
+				return fmt.Errorf("schedule %q: telegram delivery needs telegram", sc.Name)
+			}
+		}
+	}
+	if sc := cfg.SMTP; sc != nil && (sc.Addr == "" || sc.From == "") {
+		return fmt.Errorf("smtp: addr and from are required")
+	}
+	if tc := cfg.Telegram; tc != nil {
+		if tc.BotTokenEnv == "" {
+			tc.BotTokenEnv = "TELEGRAM_BOT_TOKEN"
+		}
+		if tc.APIURL == "" {
+			tc.APIURL = "https://api.telegram.org"
+		}
+	}
+
+	if cfg.Locale == "" {
+		cfg.Locale = fallbackLocale
+	}
+	for route, sc := range cfg.Sanitize.Routes {
+		if !strings.HasPrefix(route, "/") {
+			return fmt.Errorf("sanitize.routes: %q is not a route", route)
+		}
+		if len(sc.Routes) > 0 {
+			return fmt.Errorf("sanitize.routes[%q]: routes cannot be nested", route)
+		}
+	}
+	if _, ok := catalogs[cfg.Locale]; !ok {
+		return fmt.Errorf("locale %q has no message catalog", cfg.Locale)
+	}
+
+	if rc := cfg.ResponseCache; rc != nil {
+		if rc.TTL.Duration <= 0 {
+			rc.TTL.Duration = 10 * time.Minute
+		}
+		if rc.MaxEntries <= 0 {
+			rc.MaxEntries = 1000
+		}
+	}
+	paths := map[string]string{}
+	for name, p := range cfg.Personas {
+		if p.Path == "" {
+			continue
+		}
+		if err := checkPersonaPath(p.Path); err != nil {
+			return fmt.Errorf("personas.%s: %w", name, err)
+		}
+		if other, ok := paths[p.Path]; ok {
+			return fmt.Errorf("personas.%s: path %s is also used by persona %s", name, p.Path, other)
+		}
+		paths[p.Path] = name
+	}
+	for i, pc := range cfg.Plugins {
+		if pc.Path == "" {
+			return fmt.Errorf("plugins[%d]: path is empty", i)
+		}
+		if pc.Name == "" {
+			pc.Name = filepath.Base(pc.Path)
+		}
+		if pc.Timeout.Duration <= 0 {
+			pc.Timeout.Duration = 100 * time.Millisecond
+		}
+	}
+	if pc := cfg.Pipeline; pc != nil {
+		if len(pc.Default) > 0 {
+			if err := checkStages(pc.Default, cfg.authenticates()); err != nil {
+				return fmt.Errorf("pipeline.default: %w", err)
+			}
+		}
+		for route, stages := range pc.Routes {
+			if err := checkStages(stages, cfg.authenticates()); err != nil {
+				return fmt.Errorf("pipeline.routes[%s]: %w", route, err)
+			}
+		}
+	}
+	if hc := cfg.Hooks; hc != nil {
+		for i, h := range hc.PreRequest {
+			if h.Model != "" {
+				return fmt.Errorf("hooks.pre_request[%d]: model is only for route hooks", i)
+			}
+			if h.Status == 0 {
+				h.Status = http.StatusForbidden
+			}
+			if h.Status < 400 || h.Status > 599 {
+				return fmt.Errorf("hooks.pre_request[%d]: status %d is not an error status", i, h.Status)
+			}
+		}
+		for i, h := range hc.Route {
+			if h.Model == "" {
+				return fmt.Errorf("hooks.route[%d]: model is empty", i)
+			}
+			if h.Reject != "" || len(h.SetHeaders) > 0 {
+				return fmt.Errorf("hooks.route[%d]: route hooks only choose a model", i)
+			}
+		}
+		for i, h := range hc.PostResponse {
+			if h.Reject != "" || h.Model != "" {
+				return fmt.Errorf("hooks.post_response[%d]: post_response hooks only log and set headers", i)
+			}
+		}
+	}
+	if cfg.Workspaces && len(cfg.Clients) == 0 && cfg.ClientsAWS == "" && cfg.Accounts == nil {
+		return fmt.Errorf("workspaces need clients or accounts to tell members apart")
+	}
+	if ac := cfg.Accounts; ac != nil {
+		if ac.LoginTTL.Duration <= 0 {
+			ac.LoginTTL.Duration = 24 * time.Hour
+		}
+		if ac.MaxKeys <= 0 {
+			ac.MaxKeys = 10
+		}
+		if q := ac.Quota; q != nil && q.Period != "" && q.Period != quotaDay && q.Period != quotaMonth {
+			return fmt.Errorf("accounts: unknown quota period %q", q.Period)
+		}
+	}
+	if ac := cfg.Alerts; ac != nil {
+		if ac.Cooldown.Duration <= 0 {
+			ac.Cooldown.Duration = defaultAlertCooldown
+		}
+		for i, wc := range ac.Webhooks {
+			if (wc.URL == "") == (wc.URLEnv == "") {
+				return fmt.Errorf("alerts.webhooks[%d]: set exactly one of url and url_env", i)
+			}
+			switch wc.Format {
+			case "":
+				wc.Format = alertFormatGeneric
+			case alertFormatGeneric, alertFormatSlack, alertFormatDiscord:
+			default:
+				return fmt.Errorf("alerts.webhooks[%d]: unknown format %q", i, wc.Format)
+			}
+			for _, event := range wc.Events {
+				if !slices.Contains(alertEvents, event) {
+					return fmt.Errorf("alerts.webhooks[%d]: unknown event %q", i, event)
+				}
+			}
+		}
+		for i, st := range ac.Spend {
+			if st.Period != quotaDay && st.Period != quotaMonth {
+				return fmt.Errorf("alerts.spend[%d]: period must be day or month", i)
+			}
+			if st.Amount <= 0 {
+				return fmt.Errorf("alerts.spend[%d]: amount must be positive", i)
+			}
+			if _, ok := cfg.Providers[st.Provider]; st.Provider != "" && !ok {
+				return fmt.Errorf("alerts.spend[%d]: provider %q is not defined", i, st.Provider)
+			}
+		}
+	}
+
+	if mc := cfg.UserMemory; mc != nil {
+		if mc.EmbeddingModel == "" {
+			return fmt.Errorf("user_memory: embedding_model is empty")
+		}
+		if mc.Provider == "" {
+			mc.Provider = cfg.DefaultProvider
+		}
+		if _, ok := cfg.Providers[mc.Provider]; !ok {
+			return fmt.Errorf("user_memory: provider %q is not defined in providers", mc.Provider)
+		}
+		if mc.TopK <= 0 {
+			mc.TopK = defaultMemoryTopK
+		}
+		if mc.MinScore <= 0 {
+			mc.MinScore = defaultMemoryMinScore
+		}
+		if mc.MaxFacts <= 0 {
+			mc.MaxFacts = defaultMemoryMaxFacts
+		}
+	}
+
+	kbRoutes := map[kbRoute]string{}
+	for name, kc := range cfg.KnowledgeBases {
+		if kc.Workspace != "" && !cfg.Workspaces {
+			return fmt.Errorf("knowledge_bases.%s: workspace needs workspaces", name)
+		}
+		if kc.EmbeddingModel == "" {
+			return fmt.Errorf("knowledge_bases.%s: embedding_model is empty", name)
+		}
+		if kc.Provider == "" {
+			kc.Provider = cfg.DefaultProvider
+		}
+		if _, ok := cfg.Providers[kc.Provider]; !ok {
+			return fmt.Errorf("knowledge_bases.%s: provider %q is not defined in providers", name, kc.Provider)
+		}
+		if len(kc.FAQ) == 0 && len(kc.Documents) == 0 {
+			return fmt.Errorf("knowledge_bases.%s: faq and documents are empty", name)
+		}
+		for i, e := range kc.FAQ {
+			if e == nil || e.Question == "" || e.Answer == "" {
+				return fmt.Errorf("knowledge_bases.%s: faq[%d] needs a question and an answer", name, i)
+			}
+		}
+		for _, route := range kc.Routes {
+			if route != "/" && route != "/chat" {
+				return fmt.Errorf("knowledge_bases.%s: route %q cannot consult a knowledge base", name, route)
+			}
+			key := kbRoute{route, kc.Workspace}
+			if other, ok := kbRoutes[key]; ok {
+				return fmt.Errorf("knowledge_bases.%s: route %s already consults %s", name, route, other)
+			}
+			kbRoutes[key] = name
+		}
+		if kc.AnswerScore <= 0 {
+			kc.AnswerScore = defaultKBAnswerScore
+		}
+		if kc.MinScore <= 0 {
+			kc.MinScore = defaultKBMinScore
+		}
+		if kc.TopK <= 0 {
+			kc.TopK = defaultKBTopK
+		}
+		cc := &kc.Chunking
+		switch cc.Splitter {
+		case "":
+			cc.Splitter = splitParagraph
+		case splitParagraph, splitSentence, splitMarkdown, splitCode:
+		default:
+			return fmt.Errorf("knowledge_bases.%s: chunking.splitter must be paragraph, sentence, markdown or code", name)
+		}
+		if cc.Size <= 0 {
+			cc.Size = defaultChunkSize
+		}
+		if cc.Overlap < 0 || cc.Overlap > cc.Size/2 {
+			return fmt.Errorf("knowledge_bases.%s: chunking.overlap must be between 0 and half the size", name)
+		}
+		switch kc.Retrieval {
+		case "":
+			kc.Retrieval = retrievalHybrid
+		case retrievalHybrid, retrievalVector:
+		default:
+			return fmt.Errorf("knowledge_bases.%s: retrieval must be hybrid or vector", name)
+		}
+	}
+
+	if cfg.SessionWindow > 0 && cfg.SessionSummary != nil {
+		return fmt.Errorf("session_window and session_summary cannot both be set")
+	}
+	if sc := cfg.SessionSummary; sc != nil {
+		if sc.Threshold <= 0 || sc.Threshold > 1 {
+			sc.Threshold = defaultSummaryThreshold
+		}
+		if sc.KeepTurns <= 0 {
+			sc.KeepTurns = defaultSummaryKeepTurns
+		}
+		if sc.ContextWindow <= 0 {
+			sc.ContextWindow = defaultSummaryContextWindow
+		}
+	}
+
+	if lc := cfg.LoadShedding; lc != nil {
+		if lc.LatencyP95.Duration <= 0 && lc.QueueDepth <= 0 {
+			return fmt.Errorf("load_shedding: set latency_p95 or queue_depth")
+		}
+		if lc.RetryAfter.Duration <= 0 {
+			lc.RetryAfter.Duration = 10 * time.Second
+		}
+	}
+
+	if cc := cfg.Compression; cc != nil {
+		for _, enc := range cc.Encodings {
+			if enc != "br" && enc != "gzip" {
+				return fmt.Errorf("compression: unknown encoding %q", enc)
+			}
+		}
+	}
+
+	tenants := map[string]bool{}
+	for i, t := range cfg.Tenants {
+		if t.ID == "" {
+			return fmt.Errorf("tenants[%d]: id is empty", i)
+		}
+		tenants[t.ID] = true
+		if t.Namespace == "" {
+			t.Namespace = t.ID
+		}
+		if t.DefaultProvider == "" {
+			t.DefaultProvider = cfg.DefaultProvider
+		}
+		for name, pc := range t.Providers {
+			if cfg.Providers[name] != nil && pc.APIKeyEnv == "" && pc.APIKeyVault == "" && pc.APIKeyAWS == "" {
+				return fmt.Errorf("tenant %q provider %q: set api_key_env, api_key_vault or api_key_aws, or it runs on the shared key", t.ID, name)
+			}
+			merged := mergeProvider(cfg.Providers[name], pc)
+			if err := merged.validate(); err != nil {
+				return fmt.Errorf("tenant %q provider %q: %w", t.ID, name, err)
+			}
+			t.Providers[name] = merged
+		}
+		if _, ok := t.Providers[t.DefaultProvider]; !ok {
+			return fmt.Errorf("tenant %q: default_provider %q is not one of its providers, so it would run on the shared key", t.ID, t.DefaultProvider)
+		}
+	}
+	for _, cl := range cfg.Clients {
+		if cl.Tenant != "" && !tenants[cl.Tenant] {
+			return fmt.Errorf("client %q: unknown tenant %q", cl.ID, cl.Tenant)
+		}
+		if _, ok := parsePriority(cl.Priority); cl.Priority != "" && !ok {
+			return fmt.Errorf("client %q: unknown priority %q", cl.ID, cl.Priority)
+		}
+		if q := cl.Quota; q != nil && q.Period != "" && q.Period != quotaDay && q.Period != quotaMonth {
+			return fmt.Errorf("client %q: unknown quota period %q", cl.ID, q.Period)
+		}
+		if cl.Role != "" && !slices.Contains(roles, cl.Role) {
+			return fmt.Errorf("client %q: unknown role %q", cl.ID, cl.Role)
+		}
+	}
+	return nil
+}
+
+// providerDefined reports whether name is a shared provider or one of a
+// tenant's own providers.
+func (cfg *Config) providerDefined(name string) bool {
+	if _, ok := cfg.Providers[name]; ok {
+		return true
+	}
+	for _, t := range cfg.Tenants {
+		if _, ok := t.Providers[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks a provider definition and fills in defaults.
+func (pc *ProviderConfig) validate() error {
+	if len(pc.BaseURLs) == 0 {
+		return fmt.Errorf("base_urls is empty")
+	}
+	switch pc.Balance {
+	case "":
+		pc.Balance = balanceRoundRobin
+	case balanceRoundRobin, balanceLeastConnections:
+	default:
+		return fmt.Errorf("unknown balance %q", pc.Balance)
+	}
+	return nil
+}
+
+// checkStages reports unknown or repeated pipeline stages, stages that act
+// on the caller before auth and, when callers authenticate, a missing auth
+// stage, which would make the route anonymous.
+func checkStages(stages []string, authenticates bool) error {
+	seen := map[string]bool{}
+	for _, name := range stages {
+		if !slices.Contains(pipelineStages, name) {
+			return fmt.Errorf("unknown stage %q", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("stage %q is listed twice", name)
+		}
+		if slices.Contains(callerStages, name) && !seen["auth"] && (authenticates || slices.Contains(stages, "auth")) {
+			return fmt.Errorf("stage %q must come after auth", name)
+		}
+		seen[name] = true
+	}
+	if authenticates && !seen["auth"] {
+		return fmt.Errorf("stage \"auth\" is missing, although callers authenticate")
+	}
+	return nil
+}
+
+// authenticates reports whether callers are authenticated: there are
+// clients or accounts, or authentication is required.
+func (cfg *Config) authenticates() bool {
+	return len(cfg.Clients) > 0 || cfg.ClientsAWS != "" || cfg.RequireAuth || cfg.Accounts != nil
+}
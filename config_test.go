@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPersonaPathMustNotShadowRoutes(t *testing.T) {
+	for _, path := range []string{"/usage", "/r", "/s/x", "/completions", "/templates/x", "/v1/ask"} {
+		cfg := defaultConfig()
+		cfg.Personas = map[string]*PersonaConfig{"p": {Path: path}}
+		if err := cfg.validate(); err == nil {
+			t.Errorf("persona path %s: validate passed, want an error", path)
+		}
+	}
+	cfg := defaultConfig()
+	cfg.Personas = map[string]*PersonaConfig{"p": {Path: "/code"}}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("persona path /code: %v", err)
+	}
+}
+
+// TestReservedPathsCoverAPIRoutes keeps reservedPaths in step with the API
+// routes, with every optional feature on.
+func TestReservedPathsCoverAPIRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := defaultConfig()
+	cfg.ShareLinks, cfg.Workspaces, cfg.StoreCompletions = true, true, true
+	cfg.Accounts = &AccountsConfig{}
+	cfg.UserMemory = &UserMemoryConfig{}
+	s := &server{cfg: cfg, pipelineRoutes: map[string]bool{}}
+	router := gin.New()
+	s.apiRoutes(pipelineGroup{s: s, g: router.Group("/")})
+
+	for _, r := range router.Routes() {
+		first, _, _ := strings.Cut(strings.TrimPrefix(r.Path, "/"), "/")
+		if err := checkPersonaPath("/" + first); err == nil {
+			t.Errorf("route %s %s: %q is not reserved for built-in routes", r.Method, r.Path, first)
+		}
+	}
+}
+
+func TestCORSWildcardWithCredentials(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.CORS = &CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}
+	if err := cfg.validate(); err == nil {
+		t.Error(`validate passed "*" with allow_credentials, want an error`)
+	}
+	cfg.CORS.AllowedOrigins = []string{"https://app.example.com"}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("listed origin with allow_credentials: %v", err)
+	}
+}
+
+func TestKnowledgeBasePerWorkspace(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Workspaces = true
+	cfg.Accounts = &AccountsConfig{}
+	cfg.KnowledgeBases = map[string]*KnowledgeBaseConfig{
+		"shared": {Routes: []string{"/chat"}, EmbeddingModel: "e", FAQ: []*FAQEntry{{Question: "q", Answer: "a"}}},
+		"team":   {Routes: []string{"/chat"}, Workspace: "w1", EmbeddingModel: "e", FAQ: []*FAQEntry{{Question: "q", Answer: "a"}}},
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("a shared and a workspace knowledge base on one route: %v", err)
+	}
+	cfg.KnowledgeBases["other"] = &KnowledgeBaseConfig{Routes: []string{"/chat"}, Workspace: "w1", EmbeddingModel: "e", FAQ: []*FAQEntry{{Question: "q", Answer: "a"}}}
+	if err := cfg.validate(); err == nil {
+		t.Error("two knowledge bases of one workspace on one route: validate passed, want an error")
+	}
+}
+
+func TestCheckStages(t *testing.T) {
+	for _, tt := range []struct {
+		stages        []string
+		authenticates bool
+		ok            bool
+	}{
+		{[]string{"auth", "rate_limit", "cache"}, true, true},
+		{[]string{"rate_limit", "cache"}, false, true},
+		{[]string{"cache"}, true, false},
+		{[]string{"rate_limit", "auth"}, true, false},
+		{[]string{"rate_limit", "auth"}, false, false},
+		{[]string{"auth", "auth"}, true, false},
+		{[]string{"auth", "moderation"}, true, false},
+	} {
+		err := checkStages(tt.stages, tt.authenticates)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkStages(%q, %v) = %v, want ok %v", tt.stages, tt.authenticates, err, tt.ok)
+		}
+	}
+}
+
+func TestPipelineNeedsAuthWithClients(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Clients = []*ClientConfig{{ID: "ci", APIKey: "sk-ci"}}
+	cfg.Pipeline = &PipelineConfig{Routes: map[string][]string{"/chat": {"cache"}}}
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), "pipeline.routes[/chat]") {
+		t.Errorf("route without auth: err = %v, want a pipeline.routes[/chat] error", err)
+	}
+}
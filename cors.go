@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Defaults for the CORS settings left empty.
+var (
+	defaultCORSMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+	defaultCORSExposed = []string{"Retry-After", "X-Experiment", "X-Quota-Limit-Requests", "X-Quota-Remaining-Requests", "X-Quota-Limit-Tokens", "X-Quota-Remaining-Tokens", "X-Quota-Reset", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "ETag", "X-Cache", "X-Cost", "X-Knowledge-Base"}
+)
+
+// cors answers preflight requests and adds the CORS headers to responses
+// for the allowed origins. Requests from other origins get no CORS headers,
+// which makes the browser block them.
+func (s *server) cors(c *gin.Context) {
+	cc := s.cfg.CORS
+	origin := c.GetHeader("Origin")
+	c.Writer.Header().Add("Vary", "Origin")
+	if origin == "" || !cc.allows(origin) {
+		c.Next()
+		return
+	}
+
+	h := c.Writer.Header()
+	// validate rejects "*" together with credentials.
+	if slices.Contains(cc.AllowedOrigins, "*") {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if cc.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if c.Request.Method != http.MethodOptions || c.GetHeader("Access-Control-Request-Method") == "" {
+		h.Set("Access-Control-Expose-Headers", strings.Join(orDefault(cc.ExposedHeaders, defaultCORSExposed), ", "))
+		c.Next()
+		return
+	}
+
+	h.Set("Access-Control-Allow-Methods", strings.Join(orDefault(cc.AllowedMethods, defaultCORSMethods), ", "))
+	if len(cc.AllowedHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(cc.AllowedHeaders, ", "))
+	} else if req := c.GetHeader("Access-Control-Request-Headers"); req != "" {
+		h.Set("Access-Control-Allow-Headers", req)
+	}
+	if cc.MaxAge.Duration > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(cc.MaxAge.Seconds())))
+	}
+	c.AbortWithStatus(http.StatusNoContent)
+}
+
+// allows reports whether requests from origin are allowed.
+func (cc *CORSConfig) allows(origin string) bool {
+	for _, o := range cc.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func orDefault(list, def []string) []string {
+	if len(list) > 0 {
+		return list
+	}
+	return def
+}
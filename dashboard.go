@@ -0,0 +1,97 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// handleDashboard serves the admin dashboard page. The page itself holds
+// no data: it asks for the admin token and polls /admin/dashboard/data
+// with it, so it is served without authentication.
+func (s *server) handleDashboard(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", dashboardPage)
+}
+
+// handleDashboardData reports what the dashboard shows: requests per
+// minute, upstream latency, provider health, tokens per client and recent
+// failed requests.
+func (s *server) handleDashboardData(c *gin.Context) {
+	minutes, errors := recentActivity.snapshot(time.Now())
+
+	var providers []gin.H
+	for _, p := range s.allProviders() {
+		endpoints := make([]gin.H, len(p.endpoints))
+		for i, ep := range p.endpoints {
+			endpoints[i] = gin.H{"url": ep.baseURL, "healthy": ep.healthy.Load(), "inflight": ep.inflight.Load()}
+		}
+		active, queued := p.pool.counts()
+		providers = append(providers, gin.H{"name": p.name, "down": p.down.Load(), "active": active, "queued": queued, "endpoints": endpoints})
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i]["name"].(string) < providers[j]["name"].(string) })
+
+	tokens, err := tokensByClient()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not read metrics: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"minutes":   minutes,
+		"upstreams": upstreamStats(),
+		"providers": providers,
+		"tokens":    tokens,
+		"errors":    errors,
+	})
+}
+
+// tokensByClient sums askllm_tokens_total per client since the server
+// started, largest spenders first.
+func tokensByClient() ([]gin.H, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	type spend struct{ prompt, completion float64 }
+	byClient := map[string]*spend{}
+	for _, f := range families {
+		if f.GetName() != "askllm_tokens_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			var client, kind string
+			for _, l := range m.GetLabel() {
+				switch l.GetName() {
+				case "client":
+					client = l.GetValue()
+				case "type":
+					kind = l.GetValue()
+				}
+			}
+			sp, ok := byClient[client]
+			if !ok {
+				sp = &spend{}
+				byClient[client] = sp
+			}
+			if kind == "prompt" {
+				sp.prompt += m.GetCounter().GetValue()
+			} else {
+				sp.completion += m.GetCounter().GetValue()
+			}
+		}
+	}
+
+	list := make([]gin.H, 0, len(byClient))
+	for client, sp := range byClient {
+		list = append(list, gin.H{"client": client, "prompt_tokens": int64(sp.prompt), "completion_tokens": int64(sp.completion), "total_tokens": int64(sp.prompt + sp.completion)})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i]["total_tokens"].(int64) > list[j]["total_tokens"].(int64) })
+	return list, nil
+}
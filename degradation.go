@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/gin-gonic/gin"
+)
+
+// outageCodes are the error codes of requests no provider could answer,
+// which the "*" degradation response covers.
+var outageCodes = []string{
+	codeUpstreamAuth, codeRateLimited, codeQuotaExceeded, codeUpstreamTimeout, codeUpstreamUnreachable,
+	codeUpstreamError, codeUpstreamBadResponse, codeEmptyCompletion, codeOverloaded,
+}
+
+// errorCodes are every code respondUpstreamError sends.
+var errorCodes = append(slices.Clone(outageCodes), codeContextTooLong, codeContentFiltered, codeNotAllowed, codeInternal)
+
+// degradations are the configured responses to failed requests, keyed by
+// error code or "*". They are set once at startup.
+var degradations map[string]*degradation
+
+// degradation is a compiled degradation response.
+type degradation struct {
+	cfg  *DegradationResponse
+	tmpl *template.Template
+}
+
+// degradationData is what degradation templates see. Message is the
+// built-in message for the code.
+type degradationData struct {
+	Code       string
+	Status     int
+	RetryAfter int
+	Message    string
+}
+
+// compileDegradations checks the codes of the degradation responses and
+// parses their templates.
+func compileDegradations(responses map[string]*DegradationResponse) (map[string]*degradation, error) {
+	compiled := map[string]*degradation{}
+	for code, r := range responses {
+		if code != "*" && !slices.Contains(errorCodes, code) {
+			return nil, fmt.Errorf("degradation: unknown error code %q", code)
+		}
+		if r.Status != 0 && (r.Status < 200 || r.Status > 599) {
+			return nil, fmt.Errorf("degradation %s: status %d is not an HTTP status", code, r.Status)
+		}
+		d := &degradation{cfg: r}
+		if r.Template != "" {
+			var err error
+			if d.tmpl, err = template.New(code).Option("missingkey=error").Parse(r.Template); err != nil {
+				return nil, fmt.Errorf("degradation %s: %w", code, err)
+			}
+		}
+		compiled[code] = d
+	}
+	return compiled, nil
+}
+
+// degradationFor returns the response configured for code: its own, or
+// "*" for outages.
+func degradationFor(code string) *degradation {
+	if d := degradations[code]; d != nil {
+		return d
+	}
+	if slices.Contains(outageCodes, code) {
+		return degradations["*"]
+	}
+	return nil
+}
+
+// respond writes the degradation response. A template that fails falls
+// back to the message, then to the built-in message.
+func (d *degradation) respond(c *gin.Context, code string, status, retryAfter int, message string) {
+	if d.cfg.Status != 0 {
+		status = d.cfg.Status
+	}
+	if d.cfg.Message != "" {
+		message = d.cfg.Message
+	}
+	contentType := d.cfg.ContentType
+	if d.tmpl != nil {
+		var b strings.Builder
+		if err := d.tmpl.Execute(&b, degradationData{Code: code, Status: status, RetryAfter: retryAfter, Message: message}); err != nil {
+			log.Printf("Error rendering degradation response %s: %v", code, err)
+			contentType = ""
+		} else {
+			message = b.String()
+		}
+	}
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	c.Data(status, contentType, []byte(message))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// maxTelegramMessage is the longest text Telegram accepts in one message.
+const maxTelegramMessage = 4096
+
+// deliveryClient posts to webhooks and chat APIs.
+var deliveryClient = &http.Client{Timeout: 15 * time.Second}
+
+// delivery is a message to send to the destinations of a DeliveryConfig.
+type delivery struct {
+	Subject string
+	Text    string
+
+	// JSON is posted to webhooks.
+	JSON any
+}
+
+// deliver sends d to every destination of dc and returns the names of those
+// it reached; failures are combined in the error.
+func (s *server) deliver(ctx context.Context, dc *DeliveryConfig, d delivery) (reached []string, err error) {
+	var errs []string
+	if dc.Webhook != "" {
+		if err := postJSON(ctx, dc.Webhook, d.JSON); err != nil {
+			errs = append(errs, "webhook: "+err.Error())
+		} else {
+			reached = append(reached, "webhook")
+		}
+	}
+	if len(dc.Email) > 0 {
+		if err := s.sendEmail(dc.Email, d.Subject, d.Text); err != nil {
+			errs = append(errs, "email: "+err.Error())
+		} else {
+			reached = append(reached, "email")
+		}
+	}
+	if dc.Telegram != "" {
+		if err := s.sendTelegram(ctx, dc.Telegram, d.Subject+"\n\n"+d.Text); err != nil {
+			errs = append(errs, "telegram: "+err.Error())
+		} else {
+			reached = append(reached, "telegram")
+		}
+	}
+	if len(errs) > 0 {
+		return reached, fmt.Errorf("delivery failed: %s", strings.Join(errs, "; "))
+	}
+	return reached, nil
+}
+
+// postJSON posts v as JSON to url and expects a 2xx answer.
+func postJSON(ctx context.Context, url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := deliveryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// sendEmail sends a plain-text mail through the configured SMTP server.
+func (s *server) sendEmail(to []string, subject, text string) error {
+	sc := s.cfg.SMTP
+	if sc == nil {
+		return fmt.Errorf("smtp is not configured")
+	}
+	var auth smtp.Auth
+	if sc.Username != "" {
+		password, err := getenvSecret(sc.PasswordEnv)
+		if err != nil {
+			return err
+		}
+		host, _, _ := strings.Cut(sc.Addr, ":")
+		auth = smtp.PlainAuth("", sc.Username, password, host)
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n",
+		sc.From, strings.Join(to, ", "), strings.NewReplacer("\r", "", "\n", " ").Replace(subject))
+	msg.WriteString(strings.ReplaceAll(text, "\n", "\r\n"))
+	return smtp.SendMail(sc.Addr, auth, sc.From, to, []byte(msg.String()))
+}
+
+// sendTelegram sends text to a Telegram chat with the configured bot.
+func (s *server) sendTelegram(ctx context.Context, chatID, text string) error {
+	tc := s.cfg.Telegram
+	if tc == nil {
+		return fmt.Errorf("telegram is not configured")
+	}
+	token, err := getenvSecret(tc.BotTokenEnv)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return fmt.Errorf("%s is not set", tc.BotTokenEnv)
+	}
+	return postJSON(ctx, tc.APIURL+"/bot"+token+"/sendMessage", map[string]string{
+		"chat_id": chatID,
+		"text":    truncateRunes(text, maxTelegramMessage),
+	})
+}
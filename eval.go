@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// defaultMinScore is the judge score a case needs by default, out of 10.
+const defaultMinScore = 7
+
+// evalSuite is a set of golden prompts, run against each of Models (the
+// default model when empty). Judge is the model scoring judge checks.
+type evalSuite struct {
+	Models []string    `json:"models"`
+	Judge  string      `json:"judge"`
+	Cases  []*evalCase `json:"cases"`
+}
+
+// evalCase is a prompt, or a template rendered with Data, and what its
+// answer must satisfy.
+type evalCase struct {
+	Name     string         `json:"name"`
+	System   string         `json:"system"`
+	Prompt   string         `json:"prompt"`
+	Template string         `json:"template"`
+	Data     map[string]any `json:"data"`
+	Expect   evalExpect     `json:"expect"`
+}
+
+// evalExpect are the checks of a case; every one that is set must pass.
+// JSONSchema uses the schema subset request bodies are validated with.
+type evalExpect struct {
+	Contains    []string `json:"contains"`
+	NotContains []string `json:"not_contains"`
+	JSONSchema  *schema  `json:"json_schema"`
+	Judge       string   `json:"judge"`
+	MinScore    float64  `json:"min_score"`
+}
+
+// evalResult is the outcome of a case for a model.
+type evalResult struct {
+	Case      string   `json:"case"`
+	Model     string   `json:"model"`
+	Passed    bool     `json:"passed"`
+	Failures  []string `json:"failures,omitempty"`
+	Score     *float64 `json:"score,omitempty"`
+	Answer    string   `json:"answer"`
+	LatencyMS int64    `json:"latency_ms"`
+}
+
+// runEval runs an evaluation suite and reports the pass rate of each model.
+// It exits with 1 when a model's pass rate is below -min-pass-rate.
+func runEval(args []string) int {
+	fs := flag.NewFlagSet("eval", flag.ContinueOnError)
+	suitePath := fs.String("suite", "", "JSON file with the evaluation suite")
+	models := fs.String("models", "", "comma-separated models to evaluate, overriding the suite's")
+	judge := fs.String("judge", "", "model scoring judge checks, overriding the suite's")
+	parallel := fs.Int("parallel", 4, "cases run at once")
+	asJSON := fs.Bool("json", false, "print results as JSON")
+	minPassRate := fs.Float64("min-pass-rate", 1, "pass rate below which the command fails")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *suitePath == "" && fs.NArg() == 1 {
+		*suitePath = fs.Arg(0)
+	}
+	if *suitePath == "" {
+		fmt.Fprintln(os.Stderr, "Usage: askllm eval [flags] suite.json")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	suite, err := loadEvalSuite(*suitePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading suite: %v\n", err)
+		return 2
+	}
+	if *models != "" {
+		suite.Models = strings.Split(*models, ",")
+	}
+	if len(suite.Models) == 0 {
+		suite.Models = []string{""}
+	}
+	if *judge != "" {
+		suite.Judge = *judge
+	}
+
+	ctx := context.Background()
+	cfg, providers, err := loadCommandConfig(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		return 2
+	}
+	for _, c := range suite.Cases {
+		if c.Template != "" && lookupTemplate(c.Template) == nil {
+			fmt.Fprintf(os.Stderr, "Error in case %s: template %q is not defined\n", c.Name, c.Template)
+			return 2
+		}
+	}
+
+	e := &evaluator{judge: commandTarget(cfg, providers, suite.Judge)}
+	var names []string
+	var results []*evalResult
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(*parallel, 1))
+	for _, model := range suite.Models {
+		tgt := commandTarget(cfg, providers, model)
+		names = append(names, tgt.provider.name+"/"+tgt.model)
+		for _, c := range suite.Cases {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer func() { <-sem; wg.Done() }()
+				r := e.run(ctx, tgt, c)
+				mu.Lock()
+				results = append(results, r)
+				mu.Unlock()
+			}()
+		}
+	}
+	wg.Wait()
+
+	passRates := reportEval(suite, names, results, *asJSON)
+	for _, rate := range passRates {
+		if rate < *minPassRate {
+			return 1
+		}
+	}
+	return 0
+}
+
+// loadEvalSuite reads and checks a suite file.
+func loadEvalSuite(path string) (*evalSuite, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var suite evalSuite
+	if err := json.Unmarshal(data, &suite); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if len(suite.Cases) == 0 {
+		return nil, fmt.Errorf("%s has no cases", path)
+	}
+	for i, c := range suite.Cases {
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("case-%d", i+1)
+		}
+		if (c.Prompt == "") == (c.Template == "") {
+			return nil, fmt.Errorf("case %s: set either prompt or template", c.Name)
+		}
+		if c.Expect.MinScore == 0 {
+			c.Expect.MinScore = defaultMinScore
+		}
+	}
+	return &suite, nil
+}
+
+// evaluator runs cases, scoring judge checks with the judge target.
+type evaluator struct {
+	judge target
+}
+
+var judgeScore = regexp.MustCompile(`\d+(\.\d+)?`)
+
+// run sends a case to tgt and checks the answer.
+func (e *evaluator) run(ctx context.Context, tgt target, c *evalCase) *evalResult {
+	r := &evalResult{Case: c.Name, Model: tgt.provider.name + "/" + tgt.model}
+	fail := func(format string, args ...any) {
+		r.Failures = append(r.Failures, fmt.Sprintf(format, args...))
+	}
+
+	payload := newPayload(nil)
+	if c.Template != "" {
+		var err error
+		if payload, err = lookupTemplate(c.Template).Payload(c.Data, 0); err != nil {
+			fail("%v", err)
+			return r
+		}
+	} else {
+		if c.System != "" {
+			payload.Messages = append(payload.Messages, Message{Role: "system", Content: c.System})
+		}
+		payload.Messages = append(payload.Messages, Message{Role: "user", Content: c.Prompt})
+	}
+	tgt.prepare(&payload)
+
+	start := time.Now()
+	answer, err := tgt.provider.complete(ctx, payload)
+	r.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		fail("request failed: %v", err)
+		return r
+	}
+	r.Answer = stripReasoning(answer)
+
+	for _, s := range c.Expect.Contains {
+		if !strings.Contains(r.Answer, s) {
+			fail("missing %q", s)
+		}
+	}
+	for _, s := range c.Expect.NotContains {
+		if strings.Contains(r.Answer, s) {
+			fail("contains %q", s)
+		}
+	}
+	if sc := c.Expect.JSONSchema; sc != nil {
+		var v any
+		if err := json.Unmarshal([]byte(stripFence(r.Answer)), &v); err != nil {
+			fail("answer is not JSON")
+		} else {
+			for _, fe := range sc.validate("", v, nil) {
+				fail("%s", strings.TrimSpace(fe.Field+" "+fe.Message))
+			}
+		}
+	}
+	if c.Expect.Judge != "" {
+		score, err := e.score(ctx, c.Expect.Judge, payload.Messages[len(payload.Messages)-1].Content, r.Answer)
+		if err != nil {
+			fail("judge failed: %v", err)
+		} else {
+			r.Score = &score
+			if score < c.Expect.MinScore {
+				fail("judge scored %g, below %g", score, c.Expect.MinScore)
+			}
+		}
+	}
+	r.Passed = len(r.Failures) == 0
+	return r
+}
+
+// score asks the judge to rate answer from 1 to 10 against criteria.
+func (e *evaluator) score(ctx context.Context, criteria, prompt, answer string) (float64, error) {
+	payload := newPayload([]Message{
+		{Role: "system", Content: "You grade answers of an AI assistant. Reply with only an integer score from 1 (fails the criteria) to 10 (fully meets them)."},
+		{Role: "user", Content: "Criteria: " + criteria + "\n\nPrompt:\n" + prompt + "\n\nAnswer:\n" + answer},
+	})
+	payload.Temperature = 0
+	e.judge.prepare(&payload)
+	reply, err := e.judge.provider.complete(ctx, payload)
+	if err != nil {
+		return 0, err
+	}
+	m := judgeScore.FindString(stripReasoning(reply))
+	if m == "" {
+		return 0, fmt.Errorf("no score in %q", truncateRunes(reply, 80))
+	}
+	return strconv.ParseFloat(m, 64)
+}
+
+// stripFence removes a Markdown code fence around text.
+func stripFence(text string) string {
+	text = strings.TrimSpace(text)
+	if rest, ok := strings.CutPrefix(text, "```"); ok {
+		if i := strings.IndexByte(rest, '\n'); i >= 0 {
+			rest = rest[i+1:]
+		}
+		text = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(rest), "```"))
+	}
+	return text
+}
+
+// reportEval prints the results of models, in the suite's order, and
+// returns the pass rate of each model.
+func reportEval(suite *evalSuite, models []string, results []*evalResult, asJSON bool) map[string]float64 {
+	order := map[string]int{}
+	for i, c := range suite.Cases {
+		order[c.Name] = i
+	}
+	models = slices.Compact(models)
+	byModel := map[string][]*evalResult{}
+	for _, r := range results {
+		byModel[r.Model] = append(byModel[r.Model], r)
+	}
+	passRates := map[string]float64{}
+	passed := map[string]int{}
+	for _, model := range models {
+		list := byModel[model]
+		sort.Slice(list, func(i, j int) bool { return order[list[i].Case] < order[list[j].Case] })
+		for _, r := range list {
+			if r.Passed {
+				passed[model]++
+			}
+		}
+		passRates[model] = float64(passed[model]) / float64(len(list))
+	}
+
+	if asJSON {
+		out := struct {
+			Results   []*evalResult      `json:"results"`
+			PassRates map[string]float64 `json:"pass_rates"`
+		}{nil, passRates}
+		for _, model := range models {
+			out.Results = append(out.Results, byModel[model]...)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(out)
+		return passRates
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MODEL\tCASE\tRESULT\tLATENCY\tNOTES")
+	for _, model := range models {
+		for _, r := range byModel[model] {
+			result := "PASS"
+			if !r.Passed {
+				result = "FAIL"
+			}
+			notes := strings.Join(r.Failures, "; ")
+			if r.Score != nil && notes == "" {
+				notes = fmt.Sprintf("judge scored %g", *r.Score)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%dms\t%s\n", r.Model, r.Case, result, r.LatencyMS, notes)
+		}
+	}
+	w.Flush()
+	fmt.Println()
+	for _, model := range models {
+		fmt.Printf("%s: %d/%d passed (%.0f%%)\n", model, passed[model], len(byModel[model]), passRates[model]*100)
+	}
+	return passRates
+}
@@ -0,0 +1,77 @@
+//go:build wasip1
+
+// Command plugin is an example askllm plugin. It rejects prompts that
+// mention a blocked word from its config and tags responses with a header.
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o policy.wasm ./examples/plugin
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"unsafe"
+)
+
+type event struct {
+	Phase  string `json:"phase"`
+	Query  string `json:"query"`
+	Body   string `json:"body"`
+	Config struct {
+		Blocked []string `json:"blocked"`
+	} `json:"config"`
+}
+
+type result struct {
+	Status  int               `json:"status,omitempty"`
+	Error   string            `json:"error,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// buffers keeps memory handed to the host alive until it is freed.
+var buffers = map[uintptr][]byte{}
+
+//go:wasmexport alloc
+func alloc(size uint32) uint32 {
+	b := make([]byte, size)
+	if size == 0 {
+		return 0
+	}
+	p := uintptr(unsafe.Pointer(&b[0]))
+	buffers[p] = b
+	return uint32(p)
+}
+
+//go:wasmexport free
+func free(ptr, size uint32) {
+	delete(buffers, uintptr(ptr))
+}
+
+//go:wasmexport on_request
+func onRequest(ptr, size uint32) uint64 {
+	var e event
+	if err := json.Unmarshal(buffers[uintptr(ptr)][:size], &e); err != nil {
+		return 0
+	}
+	text := strings.ToLower(e.Query + " " + e.Body)
+	for _, word := range e.Config.Blocked {
+		if strings.Contains(text, strings.ToLower(word)) {
+			return reply(result{Status: 403, Error: "This topic is not allowed."})
+		}
+	}
+	return 0
+}
+
+//go:wasmexport on_response
+func onResponse(ptr, size uint32) uint64 {
+	return reply(result{Headers: map[string]string{"X-Policy": "checked"}})
+}
+
+// reply hands r to the host as a packed pointer and length.
+func reply(r result) uint64 {
+	out, _ := json.Marshal(r)
+	p := alloc(uint32(len(out)))
+	copy(buffers[uintptr(p)], out)
+	return uint64(p)<<32 | uint64(len(out))
+}
+
+func main() {}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Experiment arms.
+const (
+	armControl   = "control"
+	armTreatment = "treatment"
+)
+
+// Feedback scores are clamped to this range, so a single score cannot
+// outweigh the others.
+const (
+	minFeedbackScore = 0
+	maxFeedbackScore = 5
+)
+
+// experiment is a running A/B test with its per-arm statistics.
+type experiment struct {
+	cfg *ExperimentConfig
+
+	mu    sync.Mutex
+	stats map[string]*armStats
+}
+
+// armStats accumulates the outcomes of one arm.
+type armStats struct {
+	Requests      int
+	Errors        int
+	TotalLatency  time.Duration
+	TotalChars    int
+	Feedback      int
+	FeedbackTotal float64
+}
+
+// assignment is the arm of an experiment a request was placed in.
+type assignment struct {
+	exp *experiment
+	arm string
+}
+
+func newExperiment(cfg *ExperimentConfig) *experiment {
+	return &experiment{cfg: cfg, stats: map[string]*armStats{armControl: {}, armTreatment: {}}}
+}
+
+// variant returns the configuration of the assigned arm.
+func (a *assignment) variant() *ExperimentArm {
+	if a.arm == armTreatment {
+		return &a.exp.cfg.Treatment
+	}
+	return &a.exp.cfg.Control
+}
+
+// observe records the outcome of a request. It is safe on a nil assignment.
+func (a *assignment) observe(latency time.Duration, answer string, err error) {
+	if a == nil {
+		return
+	}
+	a.exp.mu.Lock()
+	defer a.exp.mu.Unlock()
+
+	st := a.exp.stats[a.arm]
+	st.Requests++
+	st.TotalLatency += latency
+	if err != nil {
+		st.Errors++
+		return
+	}
+	st.TotalChars += len([]rune(answer))
+}
+
+// assignExperiment places the request in the arm of the first experiment
+// that applies to it, or returns nil. The same caller always lands in the
+// same arm of an experiment, so a conversation does not flip between arms.
+func (s *server) assignExperiment(c *gin.Context, req routeRequest) *assignment {
+	for _, exp := range s.experiments {
+		if exp.cfg.Template != "" && exp.cfg.Template != req.Template {
+			continue
+		}
+		arm := exp.armFor(c)
+		c.Header("X-Experiment", exp.cfg.Name+"="+arm)
+		return &assignment{exp: exp, arm: arm}
+	}
+	return nil
+}
+
+// armFor returns the arm of exp the caller of c is in.
+func (exp *experiment) armFor(c *gin.Context) string {
+	h := fnv.New32a()
+	h.Write([]byte(exp.cfg.Name + "\x00" + callerKey(c)))
+	if int(h.Sum32()%100) < exp.cfg.Percent {
+		return armTreatment
+	}
+	return armControl
+}
+
+// callerKey identifies the caller of c for arm assignment: its client ID
+// or, when anonymous, its IP address.
+func callerKey(c *gin.Context) string {
+	if cl := clientFrom(c); cl != nil {
+		return cl.ID
+	}
+	return c.ClientIP()
+}
+
+// feedbackScore reads the score of a feedback request, clamped to the
+// range of feedback scores. It reports false when there is no finite one.
+func feedbackScore(c *gin.Context) (float64, bool) {
+	var req struct {
+		Score *float64 `json:"score"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Score == nil || math.IsNaN(*req.Score) || math.IsInf(*req.Score, 0) {
+		return 0, false
+	}
+	return min(max(*req.Score, minFeedbackScore), maxFeedbackScore), true
+}
+
+// handleExperimentFeedback records a user score for the arm of an
+// experiment the caller is in.
+func (s *server) handleExperimentFeedback(c *gin.Context) {
+	exp, ok := s.experimentByName(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Experiment not found."})
+		return
+	}
+	score, ok := feedbackScore(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Please provide a JSON body with a numeric 'score'."})
+		return
+	}
+
+	exp.mu.Lock()
+	defer exp.mu.Unlock()
+	st := exp.stats[exp.armFor(c)]
+	st.Feedback++
+	st.FeedbackTotal += score
+	c.Status(http.StatusNoContent)
+}
+
+// handleListExperiments reports per-arm statistics of all experiments.
+func (s *server) handleListExperiments(c *gin.Context) {
+	list := make([]gin.H, 0, len(s.experiments))
+	for _, exp := range s.experiments {
+		exp.mu.Lock()
+		arms := gin.H{}
+		for arm, st := range exp.stats {
+			arms[arm] = st.summary()
+		}
+		exp.mu.Unlock()
+		list = append(list, gin.H{"name": exp.cfg.Name, "percent": exp.cfg.Percent, "arms": arms})
+	}
+	c.JSON(http.StatusOK, gin.H{"experiments": list})
+}
+
+func (st *armStats) summary() gin.H {
+	h := gin.H{"requests": st.Requests, "errors": st.Errors, "feedback": st.Feedback}
+	if ok := st.Requests - st.Errors; ok > 0 {
+		h["avg_chars"] = float64(st.TotalChars) / float64(ok)
+	}
+	if st.Requests > 0 {
+		h["avg_latency_ms"] = float64(st.TotalLatency.Milliseconds()) / float64(st.Requests)
+	}
+	if st.Feedback > 0 {
+		h["avg_score"] = st.FeedbackTotal / float64(st.Feedback)
+	}
+	return h
+}
+
+func (s *server) experimentByName(name string) (*experiment, bool) {
+	for _, exp := range s.experiments {
+		if exp.cfg.Name == name {
+			return exp, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// usageGroups are the columns usage exports can be grouped by, in the
+// order they appear.
+var usageGroups = []string{"day", "key", "model"}
+
+// usageQuery reads the filters of the usage endpoints: the days from
+// through to (UTC dates, inclusive; by default the current month up to
+// today), client and model. It responds with an error if they are invalid.
+func usageQuery(c *gin.Context) (UsageQuery, bool) {
+	now := time.Now().UTC()
+	q := UsageQuery{
+		From:   c.DefaultQuery("from", now.Format("2006-01")+"-01"),
+		To:     c.DefaultQuery("to", now.Format(time.DateOnly)),
+		Client: c.Query("client"),
+		Model:  c.Query("model"),
+	}
+	for _, d := range []string{q.From, q.To} {
+		if _, err := time.Parse(time.DateOnly, d); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from and to must be dates like 2026-01-31."})
+			return q, false
+		}
+	}
+	return q, true
+}
+
+// handleListUsage returns a page of the daily usage records matching the
+// usageQuery filters.
+func (s *server) handleListUsage(c *gin.Context) {
+	q, ok := usageQuery(c)
+	if !ok {
+		return
+	}
+	s.listUsage(c, q)
+}
+
+// listUsage responds with the page of usage records matching q selected by
+// the limit and cursor query parameters.
+func (s *server) listUsage(c *gin.Context, q UsageQuery) {
+	var err error
+	if q.Limit, err = pageSize(c); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if v := c.Query("cursor"); v != "" {
+		parts, err := decodeCursor(v, 4)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor."})
+			return
+		}
+		q.After = strings.Join(parts, "\x00")
+	}
+
+	list, more := s.store.QueryUsage(q)
+	for i := range list {
+		list[i].Cost = s.cfg.usageCost(list[i])
+	}
+	resp := gin.H{"usage": list}
+	if more {
+		last := list[len(list)-1]
+		resp["next_cursor"] = encodeCursor(last.Day, last.Client, last.Provider, last.Model)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// handleExportUsage writes the usage matching the usageQuery filters as
+// CSV, summed per group_by: a comma-separated list of day, key (the client
+// ID) and model, "day" by default.
+func (s *server) handleExportUsage(c *gin.Context) {
+	q, ok := usageQuery(c)
+	if !ok {
+		return
+	}
+
+	groupBy := c.Query("group_by")
+	if groupBy == "" {
+		groupBy = "day"
+	}
+	var groups []string
+	for _, g := range strings.Split(groupBy, ",") {
+		if !slices.Contains(usageGroups, g) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "group_by must list day, key or model."})
+			return
+		}
+		if !slices.Contains(groups, g) {
+			groups = append(groups, g)
+		}
+	}
+	slices.SortFunc(groups, func(a, b string) int { return slices.Index(usageGroups, a) - slices.Index(usageGroups, b) })
+
+	list, _ := s.store.QueryUsage(q)
+	type total struct {
+		requests, prompt, completion int
+		cost                         float64
+	}
+	var order [][]string
+	totals := map[string]*total{}
+	for _, r := range list {
+		var row []string
+		for _, g := range groups {
+			switch g {
+			case "day":
+				row = append(row, r.Day)
+			case "key":
+				row = append(row, r.Client)
+			case "model":
+				row = append(row, r.Provider+"/"+r.Model)
+			}
+		}
+		key := strings.Join(row, "\x00")
+		t, ok := totals[key]
+		if !ok {
+			t = &total{}
+			totals[key] = t
+			order = append(order, row)
+		}
+		t.requests += r.Requests
+		t.prompt += r.PromptTokens
+		t.completion += r.CompletionTokens
+		t.cost += s.cfg.usageCost(r)
+	}
+	slices.SortFunc(order, func(a, b []string) int { return slices.Compare(a, b) })
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="usage-`+q.From+`-`+q.To+`.csv"`)
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	header := slices.Clone(groups)
+	if i := slices.Index(header, "key"); i >= 0 {
+		header[i] = "client"
+	}
+	w.Write(append(header, "requests", "prompt_tokens", "completion_tokens", "total_tokens", "cost"))
+	for _, row := range order {
+		t := totals[strings.Join(row, "\x00")]
+		w.Write(append(row, strconv.Itoa(t.requests), strconv.Itoa(t.prompt), strconv.Itoa(t.completion), strconv.Itoa(t.prompt+t.completion), strconv.FormatFloat(t.cost, 'f', -1, 64)))
+	}
+	w.Flush()
+}
+
+// usageWindows are the windows GET /usage reports on.
+var usageWindows = map[string]int{"24h": 1, "7d": 7, "30d": 30}
+
+// handleUsage returns what the calling key used over window (24h, 7d or
+// 30d, by default 30d): its upstream requests, tokens and estimated cost,
+// and what is left of its quota. The 24h window is counted in the hourly
+// usage records, the others in whole UTC days up to today.
+func (s *server) handleUsage(c *gin.Context) {
+	window := c.DefaultQuery("window", "30d")
+	days, ok := usageWindows[window]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "window must be 24h, 7d or 30d."})
+		return
+	}
+	cl := clientFrom(c)
+	now := time.Now().UTC()
+	var from, to string
+	var list []UsageRecord
+	if window == "24h" {
+		start := now.Truncate(time.Hour).Add(-23 * time.Hour)
+		from, to = start.Format(time.RFC3339), now.Format(time.RFC3339)
+		list = s.store.HourlyUsage(cl.ID, start)
+	} else {
+		from, to = now.AddDate(0, 0, 1-days).Format(time.DateOnly), now.Format(time.DateOnly)
+		list, _ = s.store.QueryUsage(UsageQuery{From: from, To: to, Client: cl.ID})
+	}
+	var requests, prompt, completion int
+	var cost float64
+	for _, r := range list {
+		requests += r.Requests
+		prompt += r.PromptTokens
+		completion += r.CompletionTokens
+		cost += s.cfg.usageCost(r)
+	}
+	resp := gin.H{
+		"window":            window,
+		"from":              from,
+		"to":                to,
+		"requests":          requests,
+		"prompt_tokens":     prompt,
+		"completion_tokens": completion,
+		"total_tokens":      prompt + completion,
+		"cost":              cost,
+	}
+	if qc := cl.Quota; qc != nil {
+		period, reset := quotaPeriod(qc, now)
+		u := s.store.ClientUsage(cl.ID, period)
+		quota := gin.H{"period": quotaPeriodName(qc), "reset": reset}
+		if qc.Requests > 0 {
+			quota["requests"], quota["remaining_requests"] = qc.Requests, max(qc.Requests-u.Requests, 0)
+		}
+		if qc.Tokens > 0 {
+			quota["tokens"], quota["remaining_tokens"] = qc.Tokens, max(qc.Tokens-u.Tokens, 0)
+		}
+		resp["quota"] = quota
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// atomFeed is an Atom 1.0 feed.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Content atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// rssFeed is an RSS 2.0 feed.
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	GUID        rssGUID `xml:"guid"`
+	Title       string  `xml:"title"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	ID          string `xml:",chardata"`
+}
+
+// handleFeed serves the successful runs of a schedule with a feed as Atom
+// (/feeds/<name>.atom) or RSS (/feeds/<name>.rss). Feeds with a token
+// require it as the token query parameter, since feed readers rarely send
+// other credentials.
+func (s *server) handleFeed(c *gin.Context) {
+	file := c.Param("file")
+	name, format := file, ""
+	for _, ext := range []string{".atom", ".rss"} {
+		if n, ok := strings.CutSuffix(file, ext); ok {
+			name, format = n, ext
+		}
+	}
+	job, ok := s.scheduler.jobs[name]
+	if !ok || job.cfg.Feed == nil || format == "" {
+		c.String(http.StatusNotFound, "Feed not found.")
+		return
+	}
+	if token := job.cfg.Feed.Token; token != "" && subtle.ConstantTimeCompare([]byte(c.Query("token")), []byte(token)) != 1 {
+		c.String(http.StatusUnauthorized, "Invalid feed token.")
+		return
+	}
+
+	var runs []ScheduleRun
+	for _, run := range s.store.ScheduleRuns(name) {
+		if run.Error == "" {
+			runs = append(runs, run)
+		}
+	}
+	title := job.cfg.Feed.Title
+	if title == "" {
+		title = name
+	}
+	self := "http://" + c.Request.Host + c.Request.URL.Path
+	if c.Request.TLS != nil {
+		self = "https://" + c.Request.Host + c.Request.URL.Path
+	}
+
+	if format == ".atom" {
+		feed := atomFeed{ID: "urn:askllm:schedule:" + name, Title: title, Link: atomLink{Rel: "self", Href: self}}
+		feed.Updated = time.Now().UTC().Format(time.RFC3339)
+		if len(runs) > 0 {
+			feed.Updated = runs[0].StartedAt.UTC().Format(time.RFC3339)
+		}
+		for _, run := range runs {
+			feed.Entries = append(feed.Entries, atomEntry{
+				ID:      "urn:askllm:run:" + run.ID,
+				Title:   title + ", " + run.StartedAt.Format(time.DateOnly),
+				Updated: run.StartedAt.UTC().Format(time.RFC3339),
+				Author:  run.Model,
+				Content: atomContent{Type: "text", Body: run.Answer},
+			})
+		}
+		writeFeed(c, "application/atom+xml; charset=utf-8", feed)
+		return
+	}
+
+	feed := rssFeed{Version: "2.0", Channel: rssChannel{Title: title, Link: self, Description: "Scheduled prompt " + name}}
+	for _, run := range runs {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			GUID:        rssGUID{ID: "urn:askllm:run:" + run.ID},
+			Title:       title + ", " + run.StartedAt.Format(time.DateOnly),
+			PubDate:     run.StartedAt.Format(time.RFC1123Z),
+			Description: run.Answer,
+		})
+	}
+	writeFeed(c, "application/rss+xml; charset=utf-8", feed)
+}
+
+// writeFeed writes feed as an XML document of the given content type.
+func writeFeed(c *gin.Context, contentType string, feed any) {
+	body, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Could not render feed.")
+		return
+	}
+	c.Data(http.StatusOK, contentType, append([]byte(xml.Header), body...))
+}
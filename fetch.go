@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// Limits for fetching pages into prompts.
+const (
+	fetchTimeout  = 30 * time.Second
+	maxFetchBytes = 1 << 20
+)
+
+// fetchClient fetches pages into prompts; it is separate from the provider
+// clients, which are tuned for upstream APIs.
+var fetchClient = &http.Client{Timeout: fetchTimeout}
+
+// fetchText downloads url and returns its body as text: HTML is reduced to
+// its visible text, anything else is returned as is, up to maxFetchBytes.
+func fetchText(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("creating HTTP request: %w", err)
+	}
+	req.Header.Set("User-Agent", "askllm")
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %s: status %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxFetchBytes))
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", url, err)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/html" {
+		return htmlText(string(body)), nil
+	}
+	return string(body), nil
+}
+
+// htmlText returns the visible text of an HTML document, one line per
+// block of text, without scripts and styles.
+func htmlText(doc string) string {
+	z := html.NewTokenizer(strings.NewReader(doc))
+	var b strings.Builder
+	skip := 0
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return strings.TrimSpace(b.String())
+		case html.StartTagToken:
+			if name, _ := z.TagName(); string(name) == "script" || string(name) == "style" {
+				skip++
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); (string(name) == "script" || string(name) == "style") && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			if text := strings.Join(strings.Fields(string(z.Text())), " "); text != "" {
+				b.WriteString(text)
+				b.WriteByte('\n')
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oschwald/geoip2-golang"
+)
+
+// countryContextKey is the gin context key holding the caller's ISO
+// country code, when GeoIP is configured and the address is known.
+const countryContextKey = "askllm.country"
+
+// geoPolicy admits callers by country and rate-limits them by the rate class
+// their country belongs to.
+type geoPolicy struct {
+	cfg     *GeoIPConfig
+	db      *geoip2.Reader
+	classes []*rateClass
+}
+
+// rateClass is a request rate shared by a group of countries.
+type rateClass struct {
+	cfg     *RateClassConfig
+	limiter *windowLimiter
+}
+
+func newGeoPolicy(cfg *GeoIPConfig) (*geoPolicy, error) {
+	db, err := geoip2.Open(cfg.Database)
+	if err != nil {
+		return nil, fmt.Errorf("open GeoIP database: %w", err)
+	}
+	g := &geoPolicy{cfg: cfg, db: db}
+	for _, rc := range cfg.RateClasses {
+		g.classes = append(g.classes, &rateClass{cfg: rc, limiter: newWindowLimiter(rc.RequestsPerMinute, time.Minute)})
+	}
+	return g, nil
+}
+
+// country returns the ISO code of the country ip is located in, or "" when
+// the database does not know it (private ranges, for one).
+func (g *geoPolicy) country(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	rec, err := g.db.Country(addr)
+	if err != nil {
+		return ""
+	}
+	return rec.Country.IsoCode
+}
+
+// admits reports whether callers from country may use the service.
+func (g *geoPolicy) admits(country string) bool {
+	if country == "" {
+		return g.cfg.AllowUnknown || len(g.cfg.AllowCountries) == 0
+	}
+	if containsFold(g.cfg.DenyCountries, country) {
+		return false
+	}
+	return len(g.cfg.AllowCountries) == 0 || containsFold(g.cfg.AllowCountries, country)
+}
+
+// class returns the rate class of country: the first one listing it, else
+// the first one listing "*", else nil.
+func (g *geoPolicy) class(country string) *rateClass {
+	for _, rc := range g.classes {
+		if country != "" && containsFold(rc.cfg.Countries, country) {
+			return rc
+		}
+	}
+	for _, rc := range g.classes {
+		if slices.Contains(rc.cfg.Countries, "*") {
+			return rc
+		}
+	}
+	return nil
+}
+
+func containsFold(list []string, s string) bool {
+	return slices.ContainsFunc(list, func(v string) bool { return strings.EqualFold(v, s) })
+}
+
+// checkGeo enforces the country rules on the caller's address.
+func (s *server) checkGeo(c *gin.Context) {
+	ip := c.ClientIP()
+	country := s.geo.country(ip)
+	if !s.geo.admits(country) {
+		auditNote(c, "rejected: country %q", country)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": localize(c, "region_blocked")})
+		return
+	}
+	if rc := s.geo.class(country); rc != nil {
+		if ok, _, reset := rc.limiter.allow(ip); !ok {
+			auditNote(c, "rate limited: class %s", rc.cfg.Name)
+			secs := int(math.Ceil(time.Until(reset).Seconds()))
+			c.Header("Retry-After", strconv.Itoa(secs))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": localize(c, "request_limit")})
+			return
+		}
+	}
+	if country != "" {
+		c.Set(countryContextKey, country)
+	}
+	c.Next()
+}
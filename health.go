@@ -0,0 +1,125 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A provider also counts as down while at least downMinRequests of its
+// recent requests failed and downErrorRate or more of them failed through
+// its fault, even if its endpoints still answer probes.
+const (
+	downMinRequests = 10
+	downErrorRate   = 0.5
+)
+
+// probeResult is the outcome of the last health probe of an endpoint.
+type probeResult struct {
+	At        time.Time `json:"at"`
+	OK        bool      `json:"ok"`
+	Status    int       `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMS int64     `json:"latency_ms"`
+}
+
+// providerFault reports whether err means the provider failed to serve a
+// request, as opposed to a request it refused or a full local queue.
+func providerFault(err error) bool {
+	switch code, _ := classifyError(err); code {
+	case codeUpstreamTimeout, codeUpstreamUnreachable, codeUpstreamError, codeUpstreamBadResponse, codeUpstreamAuth, codeQuotaExceeded:
+		return true
+	}
+	return false
+}
+
+// available reports whether requests should go to p: some endpoint answers
+// its probes and its recent requests mostly succeed. Without probes, failed
+// connections only count through the recent requests, as nothing would
+// find the endpoints reachable again while no traffic goes to them.
+func (p *provider) available() bool {
+	if p.cfg.HealthCheckInterval.Duration > 0 && p.down.Load() {
+		return false
+	}
+	requests, faults := latencies.recentOutcomes(p.name)
+	return requests < downMinRequests || float64(faults)/float64(requests) < downErrorRate
+}
+
+// status describes the health of p for GET /status from the cached probes
+// and recent requests; it sends nothing upstream.
+func (p *provider) status() gin.H {
+	requests, faults := latencies.recentOutcomes(p.name)
+	errorRate := 0.0
+	if requests > 0 {
+		errorRate = float64(faults) / float64(requests)
+	}
+	state := "up"
+	if !p.available() {
+		state = "down"
+	}
+	endpoints := make([]gin.H, len(p.endpoints))
+	for i, ep := range p.endpoints {
+		endpoints[i] = gin.H{"url": ep.baseURL, "healthy": ep.healthy.Load()}
+		if probe := ep.lastProbe.Load(); probe != nil {
+			endpoints[i]["last_probe"] = probe
+		}
+	}
+	h := gin.H{
+		"name":               p.name,
+		"status":             state,
+		"recent_requests":    requests,
+		"recent_error_rate":  errorRate,
+		"endpoints":          endpoints,
+		"probe_interval_sec": int(p.cfg.HealthCheckInterval.Seconds()),
+	}
+	if median := latencies.recentMedian(p.name); median > 0 {
+		h["median_latency_ms"] = median.Milliseconds()
+	}
+	return h
+}
+
+// recordProbe keeps the outcome of a probe of ep.
+func (ep *endpoint) recordProbe(start time.Time, status int, err error) {
+	r := &probeResult{At: start.UTC(), Status: status, LatencyMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	r.OK = err == nil && status < http.StatusInternalServerError
+	ep.lastProbe.Store(r)
+}
+
+// fallbackFor returns the target to use instead of tgt while its provider
+// is down: the provider's fallback model alias, if that one is available.
+func (s *server) fallbackFor(t *tenant, tgt target) (target, bool) {
+	if tgt.provider.available() || tgt.provider.cfg.Fallback == "" {
+		return tgt, false
+	}
+	alias := s.cfg.ModelAliases[tgt.provider.cfg.Fallback]
+	p := s.providerFor(t, alias.Provider)
+	if p == nil || p == tgt.provider || !p.available() {
+		return tgt, false
+	}
+	tgt.provider, tgt.model = p, alias.Model
+	return tgt, true
+}
+
+// handleStatus reports the health of every provider, from its cached probes
+// and recent requests, and the request counts and latency percentiles of
+// the recent upstream requests per provider and model. It answers 503 while
+// the default provider is down, for external monitors.
+func (s *server) handleStatus(c *gin.Context) {
+	names := slices.Sorted(maps.Keys(s.providers))
+	providers := make([]gin.H, 0, len(names))
+	for _, name := range names {
+		providers = append(providers, s.providers[name].status())
+	}
+
+	status := http.StatusOK
+	if !s.llm.available() {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{"providers": providers, "upstreams": upstreamStats()})
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"reflect"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/gin-gonic/gin"
+)
+
+// hookEnv is what hook expressions can refer to. Fields a phase does not
+// know are empty: the route phase has no status and only post_response
+// hooks see response_headers.
+type hookEnv struct {
+	Method          string            `expr:"method"`
+	Path            string            `expr:"path"`
+	Route           string            `expr:"route"`
+	Client          string            `expr:"client"`
+	Tenant          string            `expr:"tenant"`
+	Headers         map[string]string `expr:"headers"`
+	Query           map[string]string `expr:"query"`
+	Prompt          string            `expr:"prompt"`
+	PromptTokens    int               `expr:"prompt_tokens"`
+	Status          int               `expr:"status"`
+	ResponseHeaders map[string]string `expr:"response_headers"`
+}
+
+// hooks are the compiled hook expressions.
+type hooks struct {
+	preRequest   []*compiledHook
+	route        []*compiledHook
+	postResponse []*compiledHook
+}
+
+// compiledHook is a hook with its condition and log message compiled.
+type compiledHook struct {
+	cfg  *HookConfig
+	cond *vm.Program // nil matches always
+	log  *vm.Program
+}
+
+// compileHooks compiles the expressions of every hook, so mistakes are
+// found at startup.
+func compileHooks(hc *HooksConfig) (*hooks, error) {
+	if hc == nil {
+		return nil, nil
+	}
+	h := &hooks{}
+	for _, phase := range []struct {
+		name string
+		cfgs []*HookConfig
+		dst  *[]*compiledHook
+	}{
+		{"pre_request", hc.PreRequest, &h.preRequest},
+		{"route", hc.Route, &h.route},
+		{"post_response", hc.PostResponse, &h.postResponse},
+	} {
+		for i, cfg := range phase.cfgs {
+			ch := &compiledHook{cfg: cfg}
+			var err error
+			if cfg.If != "" {
+				if ch.cond, err = expr.Compile(cfg.If, expr.Env(hookEnv{}), expr.AsBool()); err != nil {
+					return nil, fmt.Errorf("hooks.%s[%d].if: %w", phase.name, i, err)
+				}
+			}
+			if cfg.Log != "" {
+				if ch.log, err = expr.Compile(cfg.Log, expr.Env(hookEnv{}), expr.AsKind(reflect.String)); err != nil {
+					return nil, fmt.Errorf("hooks.%s[%d].log: %w", phase.name, i, err)
+				}
+			}
+			*phase.dst = append(*phase.dst, ch)
+		}
+	}
+	return h, nil
+}
+
+// matches reports whether the hook's condition holds in env. A condition
+// that fails to evaluate does not hold.
+func (ch *compiledHook) matches(env *hookEnv) bool {
+	if ch.cond == nil {
+		return true
+	}
+	ok, err := expr.Run(ch.cond, env)
+	if err != nil {
+		log.Printf("Error evaluating hook %q: %v", ch.cfg.If, err)
+		return false
+	}
+	return ok.(bool)
+}
+
+// logLine writes the hook's log message, if it has one.
+func (ch *compiledHook) logLine(c *gin.Context, env *hookEnv) {
+	if ch.log == nil {
+		return
+	}
+	msg, err := expr.Run(ch.log, env)
+	if err != nil {
+		log.Printf("Error evaluating hook %q: %v", ch.cfg.Log, err)
+		return
+	}
+	log.Printf("Hook on %s: %s", c.Request.URL.Path, msg)
+}
+
+// hookEnvFor describes the request for hook expressions.
+func hookEnvFor(c *gin.Context) *hookEnv {
+	env := &hookEnv{
+		Method:  c.Request.Method,
+		Path:    c.Request.URL.Path,
+		Route:   c.FullPath(),
+		Client:  ownerFor(c),
+		Headers: flatHeader(c.Request.Header),
+		Query:   map[string]string{},
+	}
+	if t := tenantFrom(c); t != nil {
+		env.Tenant = t.cfg.ID
+	}
+	for k, v := range c.Request.URL.Query() {
+		env.Query[k] = v[0]
+	}
+	return env
+}
+
+// flatHeader returns the first value of each header.
+func flatHeader(h http.Header) map[string]string {
+	flat := make(map[string]string, len(h))
+	for k, v := range h {
+		if len(v) > 0 {
+			flat[k] = v[0]
+		}
+	}
+	return flat
+}
+
+// requestPrompt finds the prompt of a request: the q parameter of the
+// query or an alias of it, the q or message field of a form, the q, message, prompt or last
+// user message of a JSON body, or a text body.
+func requestPrompt(c *gin.Context, body []byte) string {
+	if q := queryPrompt(c); q != "" {
+		return q
+	}
+	mediaType, params, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		form, _ := url.ParseQuery(string(body))
+		return cmp.Or(form.Get("q"), form.Get("message"))
+	case "multipart/form-data":
+		form, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).ReadForm(int64(len(body)))
+		if err != nil {
+			return ""
+		}
+		defer form.RemoveAll()
+		values := url.Values(form.Value)
+		return cmp.Or(values.Get("q"), values.Get("message"))
+	}
+	var req struct {
+		Q        string `json:"q"`
+		Message  string `json:"message"`
+		Prompt   string `json:"prompt"`
+		Messages []struct {
+			Role    string `json:"role"`
+			Content any    `json:"content"`
+		} `json:"messages"`
+	}
+	if json.Unmarshal(body, &req) != nil {
+		if mediaType == "text/plain" {
+			return string(body)
+		}
+		return ""
+	}
+	if req.Q != "" {
+		return req.Q
+	}
+	if req.Message != "" {
+		return req.Message
+	}
+	if req.Prompt != "" {
+		return req.Prompt
+	}
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if text, ok := req.Messages[i].Content.(string); ok && req.Messages[i].Role == "user" {
+			return text
+		}
+	}
+	return ""
+}
+
+// runHooks applies the pre_request hooks to a request, and the
+// post_response hooks to its response just before the headers are sent.
+// The first pre_request hook that matches with a reject message rejects
+// the request; others set request headers or log.
+func (s *server) runHooks(c *gin.Context) {
+	env := hookEnvFor(c)
+	if len(s.hooks.preRequest) > 0 {
+		var body []byte
+		if c.Request.Body != nil {
+			var err error
+			if body, err = io.ReadAll(c.Request.Body); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Could not read request body."})
+				return
+			}
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		env.Prompt = requestPrompt(c, body)
+		env.PromptTokens = estimateTokens(env.Prompt)
+		for _, h := range s.hooks.preRequest {
+			if !h.matches(env) {
+				continue
+			}
+			h.logLine(c, env)
+			if h.cfg.Reject != "" {
+				auditNote(c, "rejected by hook: %s", h.cfg.Reject)
+				c.AbortWithStatusJSON(h.cfg.Status, gin.H{"error": h.cfg.Reject})
+				return
+			}
+			for k, v := range h.cfg.SetHeaders {
+				c.Request.Header.Set(k, v)
+				env.Headers[http.CanonicalHeaderKey(k)] = v
+			}
+		}
+	}
+	if len(s.hooks.postResponse) == 0 {
+		c.Next()
+		return
+	}
+
+	w := &hookWriter{ResponseWriter: c.Writer, fire: func(w gin.ResponseWriter) {
+		env.Status = w.Status()
+		env.ResponseHeaders = flatHeader(w.Header())
+		for _, h := range s.hooks.postResponse {
+			if !h.matches(env) {
+				continue
+			}
+			h.logLine(c, env)
+			for k, v := range h.cfg.SetHeaders {
+				w.Header().Set(k, v)
+			}
+		}
+	}}
+	c.Writer = w
+	c.Next()
+	c.Writer = w.ResponseWriter
+	w.before()
+}
+
+// routeModel returns the model of the first matching route hook, or "".
+func (s *server) routeModel(c *gin.Context, req routeRequest) string {
+	if s.hooks == nil || len(s.hooks.route) == 0 {
+		return ""
+	}
+	env := hookEnvFor(c)
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if req.Messages[i].Role == "user" {
+			env.Prompt = req.Messages[i].Content
+			break
+		}
+	}
+	for _, m := range req.Messages {
+		env.PromptTokens += estimateTokens(m.Content)
+	}
+	for _, h := range s.hooks.route {
+		if h.matches(env) {
+			h.logLine(c, env)
+			return h.cfg.Model
+		}
+	}
+	return ""
+}
+
+// hookWriter calls fire once, just before the response headers are sent.
+type hookWriter struct {
+	gin.ResponseWriter
+	fire  func(gin.ResponseWriter)
+	fired bool
+}
+
+func (w *hookWriter) before() {
+	if !w.fired {
+		w.fired = true
+		w.fire(w.ResponseWriter)
+	}
+}
+
+func (w *hookWriter) WriteHeaderNow() {
+	w.before()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *hookWriter) Write(b []byte) (int, error) {
+	w.before()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *hookWriter) WriteString(s string) (int, error) {
+	w.before()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *hookWriter) Flush() {
+	w.before()
+	w.ResponseWriter.Flush()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"cmp"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fallbackLocale is the locale of messages missing from a catalog.
+const fallbackLocale = "en"
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// catalogs hold the client-facing messages of every locale, keyed by
+// message ID. Messages are fmt formats.
+var catalogs = loadCatalogs()
+
+// defaultLocale is used when Accept-Language names no locale with a
+// catalog. It is set once at startup.
+var defaultLocale = fallbackLocale
+
+func loadCatalogs() map[string]map[string]string {
+	entries, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	catalogs := map[string]map[string]string{}
+	for _, e := range entries {
+		data, err := localeFiles.ReadFile("locales/" + e.Name())
+		if err != nil {
+			panic(err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			panic(fmt.Sprintf("locales/%s: %v", e.Name(), err))
+		}
+		catalogs[strings.TrimSuffix(e.Name(), path.Ext(e.Name()))] = messages
+	}
+	return catalogs
+}
+
+// localize returns the message with the given ID in the caller's locale,
+// formatted with args.
+func localize(c *gin.Context, id string, args ...any) string {
+	locale := localeFor(c)
+	c.Header("Content-Language", locale)
+	msg, ok := catalogs[locale][id]
+	if !ok {
+		msg = catalogs[fallbackLocale][id]
+	}
+	return fmt.Sprintf(msg, args...)
+}
+
+// localeFor picks the locale of the caller: the most preferred one of
+// Accept-Language with a catalog, matched on the primary language (de-CH
+// is de), or else the default locale.
+func localeFor(c *gin.Context) string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var prefs []weighted
+	for _, part := range strings.Split(c.GetHeader("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if tag != "" && q > 0 {
+			prefs = append(prefs, weighted{strings.ToLower(tag), q})
+		}
+	}
+	slices.SortStableFunc(prefs, func(a, b weighted) int { return cmp.Compare(b.q, a.q) })
+	for _, p := range prefs {
+		lang, _, _ := strings.Cut(p.tag, "-")
+		if _, ok := catalogs[lang]; ok {
+			return lang
+		}
+		if lang == "*" {
+			break
+		}
+	}
+	return defaultLocale
+}
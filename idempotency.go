@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits of the idempotency cache: responses larger than
+// maxIdempotentBody are not kept, nor are more than maxIdempotentEntries
+// responses at once.
+const (
+	maxIdempotencyKey    = 255
+	maxIdempotentBody    = 1 << 20
+	maxIdempotentEntries = 10000
+)
+
+// idempotencyCache keeps the responses of POST requests sent with an
+// Idempotency-Key for the idempotency window, so a retried request is
+// answered again without calling the model a second time.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentEntry
+}
+
+// idempotentEntry is a request seen with a key. done is set once its
+// response is stored.
+type idempotentEntry struct {
+	at          time.Time
+	fingerprint [sha256.Size]byte
+	done        bool
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{entries: map[string]*idempotentEntry{}}
+}
+
+// idempotent replays the stored response of a POST request whose
+// Idempotency-Key was used before by the same caller for the same request,
+// marking it with Idempotent-Replayed: true. Reusing a key for a different
+// request is rejected with 422 and a key whose first request is still
+// running with 409. Responses with a 5xx or 429 status are not kept, so
+// retrying after an upstream failure or a rate limit calls the model again.
+func (s *server) idempotent(c *gin.Context) {
+	key := c.GetHeader("Idempotency-Key")
+	if c.Request.Method != http.MethodPost || key == "" {
+		c.Next()
+		return
+	}
+	if len(key) > maxIdempotencyKey {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must not be longer than 255 characters."})
+		return
+	}
+
+	var body []byte
+	if c.Request.Body != nil {
+		var err error
+		if body, err = io.ReadAll(c.Request.Body); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Could not read request body."})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	h := sha256.New()
+	h.Write([]byte(c.Request.URL.RequestURI() + "\x00"))
+	h.Write(body)
+	var fingerprint [sha256.Size]byte
+	h.Sum(fingerprint[:0])
+
+	caller := "ip:" + c.ClientIP()
+	if cl := clientFrom(c); cl != nil {
+		caller = "client:" + cl.ID
+	} else if s.cfg.TenantHeader != "" {
+		caller += "\x00" + c.GetHeader(s.cfg.TenantHeader)
+	}
+	id := caller + "\x00" + c.FullPath() + "\x00" + key
+
+	cache := s.idempotency
+	window := s.cfg.IdempotencyWindow.Duration
+	cache.mu.Lock()
+	now := time.Now()
+	for k, e := range cache.entries {
+		if e.done && now.Sub(e.at) > window {
+			delete(cache.entries, k)
+		}
+	}
+	e, seen := cache.entries[id]
+	switch {
+	case !seen && len(cache.entries) >= maxIdempotentEntries:
+		cache.mu.Unlock()
+		c.Next()
+		return
+	case !seen:
+		e = &idempotentEntry{at: now, fingerprint: fingerprint}
+		cache.entries[id] = e
+		cache.mu.Unlock()
+	case e.fingerprint != fingerprint:
+		cache.mu.Unlock()
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "This Idempotency-Key was already used for a different request."})
+		return
+	case !e.done:
+		cache.mu.Unlock()
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still in progress."})
+		return
+	default:
+		status, header, body := e.status, e.header, e.body
+		cache.mu.Unlock()
+		for k, v := range header {
+			c.Writer.Header()[k] = v
+		}
+		c.Header("Idempotent-Replayed", "true")
+		c.Data(status, header.Get("Content-Type"), body)
+		c.Abort()
+		return
+	}
+
+	w := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	c.Next()
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	status := w.Status()
+	if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests || w.overflow || c.Request.Context().Err() != nil {
+		delete(cache.entries, id)
+		return
+	}
+	e.done = true
+	e.at = time.Now()
+	e.status = status
+	e.header = w.Header().Clone()
+	// Compression is redone for the client that retries.
+	for _, h := range []string{"Content-Encoding", "Content-Length", "Vary"} {
+		e.header.Del(h)
+	}
+	e.body = w.buf.Bytes()
+}
+
+// recordingWriter keeps a copy of the response body, up to
+// maxIdempotentBody.
+type recordingWriter struct {
+	gin.ResponseWriter
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.record(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.record([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *recordingWriter) record(b []byte) {
+	if w.overflow {
+		return
+	}
+	if w.buf.Len()+len(b) > maxIdempotentBody {
+		w.overflow = true
+		w.buf = bytes.Buffer{}
+		return
+	}
+	w.buf.Write(b)
+}
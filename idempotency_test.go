@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIdempotentReplay(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := defaultConfig()
+	cfg.IdempotencyWindow.Duration = time.Minute
+	s := &server{cfg: cfg, idempotency: newIdempotencyCache()}
+	calls := 0
+	router := gin.New()
+	router.POST("/chat", s.idempotent, func(c *gin.Context) {
+		calls++
+		c.String(http.StatusOK, "answer %d", calls)
+	})
+	post := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/chat", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	first := post("k1", `{"message":"hi"}`)
+	retry := post("k1", `{"message":"hi"}`)
+	if calls != 1 || retry.Body.String() != first.Body.String() || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry: %d calls, body %q, want the first answer %q replayed", calls, retry.Body, first.Body)
+	}
+	if w := post("k1", `{"message":"other"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("key reused for another body: status %d, want 422", w.Code)
+	}
+	if post("k2", `{"message":"hi"}`); calls != 2 {
+		t.Errorf("new key: %d calls, want 2", calls)
+	}
+}
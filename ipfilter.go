@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ipFilter admits callers by address range. Deny entries win over allow
+// entries; with no allow entries every address not denied is admitted.
+type ipFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func newIPFilter(cfg *IPAccessConfig) (*ipFilter, error) {
+	allow, err := parsePrefixes(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	deny, err := parsePrefixes(cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	return &ipFilter{allow: allow, deny: deny}, nil
+}
+
+// parsePrefixes parses CIDR ranges; a bare address is a range of one.
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// admits reports whether addr may use the service.
+func (f *ipFilter) admits(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if containsAddr(f.deny, addr) {
+		return false
+	}
+	return len(f.allow) == 0 || containsAddr(f.allow, addr)
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterIP rejects callers outside the ip_access ranges. The caller's
+// address is taken from X-Forwarded-For only when the connection comes from
+// one of the trusted_proxies.
+func (s *server) filterIP(c *gin.Context) {
+	addr, err := netip.ParseAddr(c.ClientIP())
+	if err != nil || !s.ipFilter.admits(addr) {
+		auditNote(c, "rejected: address not allowed")
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": localize(c, "address_blocked")})
+		return
+	}
+	c.Next()
+}
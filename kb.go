@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Defaults for knowledge bases.
+const (
+	defaultKBAnswerScore = 0.9
+	defaultKBMinScore    = 0.5
+	defaultKBTopK        = 3
+
+	// kbEmbedBatch is how many texts are embedded per upstream call.
+	kbEmbedBatch = 64
+
+	// kbRetryInterval is how long indexing waits after it failed.
+	kbRetryInterval = time.Minute
+)
+
+// knowledgeBase holds the embeddings of the FAQ questions and document
+// chunks of a knowledge base. It is consulted once indexed.
+type knowledgeBase struct {
+	name string
+	cfg  *KnowledgeBaseConfig
+
+	mu      sync.RWMutex
+	entries []kbEntry
+	lexical *bm25Index
+	indexed bool
+}
+
+// kbEntry is a FAQ question or a document chunk with its embedding.
+type kbEntry struct {
+	faq       *FAQEntry // nil for document chunks
+	source    string    // the file of a document chunk
+	text      string
+	embedding []float32
+}
+
+// kbMatch is an entry and how similar it is to a prompt.
+type kbMatch struct {
+	entry *kbEntry
+	score float64
+}
+
+// kbRoute is a route that consults a knowledge base, for requests made in
+// workspace or, when it is empty, for all others.
+type kbRoute struct {
+	route     string
+	workspace string
+}
+
+// newKnowledgeBases returns the knowledge bases of cfg keyed by the routes
+// that consult them.
+func newKnowledgeBases(cfg *Config) map[kbRoute]*knowledgeBase {
+	byRoute := map[kbRoute]*knowledgeBase{}
+	for name, kc := range cfg.KnowledgeBases {
+		kb := &knowledgeBase{name: name, cfg: kc}
+		for _, route := range kc.Routes {
+			byRoute[kbRoute{route, kc.Workspace}] = kb
+		}
+	}
+	return byRoute
+}
+
+// indexKnowledgeBases loads the saved index of every knowledge base that
+// has a current one, and indexes the others in the background, retrying
+// those that fail until ctx is done.
+func (s *server) indexKnowledgeBases(ctx context.Context) {
+	seen := map[*knowledgeBase]bool{}
+	for _, kb := range s.knowledgeBases {
+		if seen[kb] {
+			continue
+		}
+		seen[kb] = true
+		if loaded, err := kb.load(); err != nil {
+			log.Printf("Error loading the index of knowledge base %s: %v", kb.name, err)
+		} else if loaded {
+			continue
+		}
+		go func() {
+			for {
+				err := kb.index(ctx, s.providers[kb.cfg.Provider])
+				if err == nil {
+					return
+				}
+				log.Printf("Error indexing knowledge base %s, retrying in %s: %v", kb.name, kbRetryInterval, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(kbRetryInterval):
+				}
+			}
+		}()
+	}
+}
+
+// reloadKnowledgeBases loads the index files of the knowledge bases that
+// have one, e.g. after askllm reindex rebuilt them.
+func (s *server) reloadKnowledgeBases() {
+	seen := map[*knowledgeBase]bool{}
+	for _, kb := range s.knowledgeBases {
+		if seen[kb] {
+			continue
+		}
+		seen[kb] = true
+		if _, err := kb.load(); err != nil {
+			log.Printf("Error loading the index of knowledge base %s: %v", kb.name, err)
+		}
+	}
+}
+
+// index reads the documents of kb, splits them into chunks and embeds the
+// chunks and FAQ questions with p, then saves the index to the index file,
+// if any, and starts using it.
+func (kb *knowledgeBase) index(ctx context.Context, p *provider) error {
+	var entries []kbEntry
+	for _, e := range kb.cfg.FAQ {
+		entries = append(entries, kbEntry{faq: e, text: e.Question})
+	}
+	for _, pattern := range kb.cfg.Documents {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("documents %q: %w", pattern, err)
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			for _, chunk := range splitDocument(string(data), &kb.cfg.Chunking) {
+				entries = append(entries, kbEntry{source: file, text: chunk})
+			}
+		}
+	}
+
+	ctx = withPriority(ctx, priorityLow)
+	for start := 0; start < len(entries); start += kbEmbedBatch {
+		batch := entries[start:min(start+kbEmbedBatch, len(entries))]
+		texts := make([]string, len(batch))
+		for i, e := range batch {
+			texts[i] = e.text
+		}
+		vectors, err := p.embed(ctx, kb.cfg.EmbeddingModel, texts)
+		if err != nil {
+			return err
+		}
+		for i := range batch {
+			batch[i].embedding = vectors[i]
+		}
+	}
+
+	if kb.cfg.IndexFile != "" {
+		if err := kb.save(entries); err != nil {
+			return err
+		}
+	}
+	kb.use(entries)
+	log.Printf("Indexed knowledge base %s: %d entries", kb.name, len(entries))
+	return nil
+}
+
+// use makes entries the index of kb.
+func (kb *knowledgeBase) use(entries []kbEntry) {
+	texts := make([]string, len(entries))
+	for i, e := range entries {
+		texts[i] = e.text
+		if e.faq != nil {
+			texts[i] += "\n" + e.faq.Answer
+		}
+	}
+	lexical := newBM25Index(texts)
+
+	kb.mu.Lock()
+	kb.entries, kb.lexical, kb.indexed = entries, lexical, true
+	kb.mu.Unlock()
+}
+
+// kbIndexFile is the content of the index file of a knowledge base.
+type kbIndexFile struct {
+	// Settings is the fingerprint of the settings it was built with.
+	Settings string         `json:"settings"`
+	BuiltAt  time.Time      `json:"built_at"`
+	Entries  []kbIndexEntry `json:"entries"`
+}
+
+// kbIndexEntry is a saved kbEntry.
+type kbIndexEntry struct {
+	Question  string    `json:"question,omitempty"`
+	Answer    string    `json:"answer,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	Text      string    `json:"text"`
+	Embedding []float32 `json:"embedding"`
+}
+
+// settings returns a fingerprint of the settings of kb an index depends
+// on, besides its documents: the FAQ, embedding model and chunking.
+func (kb *knowledgeBase) settings() string {
+	raw, _ := json.Marshal([]any{kb.cfg.FAQ, kb.cfg.EmbeddingModel, kb.cfg.Chunking})
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// save writes entries to the index file of kb.
+func (kb *knowledgeBase) save(entries []kbEntry) error {
+	file := kbIndexFile{Settings: kb.settings(), BuiltAt: time.Now().UTC()}
+	for _, e := range entries {
+		saved := kbIndexEntry{Source: e.source, Text: e.text, Embedding: e.embedding}
+		if e.faq != nil {
+			saved.Question, saved.Answer = e.faq.Question, e.faq.Answer
+		}
+		file.Entries = append(file.Entries, saved)
+	}
+	raw, err := json.Marshal(&file)
+	if err != nil {
+		return fmt.Errorf("encoding index: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(kb.cfg.IndexFile), ".askllm-index-*.json")
+	if err != nil {
+		return fmt.Errorf("writing index: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing index: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing index: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), kb.cfg.IndexFile); err != nil {
+		return fmt.Errorf("writing index: %w", err)
+	}
+	return nil
+}
+
+// load starts using the index file of kb. It reports false, leaving the
+// index as it was, when there is no index file or it was built with other
+// settings.
+func (kb *knowledgeBase) load() (bool, error) {
+	if kb.cfg.IndexFile == "" {
+		return false, nil
+	}
+	raw, err := os.ReadFile(kb.cfg.IndexFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var file kbIndexFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return false, fmt.Errorf("parsing %s: %w", kb.cfg.IndexFile, err)
+	}
+	if file.Settings != kb.settings() {
+		log.Printf("The index file of knowledge base %s was built with other settings, ignoring it", kb.name)
+		return false, nil
+	}
+	entries := make([]kbEntry, len(file.Entries))
+	for i, e := range file.Entries {
+		entries[i] = kbEntry{source: e.Source, text: e.Text, embedding: e.Embedding}
+		if e.Question != "" {
+			entries[i].faq = &FAQEntry{Question: e.Question, Answer: e.Answer}
+		}
+	}
+	kb.use(entries)
+	log.Printf("Loaded the index of knowledge base %s, built %s: %d entries", kb.name, file.BuiltAt.Format(time.RFC3339), len(entries))
+	return true, nil
+}
+
+// lookup compares prompt to the entries of kb. It returns the most similar
+// entry, if any is at least MinScore similar, and the TopK entries to give
+// the model as context: the most similar ones or, with hybrid retrieval,
+// the best of the similar ones and those BM25 ranks highest for prompt,
+// merged by reciprocal rank fusion.
+func (kb *knowledgeBase) lookup(ctx context.Context, p *provider, prompt string) (best *kbMatch, related []kbMatch, err error) {
+	kb.mu.RLock()
+	entries, lexical, indexed := kb.entries, kb.lexical, kb.indexed
+	kb.mu.RUnlock()
+	if !indexed || len(entries) == 0 {
+		return nil, nil, nil
+	}
+
+	vectors, err := p.embed(ctx, kb.cfg.EmbeddingModel, []string{prompt})
+	if err != nil {
+		return nil, nil, err
+	}
+	similarity := make([]float64, len(entries))
+	var similar []int
+	for i := range entries {
+		similarity[i] = cosine(vectors[0], entries[i].embedding)
+		if similarity[i] >= kb.cfg.MinScore {
+			similar = append(similar, i)
+		}
+	}
+	byScore(similar, similarity)
+
+	ranked := similar
+	if kb.cfg.Retrieval == retrievalHybrid {
+		bm25 := lexical.scores(prompt)
+		var matching []int
+		for i, score := range bm25 {
+			if score > 0 {
+				matching = append(matching, i)
+			}
+		}
+		byScore(matching, bm25)
+		ranked = reciprocalRankFusion(similar, matching)
+	}
+
+	if len(similar) > 0 {
+		best = &kbMatch{&entries[similar[0]], similarity[similar[0]]}
+	}
+	for _, i := range ranked[:min(len(ranked), kb.cfg.TopK)] {
+		related = append(related, kbMatch{&entries[i], similarity[i]})
+	}
+	return best, related, nil
+}
+
+// consultKnowledgeBase looks prompt up in the knowledge base of the
+// request's route, if it has one: the one of the request's workspace, or
+// else the route's shared one. It returns the canned answer of a FAQ
+// question matching prompt with at least answer_score, or else a system
+// note with the most relevant entries, if any.
+func (s *server) consultKnowledgeBase(c *gin.Context, prompt string) (answer string, note *Message) {
+	route := unversioned(c.FullPath())
+	var kb *knowledgeBase
+	if m := workspaceFrom(c); m != nil {
+		kb = s.knowledgeBases[kbRoute{route, m.workspace.ID}]
+	}
+	if kb == nil {
+		kb = s.knowledgeBases[kbRoute{route: route}]
+	}
+	if kb == nil {
+		return "", nil
+	}
+	best, matches, err := kb.lookup(c.Request.Context(), s.providers[kb.cfg.Provider], prompt)
+	if err != nil {
+		log.Printf("Error consulting knowledge base %s: %v", kb.name, err)
+		return "", nil
+	}
+	if best != nil && best.entry.faq != nil && best.score >= kb.cfg.AnswerScore {
+		c.Header("X-Knowledge-Base", kb.name)
+		auditNote(c, "knowledge base %s answered (score %.2f)", kb.name, best.score)
+		return best.entry.faq.Answer, nil
+	}
+	if len(matches) == 0 {
+		return "", nil
+	}
+
+	var b strings.Builder
+	b.WriteString("Excerpts from the knowledge base that may answer the user. Prefer them to what you know when they apply.")
+	for _, m := range matches {
+		if m.entry.faq != nil {
+			fmt.Fprintf(&b, "\n\nQ: %s\nA: %s", m.entry.faq.Question, m.entry.faq.Answer)
+		} else {
+			fmt.Fprintf(&b, "\n\n[%s]\n%s", filepath.Base(m.entry.source), m.entry.text)
+		}
+	}
+	auditNote(c, "knowledge base %s added %d entries", kb.name, len(matches))
+	return "", &Message{Role: "system", Content: b.String()}
+}
+
+// streamCanned sends a canned answer to a streaming caller as a single
+// token event.
+func streamCanned(c *gin.Context, answer string) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("token", gin.H{"content": answer})
+	c.Writer.Flush()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// languageStopwords are frequent short words used to tell apart languages
+// written in the Latin script.
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "is", "of", "to", "what", "how", "you", "in", "it"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ich", "wie", "was", "mit"},
+	"fr": {"le", "la", "les", "et", "est", "pas", "je", "une", "des", "que"},
+	"es": {"el", "los", "las", "y", "es", "que", "una", "por", "cómo", "qué"},
+	"it": {"il", "che", "di", "non", "una", "sono", "come", "per", "gli", "della"},
+	"pt": {"o", "os", "que", "não", "uma", "é", "como", "para", "com", "do"},
+}
+
+// detectLanguage guesses the ISO 639-1 code of text from its dominant
+// script, and for Latin script from common words. It returns "" when
+// unsure. It is a routing heuristic, not a language identifier.
+func detectLanguage(text string) string {
+	counts := map[string]int{}
+	letters := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		switch {
+		case unicode.Is(unicode.Cyrillic, r):
+			counts["ru"]++
+		case unicode.Is(unicode.Hiragana, r), unicode.Is(unicode.Katakana, r):
+			counts["ja"] += 2 // kana outweighs the kanji mixed in with it
+		case unicode.Is(unicode.Han, r):
+			counts["zh"]++
+		case unicode.Is(unicode.Hangul, r):
+			counts["ko"]++
+		case unicode.Is(unicode.Arabic, r):
+			counts["ar"]++
+		case unicode.Is(unicode.Hebrew, r):
+			counts["he"]++
+		case unicode.Is(unicode.Greek, r):
+			counts["el"]++
+		case unicode.Is(unicode.Devanagari, r):
+			counts["hi"]++
+		case unicode.Is(unicode.Thai, r):
+			counts["th"]++
+		case unicode.Is(unicode.Latin, r):
+			counts["latn"]++
+		}
+	}
+	if letters == 0 {
+		return ""
+	}
+
+	best, bestCount := "", 0
+	for lang, n := range counts {
+		if n > bestCount {
+			best, bestCount = lang, n
+		}
+	}
+	if best != "latn" {
+		return best
+	}
+	return detectLatinLanguage(text)
+}
+
+// detectLatinLanguage picks the language whose stopwords occur most often.
+func detectLatinLanguage(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+
+	best, bestCount := "", 0
+	for lang, stopwords := range languageStopwords {
+		n := 0
+		for _, w := range words {
+			for _, sw := range stopwords {
+				if w == sw {
+					n++
+					break
+				}
+			}
+		}
+		if n > bestCount || (n == bestCount && n > 0 && lang < best) {
+			best, bestCount = lang, n
+		}
+	}
+	return best
+}
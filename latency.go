@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// latencyWindow is how many recent samples the /status percentiles are
+// computed from, per provider and model.
+const latencyWindow = 1000
+
+// Load shedding judges a provider by its last recentWindow response times
+// no older than recentMaxAge, so it reacts quickly and recovers once the
+// provider does.
+const (
+	recentWindow = 100
+	recentMaxAge = time.Minute
+)
+
+// latencies keeps the recent upstream latencies of every provider and model.
+var latencies = &latencyStats{series: map[latencyKey]*latencySeries{}, recent: map[string][]timedSample{}, outcomes: map[string][]timedOutcome{}}
+
+type latencyKey struct{ provider, model string }
+
+type latencyStats struct {
+	mu     sync.Mutex
+	series map[latencyKey]*latencySeries
+
+	// recent holds each provider's latest response times across models:
+	// time to first token for streams, total otherwise.
+	recent map[string][]timedSample
+
+	// outcomes holds each provider's latest requests, marking those that
+	// failed through its fault, for its status.
+	outcomes map[string][]timedOutcome
+}
+
+type timedSample struct {
+	at time.Time
+	d  time.Duration
+}
+
+type timedOutcome struct {
+	at    time.Time
+	fault bool
+}
+
+// latencySeries holds ring buffers of recent samples.
+type latencySeries struct {
+	requests int
+	errors   int
+	total    []time.Duration
+	ttft     []time.Duration
+}
+
+// observeLatency records a completed upstream request. ttft is zero for
+// requests that were not streamed. Requests the caller abandoned are not
+// recorded.
+func observeLatency(ctx context.Context, provider, model string, ttft, total time.Duration, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	if err == nil {
+		upstreamLatency.WithLabelValues(provider, model).Observe(total.Seconds())
+		if ttft > 0 {
+			timeToFirstToken.WithLabelValues(provider, model).Observe(ttft.Seconds())
+		}
+	}
+
+	latencies.mu.Lock()
+	defer latencies.mu.Unlock()
+	key := latencyKey{provider, model}
+	s, ok := latencies.series[key]
+	if !ok {
+		s = &latencySeries{}
+		latencies.series[key] = s
+	}
+	s.requests++
+	latencies.addOutcome(provider, err != nil && providerFault(err))
+	if err != nil {
+		s.errors++
+		// A timeout took at least this long; let it raise the p95.
+		if code, _ := classifyError(err); code == codeUpstreamTimeout {
+			latencies.addRecent(provider, total)
+		}
+		return
+	}
+	if ttft > 0 {
+		latencies.addRecent(provider, ttft)
+	} else {
+		latencies.addRecent(provider, total)
+	}
+	s.total = pushSample(s.total, total)
+	if ttft > 0 {
+		s.ttft = pushSample(s.ttft, ttft)
+	}
+}
+
+// tokensPerSecond is the generation speed of a response of tokens that took
+// total, rounded to a tenth. ttft is the time to its first token when it
+// was streamed; like in the benchmark, the tokens after the first are timed
+// from it, as the wait before it is spent reading the prompt.
+func tokensPerSecond(tokens int, ttft, total time.Duration) float64 {
+	generation := total - ttft
+	if ttft > 0 {
+		tokens--
+	}
+	if tokens <= 0 || generation <= 0 {
+		return 0
+	}
+	return math.Round(float64(tokens)/generation.Seconds()*10) / 10
+}
+
+// observeThroughput records the generation speed of a successful upstream
+// request, as for observeLatency.
+func observeThroughput(ctx context.Context, provider, model string, tokens int, ttft, total time.Duration) {
+	if ctx.Err() != nil {
+		return
+	}
+	if speed := tokensPerSecond(tokens, ttft, total); speed > 0 {
+		generationSpeed.WithLabelValues(provider, model).Observe(speed)
+	}
+}
+
+func pushSample(samples []time.Duration, d time.Duration) []time.Duration {
+	if len(samples) == latencyWindow {
+		samples = samples[1:]
+	}
+	return append(samples, d)
+}
+
+// addRecent records a response time of provider. The caller holds mu.
+func (l *latencyStats) addRecent(provider string, d time.Duration) {
+	samples := l.recent[provider]
+	if len(samples) == recentWindow {
+		samples = samples[1:]
+	}
+	l.recent[provider] = append(samples, timedSample{time.Now(), d})
+}
+
+// addOutcome records a request to provider. The caller holds mu.
+func (l *latencyStats) addOutcome(provider string, fault bool) {
+	outcomes := l.outcomes[provider]
+	if len(outcomes) == recentWindow {
+		outcomes = outcomes[1:]
+	}
+	l.outcomes[provider] = append(outcomes, timedOutcome{time.Now(), fault})
+}
+
+// recentOutcomes counts provider's recent requests and those that failed
+// through its fault.
+func (l *latencyStats) recentOutcomes(provider string) (requests, faults int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cutoff := time.Now().Add(-recentMaxAge)
+	for _, o := range l.outcomes[provider] {
+		if o.at.After(cutoff) {
+			requests++
+			if o.fault {
+				faults++
+			}
+		}
+	}
+	return requests, faults
+}
+
+// recentP95 returns the p95 of provider's recent response times, or zero
+// when it has none.
+func (l *latencyStats) recentP95(provider string) time.Duration {
+	return l.recentPercentile(provider, 0.95)
+}
+
+// recentMedian returns the median of provider's recent response times, or
+// zero when it has none.
+func (l *latencyStats) recentMedian(provider string) time.Duration {
+	return l.recentPercentile(provider, 0.5)
+}
+
+func (l *latencyStats) recentPercentile(provider string, p float64) time.Duration {
+	l.mu.Lock()
+	var durations []time.Duration
+	cutoff := time.Now().Add(-recentMaxAge)
+	for _, s := range l.recent[provider] {
+		if s.at.After(cutoff) {
+			durations = append(durations, s.d)
+		}
+	}
+	l.mu.Unlock()
+	if len(durations) == 0 {
+		return 0
+	}
+	slices.Sort(durations)
+	return durations[int(math.Ceil(p*float64(len(durations))))-1]
+}
+
+// percentiles summarizes samples in milliseconds, or returns nil when there
+// are none.
+func percentiles(samples []time.Duration) gin.H {
+	if len(samples) == 0 {
+		return nil
+	}
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+	// Nearest-rank percentiles.
+	at := func(p float64) int64 {
+		return sorted[int(math.Ceil(p*float64(len(sorted))))-1].Milliseconds()
+	}
+	return gin.H{"p50": at(0.5), "p90": at(0.9), "p99": at(0.99)}
+}
+
+// upstreamStats summarizes the recent upstream requests per provider and
+// model, sorted by both.
+func upstreamStats() []gin.H {
+	latencies.mu.Lock()
+	list := make([]gin.H, 0, len(latencies.series))
+	for key, series := range latencies.series {
+		list = append(list, gin.H{
+			"provider":   key.provider,
+			"model":      key.model,
+			"requests":   series.requests,
+			"errors":     series.errors,
+			"latency_ms": percentiles(series.total),
+			"ttft_ms":    percentiles(series.ttft),
+		})
+	}
+	latencies.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i]["provider"] != list[j]["provider"] {
+			return list[i]["provider"].(string) < list[j]["provider"].(string)
+		}
+		return list[i]["model"].(string) < list[j]["model"].(string)
+	})
+	return list
+}
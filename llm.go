@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Base URL for Chutes DeepSeek API
+	chutesBaseURL = "https://llm.chutes.ai/v1"
+
+	defaultModel       = "deepseek-ai/DeepSeek-R1"
+	defaultMaxTokens   = 1024
+	defaultTemperature = 0.7
+)
+
+// Message describes a single message for DeepSeek API
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// DeepSeekRequestPayload represents the request structure for Chutes DeepSeek API
+type DeepSeekRequestPayload struct {
+	Model       string    `json:"model"`
+	Messages    []Message `json:"messages"`
+	Stream      bool      `json:"stream"`
+	MaxTokens   int       `json:"max_tokens"`
+	Temperature float64   `json:"temperature"`
+}
+
+// Choice describes a single response option from DeepSeek API
+type Choice struct {
+	Index        int     `json:"index"`
+	Message      Message `json:"message"`
+	FinishReason string  `json:"finish_reason"`
+}
+
+// UsageInfo contains token usage information
+type UsageInfo struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// DeepSeekResponsePayload represents the response structure from DeepSeek API
+type DeepSeekResponsePayload struct {
+	ID      string    `json:"id"`
+	Object  string    `json:"object"`
+	Created int64     `json:"created"`
+	Model   string    `json:"model"`
+	Choices []Choice  `json:"choices"`
+	Usage   UsageInfo `json:"usage"`
+}
+
+// Errors returned by complete, used by handlers to pick the user-facing message.
+var (
+	errUpstreamUnreachable = errors.New("failed to contact DeepSeek API")
+	errUpstreamStatus      = errors.New("error status from DeepSeek API")
+	errUpstreamFormat      = errors.New("invalid response format from DeepSeek API")
+	errEmptyCompletion     = errors.New("DeepSeek LLM did not provide a text response")
+)
+
+// statusError is returned when the upstream answers with a non-200 status.
+// It matches errUpstreamStatus with errors.Is.
+type statusError struct {
+	StatusCode int
+	Body       string
+	// RetryAt is when the upstream allows the next attempt, from its
+	// Retry-After header. It is zero when no header was sent.
+	RetryAt time.Time
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%v: status %d, body: %s", errUpstreamStatus, e.StatusCode, e.Body)
+}
+
+func (e *statusError) Unwrap() error { return errUpstreamStatus }
+
+// Machine-readable codes of upstream failures, sent in the X-Error-Code
+// header.
+const (
+	codeUpstreamAuth        = "upstream_auth"
+	codeRateLimited         = "rate_limited"
+	codeQuotaExceeded       = "quota_exceeded"
+	codeContextTooLong      = "context_too_long"
+	codeContentFiltered     = "content_filtered"
+	codeUpstreamTimeout     = "upstream_timeout"
+	codeUpstreamUnreachable = "upstream_unreachable"
+	codeUpstreamError       = "upstream_error"
+	codeUpstreamBadResponse = "upstream_bad_response"
+	codeEmptyCompletion     = "empty_completion"
+	codeOverloaded          = "overloaded"
+	codeNotAllowed          = "not_allowed"
+	codeInternal            = "internal_error"
+)
+
+// Phrases providers use in error bodies for failures that share a status.
+var (
+	quotaPhrases   = []string{"quota", "insufficient", "billing", "credit", "balance"}
+	contextPhrases = []string{"context_length", "context length", "maximum context", "too many tokens", "too long"}
+	filterPhrases  = []string{"content_filter", "content filter", "content policy", "content_policy", "safety"}
+)
+
+// classifyError returns the code of an upstream failure and the status the
+// caller should get for it.
+func classifyError(err error) (code string, status int) {
+	var statusErr *statusError
+	var netErr net.Error
+	var shedErr *shedError
+	var routeErr *routeError
+	switch {
+	case errors.As(err, &routeErr):
+		return codeNotAllowed, http.StatusBadRequest
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return codeUpstreamTimeout, http.StatusGatewayTimeout
+	case errors.Is(err, errQueueFull), errors.Is(err, errQueueTimeout), errors.As(err, &shedErr):
+		return codeOverloaded, http.StatusServiceUnavailable
+	case errors.As(err, &statusErr):
+		return statusErr.classify()
+	case errors.Is(err, errUpstreamUnreachable):
+		return codeUpstreamUnreachable, http.StatusBadGateway
+	case errors.Is(err, errUpstreamFormat):
+		return codeUpstreamBadResponse, http.StatusBadGateway
+	case errors.Is(err, errEmptyCompletion):
+		return codeEmptyCompletion, http.StatusOK
+	default:
+		return codeInternal, http.StatusInternalServerError
+	}
+}
+
+func (e *statusError) classify() (code string, status int) {
+	body := strings.ToLower(e.Body)
+	mentions := func(phrases []string) bool {
+		return slices.ContainsFunc(phrases, func(p string) bool { return strings.Contains(body, p) })
+	}
+	switch {
+	case e.StatusCode == http.StatusPaymentRequired || (e.StatusCode == http.StatusTooManyRequests && mentions(quotaPhrases)):
+		return codeQuotaExceeded, http.StatusServiceUnavailable
+	case e.StatusCode == http.StatusTooManyRequests:
+		return codeRateLimited, http.StatusTooManyRequests
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		return codeUpstreamAuth, http.StatusBadGateway
+	case e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusGatewayTimeout:
+		return codeUpstreamTimeout, http.StatusGatewayTimeout
+	case e.StatusCode < 500 && mentions(filterPhrases):
+		return codeContentFiltered, http.StatusUnprocessableEntity
+	case e.StatusCode == http.StatusRequestEntityTooLarge || (e.StatusCode < 500 && mentions(contextPhrases)):
+		return codeContextTooLong, http.StatusRequestEntityTooLarge
+	default:
+		return codeUpstreamError, http.StatusBadGateway
+	}
+}
+
+// newStatusError reads and closes resp.Body and describes the failed response.
+func newStatusError(resp *http.Response) *statusError {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	e := &statusError{StatusCode: resp.StatusCode, Body: string(body)}
+	if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+		e.RetryAt = time.Now().Add(wait)
+	}
+	return e
+}
+
+// parseRetryAfter reads a Retry-After header given either as a number of
+// seconds or as an HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// newPayload builds a request payload with the default model settings.
+func newPayload(messages []Message) DeepSeekRequestPayload {
+	return DeepSeekRequestPayload{
+		Model:       defaultModel,
+		Messages:    messages,
+		Stream:      false,
+		MaxTokens:   defaultMaxTokens,
+		Temperature: defaultTemperature,
+	}
+}
+
+// StreamChunk is a single server-sent event of a streamed completion.
+type StreamChunk struct {
+	ID      string        `json:"id"`
+	Object  string        `json:"object"`
+	Created int64         `json:"created"`
+	Model   string        `json:"model"`
+	Choices []StreamDelta `json:"choices"`
+	Usage   *UsageInfo    `json:"usage,omitempty"`
+}
+
+// StreamDelta is the incremental part of a streamed choice.
+type StreamDelta struct {
+	Index        int     `json:"index"`
+	Delta        Message `json:"delta"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+var reasoningBlock = regexp.MustCompile(`(?s)<think>.*?</think>`)
+
+// stripReasoning removes the <think>...</think> block that reasoning models
+// such as DeepSeek-R1 prepend to their answer.
+func stripReasoning(s string) string {
+	return strings.TrimSpace(reasoningBlock.ReplaceAllString(s, ""))
+}
+
+// estimateTokens gives a rough token count for s, assuming about four
+// characters per token. It is only used for budgeting, never for billing.
+func estimateTokens(s string) int {
+	return (len([]rune(s)) + 3) / 4
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mockProvider is an OpenAI-compatible upstream that answers every
+// completion after a fixed delay, streaming a fixed number of tokens, so
+// the gateway can be loaded without calling or paying a real provider.
+type mockProvider struct {
+	latency   time.Duration
+	tokens    int
+	interval  time.Duration
+	errorRate float64
+
+	requests atomic.Int64
+	errors   atomic.Int64
+	inFlight atomic.Int64
+	peak     atomic.Int64
+}
+
+// ServeHTTP answers GET .../models for health checks and POST
+// .../chat/completions, streamed or not.
+func (m *mockProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/models") {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"object":"list","data":[{"id":"mock","object":"model"}]}`)
+		return
+	}
+	if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, "/chat/completions") {
+		http.NotFound(w, r)
+		return
+	}
+	var payload DeepSeekRequestPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, `{"error":{"message":"invalid JSON"}}`, http.StatusBadRequest)
+		return
+	}
+
+	m.requests.Add(1)
+	n := m.inFlight.Add(1)
+	defer m.inFlight.Add(-1)
+	for peak := m.peak.Load(); n > peak && !m.peak.CompareAndSwap(peak, n); peak = m.peak.Load() {
+	}
+
+	select {
+	case <-time.After(m.latency):
+	case <-r.Context().Done():
+		return
+	}
+	if m.errorRate > 0 && rand.Float64() < m.errorRate {
+		m.errors.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, `{"error":{"message":"mock provider failure"}}`)
+		return
+	}
+
+	tokens := max(m.tokens, 1)
+	usage := &UsageInfo{CompletionTokens: tokens}
+	for _, msg := range payload.Messages {
+		usage.PromptTokens += estimateTokens(msg.Content)
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	if !payload.Stream {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(DeepSeekResponsePayload{
+			ID: "mock", Object: "chat.completion", Created: time.Now().Unix(), Model: payload.Model,
+			Choices: []Choice{{Message: Message{Role: "assistant", Content: strings.TrimSpace(strings.Repeat("lorem ", tokens))}, FinishReason: "stop"}},
+			Usage:   *usage,
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher, _ := w.(http.Flusher)
+	send := func(chunk StreamChunk) {
+		data, _ := json.Marshal(chunk)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	for i := range tokens {
+		if i > 0 {
+			select {
+			case <-time.After(m.interval):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		send(StreamChunk{ID: "mock", Object: "chat.completion.chunk", Model: payload.Model, Choices: []StreamDelta{{Delta: Message{Content: "lorem "}}}})
+	}
+	stop := "stop"
+	send(StreamChunk{ID: "mock", Object: "chat.completion.chunk", Model: payload.Model, Choices: []StreamDelta{{FinishReason: &stop}}})
+	send(StreamChunk{ID: "mock", Object: "chat.completion.chunk", Model: payload.Model, Choices: []StreamDelta{}, Usage: usage})
+	io.WriteString(w, "data: [DONE]\n\n")
+}
+
+// loadResult is the outcome of one load test request. Status is 0 when no
+// response arrived.
+type loadResult struct {
+	status      int
+	stream      bool
+	latency     time.Duration
+	ttft        time.Duration
+	interrupted bool
+	retryAfter  bool
+}
+
+// runLoadTest sends synthetic traffic to a running gateway for a while and
+// reports how it held up: the responses by status, including requests shed
+// by rate limits or a full queue, latencies, and streams that broke off.
+// With -mock it also serves a mock provider the gateway can be pointed at.
+func runLoadTest(args []string) int {
+	fs := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	targetURL := fs.String("target", "", "base URL of the gateway, e.g. http://localhost:8080")
+	path := fs.String("path", "/v1/ask", "route to load, sent the prompt as q")
+	apiKey := fs.String("key", "", "API key sent as a bearer token")
+	prompt := fs.String("prompt", "Say hello.", "prompt to send")
+	duration := fs.Duration("duration", 30*time.Second, "how long to send requests")
+	concurrency := fs.Int("concurrency", 20, "requests in flight at most")
+	rate := fs.Float64("rate", 0, "requests per second to start (zero: as fast as -concurrency allows)")
+	streamShare := fs.Float64("stream", 0.5, "share of requests streamed, from 0 to 1")
+	timeout := fs.Duration("timeout", 2*time.Minute, "time after which a request is abandoned")
+	mockAddr := fs.String("mock", "", "address to serve a mock provider on, e.g. 127.0.0.1:9100")
+	mockLatency := fs.Duration("mock-latency", 200*time.Millisecond, "delay of the mock provider before the first token")
+	mockTokens := fs.Int("mock-tokens", 32, "tokens the mock provider answers with")
+	mockInterval := fs.Duration("mock-token-interval", 20*time.Millisecond, "delay of the mock provider between streamed tokens")
+	mockErrors := fs.Float64("mock-error-rate", 0, "share of mock provider requests failing with 503")
+	asJSON := fs.Bool("json", false, "print results as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	base, err := url.Parse(*targetURL)
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		fmt.Fprintln(os.Stderr, "Usage: askllm loadtest -target http://host:port [flags]")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var mock *mockProvider
+	if *mockAddr != "" {
+		mock = &mockProvider{latency: *mockLatency, tokens: *mockTokens, interval: *mockInterval, errorRate: *mockErrors}
+		ln, err := net.Listen("tcp", *mockAddr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error starting mock provider: %v\n", err)
+			return 2
+		}
+		srv := &http.Server{Handler: mock}
+		go srv.Serve(ln)
+		defer srv.Close()
+		log.Printf("Mock provider listening on http://%s/v1", ln.Addr())
+	}
+
+	l := &loadTester{
+		client: &http.Client{Timeout: *timeout},
+		base:   strings.TrimSuffix(base.String(), "/") + *path,
+		apiKey: *apiKey,
+		prompt: *prompt,
+		stream: *streamShare,
+	}
+	if !*asJSON {
+		log.Printf("Loading %s for %s with %d requests in flight", l.base, *duration, *concurrency)
+	}
+	results, elapsed := l.run(ctx, *duration, max(*concurrency, 1), *rate)
+	report := loadReport(results, elapsed, mock)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		printLoadReport(report)
+	}
+	if len(results) == 0 {
+		return 1
+	}
+	return 0
+}
+
+// loadTester sends the requests of a load test.
+type loadTester struct {
+	client *http.Client
+	base   string
+	apiKey string
+	prompt string
+	stream float64
+}
+
+// run sends requests until duration has passed or ctx is done, and returns
+// their results and the time it took for them to finish.
+func (l *loadTester) run(ctx context.Context, duration time.Duration, concurrency int, rate float64) ([]loadResult, time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var mu sync.Mutex
+	var results []loadResult
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	start := time.Now()
+	for ctx.Err() == nil {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				continue
+			}
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			// Requests started in time run to the end, so that the
+			// tail latency under load is counted too.
+			r := l.send(context.WithoutCancel(ctx), rand.Float64() < l.stream)
+			mu.Lock()
+			results = append(results, r)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results, time.Since(start)
+}
+
+// send makes one request, streamed or not, and reads the whole response.
+func (l *loadTester) send(ctx context.Context, stream bool) loadResult {
+	r := loadResult{stream: stream}
+	u := l.base + "?q=" + url.QueryEscape(l.prompt)
+	if stream {
+		u += "&stream=true"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return r
+	}
+	if l.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+l.apiKey)
+	}
+	start := time.Now()
+	resp, err := l.client.Do(req)
+	if err != nil {
+		r.latency = time.Since(start)
+		return r
+	}
+	defer resp.Body.Close()
+	r.status = resp.StatusCode
+	r.retryAfter = resp.Header.Get("Retry-After") != ""
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		io.Copy(io.Discard, resp.Body)
+		r.latency = time.Since(start)
+		return r
+	}
+	// A stream is complete once its done event arrives; an error event or
+	// a stream ending without one counts as interrupted.
+	done := false
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		event, ok := strings.CutPrefix(scanner.Text(), "event:")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(event) {
+		case "token":
+			if r.ttft == 0 {
+				r.ttft = time.Since(start)
+			}
+		case "done":
+			done = true
+		case "error":
+			r.interrupted = true
+		}
+	}
+	r.latency = time.Since(start)
+	r.interrupted = r.interrupted || !done || scanner.Err() != nil
+	return r
+}
+
+// loadSummary is the report of a load test.
+type loadSummary struct {
+	Requests    int            `json:"requests"`
+	Seconds     float64        `json:"seconds"`
+	Throughput  float64        `json:"requests_per_sec"`
+	Statuses    map[string]int `json:"statuses"`
+	RetryAfter  int            `json:"retry_after"`
+	LatencyMS   gin.H          `json:"latency_ms"`
+	Streams     int            `json:"streams"`
+	TTFTMS      gin.H          `json:"ttft_ms"`
+	Interrupted int            `json:"interrupted_streams"`
+	Mock        gin.H          `json:"mock_provider,omitempty"`
+}
+
+// loadReport summarizes the results of a load test. Latencies are those of
+// successful requests.
+func loadReport(results []loadResult, elapsed time.Duration, mock *mockProvider) *loadSummary {
+	s := &loadSummary{Requests: len(results), Seconds: elapsed.Seconds(), Statuses: map[string]int{}}
+	if elapsed > 0 {
+		s.Throughput = float64(len(results)) / elapsed.Seconds()
+	}
+	var latencies, ttfts []time.Duration
+	for _, r := range results {
+		status := "failed"
+		if r.status != 0 {
+			status = strconv.Itoa(r.status)
+		}
+		s.Statuses[status]++
+		if r.retryAfter {
+			s.RetryAfter++
+		}
+		if r.status == http.StatusOK {
+			latencies = append(latencies, r.latency)
+		}
+		if r.stream && r.ttft > 0 {
+			s.Streams++
+			ttfts = append(ttfts, r.ttft)
+			if r.interrupted {
+				s.Interrupted++
+			}
+		}
+	}
+	s.LatencyMS = percentiles(latencies)
+	s.TTFTMS = percentiles(ttfts)
+	if mock != nil {
+		s.Mock = gin.H{"requests": mock.requests.Load(), "errors": mock.errors.Load(), "peak_concurrency": mock.peak.Load()}
+	}
+	return s
+}
+
+func printLoadReport(s *loadSummary) {
+	fmt.Printf("%d requests in %.1fs (%.1f/s)\n\n", s.Requests, s.Seconds, s.Throughput)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tREQUESTS\tSHARE")
+	for _, status := range slices.Sorted(maps.Keys(s.Statuses)) {
+		n := s.Statuses[status]
+		fmt.Fprintf(w, "%s\t%d\t%.1f%%\n", status, n, float64(n)*100/float64(s.Requests))
+	}
+	w.Flush()
+	fmt.Printf("\nRetry-After sent: %d\n", s.RetryAfter)
+	fmt.Printf("Latency of successes: p50 %s, p90 %s, p99 %s\n", msOf(s.LatencyMS, "p50"), msOf(s.LatencyMS, "p90"), msOf(s.LatencyMS, "p99"))
+	fmt.Printf("Streams: %d, interrupted %d, time to first token p50 %s, p90 %s, p99 %s\n",
+		s.Streams, s.Interrupted, msOf(s.TTFTMS, "p50"), msOf(s.TTFTMS, "p90"), msOf(s.TTFTMS, "p99"))
+	if s.Mock != nil {
+		fmt.Printf("Mock provider: %d requests, %d failed, at most %d at once\n", s.Mock["requests"], s.Mock["errors"], s.Mock["peak_concurrency"])
+	}
+}
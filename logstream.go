@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// logStreamPing is how often an idle log stream sends a comment, so
+// proxies do not close it.
+const logStreamPing = 15 * time.Second
+
+// handleLogStream streams a "request" event with the record of every
+// request as it completes until the client disconnects. ?client= keeps
+// the requests of one client ("anonymous" for unauthenticated ones) and
+// ?status= those with a status ("429") or status class ("5xx").
+func (s *server) handleLogStream(c *gin.Context) {
+	client := c.Query("client")
+	match, ok := statusMatcher(c.Query("status"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be a status code like 429 or a class like 5xx."})
+		return
+	}
+
+	records, cancel := recentActivity.subscribe()
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	ping := time.NewTicker(logStreamPing)
+	defer ping.Stop()
+	ctx := c.Request.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ping.C:
+			c.Writer.WriteString(": ping\n\n")
+			c.Writer.Flush()
+		case r := <-records:
+			id := r.Client
+			if id == "" {
+				id = "anonymous"
+			}
+			if (client != "" && client != id) || !match(r.Status) {
+				continue
+			}
+			c.SSEvent("request", r)
+			c.Writer.Flush()
+		}
+	}
+}
+
+// statusMatcher parses a status filter: empty, a code or a class like
+// "5xx".
+func statusMatcher(filter string) (func(int) bool, bool) {
+	if filter == "" {
+		return func(int) bool { return true }, true
+	}
+	if class, ok := strings.CutSuffix(strings.ToLower(filter), "xx"); ok {
+		n, err := strconv.Atoi(class)
+		if err != nil || n < 1 || n > 5 {
+			return nil, false
+		}
+		return func(status int) bool { return status/100 == n }, true
+	}
+	code, err := strconv.Atoi(filter)
+	if err != nil || code < 100 || code > 599 {
+		return nil, false
+	}
+	return func(status int) bool { return status == code }, true
+}
@@ -1,159 +1,707 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"io"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// Message describes a single message for DeepSeek API
-type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
-}
+// server holds the state shared by all request handlers.
+type server struct {
+	cfg         *Config
+	providers   map[string]*provider
+	llm         *provider // the default provider
+	tenants     map[string]*tenant
+	store       *Store
+	clients     atomic.Pointer[clientIndex]
+	replays     *replayGuard
+	idempotency *idempotencyCache
+	secrets     *secrets
 
-// DeepSeekRequestPayload represents the request structure for Chutes DeepSeek API
-type DeepSeekRequestPayload struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Stream      bool      `json:"stream"`
-	MaxTokens   int       `json:"max_tokens"`
-	Temperature float64   `json:"temperature"`
-}
+	adminToken string
 
-// Choice describes a single response option from DeepSeek API
-type Choice struct {
-	Index        int     `json:"index"`
-	Message      Message `json:"message"`
-	FinishReason string  `json:"finish_reason"`
-}
+	experiments []*experiment
+	canaries    *canaries
+	shadow      *shadow
+	ipFilter    *ipFilter
+	geo         *geoPolicy
+	auditLog    *auditLog
+	scheduler   *scheduler
+	alerts      *alerter
 
-// UsageInfo contains token usage information
-type UsageInfo struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
-}
+	// cache holds recent answers; nil without response_cache.
+	cache *responseCache
+
+	// knowledgeBases are keyed by the routes that consult them.
+	knowledgeBases map[kbRoute]*knowledgeBase
 
-// DeepSeekResponsePayload represents the response structure from DeepSeek API
-type DeepSeekResponsePayload struct {
-	ID      string    `json:"id"`
-	Object  string    `json:"object"`
-	Created int64     `json:"created"`
-	Model   string    `json:"model"`
-	Choices []Choice  `json:"choices"`
-	Usage   UsageInfo `json:"usage"`
+	// accountAttempts limits signups and logins per client IP.
+	accountAttempts *windowLimiter
+
+	plugins []*plugin
+	hooks   *hooks
+
+	// rewrites are the compiled rewrite rules.
+	rewrites []*rewrite
+
+	// pipelineRoutes are the routes given their own pipeline.
+	pipelineRoutes map[string]bool
+
+	// openAPI describes the routes, served at /openapi.json.
+	openAPI gin.H
 }
 
 func main() {
-	// Get Chutes API token from environment variable
-	apiKey := os.Getenv("CHUTES_API_TOKEN")
-	if apiKey == "" {
-		log.Fatal("Error: CHUTES_API_TOKEN environment variable is not set.")
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
 	}
 
-	// Initialize Gin
-	router := gin.Default()
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
 
-	// Define route for root URL
-	router.GET("/", func(c *gin.Context) {
-		// Get 'q' parameter from URL query (user's prompt)
-		query := c.Query("q")
+	ctx := context.Background()
+	sc, err := newSecrets(ctx, cfg)
+	if err != nil {
+		log.Fatalf("Error configuring secrets: %v", err)
+	}
+	alerts, err := newAlerter(cfg.Alerts)
+	if err != nil {
+		log.Fatalf("Error configuring alerts: %v", err)
+	}
 
-		if query == "" {
-			c.String(http.StatusBadRequest, "Please provide a query with the 'q' parameter. Example: /?q=Hello")
-			return
+	providers, err := startProviders(ctx, cfg, sc, alerts)
+	if err != nil {
+		log.Fatalf("Error configuring providers: %v", err)
+	}
+
+	tenants := map[string]*tenant{}
+	for _, tc := range cfg.Tenants {
+		t := &tenant{cfg: tc, providers: map[string]*provider{}}
+		for name, pc := range tc.Providers {
+			p, err := startProvider(ctx, tc.ID+"/"+name, pc, cfg, sc, alerts, true)
+			if err != nil {
+				log.Fatalf("Error configuring tenant %s: %v", tc.ID, err)
+			}
+			t.providers[name] = p
+		}
+		if tc.RequestsPerMinute > 0 {
+			t.limiter = newWindowLimiter(tc.RequestsPerMinute, time.Minute)
 		}
+		tenants[tc.ID] = t
+	}
+
+	clients, err := sc.clients(ctx, cfg)
+	if err != nil {
+		log.Fatalf("Error loading clients: %v", err)
+	}
 
-		log.Printf("Received request for DeepSeek: %s", query)
+	if err := loadTemplates(cfg.Templates); err != nil {
+		log.Fatalf("Error loading templates: %v", err)
+	}
+	defaultLocale = cfg.Locale
+	if degradations, err = compileDegradations(cfg.Degradation); err != nil {
+		log.Fatalf("Error loading degradation responses: %v", err)
+	}
 
-		// Build payload for Chutes DeepSeek API request
-		payload := DeepSeekRequestPayload{
-			Model:       "deepseek-ai/DeepSeek-R1",
-			Messages:    []Message{{Role: "user", Content: query}},
-			Stream:      false,
-			MaxTokens:   1024,
-			Temperature: 0.7,
-		}
+	store, err := openStore(cfg.DataFile)
+	if err != nil {
+		log.Fatalf("Error opening data store: %v", err)
+	}
+	usageStore = store
+	if err := applyTemplateVersions(store); err != nil {
+		log.Fatalf("Error loading template versions: %v", err)
+	}
 
-		jsonPayload, err := json.Marshal(payload)
-		if err != nil {
-			log.Printf("Error marshaling JSON request for DeepSeek: %v", err)
-			c.String(http.StatusInternalServerError, "Internal server error.")
-			return
+	s := &server{
+		cfg:         cfg,
+		providers:   providers,
+		llm:         providers[cfg.DefaultProvider],
+		tenants:     tenants,
+		store:       store,
+		replays:     newReplayGuard(),
+		idempotency: newIdempotencyCache(),
+		cache:       newResponseCache(cfg.ResponseCache),
+		secrets:     sc,
+		alerts:      alerts,
+		canaries:    newCanaries(),
+
+		knowledgeBases: newKnowledgeBases(cfg),
+	}
+	s.clients.Store(newClientIndex(clients))
+	if s.plugins, err = loadPlugins(ctx, cfg.Plugins); err != nil {
+		log.Fatalf("Error loading plugins: %v", err)
+	}
+	if s.hooks, err = compileHooks(cfg.Hooks); err != nil {
+		log.Fatalf("Error compiling hooks: %v", err)
+	}
+	if s.rewrites, err = compileRewrites(cfg.Rewrites); err != nil {
+		log.Fatalf("Error compiling rewrite rules: %v", err)
+	}
+	if cfg.Accounts != nil {
+		s.accountAttempts = newWindowLimiter(accountAttemptsPerMinute, time.Minute)
+	}
+	for _, ec := range cfg.Experiments {
+		s.experiments = append(s.experiments, newExperiment(ec))
+	}
+	if ic := cfg.IPAccess; ic != nil {
+		if s.ipFilter, err = newIPFilter(ic); err != nil {
+			log.Fatalf("Error configuring ip_access: %v", err)
+		}
+	}
+	if cfg.AuditLog != "" {
+		if s.auditLog, err = openAuditLog(cfg.AuditLog); err != nil {
+			log.Fatalf("Error opening audit log: %v", err)
+		}
+	}
+	if gc := cfg.GeoIP; gc != nil {
+		if s.geo, err = newGeoPolicy(gc); err != nil {
+			log.Fatalf("Error configuring geoip: %v", err)
 		}
+	}
+	if sc := cfg.Shadow; sc != nil {
+		if s.shadow, err = newShadow(sc, providers[sc.Provider]); err != nil {
+			log.Fatalf("Error configuring shadow traffic: %v", err)
+		}
+	}
+	if s.adminToken, err = getenvSecret("ASKLLM_ADMIN_TOKEN"); err != nil {
+		log.Fatalf("Error loading admin token: %v", err)
+	}
+	dynamicKeys := slices.ContainsFunc(s.allProviders(), func(p *provider) bool { return sc.dynamic(p.cfg) })
+	if (dynamicKeys || cfg.ClientsAWS != "") && cfg.SecretsRefreshInterval.Duration > 0 {
+		go s.refreshSecrets(ctx, cfg.SecretsRefreshInterval.Duration)
+	}
+	go s.reloadOnSignal(ctx)
+	if cfg.Warmup != nil {
+		s.warmupAll(ctx)
+	}
+	go s.rollupUsage(ctx, cfg.UsageRollupInterval.Duration)
+	s.indexKnowledgeBases(ctx)
+	if rc := cfg.Retention; rc != nil {
+		go s.purgeExpired(ctx, rc)
+	}
+	if ac := cfg.Alerts; ac != nil && len(ac.Spend) > 0 {
+		go s.watchSpend(ctx, ac)
+	}
+	if len(cfg.Schedules) > 0 {
+		if s.scheduler, err = newScheduler(cfg); err != nil {
+			log.Fatalf("Error configuring schedules: %v", err)
+		}
+		if err := s.scheduler.start(ctx, s); err != nil {
+			log.Fatalf("Error starting schedules: %v", err)
+		}
+	}
+
+	// Initialize Gin
+	router := gin.New()
+	router.Use(gin.LoggerWithFormatter(accessLogFormat), gin.Recovery(), recordActivity)
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Error configuring trusted_proxies: %v", err)
+	}
+	router.Use(s.propagateTrace)
+	if s.auditLog != nil {
+		router.Use(s.audit)
+	}
+	if s.ipFilter != nil {
+		router.Use(s.filterIP)
+	}
+	if s.geo != nil {
+		router.Use(s.checkGeo)
+	}
+	if cfg.CORS != nil {
+		router.Use(s.cors)
+	}
+	if cfg.MaxBodySize > 0 {
+		router.Use(s.limitBody)
+	}
+	if s.storesCompletions() {
+		router.Use(meterUsage)
+	}
+	if cfg.Compression != nil {
+		router.Use(s.compress)
+	}
+
+	router.GET("/ready", s.handleReady)
+	router.GET("/openapi.json", s.handleOpenAPI)
 
-		// URL for Chutes DeepSeek API
-		apiUrl := "https://llm.chutes.ai/v1/chat/completions"
+	// API routes run behind the stages of their pipeline.
+	s.pipelineRoutes = map[string]bool{}
+	api := pipelineGroup{s: s, g: router.Group("/")}
 
-		// Create HTTP client
-		client := &http.Client{
-			Timeout: 60 * time.Second, // Increase timeout if LLM may respond slowly
+	// The API is versioned under /v1. The unversioned routes, including
+	// GET /?q=, predate versioning and stay as aliases of v1 so existing
+	// scripts keep working; breaking changes get a new group.
+	v1 := api.Group("/v1")
+	v1.GET("/ask", s.handleAsk)
+	v1.POST("/ask", s.handleAsk)
+	v1.POST("/chat/completions", s.handleChatCompletions)
+	s.apiRoutes(v1)
+	api.GET("/", s.handleAsk)
+	api.POST("/", s.handleAsk)
+	s.apiRoutes(api)
+	if pc := cfg.Pipeline; pc != nil {
+		for route := range pc.Routes {
+			if !s.pipelineRoutes[route] {
+				log.Fatalf("Error configuring pipeline: no API route %s", route)
+			}
 		}
+	}
+
+	if s.scheduler != nil {
+		router.GET("/feeds/:file", s.handleFeed)
+	}
+	if cfg.Permalinks {
+		router.GET("/r/:id", s.handlePermalink)
+	}
+	if cfg.ShareLinks {
+		router.GET("/s/:token", s.handleShared)
+	}
+	if cfg.Accounts != nil {
+		router.POST("/signup", s.limitAccountAttempts, validateBody, s.handleSignup)
+		router.POST("/login", s.limitAccountAttempts, validateBody, s.handleLogin)
+	}
 
-		// Create HTTP request
-		req, err := http.NewRequest("POST", apiUrl, bytes.NewBuffer(jsonPayload))
+	if s.adminEnabled() {
+		router.GET("/admin/dashboard", s.handleDashboard)
+	}
+
+	admin := router.Group("/admin", s.requireAdmin, validateBody)
+	admin.PUT("/providers/:name/key", s.handleSetProviderKey)
+	admin.POST("/reload", s.handleReload)
+	admin.GET("/experiments", s.handleListExperiments)
+	admin.GET("/templates", s.handleListTemplates)
+	admin.GET("/templates/:name/versions", s.handleListTemplateVersions)
+	admin.POST("/templates/:name/versions", s.handlePublishTemplate)
+	admin.POST("/templates/:name/rollback", s.handleRollbackTemplate)
+	admin.GET("/canaries", s.handleListCanaries)
+	admin.PUT("/templates/:name/canary", s.handleStartCanary)
+	admin.POST("/templates/:name/canary/promote", s.handlePromoteCanary)
+	admin.DELETE("/templates/:name/canary", s.handleStopCanary)
+	admin.DELETE("/users/:id/data", s.handleDeleteUserData)
+	admin.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	admin.GET("/dashboard/data", s.handleDashboardData)
+	admin.GET("/logs/stream", s.handleLogStream)
+	admin.GET("/usage", s.handleListUsage)
+	admin.GET("/usage/export", s.handleExportUsage)
+	if cfg.Accounts != nil {
+		admin.GET("/accounts", s.handleAdminListAccounts)
+		admin.POST("/accounts", s.handleAdminCreateAccount)
+		admin.PATCH("/accounts/:id", s.handleAdminUpdateAccount)
+		admin.DELETE("/accounts/:id", s.handleAdminDeleteAccount)
+	}
+	if s.scheduler != nil {
+		admin.GET("/schedules", s.handleListSchedules)
+		admin.GET("/schedules/:name/runs", s.handleScheduleRuns)
+		admin.POST("/schedules/:name/run", s.handleRunSchedule)
+	}
+	if s.alerts != nil {
+		admin.POST("/alerts/test", s.handleTestAlert)
+	}
+	if s.auditLog != nil {
+		admin.GET("/audit", s.handleExportAudit)
+		admin.GET("/audit/verify", s.handleVerifyAudit)
+	}
+
+	s.openAPI = buildOpenAPI(router.Routes())
+	if err := s.serve(router); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+}
+
+// startProviders starts the configured providers, keyed by name.
+func startProviders(ctx context.Context, cfg *Config, sc *secrets, alerts *alerter) (map[string]*provider, error) {
+	providers := map[string]*provider{}
+	for name, pc := range cfg.Providers {
+		p, err := startProvider(ctx, name, pc, cfg, sc, alerts, name == cfg.DefaultProvider)
 		if err != nil {
-			log.Printf("Error creating HTTP request for DeepSeek: %v", err)
-			c.String(http.StatusInternalServerError, "Internal server error.")
+			return nil, err
+		}
+		providers[name] = p
+	}
+	return providers, nil
+}
+
+// startProvider resolves the API key of a provider, creates it and starts
+// its health checks. A provider that must have a key fails without one.
+func startProvider(ctx context.Context, name string, pc *ProviderConfig, cfg *Config, sc *secrets, alerts *alerter, needKey bool) (*provider, error) {
+	// Get the provider's API token from its environment variable or secret store
+	apiKey, err := sc.providerKey(ctx, pc)
+	if err != nil {
+		return nil, fmt.Errorf("loading API key for provider %s: %w", name, err)
+	}
+	if apiKey == "" && needKey {
+		return nil, fmt.Errorf("provider %s: %s environment variable is not set (or %s_FILE)", name, pc.APIKeyEnv, pc.APIKeyEnv)
+	}
+
+	p, err := newProvider(name, pc, cfg, apiKey)
+	if err != nil {
+		return nil, err
+	}
+	p.alerts = alerts
+	if pc.HealthCheckInterval.Duration > 0 {
+		go p.healthCheck(ctx, pc.HealthCheckInterval.Duration)
+	}
+	return p, nil
+}
+
+// apiRoutes registers the routes every API version shares on g.
+func (s *server) apiRoutes(g pipelineGroup) {
+	g.GET("/as/:persona", s.handleAsPersona)
+	s.personaRoutes(g)
+	g.POST("/summarize", s.handleSummarize)
+	g.POST("/chat", forbidReadOnly, s.handleChat)
+	g.GET("/sessions", s.handleListSessions)
+	g.GET("/sessions/:id", s.handleGetSession)
+	g.PATCH("/sessions/:id", forbidReadOnly, s.handleUpdateSession)
+	g.GET("/sessions/:id/stream", s.handleSessionStream)
+	if s.cfg.ShareLinks {
+		shares := g.Group("/sessions/:id/shares", requireClient)
+		shares.POST("", forbidReadOnly, s.handleCreateShare)
+		shares.GET("", s.handleListShares)
+		shares.DELETE("/:token", forbidReadOnly, s.handleRevokeShare)
+	}
+	g.GET("/labels", s.handleListLabels)
+	if s.storesCompletions() {
+		g.GET("/completions/:id", s.handleGetCompletion)
+	}
+	g.GET("/search", s.handleSearch)
+	g.POST("/compare", s.handleCompare)
+	g.GET("/status", s.handleStatus)
+	g.POST("/experiments/:name/feedback", s.handleExperimentFeedback)
+	g.POST("/templates/:name/feedback", s.handleCanaryFeedback)
+	g.GET("/usage", requireClient, s.handleUsage)
+	g.DELETE("/me/data", forbidReadOnly, s.handleDeleteMyData)
+	if s.cfg.Workspaces {
+		ws := g.Group("/workspaces", requireClient)
+		ws.POST("", forbidReadOnly, s.handleCreateWorkspace)
+		ws.GET("", s.handleListWorkspaces)
+		ws.GET("/:id", s.handleGetWorkspace)
+		ws.DELETE("/:id", forbidReadOnly, s.handleDeleteWorkspace)
+		ws.PUT("/:id/members/:member", forbidReadOnly, s.handleSetWorkspaceMember)
+		ws.DELETE("/:id/members/:member", forbidReadOnly, s.handleRemoveWorkspaceMember)
+		ws.GET("/:id/templates", s.handleListWorkspaceTemplates)
+		ws.PUT("/:id/templates/:name", forbidReadOnly, s.handleSetWorkspaceTemplate)
+		ws.DELETE("/:id/templates/:name", forbidReadOnly, s.handleDeleteWorkspaceTemplate)
+	}
+	if s.cfg.Accounts != nil {
+		account := g.Group("/account", requireAccount)
+		account.GET("", s.handleGetAccount)
+		account.POST("/keys", forbidReadOnly, s.handleCreateAccountKey)
+		account.DELETE("/keys/:id", forbidReadOnly, s.handleDeleteAccountKey)
+		account.GET("/usage", s.handleAccountUsage)
+	}
+	if s.cfg.UserMemory != nil {
+		g.GET("/me/memory", s.handleGetMemory)
+		g.PUT("/me/memory", forbidReadOnly, s.handleSetMemory)
+		g.DELETE("/me/memory", forbidReadOnly, s.handleDeleteMemories)
+		g.DELETE("/me/memory/:id", forbidReadOnly, s.handleDeleteMemories)
+	}
+}
+
+// unversioned returns the unversioned route of an API route, so settings
+// and schemas keyed by it ("/chat") apply to every version. GET /v1/ask
+// is "/"; the OpenAI-compatible route keeps its path, which has always
+// been versioned.
+func unversioned(route string) string {
+	if route == "/v1/chat/completions" {
+		return route
+	}
+	rest, ok := strings.CutPrefix(route, "/v1/")
+	if !ok {
+		return route
+	}
+	if rest == "ask" {
+		return "/"
+	}
+	return "/" + rest
+}
+
+// serve runs the HTTP server on the configured address, over TLS when
+// listen_tls is set.
+func (s *server) serve(handler http.Handler) error {
+	srv := &http.Server{Addr: s.cfg.Listen, Handler: handler}
+
+	lc := s.cfg.ListenTLS
+	if lc == nil {
+		log.Printf("AskLLM.io (DeepSeek) server started on %s", s.cfg.Listen)
+		return srv.ListenAndServe()
+	}
+
+	tlsConfig, err := lc.serverTLSConfig()
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = tlsConfig
+	log.Printf("AskLLM.io (DeepSeek) server started on %s (TLS)", s.cfg.Listen)
+	return srv.ListenAndServeTLS(lc.CertFile, lc.KeyFile)
+}
+
+// askContextKey holds the askRequest of a POST to the ask route.
+const askContextKey = "askllm.ask"
+
+// askRequest holds the parameters of a POST to the ask route, from a form
+// or JSON body, so long prompts need not fit in the URL. Parameters the
+// body leaves out are taken from the query.
+type askRequest struct {
+	Q      string `form:"q" json:"q"`
+	Model  string `form:"model" json:"model"`
+	Stream bool   `form:"stream" json:"stream"`
+}
+
+// handleAsk forwards the 'q' parameter (or an alias of it) to DeepSeek and returns the plain text answer.
+func (s *server) handleAsk(c *gin.Context) {
+	// Get 'q' parameter (or an alias) from URL query (user's prompt), or from the body of a POST
+	query, model := queryPrompt(c), c.Query("model")
+	if c.Request.Method == http.MethodPost {
+		req, ok := bindAsk(c)
+		if !ok {
 			return
 		}
-		req.Header.Set("Content-Type", "application/json")
-		// Add Authorization header with your API key
-		req.Header.Set("Authorization", "Bearer "+apiKey)
+		query, model = req.Q, req.Model
+	}
 
-		// Send request to DeepSeek API
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Printf("Error sending request to DeepSeek API: %v", err)
-			c.String(http.StatusInternalServerError, "Failed to contact DeepSeek LLM. Please try again later.")
+	if query == "" {
+		respondMissingPrompt(c, c.Request.URL.Path)
+		return
+	}
+
+	log.Printf("Received request for DeepSeek: %s", query)
+
+	messages := []Message{{Role: "user", Content: query}}
+	canned, note := s.consultKnowledgeBase(c, query)
+	if canned != "" {
+		if wantsStream(c) {
+			streamCanned(c, canned)
+			c.SSEvent("done", gin.H{})
+			c.Writer.Flush()
 			return
 		}
-		defer resp.Body.Close() // Close response body after use
+		c.String(http.StatusOK, canned)
+		return
+	}
+	if note != nil {
+		messages = append([]Message{*note}, messages...)
+	}
+	tgt, err := s.targetFor(c, routeRequest{Model: model, Messages: messages})
+	if err != nil {
+		respondUpstreamError(c, err)
+		return
+	}
+	payload := newPayload(messages)
+	tgt.prepare(&payload)
+	s.respondAnswer(c, tgt, payload)
+}
 
-		// Read response body
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Printf("Error reading response body from DeepSeek API: %v", err)
-			c.String(http.StatusInternalServerError, "Internal server error.")
+// respondAnswer sends payload to tgt and writes the answer as plain text, or
+// as SSE with the stream query parameter. With response_cache, plain text
+// answers are served from the cache when possible and carry an ETag, so a
+// client polling with If-None-Match gets 304 while the answer is unchanged.
+func (s *server) respondAnswer(c *gin.Context, tgt target, payload DeepSeekRequestPayload) {
+	if wantsStream(c) {
+		s.streamAnswer(c, tgt, payload)
+		return
+	}
+
+	key := ""
+	useCache := s.cache != nil && cacheEnabled(c)
+	if useCache {
+		key = cacheKey(tgt.provider, payload)
+		if cached, ok := s.cache.get(key); ok {
+			c.Header("X-Cache", "hit")
+			respondCached(c, cached)
 			return
 		}
+	}
+
+	if useCache && !tgt.provider.available() && s.respondStale(c, tgt, key) {
+		return
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("Error from DeepSeek API. Status: %d, Body: %s", resp.StatusCode, string(body))
-			c.String(http.StatusInternalServerError, "Error from DeepSeek LLM. Please try again later.")
+	start := time.Now()
+	llmText, usage, err := tgt.provider.completeUsage(c.Request.Context(), payload)
+	tgt.experiment.observe(time.Since(start), llmText, err)
+	if err != nil {
+		if useCache && providerFault(err) && s.respondStale(c, tgt, key) {
 			return
 		}
+		respondUpstreamError(c, err)
+		return
+	}
 
-		// Decode JSON response from DeepSeek API
-		var deepseekResponse DeepSeekResponsePayload
-		err = json.Unmarshal(body, &deepseekResponse)
-		if err != nil {
-			log.Printf("Error decoding JSON response from DeepSeek API: %v", err)
-			c.String(http.StatusInternalServerError, "Internal server error: invalid response format from DeepSeek LLM.")
+	s.shadow.mirror(tgt, payload, llmText, time.Since(start))
+	if usage.TotalTokens == 0 {
+		usage = estimateUsage(payload.Messages, llmText)
+	}
+	setCostHeader(c, tgt, usage)
+	llmText = tgt.rewriteText(rewriteCompletion, llmText)
+
+	log.Printf("DeepSeek LLM response: %s", llmText)
+	cp := s.newCompletion(c, tgt, askedPrompt(c))
+	s.shareCompletion(c, cp)
+	s.announceCompletion(c, cp)
+	s.saveCompletion(c, cp, llmText, start)
+	if useCache {
+		c.Header("X-Cache", "miss")
+		respondCached(c, s.cache.put(key, llmText))
+		return
+	}
+	c.String(http.StatusOK, llmText) // Send plain response text to user
+}
+
+// bindAsk reads the askRequest of a POST to the ask route from its form or
+// JSON body. It writes the error response and reports false if it cannot.
+func bindAsk(c *gin.Context) (*askRequest, bool) {
+	req := &askRequest{}
+	switch c.ContentType() {
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		// The form binding also reads the query.
+		if err := c.ShouldBindWith(req, binding.Form); err != nil {
+			c.String(http.StatusBadRequest, "Invalid form body: %v", err)
+			return nil, false
+		}
+	case "application/json", "":
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(req); err != nil {
+				c.String(http.StatusBadRequest, "Invalid JSON body: %v", err)
+				return nil, false
+			}
+		}
+		req.Model = cmp.Or(req.Model, c.Query("model"))
+		if !req.Stream {
+			req.Stream, _ = strconv.ParseBool(c.Query("stream"))
+		}
+	default:
+		c.String(http.StatusUnsupportedMediaType, "Send the prompt as a form or JSON body with a 'q' field.")
+		return nil, false
+	}
+	req.Q = cmp.Or(req.Q, queryPrompt(c))
+	c.Set(askContextKey, req)
+	return req, true
+}
+
+// wantsStream reports whether the caller asked for SSE with the stream
+// parameter, in the query or the body of a POST to the ask route.
+func wantsStream(c *gin.Context) bool {
+	if req, ok := c.Get(askContextKey); ok {
+		return req.(*askRequest).Stream
+	}
+	stream, _ := strconv.ParseBool(c.Query("stream"))
+	return stream
+}
+
+// askedPrompt returns the prompt of a plain text request as the caller
+// sent it.
+func askedPrompt(c *gin.Context) string {
+	if req, ok := c.Get(askContextKey); ok {
+		return req.(*askRequest).Q
+	}
+	return queryPrompt(c)
+}
+
+// respondStale writes the answer cached under key, even if it expired,
+// when the provider of tgt cannot answer. It reports whether there was one.
+func (s *server) respondStale(c *gin.Context, tgt target, key string) bool {
+	cached, ok := s.cache.getStale(key)
+	if !ok {
+		return false
+	}
+	log.Printf("Provider %s failed, serving a cached answer from %s", tgt.provider.name, cached.stored.Format(time.RFC3339))
+	auditNote(c, "provider %s failed, served cached answer", tgt.provider.name)
+	c.Header("X-Cache", "stale")
+	c.Header("Age", strconv.Itoa(int(time.Since(cached.stored).Seconds())))
+	respondCached(c, cached)
+	return true
+}
+
+// respondCached writes a cached answer with its ETag, or 304 when the
+// client's If-None-Match already names it.
+func respondCached(c *gin.Context, a *cachedAnswer) {
+	c.Header("ETag", a.etag)
+	for _, tag := range strings.Split(c.GetHeader("If-None-Match"), ",") {
+		if tag = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(tag), "W/")); tag == a.etag || tag == "*" {
+			c.Status(http.StatusNotModified)
 			return
 		}
+	}
+	c.String(http.StatusOK, a.answer)
+}
+
+// respondUpstreamError logs err and writes the matching user-facing message
+// with the error's code in the X-Error-Code header.
+func respondUpstreamError(c *gin.Context, err error) {
+	code, status := classifyError(err)
+	c.Header("X-Error-Code", code)
 
-		// Extract response text
-		if len(deepseekResponse.Choices) > 0 && deepseekResponse.Choices[0].Message.Content != "" {
-			llmText := deepseekResponse.Choices[0].Message.Content
-			log.Printf("DeepSeek LLM response: %s", llmText)
-			c.String(http.StatusOK, llmText) // Send plain response text to user
-		} else {
-			log.Println("DeepSeek LLM did not provide a text response.")
-			c.String(http.StatusOK, "DeepSeek LLM could not generate a response to your query.")
+	var message string
+	retryAfter := 0
+	switch code {
+	case codeRateLimited:
+		log.Printf("DeepSeek API rate limit reached: %v", err)
+		message = localize(c, "rate_limited")
+		var statusErr *statusError
+		if errors.As(err, &statusErr) && !statusErr.RetryAt.IsZero() {
+			// Pass on the wait that remains, not the one the upstream announced.
+			retryAfter = int(math.Ceil(max(time.Until(statusErr.RetryAt), 0).Seconds()))
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			message = localize(c, "rate_limited_retry", retryAfter)
 		}
-	})
+	case codeNotAllowed:
+		message = localize(c, "not_allowed", err)
+	case codeOverloaded:
+		log.Printf("Provider overloaded: %v", err)
+		c.Header("Retry-After", overloadRetryAfter(err))
+		retryAfter, _ = strconv.Atoi(overloadRetryAfter(err))
+		message = localize(c, "overloaded")
+	case codeQuotaExceeded:
+		log.Printf("DeepSeek API quota exhausted: %v", err)
+		message = localize(c, "quota_exceeded")
+	case codeUpstreamAuth:
+		log.Printf("DeepSeek API rejected the server's credentials: %v", err)
+		message = localize(c, "upstream_auth")
+	case codeContextTooLong:
+		log.Printf("DeepSeek API rejected an over-long prompt: %v", err)
+		message = localize(c, "context_too_long")
+	case codeContentFiltered:
+		log.Printf("DeepSeek API content filter triggered: %v", err)
+		message = localize(c, "content_filtered")
+	case codeUpstreamTimeout:
+		log.Printf("DeepSeek API timed out: %v", err)
+		message = localize(c, "upstream_timeout")
+	case codeEmptyCompletion:
+		log.Println("DeepSeek LLM did not provide a text response.")
+		message = localize(c, "empty_completion")
+	case codeUpstreamUnreachable:
+		log.Printf("Error sending request to DeepSeek API: %v", err)
+		message = localize(c, "upstream_unreachable")
+	case codeUpstreamError:
+		log.Printf("Error from DeepSeek API: %v", err)
+		message = localize(c, "upstream_error")
+	case codeUpstreamBadResponse:
+		log.Printf("Error decoding JSON response from DeepSeek API: %v", err)
+		message = localize(c, "upstream_bad_response")
+	default:
+		log.Printf("Error handling DeepSeek request: %v", err)
+		message = localize(c, "internal_error")
+	}
 
-	// Start server on port 8080
-	log.Println("AskLLM.io (DeepSeek) server started on port :8080")
-	if err := router.Run(":8080"); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	if d := degradationFor(code); d != nil {
+		d.respond(c, code, status, retryAfter, message)
+		return
 	}
+	c.String(status, message)
 }
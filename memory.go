@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+)
+
+// Defaults for session summarization.
+const (
+	defaultSummaryThreshold     = 0.75
+	defaultSummaryKeepTurns     = 4
+	defaultSummaryContextWindow = 8192
+)
+
+func init() {
+	registerTemplate(newTemplate("session-summary",
+		"You condense conversations into compact notes for an assistant continuing them. Keep facts, names, numbers, decisions, open questions and the user's preferences. Reply with the notes only.",
+		`{{if .Summary}}Notes on the conversation so far:
+{{.Summary}}
+
+{{end}}Continue the notes with these later messages:
+{{range .Messages}}
+{{.Role}}: {{.Content}}
+{{end}}`,
+		512, 0.2))
+}
+
+// sessionContext returns the messages to send for sess followed by next:
+// the session's summary, if any, in place of the turns it covers, then the
+// remaining turns verbatim. With session_summary configured, older turns
+// are first folded into the summary when the conversation nears the
+// model's context window. Summarization failures are logged and the
+// conversation is sent as it is. With session_window instead, only the
+// last session_window exchanges are sent.
+func (s *server) sessionContext(ctx context.Context, tgt target, sess *Session, next Message) []Message {
+	if n := s.cfg.SessionWindow; n > 0 {
+		start := max(len(sess.Messages)-2*n, 0)
+		return append(slices.Clone(sess.Messages[start:]), next)
+	}
+	if sc := s.cfg.SessionSummary; sc != nil {
+		if err := s.summarizeSession(ctx, tgt, sess, next, sc); err != nil {
+			log.Printf("Error summarizing session %s: %v", sess.ID, err)
+		}
+	}
+
+	var messages []Message
+	if sess.Summary != "" {
+		messages = append(messages, summaryNote(sess.Summary))
+	}
+	messages = append(messages, sess.Messages[sess.Summarized:]...)
+	return append(messages, next)
+}
+
+// summaryNote is the system message standing in for summarized turns.
+func summaryNote(summary string) Message {
+	return Message{Role: "system", Content: "Summary of the earlier conversation:\n" + summary}
+}
+
+// summarizeSession folds all but the last keep_turns exchanges of sess
+// into its summary, storing it, when the conversation with next would take
+// up more than the threshold share of the context window.
+func (s *server) summarizeSession(ctx context.Context, tgt target, sess *Session, next Message, sc *SessionSummaryConfig) error {
+	window := tgt.contextWindow
+	if window <= 0 {
+		window = sc.ContextWindow
+	}
+	completion := defaultMaxTokens
+	if tgt.maxTokens > 0 {
+		completion = min(completion, tgt.maxTokens)
+	}
+	tokens := estimateTokens(next.Content) + completion
+	if sess.Summary != "" {
+		tokens += estimateTokens(summaryNote(sess.Summary).Content)
+	}
+	for _, m := range sess.Messages[sess.Summarized:] {
+		tokens += estimateTokens(m.Content)
+	}
+	cut := len(sess.Messages) - 2*sc.KeepTurns
+	if float64(tokens) <= sc.Threshold*float64(window) || cut <= sess.Summarized {
+		return nil
+	}
+
+	payload, err := lookupTemplate("session-summary").Payload(struct {
+		Summary  string
+		Messages []Message
+	}{sess.Summary, sess.Messages[sess.Summarized:cut]}, window)
+	if err != nil {
+		return err
+	}
+	tgt.wrapper = nil
+	tgt.prepare(&payload)
+	if sc.Model != "" {
+		payload.Model = sc.Model
+	}
+	summary, err := tgt.provider.complete(ctx, payload)
+	if err != nil {
+		return err
+	}
+	if summary = stripReasoning(summary); summary == "" {
+		return errEmptyCompletion
+	}
+	if err := s.store.SetSummary(sess.ID, summary, cut); err != nil {
+		return err
+	}
+	log.Printf("Summarized %d messages of session %s", cut-sess.Summarized, sess.ID)
+	sess.Summary, sess.Summarized = summary, cut
+	return nil
+}
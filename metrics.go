@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus metrics, served at GET /admin/metrics.
+var (
+	retentionPurged = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "askllm_retention_purged_total",
+		Help: "Stored records deleted by the retention janitor.",
+	}, []string{"kind"})
+
+	tokensTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "askllm_tokens_total",
+		Help: "Tokens spent upstream, as reported by the provider or estimated.",
+	}, []string{"provider", "model", "client", "type"})
+
+	requestTokens = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "askllm_request_tokens",
+		Help:    "Tokens per upstream request.",
+		Buckets: prometheus.ExponentialBuckets(16, 4, 7),
+	}, []string{"provider", "model", "type"})
+
+	dedupedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "askllm_deduplicated_requests_total",
+		Help: "Completions answered by sharing an identical in-flight upstream request.",
+	}, []string{"provider"})
+
+	poolActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "askllm_provider_active_requests",
+		Help: "Upstream requests holding a slot of the provider's pool.",
+	}, []string{"provider"})
+
+	poolQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "askllm_provider_queued_requests",
+		Help: "Requests waiting for a slot of the provider's pool.",
+	}, []string{"provider"})
+
+	shedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "askllm_shed_requests_total",
+		Help: "Requests rejected by load shedding.",
+	}, []string{"provider", "priority"})
+
+	upstreamLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "askllm_upstream_latency_seconds",
+		Help:    "Duration of successful upstream requests, to the end of the answer.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"provider", "model"})
+
+	timeToFirstToken = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "askllm_time_to_first_token_seconds",
+		Help:    "Time from sending a streamed upstream request to its first token.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"provider", "model"})
+
+	generationSpeed = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "askllm_tokens_per_second",
+		Help:    "Completion tokens generated per second by successful upstream requests, after the first token for streams.",
+		Buckets: prometheus.ExponentialBuckets(5, 2, 8),
+	}, []string{"provider", "model"})
+)
+
+func init() {
+	prometheus.MustRegister(retentionPurged, tokensTotal, requestTokens, dedupedRequests, poolActive, poolQueued, shedRequests, upstreamLatency, timeToFirstToken, generationSpeed)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxCompatBody caps the JSON body accepted by the compatible endpoint.
+const maxCompatBody = 4 << 20
+
+// openAIError writes an error in the shape OpenAI SDKs expect.
+func openAIError(c *gin.Context, status int, errType, message string) {
+	c.JSON(status, gin.H{"error": gin.H{"message": message, "type": errType}})
+}
+
+// handleChatCompletions is an OpenAI-compatible /v1/chat/completions
+// endpoint. The request body is forwarded unchanged apart from filling in a
+// default model, and the upstream response is relayed as is, apart from
+// completion rewrites of non-streamed responses. With
+// "stream": true the upstream SSE chunks are copied to the client verbatim
+// as they arrive, including the final usage chunk and the [DONE] marker, so
+// SDK streaming iterators work unmodified.
+func (s *server) handleChatCompletions(c *gin.Context) {
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxCompatBody))
+	if err != nil {
+		openAIError(c, http.StatusBadRequest, "invalid_request_error", "Could not read request body.")
+		return
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		openAIError(c, http.StatusBadRequest, "invalid_request_error", "Request body must be a JSON object.")
+		return
+	}
+	if _, ok := fields["messages"]; !ok {
+		openAIError(c, http.StatusBadRequest, "invalid_request_error", "Missing required parameter: 'messages'.")
+		return
+	}
+	var route routeRequest
+	if raw, ok := fields["model"]; ok {
+		json.Unmarshal(raw, &route.Model)
+	}
+	if raw, ok := fields["max_tokens"]; ok {
+		json.Unmarshal(raw, &route.MaxTokens)
+	}
+	_, route.NeedsTools = fields["tools"]
+	route.Messages, route.NeedsVision = inspectMessages(fields["messages"])
+	tgt, err := s.targetFor(c, route)
+	if err != nil {
+		code, status := classifyError(err)
+		c.Header("X-Error-Code", code)
+		openAIError(c, status, "invalid_request_error", "The request cannot be routed: "+err.Error()+".")
+		return
+	}
+	changed := tgt.prepareRaw(fields)
+	if s.fitRawContext(tgt, fields, route.Messages) || changed {
+		body, _ = json.Marshal(fields)
+	}
+
+	var stream bool
+	if raw, ok := fields["stream"]; ok {
+		json.Unmarshal(raw, &stream)
+	}
+
+	client := tgt.provider.completeClient
+	if stream {
+		client = tgt.provider.streamClient
+	}
+
+	start := time.Now()
+	resp, err := tgt.provider.do(c.Request.Context(), client, body, nil)
+	if err != nil {
+		observeLatency(c.Request.Context(), tgt.provider.name, tgt.model, 0, time.Since(start), err)
+		if c.Request.Context().Err() != nil {
+			log.Printf("Client disconnected before DeepSeek API responded")
+			return
+		}
+		log.Printf("Error sending request to DeepSeek API: %v", err)
+		code, status := classifyError(err)
+		c.Header("X-Error-Code", code)
+		if code == codeOverloaded {
+			c.Header("Retry-After", overloadRetryAfter(err))
+		}
+		openAIError(c, status, "upstream_error", "Failed to contact DeepSeek LLM. Please try again later.")
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range []string{"Content-Type", "Cache-Control", "Retry-After"} {
+		if v := resp.Header.Get(h); v != "" {
+			c.Header(h, v)
+		}
+	}
+	if stream {
+		c.Header("X-Accel-Buffering", "no")
+	}
+	var cp *Completion
+	var relayed bytes.Buffer
+	if resp.StatusCode < http.StatusBadRequest {
+		cp = s.newCompletion(c, tgt, lastUserText(route.Messages))
+		s.announceCompletion(c, cp)
+	}
+	c.Status(resp.StatusCode)
+
+	// The relayed body is kept for the usage it reports and the answer.
+	src := &firstReadReader{Reader: resp.Body}
+	if !stream && resp.StatusCode < http.StatusBadRequest && tgt.hasRewrites(rewriteCompletion) {
+		var raw []byte
+		if raw, err = io.ReadAll(src); err == nil {
+			raw = tgt.rewriteRawCompletion(raw)
+			relayed.Write(raw)
+			_, err = c.Writer.Write(raw)
+		}
+	} else {
+		_, err = relay(c.Writer, io.TeeReader(src, &relayed))
+	}
+	if err != nil && c.Request.Context().Err() == nil {
+		log.Printf("Error relaying response from DeepSeek API: %v", err)
+	}
+	if err == nil && resp.StatusCode >= http.StatusBadRequest {
+		err = errUpstreamStatus
+	}
+	var ttft time.Duration
+	if stream && !src.at.IsZero() {
+		ttft = src.at.Sub(start)
+	}
+	elapsed := time.Since(start)
+	observeLatency(c.Request.Context(), tgt.provider.name, tgt.model, ttft, elapsed, err)
+
+	// Count the usage the upstream reported, or else estimate it from the
+	// answer.
+	answer, usage := rawCompletion(relayed.Bytes(), stream)
+	if usage.TotalTokens == 0 {
+		usage = estimateUsage(route.Messages, answer)
+	}
+	countUsage(c.Request.Context(), tgt.provider.name, tgt.model, usage)
+	if err == nil {
+		observeThroughput(c.Request.Context(), tgt.provider.name, tgt.model, usage.CompletionTokens, ttft, elapsed)
+	}
+
+	if cp != nil && err == nil {
+		cp.Usage = usage
+		cp.Stream = stream
+		cp.TTFTMS = ttft.Milliseconds()
+		s.saveCompletion(c, cp, answer, start)
+	}
+}
+
+// rawCompletion extracts the answer and reported usage of a relayed
+// OpenAI-format response body, or of its SSE chunks when streamed.
+func rawCompletion(body []byte, stream bool) (answer string, usage UsageInfo) {
+	if !stream {
+		var resp DeepSeekResponsePayload
+		if json.Unmarshal(body, &resp) == nil && len(resp.Choices) > 0 {
+			answer = resp.Choices[0].Message.Content
+		}
+		return answer, resp.Usage
+	}
+	var b strings.Builder
+	for _, line := range strings.Split(string(body), "\n") {
+		data, ok := strings.CutPrefix(line, "data:")
+		if !ok {
+			continue
+		}
+		var chunk StreamChunk
+		if json.Unmarshal([]byte(strings.TrimSpace(data)), &chunk) != nil {
+			continue
+		}
+		if chunk.Usage != nil {
+			usage = *chunk.Usage
+		}
+		if len(chunk.Choices) > 0 {
+			b.WriteString(chunk.Choices[0].Delta.Content)
+		}
+	}
+	return b.String(), usage
+}
+
+// lastUserText returns the content of the last user message.
+func lastUserText(messages []Message) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return messages[i].Content
+		}
+	}
+	return ""
+}
+
+// inspectMessages extracts the text of OpenAI-format messages, whose
+// content is either a string or an array of parts, and reports whether any
+// part is an image.
+func inspectMessages(raw json.RawMessage) (messages []Message, hasImage bool) {
+	var parsed []struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	}
+	json.Unmarshal(raw, &parsed)
+
+	for _, m := range parsed {
+		var text string
+		if err := json.Unmarshal(m.Content, &text); err != nil {
+			var parts []struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			}
+			json.Unmarshal(m.Content, &parts)
+			var texts []string
+			for _, part := range parts {
+				switch part.Type {
+				case "text":
+					texts = append(texts, part.Text)
+				case "image_url", "input_image":
+					hasImage = true
+				}
+			}
+			text = strings.Join(texts, "\n")
+		}
+		messages = append(messages, Message{Role: m.Role, Content: text})
+	}
+	return messages, hasImage
+}
+
+// prepareRaw is prepare for a request body forwarded as is: it sets the
+// target's model, which differs from the requested one for aliases and
+// defaults, applies its max_tokens cap and wraps and rewrites the last user
+// message. It reports whether fields changed.
+func (tgt target) prepareRaw(fields map[string]json.RawMessage) bool {
+	changed := false
+	if tgt.wrapper != nil {
+		if messages, ok := wrapRawMessages(fields["messages"], tgt.wrapper); ok {
+			fields["messages"] = messages
+			changed = true
+		}
+	}
+	if tgt.hasRewrites(rewritePrompt) {
+		if messages, ok := rewriteRawMessages(fields["messages"], tgt); ok {
+			fields["messages"] = messages
+			changed = true
+		}
+	}
+	if model, _ := json.Marshal(tgt.model); string(fields["model"]) != string(model) {
+		fields["model"] = model
+		changed = true
+	}
+	if tgt.maxTokens > 0 {
+		var requested int
+		if raw, ok := fields["max_tokens"]; ok {
+			json.Unmarshal(raw, &requested)
+		}
+		if requested <= 0 || requested > tgt.maxTokens {
+			fields["max_tokens"], _ = json.Marshal(tgt.maxTokens)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// wrapRawMessages wraps the last user message of OpenAI-format messages:
+// string content directly, content parts by adding text parts around them.
+func wrapRawMessages(raw json.RawMessage, w *PromptWrapper) (json.RawMessage, bool) {
+	var messages []map[string]json.RawMessage
+	if json.Unmarshal(raw, &messages) != nil {
+		return nil, false
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		var role string
+		if json.Unmarshal(messages[i]["role"], &role); role != "user" {
+			continue
+		}
+		var text string
+		if err := json.Unmarshal(messages[i]["content"], &text); err == nil {
+			messages[i]["content"], _ = json.Marshal(w.wrap(text))
+		} else {
+			var parts []json.RawMessage
+			if json.Unmarshal(messages[i]["content"], &parts) != nil {
+				return nil, false
+			}
+			textPart := func(s string) json.RawMessage {
+				part, _ := json.Marshal(map[string]string{"type": "text", "text": s})
+				return part
+			}
+			if w.Prefix != "" {
+				parts = append([]json.RawMessage{textPart(w.Prefix)}, parts...)
+			}
+			if w.Suffix != "" {
+				parts = append(parts, textPart(w.Suffix))
+			}
+			messages[i]["content"], _ = json.Marshal(parts)
+		}
+		wrapped, err := json.Marshal(messages)
+		return wrapped, err == nil
+	}
+	return nil, false
+}
+
+// firstReadReader notes when the first bytes were read from Reader.
+type firstReadReader struct {
+	io.Reader
+	at time.Time
+}
+
+func (r *firstReadReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 && r.at.IsZero() {
+		r.at = time.Now()
+	}
+	return n, err
+}
+
+// relay copies src to the client, flushing after every read so streamed
+// chunks are delivered without buffering, and returns the bytes copied.
+func relay(w gin.ResponseWriter, src io.Reader) (written int64, err error) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+			w.Flush()
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
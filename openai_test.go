@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestRawCompletionStream(t *testing.T) {
+	body := "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hel\"}}]}\n\n" +
+		"data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"lo\"}}]}\n\n" +
+		"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":5,\"completion_tokens\":2,\"total_tokens\":7}}\n\n" +
+		"data: [DONE]\n\n"
+	answer, usage := rawCompletion([]byte(body), true)
+	if answer != "Hello" {
+		t.Errorf("answer = %q, want Hello", answer)
+	}
+	if usage != (UsageInfo{PromptTokens: 5, CompletionTokens: 2, TotalTokens: 7}) {
+		t.Errorf("usage = %+v, want the reported usage", usage)
+	}
+}
+
+func TestRawCompletionWithoutUsage(t *testing.T) {
+	body := `{"choices":[{"message":{"role":"assistant","content":"Hello there"}}]}`
+	answer, usage := rawCompletion([]byte(body), false)
+	if answer != "Hello there" || usage.TotalTokens != 0 {
+		t.Errorf("got %q and %+v, want the answer and no usage", answer, usage)
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// schema is the subset of JSON Schema used to describe and validate
+// request bodies.
+type schema struct {
+	Type        string             `json:"type,omitempty"`
+	Format      string             `json:"format,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Properties  map[string]*schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	Items       *schema            `json:"items,omitempty"`
+	OneOf       []*schema          `json:"oneOf,omitempty"`
+	Enum        []string           `json:"enum,omitempty"`
+	MinLength   int                `json:"minLength,omitempty"`
+	MinItems    int                `json:"minItems,omitempty"`
+	Minimum     *float64           `json:"minimum,omitempty"`
+	Maximum     *float64           `json:"maximum,omitempty"`
+}
+
+func bound(v float64) *float64 { return &v }
+
+// credentialsSchema is the body of signup and login requests.
+var credentialsSchema = &schema{Type: "object", Required: []string{"username", "password"}, Properties: map[string]*schema{
+	"username": {Type: "string", MinLength: 1},
+	"password": {Type: "string", MinLength: 1},
+}}
+
+// param is a query parameter of an operation.
+type param struct {
+	Name        string
+	Description string
+	Type        string
+	Enum        []string
+	Required    bool
+}
+
+// operation documents a route. Body is the schema of a JSON request body,
+// which is validated before the handler runs; with Form, the same fields
+// may be sent form-encoded instead, and Files describes the file fields of
+// a multipart form. TextBody describes a plain text body.
+type operation struct {
+	Summary  string
+	Query    []param
+	Body     *schema
+	Form     bool
+	Files    string
+	TextBody string
+}
+
+// askParams are the query parameters of the plain text endpoints.
+var askParams = []param{
+	{Name: "q", Description: "The prompt.", Type: "string", Required: true},
+	{Name: "prompt", Description: "Alias of q.", Type: "string"},
+	{Name: "text", Description: "Alias of q.", Type: "string"},
+	{Name: "question", Description: "Alias of q.", Type: "string"},
+	{Name: "model", Description: "Model or alias to use.", Type: "string"},
+	{Name: "stream", Description: "Stream the answer as server-sent events.", Type: "boolean"},
+	{Name: "complexity", Description: "Complexity for routing_rules, like X-Complexity.", Type: "string"},
+	{Name: "route", Description: "Routing policy, like X-Route.", Type: "string", Enum: []string{"cost", "default"}},
+}
+
+// operations are keyed by method and gin route path.
+var operations = map[string]*operation{
+	"GET /": {Summary: "Answer a prompt as plain text.", Query: askParams},
+	"POST /": {
+		Summary: "Answer a prompt from a form or JSON body as plain text.",
+		Body: &schema{Type: "object", Required: []string{"q"}, Properties: map[string]*schema{
+			"q":      {Type: "string", Description: "The prompt.", MinLength: 1},
+			"model":  {Type: "string", Description: "Model or alias to use."},
+			"stream": {Type: "boolean", Description: "Stream the answer as server-sent events."},
+		}},
+		Form: true,
+	},
+	"GET /as/:persona":  {Summary: "Answer a prompt as a configured persona.", Query: askParams},
+	"GET /ready":        {Summary: "Report whether the providers are warmed up."},
+	"GET /r/:id":        {Summary: "Show a stored answer, as HTML to browsers and plain text otherwise."},
+	"GET /s/:token":     {Summary: "Show a shared session, as HTML to browsers and JSON otherwise."},
+	"GET /openapi.json": {Summary: "This specification."},
+	"POST /summarize": {
+		Summary: "Summarize the text in the request body.",
+		Query: []param{
+			{Name: "length", Type: "string", Enum: []string{"short", "medium", "long"}},
+			{Name: "style", Type: "string", Enum: []string{"bullets", "paragraph"}},
+			{Name: "model", Description: "Model or alias to use.", Type: "string"},
+		},
+		TextBody: "The text to summarize.",
+	},
+	"POST /chat": {
+		Summary: "Add a message to a stored session and answer it.",
+		Body: &schema{Type: "object", Required: []string{"message"}, Properties: map[string]*schema{
+			"session_id": {Type: "string", Description: "Session to continue; a new one is created without it."},
+			"message":    {Type: "string", MinLength: 1},
+			"model":      {Type: "string", Description: "Model or alias to use."},
+			"stream":     {Type: "boolean", Description: "Stream the answer as server-sent events."},
+		}},
+		Form:  true,
+		Files: "Text files to attach to the message; the message may then be empty.",
+	},
+	"GET /sessions": {Summary: "List the caller's sessions.", Query: []param{
+		{Name: "from", Description: "Updated at or after this date or time.", Type: "string"},
+		{Name: "to", Description: "Updated before this time or on or before this date.", Type: "string"},
+		{Name: "model", Description: "Answered by this model or provider/model.", Type: "string"},
+		{Name: "label", Description: "Carrying this label; repeat to require several.", Type: "string"},
+		{Name: "limit", Type: "integer"},
+		{Name: "cursor", Description: "next_cursor of the previous page.", Type: "string"},
+	}},
+	"GET /sessions/:id":    {Summary: "Get a session with its messages."},
+	"GET /completions/:id": {Summary: "Get a stored completion with its prompt, answer, usage, model and latency."},
+	"POST /sessions/:id/shares": {
+		Summary: "Create a public read-only link to a session.",
+		Body: &schema{Type: "object", Properties: map[string]*schema{
+			"expires_in": {Type: "string", Description: "How long the link works, such as 7d; it works until revoked without."},
+		}},
+	},
+	"GET /sessions/:id/shares":           {Summary: "List the public links to a session."},
+	"DELETE /sessions/:id/shares/:token": {Summary: "Revoke a public link to a session."},
+	"PATCH /sessions/:id": {
+		Summary: "Replace the labels of a session.",
+		Body: &schema{Type: "object", Required: []string{"labels"}, Properties: map[string]*schema{
+			"labels": {Type: "array", Items: &schema{Type: "string", MinLength: 1}},
+		}},
+	},
+	"GET /labels": {Summary: "Labels in use with their session counts."},
+	"GET /search": {Summary: "Search the caller's stored messages.", Query: []param{
+		{Name: "q", Description: "Words that must all appear in a message.", Type: "string", Required: true},
+		{Name: "limit", Type: "integer"},
+	}},
+	"POST /v1/chat/completions": {
+		Summary: "OpenAI-compatible chat completions.",
+		Body: &schema{Type: "object", Required: []string{"messages"}, Properties: map[string]*schema{
+			"model": {Type: "string"},
+			"messages": {Type: "array", MinItems: 1, Items: &schema{Type: "object", Required: []string{"role", "content"}, Properties: map[string]*schema{
+				"role":    {Type: "string", Enum: []string{"system", "developer", "user", "assistant", "tool", "function"}},
+				"content": {OneOf: []*schema{{Type: "string"}, {Type: "array", Items: &schema{Type: "object"}}, {Type: "null"}}},
+			}}},
+			"stream":      {Type: "boolean"},
+			"max_tokens":  {Type: "integer", Minimum: bound(1)},
+			"temperature": {Type: "number", Minimum: bound(0), Maximum: bound(2)},
+		}},
+	},
+	"POST /compare": {
+		Summary: "Send one prompt to several models.",
+		Body: &schema{Type: "object", Required: []string{"prompt"}, Properties: map[string]*schema{
+			"prompt": {Type: "string", MinLength: 1},
+			"models": {Type: "array", Items: &schema{Type: "string"}, Description: "Defaults to compare_models."},
+		}},
+	},
+	"GET /status": {Summary: "Provider health and recent upstream request counts and latency."},
+	"POST /experiments/:name/feedback": {
+		Summary: "Score the answer of the caller's experiment arm.",
+		Body: &schema{Type: "object", Required: []string{"score"}, Properties: map[string]*schema{
+			"score": {Type: "number", Description: "Clamped to 0-5."},
+		}},
+	},
+	"POST /templates/:name/feedback": {
+		Summary: "Score the answer of the caller's version of a template with a canary.",
+		Body: &schema{Type: "object", Required: []string{"score"}, Properties: map[string]*schema{
+			"score": {Type: "number", Description: "Clamped to 0-5."},
+		}},
+	},
+	"GET /usage":      {Summary: "The calling key's usage, estimated cost and remaining quota.", Query: []param{{Name: "window", Type: "string", Enum: []string{"24h", "7d", "30d"}}}},
+	"DELETE /me/data": {Summary: "Delete the caller's stored data."},
+	"GET /me/memory":  {Summary: "List the caller's remembered facts."},
+	"PUT /me/memory": {
+		Summary: "Turn long-term memory on or off.",
+		Body: &schema{Type: "object", Required: []string{"enabled"}, Properties: map[string]*schema{
+			"enabled": {Type: "boolean"},
+		}},
+	},
+	"DELETE /me/memory":     {Summary: "Forget all remembered facts."},
+	"DELETE /me/memory/:id": {Summary: "Forget one remembered fact."},
+	"GET /feeds/:file":      {Summary: "Atom or RSS feed of a schedule's results.", Query: []param{{Name: "token", Type: "string"}}},
+	"POST /signup":          {Summary: "Create an account and its first API key.", Body: credentialsSchema},
+	"POST /login":           {Summary: "Get a login token for an account.", Body: credentialsSchema},
+	"GET /account":          {Summary: "The caller's account and API keys."},
+	"POST /workspaces": {
+		Summary: "Create a workspace owned by the caller.",
+		Body:    &schema{Type: "object", Required: []string{"name"}, Properties: map[string]*schema{"name": {Type: "string", MinLength: 1}}},
+	},
+	"GET /workspaces":        {Summary: "The caller's workspaces."},
+	"GET /workspaces/:id":    {Summary: "A workspace with its members."},
+	"DELETE /workspaces/:id": {Summary: "Delete a workspace and its sessions."},
+	"PUT /workspaces/:id/members/:member": {
+		Summary: "Add a member or change their role.",
+		Body: &schema{Type: "object", Required: []string{"role"}, Properties: map[string]*schema{
+			"role": {Type: "string", Enum: workspaceRoles},
+		}},
+	},
+	"DELETE /workspaces/:id/members/:member": {Summary: "Remove a member or leave a workspace."},
+	"GET /workspaces/:id/templates":          {Summary: "The workspace's own versions of templates."},
+	"PUT /workspaces/:id/templates/:name": {
+		Summary: "Set the workspace's version of a template.",
+		Body:    &schema{Type: "object", Properties: map[string]*schema{"system": {Type: "string"}, "user": {Type: "string"}}},
+	},
+	"DELETE /workspaces/:id/templates/:name": {Summary: "Use the server's version of a template again."},
+	"POST /account/keys": {
+		Summary: "Create an API key.",
+		Body:    &schema{Type: "object", Properties: map[string]*schema{"name": {Type: "string"}}},
+	},
+	"DELETE /account/keys/:id": {Summary: "Revoke an API key or login token."},
+	"GET /account/usage":       {Summary: "The caller's daily usage records.", Query: []param{{Name: "from", Type: "string"}, {Name: "to", Type: "string"}, {Name: "model", Type: "string"}, {Name: "limit", Type: "integer"}, {Name: "cursor", Type: "string"}}},
+	"GET /admin/dashboard":     {Summary: "Admin dashboard page."},
+	"PUT /admin/providers/:name/key": {
+		Summary: "Replace a provider's API key.",
+		Query:   []param{{Name: "tenant", Type: "string"}},
+		Body: &schema{Type: "object", Required: []string{"api_key"}, Properties: map[string]*schema{
+			"api_key": {Type: "string", MinLength: 1},
+		}},
+	},
+	"POST /admin/reload":   {Summary: "Re-read secrets."},
+	"GET /admin/accounts":  {Summary: "User accounts."},
+	"POST /admin/accounts": {Summary: "Create an account.", Body: credentialsSchema},
+	"PATCH /admin/accounts/:id": {
+		Summary: "Change the role of an account.",
+		Body: &schema{Type: "object", Required: []string{"role"}, Properties: map[string]*schema{
+			"role": {Type: "string", Enum: roles},
+		}},
+	},
+	"DELETE /admin/accounts/:id":          {Summary: "Delete an account and its keys."},
+	"GET /admin/experiments":              {Summary: "Experiment results."},
+	"GET /admin/templates":                {Summary: "Templates with the version in use."},
+	"GET /admin/templates/:name/versions": {Summary: "Stored versions of a template."},
+	"POST /admin/templates/:name/versions": {
+		Summary: "Publish a new version of a template.",
+		Body: &schema{Type: "object", Required: []string{"template"}, Properties: map[string]*schema{
+			"template": {Type: "object"},
+			"note":     {Type: "string"},
+			"activate": {Type: "boolean"},
+		}},
+	},
+	"POST /admin/templates/:name/rollback": {
+		Summary: "Put an earlier version of a template in use.",
+		Body: &schema{Type: "object", Properties: map[string]*schema{
+			"version": {Type: "integer", Minimum: bound(0)},
+		}},
+	},
+	"GET /admin/canaries": {Summary: "Template canaries and their results."},
+	"PUT /admin/templates/:name/canary": {
+		Summary: "Start a canary of a new template version.",
+		Body: &schema{Type: "object", Required: []string{"template"}, Properties: map[string]*schema{
+			"template":                {Type: "object"},
+			"percent":                 {Type: "integer", Minimum: bound(1), Maximum: bound(100)},
+			"min_requests":            {Type: "integer", Minimum: bound(0)},
+			"max_error_rate_increase": {Type: "number", Minimum: bound(0)},
+			"min_feedback":            {Type: "integer", Minimum: bound(0)},
+			"max_score_drop":          {Type: "number", Minimum: bound(0)},
+		}},
+	},
+	"POST /admin/templates/:name/canary/promote": {Summary: "Make the canary version of a template the stable one."},
+	"DELETE /admin/templates/:name/canary":       {Summary: "Stop a template canary."},
+	"DELETE /admin/users/:id/data":               {Summary: "Delete a user's stored data."},
+	"GET /admin/metrics":                         {Summary: "Prometheus metrics."},
+	"GET /admin/dashboard/data":                  {Summary: "Data shown by the dashboard."},
+	"GET /admin/logs/stream":                     {Summary: "Live request records as server-sent events.", Query: []param{{Name: "client", Type: "string"}, {Name: "status", Type: "string"}}},
+	"GET /admin/usage":                           {Summary: "Daily usage records.", Query: []param{{Name: "from", Type: "string"}, {Name: "to", Type: "string"}, {Name: "client", Type: "string"}, {Name: "model", Type: "string"}, {Name: "limit", Type: "integer"}, {Name: "cursor", Type: "string"}}},
+	"GET /admin/usage/export":                    {Summary: "Usage as CSV.", Query: []param{{Name: "from", Type: "string"}, {Name: "to", Type: "string"}, {Name: "client", Type: "string"}, {Name: "model", Type: "string"}, {Name: "group_by", Type: "string"}}},
+	"GET /admin/schedules":                       {Summary: "Scheduled prompts."},
+	"GET /admin/schedules/:name/runs":            {Summary: "Recent runs of a schedule."},
+	"POST /admin/schedules/:name/run":            {Summary: "Run a schedule now."},
+	"POST /admin/alerts/test":                    {Summary: "Send a test alert."},
+	"GET /admin/audit":                           {Summary: "Export the audit log.", Query: []param{{Name: "after", Type: "integer"}}},
+	"GET /admin/audit/verify":                    {Summary: "Verify the audit log's hash chain."},
+}
+
+// buildOpenAPI describes routes as an OpenAPI 3.1 document. Routes without
+// an entry in operations are listed with their path parameters only, and
+// unversioned routes with a /v1 equivalent are marked deprecated.
+func buildOpenAPI(routes gin.RoutesInfo) gin.H {
+	versioned := map[string]bool{}
+	for _, r := range routes {
+		if unversioned(r.Path) != r.Path {
+			versioned[r.Method+" "+unversioned(r.Path)] = true
+		}
+	}
+
+	paths := gin.H{}
+	for _, r := range routes {
+		var segments []string
+		var params []gin.H
+		for _, seg := range strings.Split(r.Path, "/") {
+			if name, ok := strings.CutPrefix(seg, ":"); ok {
+				seg = "{" + name + "}"
+				params = append(params, gin.H{"name": name, "in": "path", "required": true, "schema": gin.H{"type": "string"}})
+			}
+			segments = append(segments, seg)
+		}
+		path := strings.Join(segments, "/")
+
+		op := gin.H{"responses": gin.H{"200": gin.H{"description": "Success."}, "default": gin.H{"description": "An error; see X-Error-Code."}}}
+		if strings.HasPrefix(r.Path, "/admin/") && r.Path != "/admin/dashboard" {
+			op["security"] = []gin.H{{"adminToken": []string{}}}
+		}
+		if versioned[r.Method+" "+r.Path] {
+			op["deprecated"] = true
+		}
+		if o := operations[r.Method+" "+unversioned(r.Path)]; o != nil {
+			op["summary"] = o.Summary
+			for _, p := range o.Query {
+				ps := gin.H{"type": p.Type}
+				if len(p.Enum) > 0 {
+					ps["enum"] = p.Enum
+				}
+				params = append(params, gin.H{"name": p.Name, "in": "query", "required": p.Required, "description": p.Description, "schema": ps})
+			}
+			switch {
+			case o.Body != nil:
+				content := gin.H{"application/json": gin.H{"schema": o.Body}}
+				if o.Form {
+					content["application/x-www-form-urlencoded"] = gin.H{"schema": o.Body}
+				}
+				if o.Files != "" {
+					form := *o.Body
+					form.Required = nil
+					form.Properties = maps.Clone(o.Body.Properties)
+					form.Properties["file"] = &schema{Type: "array", Description: o.Files, Items: &schema{Type: "string", Format: "binary"}}
+					content["multipart/form-data"] = gin.H{"schema": &form}
+				}
+				op["requestBody"] = gin.H{"required": true, "content": content}
+			case o.TextBody != "":
+				op["requestBody"] = gin.H{"required": true, "description": o.TextBody, "content": gin.H{"text/plain": gin.H{"schema": gin.H{"type": "string"}}}}
+			}
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		item, ok := paths[path].(gin.H)
+		if !ok {
+			item = gin.H{}
+			paths[path] = item
+		}
+		item[strings.ToLower(r.Method)] = op
+	}
+
+	return gin.H{
+		"openapi": "3.1.0",
+		"info":    gin.H{"title": "askllm", "version": "1"},
+		"paths":   paths,
+		"components": gin.H{"securitySchemes": gin.H{
+			"apiKey":     gin.H{"type": "http", "scheme": "bearer", "description": "A client API key."},
+			"adminToken": gin.H{"type": "http", "scheme": "bearer", "description": "ASKLLM_ADMIN_TOKEN."},
+		}},
+		"security": []gin.H{{"apiKey": []string{}}, {}},
+	}
+}
+
+// handleOpenAPI serves the OpenAPI document of the server's routes.
+func (s *server) handleOpenAPI(c *gin.Context) {
+	c.JSON(http.StatusOK, s.openAPI)
+}
+
+// fieldError is one problem found in a request body.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validateBody checks JSON request bodies against the schema of their
+// route and rejects invalid ones with 400, listing every invalid field.
+// The OpenAI-compatible routes answer in OpenAI's error format instead.
+func validateBody(c *gin.Context) {
+	op := operations[c.Request.Method+" "+unversioned(c.FullPath())]
+	if op == nil || op.Body == nil || c.Request.Body == nil || c.Request.Body == http.NoBody || op.Form && formBody(c.ContentType()) {
+		c.Next()
+		return
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Could not read request body."})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	var errs []fieldError
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		errs = []fieldError{{Field: "", Message: "is not valid JSON"}}
+	} else {
+		errs = op.Body.validate("", v, errs)
+	}
+	if len(errs) == 0 {
+		c.Next()
+		return
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+
+	if c.FullPath() == "/v1/chat/completions" {
+		msgs := make([]string, len(errs))
+		for i, e := range errs {
+			msgs[i] = strings.TrimSpace(e.Field + " " + e.Message)
+		}
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": gin.H{
+			"message": "Invalid request body: " + strings.Join(msgs, "; ") + ".",
+			"type":    "invalid_request_error",
+			"param":   errs[0].Field,
+		}})
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request body.", "fields": errs})
+}
+
+// validate appends the ways v, found at path, does not match sc to errs.
+func (sc *schema) validate(path string, v any, errs []fieldError) []fieldError {
+	fail := func(format string, args ...any) []fieldError {
+		return append(errs, fieldError{Field: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(sc.OneOf) > 0 {
+		for _, alt := range sc.OneOf {
+			if len(alt.validate(path, v, nil)) == 0 {
+				return errs
+			}
+		}
+		types := make([]string, len(sc.OneOf))
+		for i, alt := range sc.OneOf {
+			types[i] = alt.Type
+		}
+		return fail("must be one of the types %s", strings.Join(types, ", "))
+	}
+
+	switch sc.Type {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return fail("must be an object")
+		}
+		for _, name := range sc.Required {
+			if _, ok := obj[name]; !ok {
+				errs = append(errs, fieldError{Field: joinField(path, name), Message: "is required"})
+			}
+		}
+		for name, value := range obj {
+			if prop, ok := sc.Properties[name]; ok {
+				errs = prop.validate(joinField(path, name), value, errs)
+			}
+		}
+	case "array":
+		items, ok := v.([]any)
+		if !ok {
+			return fail("must be an array")
+		}
+		if len(items) < sc.MinItems {
+			return fail("must have at least %d items", sc.MinItems)
+		}
+		if sc.Items != nil {
+			for i, item := range items {
+				errs = sc.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, errs)
+			}
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return fail("must be a string")
+		}
+		if len(strings.TrimSpace(s)) < sc.MinLength {
+			return fail("must not be empty")
+		}
+		if len(sc.Enum) > 0 && !slices.Contains(sc.Enum, s) {
+			return fail("must be one of %s", strings.Join(sc.Enum, ", "))
+		}
+	case "integer", "number":
+		n, ok := v.(float64)
+		if !ok || (sc.Type == "integer" && n != math.Trunc(n)) {
+			return fail("must be %s", map[string]string{"integer": "an integer", "number": "a number"}[sc.Type])
+		}
+		if sc.Minimum != nil && n < *sc.Minimum {
+			return fail("must be at least %v", *sc.Minimum)
+		}
+		if sc.Maximum != nil && n > *sc.Maximum {
+			return fail("must be at most %v", *sc.Maximum)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fail("must be a boolean")
+		}
+	case "null":
+		if v != nil {
+			return fail("must be null")
+		}
+	}
+	return errs
+}
+
+func joinField(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// formBody reports whether a body of the content type is a form.
+func formBody(contentType string) bool {
+	return contentType == "application/x-www-form-urlencoded" || contentType == "multipart/form-data"
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Page sizes of the listing endpoints.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+var errBadCursor = errors.New("invalid cursor")
+
+// pageSize returns the limit query parameter, defaultPageSize without one.
+func pageSize(c *gin.Context) (int, error) {
+	v := c.Query("limit")
+	if v == "" {
+		return defaultPageSize, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > maxPageSize {
+		return 0, errors.New("limit must be between 1 and " + strconv.Itoa(maxPageSize) + ".")
+	}
+	return n, nil
+}
+
+// encodeCursor makes an opaque cursor of the sort key of the last item on
+// a page.
+func encodeCursor(parts ...string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(parts, "\x00")))
+}
+
+// decodeCursor returns the n parts of a cursor made by encodeCursor.
+func decodeCursor(cursor string, n int) ([]string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	parts := strings.Split(string(b), "\x00")
+	if len(parts) != n {
+		return nil, errBadCursor
+	}
+	return parts, nil
+}
+
+// parseBound parses a from or to query parameter, either an RFC 3339 time
+// or a UTC date. A date in to includes the whole day.
+func parseBound(v string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
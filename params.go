@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// promptParams are the query parameters that carry the prompt of the plain
+// text routes, in order of precedence. q is the documented one; the others
+// are accepted so scripts written against other services work unchanged.
+var promptParams = []string{"q", "prompt", "text", "question"}
+
+// queryPrompt returns the prompt in the query: the first non-empty one of
+// promptParams.
+func queryPrompt(c *gin.Context) string {
+	for _, name := range promptParams {
+		if v := c.Query(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// respondMissingPrompt answers a plain text request at path that carries
+// no prompt with 400, the parameters that would carry one with examples,
+// and which of the parameters it sent were recognized.
+func respondMissingPrompt(c *gin.Context, path string) {
+	recognized, unrecognized := []string{}, []string{}
+	for name := range c.Request.URL.Query() {
+		if slices.ContainsFunc(askParams, func(p param) bool { return p.Name == name }) {
+			recognized = append(recognized, name)
+		} else {
+			unrecognized = append(unrecognized, name)
+		}
+	}
+	slices.Sort(recognized)
+	slices.Sort(unrecognized)
+
+	examples := make([]string, len(promptParams))
+	for i, name := range promptParams {
+		examples[i] = path + "?" + name + "=Hello"
+	}
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":        "Please provide a prompt with the 'q' parameter. Example: " + path + "?q=Hello",
+		"accepted":     promptParams,
+		"recognized":   recognized,
+		"unrecognized": unrecognized,
+		"examples":     examples,
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed permalink.html
+var permalinkHTML string
+
+var permalinkPage = template.Must(template.New("permalink").Parse(permalinkHTML))
+
+// maxPermalinkTitle bounds the page title of a permalink, in characters.
+const maxPermalinkTitle = 60
+
+// permalinkPath is where the completion with the given ID is shared.
+func permalinkPath(id string) string {
+	return "/r/" + id
+}
+
+// handlePermalink serves a public stored answer: as HTML to browsers, else
+// as plain text. Anyone with the link may see it; IDs are not guessable.
+func (s *server) handlePermalink(c *gin.Context) {
+	cp, err := s.store.Completion(c.Param("id"))
+	if err == nil && !cp.Public {
+		err = errCompletionNotFound
+	}
+	if errors.Is(err, errCompletionNotFound) {
+		c.String(http.StatusNotFound, "Completion not found.")
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading completion: %v", err)
+		c.String(http.StatusInternalServerError, "Internal server error.")
+		return
+	}
+
+	c.Header("Cache-Control", "private, max-age=300")
+	c.Header("X-Robots-Tag", "noindex")
+	if c.NegotiateFormat(gin.MIMEPlain, gin.MIMEHTML) != gin.MIMEHTML {
+		c.String(http.StatusOK, cp.Answer)
+		return
+	}
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	data := struct {
+		*Completion
+		Title string
+	}{cp, truncateRunes(cp.Prompt, maxPermalinkTitle)}
+	if err := permalinkPage.Execute(c.Writer, data); err != nil {
+		log.Printf("Error rendering completion %s: %v", cp.ID, err)
+	}
+}
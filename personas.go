@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var personaPathPattern = regexp.MustCompile(`^(/[A-Za-z0-9][A-Za-z0-9._-]*)+$`)
+
+// reservedPaths are the first path segments of the built-in routes, which
+// persona paths may not use.
+var reservedPaths = []string{
+	"v1", "admin", "feeds", "ready", "openapi.json", "signup", "login", "r", "s",
+	"as", "summarize", "chat", "sessions", "search", "labels", "completions", "compare", "status",
+	"experiments", "templates", "usage", "me", "workspaces", "account",
+}
+
+// checkPersonaPath reports whether path can be a persona's own route.
+func checkPersonaPath(path string) error {
+	if !personaPathPattern.MatchString(path) {
+		return fmt.Errorf("path %q must be like /code, made of letters, digits, dots, dashes and underscores", path)
+	}
+	first, _, _ := strings.Cut(path[1:], "/")
+	if slices.Contains(reservedPaths, first) {
+		return fmt.Errorf("path %q is taken by a built-in route", path)
+	}
+	return nil
+}
+
+// personaRoutes serves the personas with a path of their own on g.
+func (s *server) personaRoutes(g pipelineGroup) {
+	for name, p := range s.cfg.Personas {
+		if p.Path == "" {
+			continue
+		}
+		g.GET(p.Path, func(c *gin.Context) { s.askPersona(c, name, p.Path) })
+		operations["GET "+p.Path] = &operation{Summary: "Answer a prompt as the " + name + " persona.", Query: askParams}
+	}
+}
+
+// handleAsPersona answers the 'q' query parameter as the persona named in
+// the path, like GET / but with the persona's system prompt and settings.
+func (s *server) handleAsPersona(c *gin.Context) {
+	name := c.Param("persona")
+	s.askPersona(c, name, "/as/"+name)
+}
+
+// askPersona answers the 'q' query parameter as the named persona, served
+// at path.
+func (s *server) askPersona(c *gin.Context, name, path string) {
+	persona, ok := s.cfg.Personas[name]
+	if !ok {
+		c.String(http.StatusNotFound, "Unknown persona.")
+		return
+	}
+	query := queryPrompt(c)
+	if query == "" {
+		respondMissingPrompt(c, path)
+		return
+	}
+
+	log.Printf("Received request for persona %s: %s", name, query)
+
+	var messages []Message
+	if persona.System != "" {
+		messages = append(messages, Message{Role: "system", Content: persona.System})
+	}
+	messages = append(messages, Message{Role: "user", Content: query})
+	tgt, err := s.targetFor(c, routeRequest{Model: c.Query("model"), DefaultModel: persona.Model, Messages: messages})
+	if err != nil {
+		respondUpstreamError(c, err)
+		return
+	}
+	payload := newPayload(messages)
+	if persona.Temperature != nil {
+		payload.Temperature = *persona.Temperature
+	}
+	if persona.MaxTokens > 0 {
+		payload.MaxTokens = persona.MaxTokens
+	}
+	tgt.prepare(&payload)
+	s.respondAnswer(c, tgt, payload)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"path"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pipelineStages are the middleware stages of API routes, in their default
+// order. Each route's request then reaches its handler, which calls the
+// provider.
+var pipelineStages = []string{
+	"auth",
+	"idempotency",
+	"tenant",
+	"workspace",
+	"plugins",
+	"hooks",
+	"anonymous_limits",
+	"rate_limit",
+	"priority",
+	"validate",
+	"cache",
+}
+
+// callerStages are the stages that act on who the caller is, so they must
+// come after auth.
+var callerStages = []string{"idempotency", "tenant", "workspace", "anonymous_limits", "rate_limit", "priority"}
+
+// cacheContextKey is set on requests whose pipeline has the cache stage.
+const cacheContextKey = "askllm.cache"
+
+// stageHandlers returns the handler of each pipeline stage whose feature is
+// configured. Stages left out do nothing, wherever they are declared.
+func (s *server) stageHandlers() map[string]gin.HandlerFunc {
+	cfg := s.cfg
+	h := map[string]gin.HandlerFunc{
+		"idempotency": s.idempotent,
+		"rate_limit":  s.limitClient,
+		"priority":    s.assignPriority,
+		"validate":    s.validateRequest,
+	}
+	if cfg.authenticates() {
+		h["auth"] = s.authenticate
+	}
+	if len(s.tenants) > 0 {
+		h["tenant"] = s.identifyTenant
+	}
+	if cfg.Workspaces {
+		h["workspace"] = s.selectWorkspace
+	}
+	if len(s.plugins) > 0 {
+		h["plugins"] = s.runPlugins
+	}
+	if s.hooks != nil {
+		h["hooks"] = s.runHooks
+	}
+	if cfg.AnonymousLimits != nil {
+		h["anonymous_limits"] = s.limitAnonymous
+	}
+	if s.cache != nil {
+		h["cache"] = func(c *gin.Context) { c.Set(cacheContextKey, true) }
+	}
+	return h
+}
+
+// stagesFor returns the middleware of the route's pipeline: its own from
+// the pipeline config, else the configured default, else every stage.
+func (s *server) stagesFor(route string) []gin.HandlerFunc {
+	names := pipelineStages
+	if pc := s.cfg.Pipeline; pc != nil {
+		if own, ok := pc.Routes[route]; ok {
+			names = own
+			s.pipelineRoutes[route] = true
+		} else if len(pc.Default) > 0 {
+			names = pc.Default
+		}
+	}
+	handlers := s.stageHandlers()
+	var chain []gin.HandlerFunc
+	for _, name := range names {
+		if h := handlers[name]; h != nil {
+			chain = append(chain, h)
+		}
+	}
+	return chain
+}
+
+// cacheEnabled reports whether the request may be answered from the
+// response cache.
+func cacheEnabled(c *gin.Context) bool {
+	return c.GetBool(cacheContextKey)
+}
+
+// pipelineGroup registers API routes behind the stages of their pipeline,
+// followed by the group's own middleware.
+type pipelineGroup struct {
+	s          *server
+	g          *gin.RouterGroup
+	middleware []gin.HandlerFunc
+}
+
+// Group returns a subgroup at relativePath with additional middleware.
+func (pg pipelineGroup) Group(relativePath string, middleware ...gin.HandlerFunc) pipelineGroup {
+	return pipelineGroup{pg.s, pg.g.Group(relativePath), append(pg.middleware[:len(pg.middleware):len(pg.middleware)], middleware...)}
+}
+
+// Handle registers a route.
+func (pg pipelineGroup) Handle(method, relativePath string, handlers ...gin.HandlerFunc) {
+	full := pg.g.BasePath()
+	if relativePath != "" {
+		full = path.Join(full, relativePath)
+	}
+	chain := append(pg.s.stagesFor(unversioned(full)), pg.middleware...)
+	pg.g.Handle(method, relativePath, append(chain, handlers...)...)
+}
+
+func (pg pipelineGroup) GET(relativePath string, handlers ...gin.HandlerFunc) {
+	pg.Handle(http.MethodGet, relativePath, handlers...)
+}
+
+func (pg pipelineGroup) POST(relativePath string, handlers ...gin.HandlerFunc) {
+	pg.Handle(http.MethodPost, relativePath, handlers...)
+}
+
+func (pg pipelineGroup) PUT(relativePath string, handlers ...gin.HandlerFunc) {
+	pg.Handle(http.MethodPut, relativePath, handlers...)
+}
+
+func (pg pipelineGroup) PATCH(relativePath string, handlers ...gin.HandlerFunc) {
+	pg.Handle(http.MethodPatch, relativePath, handlers...)
+}
+
+func (pg pipelineGroup) DELETE(relativePath string, handlers ...gin.HandlerFunc) {
+	pg.Handle(http.MethodDelete, relativePath, handlers...)
+}
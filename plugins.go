@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Exports of a plugin module. alloc(size) returns a buffer the host writes
+// an event into; on_request and on_response take the event's pointer and
+// length and return the pointer and length of their result packed into
+// one i64 (pointer in the high 32 bits), or 0 to change nothing. free, if
+// exported, is called with each buffer once the host is done with it.
+const (
+	pluginAlloc      = "alloc"
+	pluginFree       = "free"
+	pluginOnRequest  = "on_request"
+	pluginOnResponse = "on_response"
+)
+
+// plugin is a loaded WebAssembly middleware module. Instances are not safe
+// for concurrent use, so idle ones are kept in a pool.
+type plugin struct {
+	cfg      *PluginConfig
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+
+	onRequest, onResponse bool
+
+	idle chan api.Module
+}
+
+// pluginEvent is what a plugin is told about a request or its response.
+type pluginEvent struct {
+	Phase   string            `json:"phase"` // "request" or "response"
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Route   string            `json:"route"`
+	Query   string            `json:"query,omitempty"`
+	Client  string            `json:"client,omitempty"`
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// pluginResult is a plugin's answer. On requests a Status rejects the
+// request with Error as the message; Headers are set on the request or
+// response, and Body, if set, replaces it.
+type pluginResult struct {
+	Status  int               `json:"status"`
+	Error   string            `json:"error"`
+	Headers map[string]string `json:"headers"`
+	Body    *string           `json:"body"`
+}
+
+// loadPlugins compiles the configured plugin modules.
+func loadPlugins(ctx context.Context, cfgs []*PluginConfig) ([]*plugin, error) {
+	var plugins []*plugin
+	for _, pc := range cfgs {
+		wasm, err := os.ReadFile(pc.Path)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: %w", pc.Name, err)
+		}
+		r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+		wasi_snapshot_preview1.MustInstantiate(ctx, r)
+		compiled, err := r.CompileModule(ctx, wasm)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: compiling %s: %w", pc.Name, pc.Path, err)
+		}
+		p := &plugin{cfg: pc, runtime: r, compiled: compiled, idle: make(chan api.Module, 16)}
+		exports := compiled.ExportedFunctions()
+		if _, ok := exports[pluginAlloc]; !ok {
+			return nil, fmt.Errorf("plugin %s: module does not export %s", pc.Name, pluginAlloc)
+		}
+		_, p.onRequest = exports[pluginOnRequest]
+		_, p.onResponse = exports[pluginOnResponse]
+		if !p.onRequest && !p.onResponse {
+			return nil, fmt.Errorf("plugin %s: module exports neither %s nor %s", pc.Name, pluginOnRequest, pluginOnResponse)
+		}
+		plugins = append(plugins, p)
+	}
+	return plugins, nil
+}
+
+// instance returns an idle instance of the module or starts a new one.
+func (p *plugin) instance(ctx context.Context) (api.Module, error) {
+	select {
+	case m := <-p.idle:
+		return m, nil
+	default:
+	}
+	// Reactor modules, such as Go's c-shared builds, initialize in
+	// _initialize; it is skipped when not exported.
+	cfg := wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize").WithStderr(os.Stderr)
+	return p.runtime.InstantiateModule(ctx, p.compiled, cfg)
+}
+
+// call passes event to the exported function fn and returns its result,
+// nil if it changes nothing.
+func (p *plugin) call(ctx context.Context, fn string, event *pluginEvent) (*pluginResult, error) {
+	event.Config = p.cfg.Config
+	in, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	// The instance is created outside the deadline: closing it when the
+	// deadline passes must not affect later calls.
+	m, err := p.instance(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout.Duration)
+	defer cancel()
+
+	out, err := p.exchange(ctx, m, fn, in)
+	if err != nil {
+		m.Close(context.Background())
+		return nil, err
+	}
+	select {
+	case p.idle <- m:
+	default:
+		m.Close(context.Background())
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	var res pluginResult
+	if err := json.Unmarshal(out, &res); err != nil {
+		return nil, fmt.Errorf("parsing result: %w", err)
+	}
+	return &res, nil
+}
+
+// exchange writes in to the instance's memory, calls fn and reads back its
+// result.
+func (p *plugin) exchange(ctx context.Context, m api.Module, fn string, in []byte) ([]byte, error) {
+	res, err := m.ExportedFunction(pluginAlloc).Call(ctx, uint64(len(in)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", pluginAlloc, err)
+	}
+	ptr := uint32(res[0])
+	if !m.Memory().Write(ptr, in) {
+		return nil, errors.New("alloc returned a buffer outside memory")
+	}
+	res, err = m.ExportedFunction(fn).Call(ctx, uint64(ptr), uint64(len(in)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	outPtr, outLen := uint32(res[0]>>32), uint32(res[0])
+	var out []byte
+	if outLen > 0 {
+		b, ok := m.Memory().Read(outPtr, outLen)
+		if !ok {
+			return nil, errors.New("result is outside memory")
+		}
+		out = bytes.Clone(b)
+	}
+	if free := m.ExportedFunction(pluginFree); free != nil {
+		if _, err := free.Call(ctx, uint64(ptr), uint64(len(in))); err != nil {
+			return nil, fmt.Errorf("%s: %w", pluginFree, err)
+		}
+		if outLen > 0 {
+			if _, err := free.Call(ctx, uint64(outPtr), uint64(outLen)); err != nil {
+				return nil, fmt.Errorf("%s: %w", pluginFree, err)
+			}
+		}
+	}
+	return out, nil
+}
+
+// pluginHeaders flattens headers for plugins, leaving out credentials.
+func pluginHeaders(h http.Header) map[string]string {
+	flat := map[string]string{}
+	for k, v := range h {
+		if k == "Authorization" || k == "Cookie" || k == "Set-Cookie" || len(v) == 0 {
+			continue
+		}
+		flat[k] = v[0]
+	}
+	return flat
+}
+
+// runPlugins passes requests, and their responses unless they are event
+// streams, through the plugins in order. A plugin can reject a request,
+// set request and response headers and replace either body. A plugin that
+// fails rejects the request with 500 unless it is fail_open.
+func (s *server) runPlugins(c *gin.Context) {
+	var body []byte
+	if c.Request.Body != nil {
+		var err error
+		if body, err = io.ReadAll(c.Request.Body); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Could not read request body."})
+			return
+		}
+	}
+	event := &pluginEvent{
+		Phase:   "request",
+		Method:  c.Request.Method,
+		Path:    c.Request.URL.Path,
+		Route:   c.FullPath(),
+		Query:   c.Request.URL.RawQuery,
+		Client:  ownerFor(c),
+		Headers: pluginHeaders(c.Request.Header),
+		Body:    string(body),
+	}
+	respond := false
+	for _, p := range s.plugins {
+		respond = respond || p.onResponse
+		if !p.onRequest {
+			continue
+		}
+		res, err := p.call(c.Request.Context(), pluginOnRequest, event)
+		if !s.pluginOK(c, p, err) {
+			return
+		}
+		if res == nil {
+			continue
+		}
+		if res.Status != 0 {
+			if res.Status < 400 || res.Status > 599 {
+				res.Status = http.StatusForbidden
+			}
+			if res.Error == "" {
+				res.Error = "Request rejected by policy."
+			}
+			auditNote(c, "rejected by plugin %s: %s", p.cfg.Name, res.Error)
+			c.AbortWithStatusJSON(res.Status, gin.H{"error": res.Error})
+			return
+		}
+		for k, v := range res.Headers {
+			c.Request.Header.Set(k, v)
+			event.Headers[http.CanonicalHeaderKey(k)] = v
+		}
+		if res.Body != nil {
+			body = []byte(*res.Body)
+			event.Body = *res.Body
+		}
+	}
+	if c.Request.Body != nil {
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Request.ContentLength = int64(len(body))
+	}
+	if !respond {
+		c.Next()
+		return
+	}
+
+	w := &pluginWriter{ResponseWriter: c.Writer, status: http.StatusOK}
+	c.Writer = w
+	c.Next()
+	c.Writer = w.ResponseWriter
+	if w.stream {
+		return
+	}
+
+	event.Phase = "response"
+	event.Status = w.status
+	event.Headers = pluginHeaders(w.Header())
+	event.Body = w.buf.String()
+	out := w.buf.Bytes()
+	for _, p := range s.plugins {
+		if !p.onResponse {
+			continue
+		}
+		res, err := p.call(context.WithoutCancel(c.Request.Context()), pluginOnResponse, event)
+		if err != nil {
+			log.Printf("Plugin %s failed on the response to %s: %v", p.cfg.Name, c.Request.URL.Path, err)
+			if !p.cfg.FailOpen {
+				event.Status, out = http.StatusInternalServerError, []byte(`{"error":"Internal server error."}`)
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				break
+			}
+			continue
+		}
+		if res == nil {
+			continue
+		}
+		if res.Status >= 100 && res.Status <= 599 {
+			event.Status = res.Status
+		}
+		for k, v := range res.Headers {
+			w.Header().Set(k, v)
+			event.Headers[http.CanonicalHeaderKey(k)] = v
+		}
+		if res.Body != nil {
+			out = []byte(*res.Body)
+			event.Body = *res.Body
+		}
+	}
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(event.Status)
+	w.ResponseWriter.Write(out)
+}
+
+// pluginOK handles a plugin's error on a request: it logs it and, unless
+// the plugin is fail_open, rejects the request.
+func (s *server) pluginOK(c *gin.Context, p *plugin, err error) bool {
+	if err == nil {
+		return true
+	}
+	log.Printf("Plugin %s failed on %s: %v", p.cfg.Name, c.Request.URL.Path, err)
+	if p.cfg.FailOpen {
+		return true
+	}
+	c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+	return false
+}
+
+// pluginWriter holds back a response for the response plugins. Event
+// streams are passed on as they are written.
+type pluginWriter struct {
+	gin.ResponseWriter
+	status  int
+	decided bool
+	stream  bool
+	buf     bytes.Buffer
+}
+
+func (w *pluginWriter) WriteHeader(code int) {
+	if w.stream {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+}
+
+func (w *pluginWriter) WriteHeaderNow() {
+	if w.stream {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *pluginWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.decided = true
+		mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		if mediaType == "text/event-stream" {
+			w.stream = true
+			w.ResponseWriter.WriteHeader(w.status)
+		}
+	}
+	if w.stream {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.buf.Write(b)
+}
+
+func (w *pluginWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *pluginWriter) Flush() {
+	if !w.decided {
+		// Streams flush their headers before the first event.
+		w.Write(nil)
+	}
+	if w.stream {
+		w.ResponseWriter.Flush()
+	}
+}
+
+func (w *pluginWriter) Status() int {
+	if w.stream {
+		return w.ResponseWriter.Status()
+	}
+	return w.status
+}
+
+func (w *pluginWriter) Size() int {
+	if w.stream {
+		return w.ResponseWriter.Size()
+	}
+	return w.buf.Len()
+}
+
+func (w *pluginWriter) Written() bool {
+	return w.stream || w.decided
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Errors returned when a provider's pool cannot take a request.
+var (
+	errQueueFull    = errors.New("provider queue is full")
+	errQueueTimeout = errors.New("timed out waiting in the provider queue")
+)
+
+// pool bounds how many upstream requests a provider runs at once. Requests
+// beyond the limit wait in a queue, highest priority first and first come
+// first served within a priority, for up to the queue timeout.
+type pool struct {
+	name     string
+	size     int
+	maxQueue int // 0 means unbounded
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	active  int
+	waiters []*waiter // ordered by priority, then arrival
+}
+
+// waiter is a request queued for a slot. ready is closed when it gets one,
+// or when err is set because a higher priority request took its place.
+type waiter struct {
+	prio  priority
+	ready chan struct{}
+	err   error
+}
+
+func newPool(name string, size, maxQueue int, timeout time.Duration) *pool {
+	return &pool{name: name, size: size, maxQueue: maxQueue, timeout: timeout}
+}
+
+// acquire waits for a free slot. The caller must call release once the
+// request is done. It is safe on a nil pool, which never waits.
+func (p *pool) acquire(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	if p.active < p.size && len(p.waiters) == 0 {
+		p.active++
+		p.mu.Unlock()
+		p.report()
+		return nil
+	}
+	w := &waiter{prio: priorityFrom(ctx), ready: make(chan struct{})}
+	if p.maxQueue > 0 && len(p.waiters) >= p.maxQueue {
+		last := p.waiters[len(p.waiters)-1]
+		if last.prio >= w.prio {
+			p.mu.Unlock()
+			return errQueueFull
+		}
+		// Turn away the newest of the lowest priority waiters instead.
+		p.waiters = p.waiters[:len(p.waiters)-1]
+		last.err = errQueueFull
+		close(last.ready)
+	}
+	i := len(p.waiters)
+	for i > 0 && p.waiters[i-1].prio < w.prio {
+		i--
+	}
+	p.waiters = slices.Insert(p.waiters, i, w)
+	p.mu.Unlock()
+	p.report()
+
+	var timeout <-chan time.Time
+	if p.timeout > 0 {
+		timer := time.NewTimer(p.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-w.ready:
+		return w.err
+	case <-ctx.Done():
+		p.abandon(w)
+		return ctx.Err()
+	case <-timeout:
+		p.abandon(w)
+		return errQueueTimeout
+	}
+}
+
+// abandon removes a waiter that gave up. If it was handed a slot in the
+// meantime, the slot is passed on.
+func (p *pool) abandon(w *waiter) {
+	p.mu.Lock()
+	if i := slices.Index(p.waiters, w); i >= 0 {
+		p.waiters = slices.Delete(p.waiters, i, i+1)
+		p.mu.Unlock()
+		p.report()
+		return
+	}
+	evicted := w.err != nil
+	p.mu.Unlock()
+	if !evicted {
+		p.release()
+	}
+}
+
+// release frees a slot, handing it to the first waiting request if any.
+func (p *pool) release() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if len(p.waiters) > 0 {
+		w := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		close(w.ready)
+	} else {
+		p.active--
+	}
+	p.mu.Unlock()
+	p.report()
+}
+
+// depth returns how many requests are waiting. It is zero for a nil pool.
+func (p *pool) depth() int {
+	if p == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.waiters)
+}
+
+// counts returns the requests holding a slot and those waiting for one.
+func (p *pool) counts() (active, queued int) {
+	if p == nil {
+		return 0, 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active, len(p.waiters)
+}
+
+func (p *pool) report() {
+	active, queued := p.counts()
+	poolActive.WithLabelValues(p.name).Set(float64(active))
+	poolQueued.WithLabelValues(p.name).Set(float64(queued))
+}
+
+// releaseBody releases a pool slot when the response body is closed.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ModelPrice is what a model charges per million tokens.
+type ModelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// defaultPrices returns the list prices of well-known models, which the
+// prices section of the configuration extends or overrides.
+func defaultPrices() map[string]*ModelPrice {
+	return map[string]*ModelPrice{
+		"deepseek-chat":           {Input: 0.27, Output: 1.10},
+		"deepseek-reasoner":       {Input: 0.55, Output: 2.19},
+		"deepseek-ai/DeepSeek-V3": {Input: 0.27, Output: 1.10},
+		"deepseek-ai/DeepSeek-R1": {Input: 0.55, Output: 2.19},
+		"gpt-4o":                  {Input: 2.50, Output: 10.00},
+		"gpt-4o-mini":             {Input: 0.15, Output: 0.60},
+		"gpt-4.1":                 {Input: 2.00, Output: 8.00},
+		"gpt-4.1-mini":            {Input: 0.40, Output: 1.60},
+	}
+}
+
+// cost estimates the price of a request in the price table's currency.
+func (p *ModelPrice) cost(promptTokens, completionTokens int) float64 {
+	return (float64(promptTokens)*p.Input + float64(completionTokens)*p.Output) / 1e6
+}
+
+// tablePrice returns the price of model on provider from the prices
+// section, looked up as provider/model and then as model, or nil.
+func (cfg *Config) tablePrice(provider, model string) *ModelPrice {
+	if p, ok := cfg.Prices[provider+"/"+model]; ok {
+		return p
+	}
+	return cfg.Prices[model]
+}
+
+// priceOf returns the price of model on provider: that of its catalog
+// entry, which validate fills in from the price table when it gives none,
+// or else the price table's. It returns nil when the model is not priced.
+func (cfg *Config) priceOf(provider, model string) *ModelPrice {
+	for _, m := range cfg.Models {
+		if m.Provider == provider && m.Model == model {
+			return &ModelPrice{Input: m.InputPrice, Output: m.OutputPrice}
+		}
+	}
+	return cfg.tablePrice(provider, model)
+}
+
+// usageCost estimates the cost of the tokens of a usage record, zero when
+// its model is not priced.
+func (cfg *Config) usageCost(r UsageRecord) float64 {
+	p := cfg.priceOf(r.Provider, r.Model)
+	if p == nil {
+		return 0
+	}
+	return p.cost(r.PromptTokens, r.CompletionTokens)
+}
+
+// setCostHeader sends the estimated cost of an answer that used usage in
+// X-Cost, when the model of tgt is priced.
+func setCostHeader(c *gin.Context, tgt target, usage UsageInfo) {
+	if cost, ok := tgt.cost(usage); ok {
+		c.Header("X-Cost", strconv.FormatFloat(cost, 'f', -1, 64))
+	}
+}
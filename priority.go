@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// priority orders requests waiting for a provider's pool: higher priorities
+// are served first.
+type priority int
+
+const (
+	priorityLow priority = iota
+	priorityNormal
+	priorityHigh
+)
+
+// priorityNames are the names used in client configs and the X-Priority
+// header.
+var priorityNames = map[string]priority{
+	"low":    priorityLow,
+	"normal": priorityNormal,
+	"high":   priorityHigh,
+}
+
+func (p priority) String() string {
+	for name, v := range priorityNames {
+		if v == p {
+			return name
+		}
+	}
+	return "normal"
+}
+
+// parsePriority returns the named priority.
+func parsePriority(name string) (priority, bool) {
+	p, ok := priorityNames[strings.ToLower(strings.TrimSpace(name))]
+	return p, ok
+}
+
+type priorityKey struct{}
+
+// withPriority returns ctx carrying the priority of its upstream calls.
+func withPriority(ctx context.Context, p priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// priorityFrom returns the priority carried by ctx, normal by default.
+func priorityFrom(ctx context.Context) priority {
+	if p, ok := ctx.Value(priorityKey{}).(priority); ok {
+		return p
+	}
+	return priorityNormal
+}
+
+// assignPriority sets the request's priority from its client's tier, normal
+// for anonymous callers. The X-Priority header may lower it, so a client
+// can mark its own background jobs, but never raise it above the tier.
+func (s *server) assignPriority(c *gin.Context) {
+	p := priorityNormal
+	if cl := clientFrom(c); cl != nil && cl.Priority != "" {
+		p, _ = parsePriority(cl.Priority)
+	}
+	if requested, ok := parsePriority(c.GetHeader("X-Priority")); ok && requested < p {
+		p = requested
+	}
+	c.Request = c.Request.WithContext(withPriority(c.Request.Context(), p))
+	c.Next()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// deletionReceipt confirms what was deleted for a user.
+type deletionReceipt struct {
+	ReceiptID   string    `json:"receipt_id"`
+	User        string    `json:"user"`
+	DeletedAt   time.Time `json:"deleted_at"`
+	Sessions    int       `json:"sessions"`
+	Memories    int       `json:"memories"`
+	Completions int       `json:"completions"`
+	Usage       int       `json:"usage_records"`
+}
+
+// ownerFor returns the ID of the authenticated client, which owns what the
+// request stores, or "" for anonymous callers.
+func ownerFor(c *gin.Context) string {
+	if cl := clientFrom(c); cl != nil {
+		return cl.ID
+	}
+	return ""
+}
+
+// handleDeleteUserData purges the stored data of the client named in the
+// path on an operator's behalf.
+func (s *server) handleDeleteUserData(c *gin.Context) {
+	s.deleteData(c, c.Param("id"))
+}
+
+// handleDeleteMyData purges the stored data of the calling client.
+func (s *server) handleDeleteMyData(c *gin.Context) {
+	owner := ownerFor(c)
+	if owner == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required: anonymous data is not tied to you."})
+		return
+	}
+	s.deleteData(c, owner)
+}
+
+func (s *server) deleteData(c *gin.Context, owner string) {
+	sessions, memories, completions, usage, err := s.store.DeleteOwnerData(owner)
+	if err != nil {
+		log.Printf("Error deleting data of %s: %v", owner, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+
+	receipt := deletionReceipt{ReceiptID: newID(), User: owner, DeletedAt: time.Now().UTC(), Sessions: sessions, Memories: memories, Completions: completions, Usage: usage}
+	auditNote(c, "deleted data of %s, receipt %s", owner, receipt.ReceiptID)
+	log.Printf("Deleted data of %s: %d sessions, %d memories, %d completions, %d usage records (receipt %s)", owner, sessions, memories, completions, usage, receipt.ReceiptID)
+	c.JSON(http.StatusOK, receipt)
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Balancing strategies for providers with several endpoints.
+const (
+	balanceRoundRobin       = "round_robin"
+	balanceLeastConnections = "least_connections"
+)
+
+var errNoEndpoint = errors.New("no endpoint configured")
+
+// endpoint is one base URL of a provider, e.g. a single vLLM replica.
+type endpoint struct {
+	baseURL   string
+	inflight  atomic.Int64
+	healthy   atomic.Bool
+	lastProbe atomic.Pointer[probeResult]
+}
+
+// apiKey is one generation of a provider's API key, counting the requests
+// still using it so a rotated key can be drained.
+type apiKey struct {
+	value    string
+	inflight atomic.Int64
+}
+
+// provider sends chat completion requests to an OpenAI-compatible API,
+// spreading them over the provider's endpoints.
+type provider struct {
+	name      string
+	cfg       *ProviderConfig
+	apiKey    atomic.Pointer[apiKey]
+	balance   string
+	endpoints []*endpoint
+	next      atomic.Uint64
+
+	// The clients share one transport. completeClient bounds a whole
+	// non-streamed request, streamClient has no overall limit (a stream
+	// lasts as long as the generation), probeClient is for health checks.
+	completeClient *http.Client
+	streamClient   *http.Client
+	probeClient    *http.Client
+
+	// shedding is the load shedding thresholds, or nil.
+	shedding *LoadSheddingConfig
+
+	// pool bounds concurrent upstream requests; nil without
+	// max_concurrency.
+	pool *pool
+
+	// warmup is the outcome of the last warmup, nil before the first.
+	warmup atomic.Pointer[warmupResult]
+
+	// inflight collapses identical concurrent completions; nil when
+	// dedupe_inflight is off.
+	inflight *singleflight.Group
+
+	// retryBudget is the longest Retry-After the client waits out before
+	// retrying a 429 once. Longer waits are passed on to the caller.
+	retryBudget time.Duration
+
+	// alerts notifies operators of outages and rejected keys; down is
+	// set while no endpoint is healthy.
+	alerts *alerter
+	down   atomic.Bool
+}
+
+// newProvider creates a provider from its configuration. All endpoints start
+// out healthy.
+func newProvider(name string, pc *ProviderConfig, cfg *Config, apiKey string) (*provider, error) {
+	proxy := pc.Proxy
+	if proxy == "" {
+		proxy = cfg.Proxy
+	}
+	transport, err := providerTransport(proxy, pc.TLS, &cfg.HTTPClient)
+	if err != nil {
+		return nil, fmt.Errorf("provider %s: %w", name, err)
+	}
+	if pc.TLS != nil && pc.TLS.InsecureSkipVerify {
+		log.Printf("Warning: TLS certificate verification is disabled for provider %s", name)
+	}
+
+	p := &provider{
+		name:           name,
+		cfg:            pc,
+		balance:        pc.Balance,
+		completeClient: &http.Client{Transport: transport, Timeout: cmp.Or(cfg.HTTPClient.RequestTimeout.Duration, defaultRequestTimeout)},
+		streamClient:   &http.Client{Transport: transport},
+		probeClient:    &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		retryBudget:    cfg.RetryBudget.Duration,
+	}
+	for _, u := range pc.BaseURLs {
+		ep := &endpoint{baseURL: strings.TrimSuffix(u, "/")}
+		ep.healthy.Store(true)
+		p.endpoints = append(p.endpoints, ep)
+	}
+	p.shedding = cfg.LoadShedding
+	if pc.MaxConcurrency > 0 {
+		p.pool = newPool(name, pc.MaxConcurrency, pc.MaxQueue, pc.QueueTimeout.Duration)
+	}
+	if cfg.DedupeInflight {
+		p.inflight = &singleflight.Group{}
+	}
+	p.setKey(apiKey)
+	return p, nil
+}
+
+// key returns the provider's current API key.
+func (p *provider) key() string {
+	return p.apiKey.Load().value
+}
+
+// setKey replaces the API key used for new requests and reports whether it
+// changed. Requests already sent keep the key they started with; once the
+// last of them finishes the old key is reported as drained.
+func (p *provider) setKey(key string) bool {
+	if old := p.apiKey.Load(); old != nil && old.value == key {
+		return false
+	}
+	old := p.apiKey.Swap(&apiKey{value: key})
+	if old != nil {
+		go p.drain(old)
+	}
+	return true
+}
+
+// drain waits for the requests using a replaced key to finish.
+func (p *provider) drain(old *apiKey) {
+	for old.inflight.Load() > 0 {
+		time.Sleep(time.Second)
+	}
+	log.Printf("Provider %s: requests using the previous API key have drained", p.name)
+}
+
+// candidates returns the provider's endpoints in the order they should be
+// tried: healthy ones first, ordered by the balancing strategy, then the
+// unhealthy ones as a last resort.
+func (p *provider) candidates() []*endpoint {
+	n := len(p.endpoints)
+	start := int(p.next.Add(1)-1) % max(n, 1)
+
+	ordered := make([]*endpoint, 0, n)
+	for i := range n {
+		ordered = append(ordered, p.endpoints[(start+i)%n])
+	}
+	if p.balance == balanceLeastConnections {
+		// Stable, so ties keep the round-robin order.
+		slices.SortStableFunc(ordered, func(a, b *endpoint) int {
+			return cmp.Compare(a.inflight.Load(), b.inflight.Load())
+		})
+	}
+	slices.SortStableFunc(ordered, func(a, b *endpoint) int {
+		return cmp.Compare(healthRank(a), healthRank(b))
+	})
+	return ordered
+}
+
+// healthRank orders healthy endpoints before unhealthy ones.
+func healthRank(ep *endpoint) int {
+	if ep.healthy.Load() {
+		return 0
+	}
+	return 1
+}
+
+// trackedBody releases the endpoint's connection count and the key's
+// request count when the response body is closed, so streamed responses
+// count for their whole duration.
+type trackedBody struct {
+	io.ReadCloser
+	once sync.Once
+	ep   *endpoint
+	key  *apiKey
+}
+
+func (b *trackedBody) Close() error {
+	b.once.Do(func() {
+		b.ep.inflight.Add(-1)
+		b.key.inflight.Add(-1)
+	})
+	return b.ReadCloser.Close()
+}
+
+// newRequest builds the HTTP request posting an encoded body to path under
+// the endpoint's base URL. The request is tied to ctx, so cancelling ctx
+// aborts the upstream call.
+func (p *provider) newRequest(ctx context.Context, ep *endpoint, key *apiKey, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", ep.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("creating HTTP request: %w", err)
+	}
+	for k, v := range forwardedHeaders(ctx) {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// Add Authorization header with your API key
+	req.Header.Set("Authorization", "Bearer "+key.value)
+	return req, nil
+}
+
+// send posts body to the first endpoint that accepts the connection,
+// marking endpoints that cannot be reached as unhealthy and the one that
+// answers as healthy.
+func (p *provider) send(ctx context.Context, client *http.Client, path string, body []byte, header http.Header) (*http.Response, error) {
+	var lastErr error = errNoEndpoint
+	for _, ep := range p.candidates() {
+		key := p.apiKey.Load()
+		req, err := p.newRequest(ctx, ep, key, path, body)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		ep.inflight.Add(1)
+		key.inflight.Add(1)
+		resp, err := client.Do(req)
+		if err != nil {
+			ep.inflight.Add(-1)
+			key.inflight.Add(-1)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if p.setHealth(ep, false) {
+				log.Printf("Provider %s endpoint %s marked unhealthy: %v", p.name, ep.baseURL, err)
+			}
+			lastErr = err
+			continue
+		}
+		if p.setHealth(ep, true) {
+			log.Printf("Provider %s endpoint %s marked healthy", p.name, ep.baseURL)
+		}
+		resp.Body = &trackedBody{ReadCloser: resp.Body, ep: ep, key: key}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("%w: %w", errUpstreamUnreachable, lastErr)
+}
+
+// do posts body and returns the upstream response whatever its status. A
+// 429 whose Retry-After fits within the retry budget is waited out and
+// retried once. The request holds a slot of the provider's pool until the
+// response body is closed.
+func (p *provider) do(ctx context.Context, client *http.Client, body []byte, header http.Header) (*http.Response, error) {
+	return p.doPath(ctx, client, "/chat/completions", body, header)
+}
+
+// doPath is do for another API path, such as /embeddings.
+func (p *provider) doPath(ctx context.Context, client *http.Client, path string, body []byte, header http.Header) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := p.shedLoad(ctx); err != nil {
+			return nil, err
+		}
+		if err := p.pool.acquire(ctx); err != nil {
+			return nil, err
+		}
+		resp, err := p.send(ctx, client, path, body, header)
+		if err != nil {
+			p.pool.release()
+			return nil, err
+		}
+		p.checkKey(resp.StatusCode)
+		if p.pool != nil {
+			resp.Body = &releaseBody{ReadCloser: resp.Body, release: p.pool.release}
+		}
+		if resp.StatusCode != http.StatusTooManyRequests || attempt > 0 || p.retryBudget <= 0 {
+			return resp, nil
+		}
+
+		wait, _ := parseRetryAfter(resp.Header.Get("Retry-After"))
+		if wait > p.retryBudget {
+			return resp, nil
+		}
+		resp.Body.Close()
+		log.Printf("Provider %s rate limited the request, retrying in %s", p.name, wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// complete sends a chat completion request and returns the text of the
+// first choice.
+func (p *provider) complete(ctx context.Context, payload DeepSeekRequestPayload) (string, error) {
+	answer, _, err := p.completeUsage(ctx, payload)
+	return answer, err
+}
+
+// completeUsage is complete that also returns the token usage the upstream
+// reported, which is zero when it reported none. With dedupe_inflight,
+// identical requests made while one is in flight share its upstream call.
+func (p *provider) completeUsage(ctx context.Context, payload DeepSeekRequestPayload) (string, UsageInfo, error) {
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return "", UsageInfo{}, fmt.Errorf("marshaling JSON request: %w", err)
+	}
+	if p.inflight == nil {
+		return p.fetch(ctx, payload, jsonPayload)
+	}
+
+	type result struct {
+		answer string
+		usage  UsageInfo
+	}
+	sum := sha256.Sum256(jsonPayload)
+	ran := false
+	// The shared call must outlive the first caller if it goes away.
+	ch := p.inflight.DoChan(string(sum[:]), func() (any, error) {
+		ran = true
+		answer, usage, err := p.fetch(context.WithoutCancel(ctx), payload, jsonPayload)
+		return result{answer, usage}, err
+	})
+	select {
+	case r := <-ch:
+		res := r.Val.(result)
+		if !ran {
+			// The call counted its usage to the caller that ran it; every
+			// caller that shares the answer is charged the same.
+			dedupedRequests.WithLabelValues(p.name).Inc()
+			if res.usage.TotalTokens > 0 {
+				countUsage(ctx, p.name, payload.Model, res.usage)
+			}
+		}
+		return res.answer, res.usage, r.Err
+	case <-ctx.Done():
+		return "", UsageInfo{}, ctx.Err()
+	}
+}
+
+// fetch makes the upstream call of completeUsage.
+func (p *provider) fetch(ctx context.Context, payload DeepSeekRequestPayload, jsonPayload []byte) (answer string, usage UsageInfo, err error) {
+	start := time.Now()
+	defer func() { observeLatency(ctx, p.name, payload.Model, 0, time.Since(start), err) }()
+
+	resp, err := p.do(ctx, p.completeClient, jsonPayload, nil)
+	if err != nil {
+		return "", usage, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", usage, newStatusError(resp)
+	}
+	defer resp.Body.Close() // Close response body after use
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", usage, fmt.Errorf("reading response body: %w", err)
+	}
+
+	var deepseekResponse DeepSeekResponsePayload
+	if err := json.Unmarshal(body, &deepseekResponse); err != nil {
+		return "", usage, fmt.Errorf("%w: %v", errUpstreamFormat, err)
+	}
+	usage = deepseekResponse.Usage
+
+	if len(deepseekResponse.Choices) == 0 || deepseekResponse.Choices[0].Message.Content == "" {
+		recordUsage(ctx, p, payload, &usage, "")
+		return "", usage, errEmptyCompletion
+	}
+	answer = deepseekResponse.Choices[0].Message.Content
+	usage = recordUsage(ctx, p, payload, &usage, answer)
+	observeThroughput(ctx, p.name, payload.Model, usage.CompletionTokens, 0, time.Since(start))
+	return answer, usage, nil
+}
+
+// completeStream sends payload as a streaming request and calls onDelta with
+// each piece of generated text as it arrives. When onDelta returns an error
+// or ctx is cancelled, the upstream stream is closed immediately. It returns
+// the usage of the stream, as reported or estimated, and the finish reason
+// the upstream gave, if any.
+func (p *provider) completeStream(ctx context.Context, payload DeepSeekRequestPayload, onDelta func(string) error) (usage UsageInfo, finishReason string, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	payload.Stream = true
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return usage, finishReason, fmt.Errorf("marshaling JSON request: %w", err)
+	}
+
+	start := time.Now()
+	var ttft time.Duration
+	defer func() { observeLatency(ctx, p.name, payload.Model, ttft, time.Since(start), err) }()
+
+	resp, err := p.do(ctx, p.streamClient, jsonPayload, http.Header{"Accept": {"text/event-stream"}})
+	if err != nil {
+		return usage, finishReason, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return usage, finishReason, newStatusError(resp)
+	}
+	defer resp.Body.Close()
+
+	// Tokens are spent however the stream ends.
+	var reported *UsageInfo
+	var answer strings.Builder
+	defer func() {
+		usage = recordUsage(ctx, p, payload, reported, answer.String())
+		if err == nil {
+			observeThroughput(ctx, p.name, payload.Model, usage.CompletionTokens, ttft, time.Since(start))
+		}
+	}()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			return usage, finishReason, nil
+		}
+
+		var chunk StreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return usage, finishReason, fmt.Errorf("%w: %v", errUpstreamFormat, err)
+		}
+		if chunk.Usage != nil {
+			reported = chunk.Usage
+		}
+		if len(chunk.Choices) > 0 && chunk.Choices[0].FinishReason != nil {
+			finishReason = *chunk.Choices[0].FinishReason
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+		if ttft == 0 {
+			ttft = time.Since(start)
+		}
+		answer.WriteString(chunk.Choices[0].Delta.Content)
+		if err := onDelta(chunk.Choices[0].Delta.Content); err != nil {
+			return usage, finishReason, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return usage, finishReason, fmt.Errorf("reading response stream: %w", err)
+	}
+	return usage, finishReason, nil
+}
+
+// healthCheck probes every endpoint with GET /models each interval until ctx
+// is done. An endpoint is healthy when it answers without a 5xx status.
+func (p *provider) healthCheck(ctx context.Context, interval time.Duration) {
+	client := p.probeClient
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, ep := range p.endpoints {
+			healthy := p.probe(ctx, client, ep)
+			if p.setHealth(ep, healthy) {
+				log.Printf("Provider %s endpoint %s healthy=%t", p.name, ep.baseURL, healthy)
+			}
+		}
+	}
+}
+
+func (p *provider) probe(ctx context.Context, client *http.Client, ep *endpoint) bool {
+	req, err := http.NewRequestWithContext(ctx, "GET", ep.baseURL+"/models", nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Authorization", "Bearer "+p.key())
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		ep.recordProbe(start, 0, err)
+		return false
+	}
+	resp.Body.Close()
+	ep.recordProbe(start, resp.StatusCode, nil)
+	p.checkKey(resp.StatusCode)
+	return resp.StatusCode < http.StatusInternalServerError
+}
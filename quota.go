@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// limitAnonymous enforces the daily anonymous_limits on callers that are not
+// an authenticated client. Usage is kept in the store so a restart does not
+// reset it.
+func (s *server) limitAnonymous(c *gin.Context) {
+	if clientFrom(c) != nil {
+		c.Next()
+		return
+	}
+
+	lim := s.cfg.AnonymousLimits
+	ip := c.ClientIP()
+	now := time.Now().UTC()
+	day := now.Format(time.DateOnly)
+
+	// Checking and counting the request at once keeps concurrent requests
+	// from all passing the check.
+	u, allowed, err := s.store.ReserveAnonymousRequest(ip, day, lim.RequestsPerDay, lim.TokensPerDay)
+	if err != nil {
+		log.Printf("Error saving anonymous usage: %v", err)
+	}
+	midnight := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+	if lim.RequestsPerDay > 0 {
+		remaining := max(lim.RequestsPerDay-u.Requests, 0)
+		if !allowed {
+			remaining = 0
+		}
+		noteRateLimit(c, rateLimit{limit: lim.RequestsPerDay, remaining: remaining, reset: midnight, window: 24 * time.Hour})
+	}
+	if !allowed {
+		auditNote(c, "rate limited: anonymous daily limit")
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(midnight.Sub(now).Seconds()))))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": localize(c, "anonymous_limit")})
+		return
+	}
+
+	ctx, meter := withUsageMeter(c.Request.Context())
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	if tokens := meter.total().TotalTokens; tokens > 0 {
+		if err := s.store.AddAnonymousUsage(ip, day, 0, tokens); err != nil {
+			log.Printf("Error saving anonymous usage: %v", err)
+		}
+	}
+}
+
+// Quota periods.
+const (
+	quotaDay   = "day"
+	quotaMonth = "month"
+)
+
+// quotaThresholds are the percentages of a quota at which its owner is
+// notified.
+var quotaThresholds = []int{80, 100}
+
+// quotaPeriod returns the key of the period q counts now in and when the
+// next one starts.
+func quotaPeriod(q *QuotaConfig, now time.Time) (period string, reset time.Time) {
+	now = now.UTC()
+	if q.Period == quotaDay {
+		return now.Format(time.DateOnly), now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+	}
+	return now.Format("2006-01"), time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// limitClient enforces the quota of authenticated clients that have one.
+// Every response carries X-Quota-Remaining-Requests and
+// X-Quota-Remaining-Tokens (after this request's count, before its tokens)
+// with the matching limits and X-Quota-Reset, the Unix time the period
+// ends. Clients over a limit get 429 until then.
+func (s *server) limitClient(c *gin.Context) {
+	cl := clientFrom(c)
+	if cl == nil || cl.Quota == nil {
+		c.Next()
+		return
+	}
+
+	q := cl.Quota
+	now := time.Now()
+	period, reset := quotaPeriod(q, now)
+	c.Header("X-Quota-Reset", strconv.FormatInt(reset.Unix(), 10))
+
+	u, allowed, err := s.store.ReserveClientRequest(cl.ID, period, q.Requests, q.Tokens)
+	if err != nil {
+		log.Printf("Error saving client usage: %v", err)
+	}
+	if !allowed {
+		setQuotaHeaders(c, q, u)
+		if q.Requests > 0 {
+			noteRateLimit(c, rateLimit{limit: q.Requests, remaining: 0, reset: reset, window: quotaWindow(q, reset)})
+		}
+		auditNote(c, "rate limited: client quota")
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(reset.Sub(now).Seconds()))))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": localize(c, "quota_used_up_"+quotaPeriodName(q))})
+		return
+	}
+	setQuotaHeaders(c, q, u)
+	if q.Requests > 0 {
+		noteRateLimit(c, rateLimit{limit: q.Requests, remaining: max(q.Requests-u.Requests, 0), reset: reset, window: quotaWindow(q, reset)})
+	}
+
+	ctx, meter := withUsageMeter(c.Request.Context())
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	if tokens := meter.total().TotalTokens; tokens > 0 {
+		if u, err = s.store.AddClientUsage(cl.ID, period, 0, tokens); err != nil {
+			log.Printf("Error saving client usage: %v", err)
+		}
+	}
+	if q.Webhook != "" {
+		s.notifyQuota(cl, period, u)
+	}
+}
+
+// setQuotaHeaders reports the limits of q and what is left of them after u.
+func setQuotaHeaders(c *gin.Context, q *QuotaConfig, u PeriodUsage) {
+	if q.Requests > 0 {
+		c.Header("X-Quota-Limit-Requests", strconv.Itoa(q.Requests))
+		c.Header("X-Quota-Remaining-Requests", strconv.Itoa(max(q.Requests-u.Requests, 0)))
+	}
+	if q.Tokens > 0 {
+		c.Header("X-Quota-Limit-Tokens", strconv.Itoa(q.Tokens))
+		c.Header("X-Quota-Remaining-Tokens", strconv.Itoa(max(q.Tokens-u.Tokens, 0)))
+	}
+}
+
+// quotaWindow returns the length of the period of q ending at reset.
+func quotaWindow(q *QuotaConfig, reset time.Time) time.Duration {
+	if q.Period == quotaDay {
+		return 24 * time.Hour
+	}
+	return reset.Sub(reset.AddDate(0, -1, 0))
+}
+
+func quotaPeriodName(q *QuotaConfig) string {
+	if q.Period == quotaDay {
+		return quotaDay
+	}
+	return quotaMonth
+}
+
+// notifyQuota posts to the quota webhook of cl, in the background, when u
+// crossed a threshold its owner has not been told about this period.
+func (s *server) notifyQuota(cl *ClientConfig, period string, u PeriodUsage) {
+	q := cl.Quota
+	used := 0
+	if q.Requests > 0 {
+		used = u.Requests * 100 / q.Requests
+	}
+	if q.Tokens > 0 {
+		used = max(used, u.Tokens*100/q.Tokens)
+	}
+	threshold := 0
+	for _, t := range quotaThresholds {
+		if used >= t {
+			threshold = t
+		}
+	}
+	if threshold == 0 {
+		return
+	}
+	ok, err := s.store.MarkQuotaNotified(cl.ID, period, threshold)
+	if err != nil {
+		log.Printf("Error saving client usage: %v", err)
+	}
+	if !ok {
+		return
+	}
+
+	payload := gin.H{
+		"client":    cl.ID,
+		"period":    period,
+		"threshold": threshold,
+		"requests":  gin.H{"used": u.Requests, "limit": q.Requests},
+		"tokens":    gin.H{"used": u.Tokens, "limit": q.Tokens},
+	}
+	go func() {
+		if err := postJSON(context.Background(), q.Webhook, payload); err != nil {
+			log.Printf("Error notifying client %s of its quota: %v", cl.ID, err)
+		}
+	}()
+}
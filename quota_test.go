@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestClientQuota(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	st, err := openStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{cfg: defaultConfig(), store: st}
+	cl := &ClientConfig{ID: "ci", Quota: &QuotaConfig{Period: quotaDay, Requests: 2}}
+	router := gin.New()
+	router.GET("/ask", func(c *gin.Context) { c.Set(clientContextKey, cl) }, s.limitClient, func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	for i, want := range []struct {
+		status    int
+		remaining string
+	}{{http.StatusOK, "1"}, {http.StatusOK, "0"}, {http.StatusTooManyRequests, "0"}} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ask", nil))
+		if w.Code != want.status || w.Header().Get("X-Quota-Remaining-Requests") != want.remaining {
+			t.Errorf("request %d: status %d, %s requests left, want %d and %s", i+1, w.Code, w.Header().Get("X-Quota-Remaining-Requests"), want.status, want.remaining)
+		}
+	}
+	period, _ := quotaPeriod(cl.Quota, time.Now())
+	if u := st.ClientUsage("ci", period); u.Requests != 2 {
+		t.Errorf("counted %d requests, want the 2 allowed", u.Requests)
+	}
+}
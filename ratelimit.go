@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// windowLimiter allows up to limit events per key in each fixed time window.
+type windowLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu      sync.Mutex
+	windows map[string]*limitWindow
+}
+
+type limitWindow struct {
+	start time.Time
+	count int
+}
+
+func newWindowLimiter(limit int, window time.Duration) *windowLimiter {
+	return &windowLimiter{limit: limit, window: window, windows: map[string]*limitWindow{}}
+}
+
+// allow records an event for key and reports whether it is within the
+// limit, how many events remain, and when the current window resets.
+func (l *windowLimiter) allow(key string) (ok bool, remaining int, reset time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	w, found := l.windows[key]
+	if !found || now.Sub(w.start) >= l.window {
+		// Drop expired windows so idle keys do not accumulate.
+		for k, old := range l.windows {
+			if now.Sub(old.start) >= l.window {
+				delete(l.windows, k)
+			}
+		}
+		w = &limitWindow{start: now.Truncate(l.window)}
+		l.windows[key] = w
+	}
+
+	reset = w.start.Add(l.window)
+	if w.count >= l.limit {
+		return false, 0, reset
+	}
+	w.count++
+	return true, l.limit - w.count, reset
+}
+
+// rateLimitContextKey is the gin context key holding the rateLimit
+// reported for the request.
+const rateLimitContextKey = "askllm.ratelimit"
+
+// rateLimit is the state of one request limit for the current caller.
+type rateLimit struct {
+	limit     int
+	remaining int
+	reset     time.Time
+	window    time.Duration
+}
+
+// noteRateLimit reports rl in the response headers unless a limit closer to
+// running out was already reported: X-RateLimit-Limit, -Remaining and
+// -Reset (a Unix time) as well as the IETF RateLimit-Limit, -Remaining,
+// -Reset (in seconds) and RateLimit-Policy.
+func noteRateLimit(c *gin.Context, rl rateLimit) {
+	if v, ok := c.Get(rateLimitContextKey); ok {
+		if prev := v.(rateLimit); prev.remaining < rl.remaining || (prev.remaining == rl.remaining && prev.reset.Before(rl.reset)) {
+			return
+		}
+	}
+	c.Set(rateLimitContextKey, rl)
+
+	secs := max(int(math.Ceil(time.Until(rl.reset).Seconds())), 0)
+	c.Header("X-RateLimit-Limit", strconv.Itoa(rl.limit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(rl.remaining))
+	c.Header("X-RateLimit-Reset", strconv.FormatInt(rl.reset.Unix(), 10))
+	c.Header("RateLimit-Limit", strconv.Itoa(rl.limit))
+	c.Header("RateLimit-Remaining", strconv.Itoa(rl.remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(secs))
+	c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rl.limit, int(rl.window.Seconds())))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// runReindex rebuilds the index files of knowledge bases, so a server can
+// load them at startup or on reload rather than embed every document.
+func runReindex(args []string) int {
+	fs := flag.NewFlagSet("reindex", flag.ContinueOnError)
+	only := fs.String("kb", "", "knowledge base to reindex, all that have an index_file when empty")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx := context.Background()
+	cfg, providers, err := loadCommandConfig(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error %v\n", err)
+		return 2
+	}
+	var names []string
+	for name, kc := range cfg.KnowledgeBases {
+		if *only == "" && kc.IndexFile != "" || name == *only {
+			names = append(names, name)
+		}
+	}
+	if *only != "" && len(names) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: knowledge base %q is not defined\n", *only)
+		return 2
+	}
+	if len(names) == 0 {
+		fmt.Fprintln(os.Stderr, "No knowledge base has an index_file.")
+		return 2
+	}
+	slices.Sort(names)
+
+	code := 0
+	for _, name := range names {
+		kc := cfg.KnowledgeBases[name]
+		if kc.IndexFile == "" {
+			fmt.Fprintf(os.Stderr, "Error: knowledge base %s has no index_file\n", name)
+			code = 1
+			continue
+		}
+		kb := &knowledgeBase{name: name, cfg: kc}
+		if err := kb.index(ctx, providers[kc.Provider]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error indexing knowledge base %s: %v\n", name, err)
+			code = 1
+			continue
+		}
+		fmt.Printf("%s: %d entries written to %s\n", name, len(kb.entries), kc.IndexFile)
+	}
+	return code
+}
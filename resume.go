@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamBuffer holds the tokens of a streamed answer while it is generated
+// and, with stream_resume_window, for that long after its client went
+// away, so the client can reconnect with Last-Event-ID and pick up where
+// it left off.
+type streamBuffer struct {
+	id, owner string
+	cancel    context.CancelFunc // stops the generation
+
+	mu       sync.Mutex
+	tokens   []string
+	done     bool
+	final    gin.H // data of the done event
+	err      error // why the generation failed
+	changed  chan struct{}
+	attached int
+	expiry   *time.Timer
+}
+
+// streamBuffers are the buffers of the streams in progress or resumable,
+// by stream ID.
+type streamBuffers struct {
+	mu      sync.Mutex
+	buffers map[string]*streamBuffer
+}
+
+var resumableStreams = &streamBuffers{}
+
+// start registers the buffer of a new stream for owner, attached to its
+// first client.
+func (r *streamBuffers) start(owner string, cancel context.CancelFunc) *streamBuffer {
+	b := &streamBuffer{id: newID(), owner: owner, cancel: cancel, changed: make(chan struct{}), attached: 1}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.buffers == nil {
+		r.buffers = map[string]*streamBuffer{}
+	}
+	r.buffers[b.id] = b
+	return b
+}
+
+// resume attaches a reconnecting client of owner to the stream named by
+// lastEventID, "<stream ID>-<tokens received>", and returns its buffer and
+// the offset to continue from.
+func (r *streamBuffers) resume(owner, lastEventID string) (*streamBuffer, int, bool) {
+	id, n, ok := strings.Cut(lastEventID, "-")
+	offset, err := strconv.Atoi(n)
+	if !ok || err != nil || offset < 0 {
+		return nil, 0, false
+	}
+	r.mu.Lock()
+	b := r.buffers[id]
+	r.mu.Unlock()
+	if b == nil || b.owner != owner {
+		return nil, 0, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if offset > len(b.tokens) {
+		return nil, 0, false
+	}
+	b.attached++
+	if b.expiry != nil {
+		b.expiry.Stop()
+		b.expiry = nil
+	}
+	return b, offset, true
+}
+
+// remove forgets the buffer with the given ID.
+func (r *streamBuffers) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.buffers, id)
+}
+
+// eventID is the SSE ID of the event carrying the n-th token of b.
+func (b *streamBuffer) eventID(n int) string {
+	return b.id + "-" + strconv.Itoa(n)
+}
+
+// append adds a generated token.
+func (b *streamBuffer) append(token string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = append(b.tokens, token)
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// finish ends the stream with the data of its done event, or with err.
+func (b *streamBuffer) finish(final gin.H, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.done, b.final, b.err = true, final, err
+	close(b.changed)
+}
+
+// next returns the tokens from offset on, whether the stream is done, and
+// a channel that is closed when there is more.
+func (b *streamBuffer) next(offset int) ([]string, bool, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens[offset:], b.done, b.changed
+}
+
+// detach records that a client went away. Once no client is attached the
+// buffer is kept for window, the generation continuing meanwhile, and then
+// dropped, which stops a generation still in progress.
+func (b *streamBuffer) detach(window time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.attached--; b.attached > 0 {
+		return
+	}
+	drop := func() {
+		resumableStreams.remove(b.id)
+		b.cancel()
+	}
+	if window <= 0 {
+		drop()
+		return
+	}
+	b.expiry = time.AfterFunc(window, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.attached == 0 {
+			drop()
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// purgeExpired deletes the data older than the retention policy every
+// interval until ctx is done.
+func (s *server) purgeExpired(ctx context.Context, rc *RetentionConfig) {
+	ticker := time.NewTicker(rc.Interval.Duration)
+	defer ticker.Stop()
+
+	for {
+		s.purgeOnce(rc)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *server) purgeOnce(rc *RetentionConfig) {
+	now := time.Now()
+	if rc.Sessions.Duration > 0 {
+		n, err := s.store.PurgeSessions(now.Add(-rc.Sessions.Duration))
+		s.reportPurge("sessions", n, err)
+	}
+	if rc.Usage.Duration > 0 {
+		n, err := s.store.PurgeUsage(now.Add(-rc.Usage.Duration))
+		s.reportPurge("usage", n, err)
+	}
+	if rc.Completions.Duration > 0 {
+		n, err := s.store.PurgeCompletions(now.Add(-rc.Completions.Duration))
+		s.reportPurge("completions", n, err)
+	}
+}
+
+func (s *server) reportPurge(kind string, n int, err error) {
+	if err != nil {
+		log.Printf("Error purging expired %s: %v", kind, err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Retention: purged %d %s", n, kind)
+		retentionPurged.WithLabelValues(kind).Add(float64(n))
+	}
+}
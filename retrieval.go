@@ -0,0 +1,124 @@
+package main
+
+import (
+	"cmp"
+	"math"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// BM25 parameters, with the usual values.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+
+	// rrfK damps the weight of the top ranks in reciprocal rank fusion.
+	rrfK = 60
+)
+
+// Retrieval modes of knowledge bases.
+const (
+	retrievalHybrid = "hybrid"
+	retrievalVector = "vector"
+)
+
+// bm25Index scores texts against a query with Okapi BM25, which finds the
+// exact identifiers and error codes that embeddings blur.
+type bm25Index struct {
+	docs    []map[string]int // term frequencies of each text
+	lengths []int
+	avgLen  float64
+	df      map[string]int // how many texts contain each term
+}
+
+// lexicalTerms splits text into lowercase words, keeping underscores and
+// digits inside them so identifiers like ERR_QUOTA_42 stay whole.
+func lexicalTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '_'
+	})
+}
+
+func newBM25Index(texts []string) *bm25Index {
+	idx := &bm25Index{df: map[string]int{}}
+	total := 0
+	for _, text := range texts {
+		terms := lexicalTerms(text)
+		tf := map[string]int{}
+		for _, t := range terms {
+			tf[t]++
+		}
+		for t := range tf {
+			idx.df[t]++
+		}
+		idx.docs = append(idx.docs, tf)
+		idx.lengths = append(idx.lengths, len(terms))
+		total += len(terms)
+	}
+	if len(texts) > 0 {
+		idx.avgLen = float64(total) / float64(len(texts))
+	}
+	return idx
+}
+
+// scores returns the BM25 score of every text for query, zero for texts
+// sharing no term with it.
+func (idx *bm25Index) scores(query string) []float64 {
+	scores := make([]float64, len(idx.docs))
+	if idx.avgLen == 0 {
+		return scores
+	}
+	n := float64(len(idx.docs))
+	for _, t := range uniqueTerms(lexicalTerms(query)) {
+		df := float64(idx.df[t])
+		if df == 0 {
+			continue
+		}
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for i, tf := range idx.docs {
+			f := float64(tf[t])
+			if f == 0 {
+				continue
+			}
+			norm := 1 - bm25B + bm25B*float64(idx.lengths[i])/idx.avgLen
+			scores[i] += idf * f * (bm25K1 + 1) / (f + bm25K1*norm)
+		}
+	}
+	return scores
+}
+
+func uniqueTerms(terms []string) []string {
+	seen := map[string]bool{}
+	var unique []string
+	for _, t := range terms {
+		if !seen[t] {
+			seen[t] = true
+			unique = append(unique, t)
+		}
+	}
+	return unique
+}
+
+// reciprocalRankFusion merges rankings of item indexes, best first, into
+// one: each item scores the sum of 1/(rrfK+rank) over the rankings it is
+// in. It returns the items by that score, best first.
+func reciprocalRankFusion(rankings ...[]int) []int {
+	fused := map[int]float64{}
+	var items []int
+	for _, ranking := range rankings {
+		for rank, item := range ranking {
+			if _, ok := fused[item]; !ok {
+				items = append(items, item)
+			}
+			fused[item] += 1 / float64(rrfK+rank+1)
+		}
+	}
+	slices.SortStableFunc(items, func(a, b int) int { return cmp.Compare(fused[b], fused[a]) })
+	return items
+}
+
+// byScore sorts items, indexes into scores, by score, best first.
+func byScore(items []int, scores []float64) {
+	slices.SortStableFunc(items, func(a, b int) int { return cmp.Compare(scores[b], scores[a]) })
+}
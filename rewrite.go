@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// Rewrite rules apply to prompts before dispatch or to completions before
+// they are returned.
+const (
+	rewritePrompt     = "prompt"
+	rewriteCompletion = "completion"
+)
+
+// rewrite is a compiled rewrite rule.
+type rewrite struct {
+	cfg  *RewriteRule
+	re   *regexp.Regexp
+	tmpl *template.Template
+}
+
+// rewriteData is what rewrite templates see.
+type rewriteData struct {
+	Text string
+}
+
+// compileRewrites compiles the patterns and templates of rewrite rules.
+func compileRewrites(rules []*RewriteRule) ([]*rewrite, error) {
+	var rewrites []*rewrite
+	for i, rule := range rules {
+		rw := &rewrite{cfg: rule}
+		var err error
+		if rule.Match != "" {
+			if rw.re, err = regexp.Compile(rule.Match); err != nil {
+				return nil, fmt.Errorf("rewrites[%d].match: %w", i, err)
+			}
+		}
+		if rule.Template != "" {
+			if rw.tmpl, err = template.New(fmt.Sprintf("rewrites[%d]", i)).Option("missingkey=error").Parse(rule.Template); err != nil {
+				return nil, fmt.Errorf("rewrites[%d].template: %w", i, err)
+			}
+		}
+		rewrites = append(rewrites, rw)
+	}
+	return rewrites, nil
+}
+
+// rewritesFor returns the rules that apply to route.
+func (s *server) rewritesFor(route string) []*rewrite {
+	var rws []*rewrite
+	for _, rw := range s.rewrites {
+		if len(rw.cfg.Routes) == 0 || slices.Contains(rw.cfg.Routes, route) {
+			rws = append(rws, rw)
+		}
+	}
+	return rws
+}
+
+// apply rewrites text: the match is replaced, then the template is run on
+// the result. A template that fails leaves the text as it was.
+func (rw *rewrite) apply(text string) string {
+	if rw.re != nil {
+		text = rw.re.ReplaceAllString(text, rw.cfg.Replace)
+	}
+	if rw.tmpl != nil {
+		var b strings.Builder
+		if err := rw.tmpl.Execute(&b, rewriteData{Text: text}); err != nil {
+			return text
+		}
+		text = b.String()
+	}
+	return text
+}
+
+// rewriteText applies every rule of the target for the given kind, in
+// order.
+func (t target) rewriteText(kind, text string) string {
+	for _, rw := range t.rewrites {
+		if rw.cfg.Apply == kind {
+			text = rw.apply(text)
+		}
+	}
+	return text
+}
+
+// hasRewrites reports whether the target has rules of the given kind.
+func (t target) hasRewrites(kind string) bool {
+	return slices.ContainsFunc(t.rewrites, func(rw *rewrite) bool { return rw.cfg.Apply == kind })
+}
+
+// rewriteRawMessages applies the prompt rules of t to the last user message
+// of OpenAI-format messages: to string content, or to each text part.
+func rewriteRawMessages(raw json.RawMessage, t target) (json.RawMessage, bool) {
+	var messages []map[string]json.RawMessage
+	if json.Unmarshal(raw, &messages) != nil {
+		return nil, false
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		var role string
+		if json.Unmarshal(messages[i]["role"], &role); role != "user" {
+			continue
+		}
+		var text string
+		if err := json.Unmarshal(messages[i]["content"], &text); err == nil {
+			messages[i]["content"], _ = json.Marshal(t.rewriteText(rewritePrompt, text))
+		} else {
+			var parts []map[string]json.RawMessage
+			if json.Unmarshal(messages[i]["content"], &parts) != nil {
+				return nil, false
+			}
+			for _, part := range parts {
+				var kind string
+				if json.Unmarshal(part["type"], &kind); kind != "text" {
+					continue
+				}
+				json.Unmarshal(part["text"], &text)
+				part["text"], _ = json.Marshal(t.rewriteText(rewritePrompt, text))
+			}
+			messages[i]["content"], _ = json.Marshal(parts)
+		}
+		rewritten, err := json.Marshal(messages)
+		return rewritten, err == nil
+	}
+	return nil, false
+}
+
+// rewriteRawCompletion rewrites the message content of the choices of an
+// OpenAI-format chat completion. Bodies it cannot parse are returned as
+// they are.
+func (t target) rewriteRawCompletion(body []byte) []byte {
+	var resp map[string]json.RawMessage
+	if json.Unmarshal(body, &resp) != nil {
+		return body
+	}
+	var choices []map[string]json.RawMessage
+	if json.Unmarshal(resp["choices"], &choices) != nil {
+		return body
+	}
+	for _, choice := range choices {
+		var message map[string]json.RawMessage
+		if json.Unmarshal(choice["message"], &message) != nil {
+			continue
+		}
+		var content string
+		if json.Unmarshal(message["content"], &content) != nil {
+			continue
+		}
+		message["content"], _ = json.Marshal(t.rewriteText(rewriteCompletion, content))
+		choice["message"], _ = json.Marshal(message)
+	}
+	resp["choices"], _ = json.Marshal(choices)
+	out, err := json.Marshal(resp)
+	if err != nil {
+		return body
+	}
+	return out
+}
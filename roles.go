@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Roles of clients and accounts. Admins may do everything; operators may
+// use the admin API except to manage keys and accounts; read-only callers
+// may only view it and cannot change stored sessions. Users, the default,
+// have no admin access.
+const (
+	roleAdmin    = "admin"
+	roleOperator = "operator"
+	roleUser     = "user"
+	roleReadOnly = "read-only"
+)
+
+var roles = []string{roleAdmin, roleOperator, roleUser, roleReadOnly}
+
+// roleContextKey is the gin context key holding the role of an admin API
+// caller.
+const roleContextKey = "askllm.role"
+
+// keyManagementRoutes are the admin routes only admins may use.
+var keyManagementRoutes = []string{
+	"PUT /admin/providers/:name/key",
+	"POST /admin/accounts",
+	"PATCH /admin/accounts/:id",
+	"DELETE /admin/accounts/:id",
+}
+
+// roleOf returns the role of a client.
+func roleOf(cl *ClientConfig) string {
+	if cl == nil || cl.Role == "" {
+		return roleUser
+	}
+	return cl.Role
+}
+
+// roleAllows reports whether role may make a request to route, given as
+// "METHOD /path".
+func roleAllows(role, route string) bool {
+	switch role {
+	case roleAdmin:
+		return true
+	case roleOperator:
+		return !slices.Contains(keyManagementRoutes, route)
+	case roleReadOnly:
+		return strings.HasPrefix(route, http.MethodGet+" ")
+	}
+	return false
+}
+
+// adminEnabled reports whether anyone can reach the admin API: the admin
+// token is set, a client has a role beyond user, or accounts, which admins
+// can give roles, are enabled.
+func (s *server) adminEnabled() bool {
+	if s.adminToken != "" || s.cfg.Accounts != nil {
+		return true
+	}
+	for _, cl := range s.clients.Load().byID {
+		if roleOf(cl) != roleUser {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAdmin admits requests bearing the admin token, which has the admin
+// role, or the key of a client or account whose role allows the route.
+// Without a token or any privileged client the admin API is disabled.
+func (s *server) requireAdmin(c *gin.Context) {
+	if !s.adminEnabled() {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Admin API is disabled."})
+		return
+	}
+	token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	token = strings.TrimSpace(token)
+	role := ""
+	if s.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1 {
+		role = roleAdmin
+	} else if token != "" {
+		cl := s.clients.Load().byKey[token]
+		if cl == nil {
+			cl = s.accountClient(token)
+		}
+		if cl != nil {
+			role = roleOf(cl)
+			c.Set(clientContextKey, cl)
+		}
+	}
+	if role == "" {
+		auditNote(c, "rejected: invalid admin token")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin token."})
+		return
+	}
+	if !roleAllows(role, c.Request.Method+" "+c.FullPath()) {
+		auditNote(c, "rejected: role %s may not use %s %s", role, c.Request.Method, c.FullPath())
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Your role (" + role + ") does not allow this."})
+		return
+	}
+	c.Set(roleContextKey, role)
+	c.Next()
+}
+
+// forbidReadOnly rejects read-only callers, and viewers of the selected
+// workspace, on routes that change stored sessions or keys.
+func forbidReadOnly(c *gin.Context) {
+	if roleOf(clientFrom(c)) == roleReadOnly {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Your role (read-only) does not allow this."})
+		return
+	}
+	if m := workspaceFrom(c); m != nil && m.role == workspaceViewer {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Viewers cannot change the workspace's sessions."})
+		return
+	}
+	c.Next()
+}
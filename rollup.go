@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// rollupUsage adds the usage events up into the hourly and daily usage
+// records every interval until ctx is done, deleting the rolled up events
+// past their retention. Rolling up saves the events recorded since the
+// last run, so at most one interval of them is lost if the process dies.
+func (s *server) rollupUsage(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.rollupOnce()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *server) rollupOnce() {
+	var keep time.Duration
+	if rc := s.cfg.Retention; rc != nil {
+		keep = rc.UsageEvents.Duration
+	}
+	_, purged, err := s.store.RollupUsage(time.Now().Add(-keep))
+	if err != nil {
+		log.Printf("Error rolling up usage: %v", err)
+		return
+	}
+	s.reportPurge("usage_events", purged, nil)
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// target is where a request is sent: a provider and model, plus the limits
+// and data namespace that apply to the caller.
+type target struct {
+	provider  *provider
+	model     string
+	maxTokens int
+	namespace string
+
+	// experiment is the A/B arm the request was placed in, if any.
+	experiment *assignment
+
+	// canary is the arm of the template canary the request was placed in,
+	// if any.
+	canary *canaryAssignment
+
+	// templates are the workspace's own versions of templates, if the
+	// request is made in a workspace.
+	templates map[string]*TemplateConfig
+
+	// wrapper is the route's prompt wrapper, if any.
+	wrapper *PromptWrapper
+
+	// rewrites are the route's rewrite rules.
+	rewrites []*rewrite
+
+	// contextWindow is the model's context size in tokens from the model
+	// catalog, or zero when unknown.
+	contextWindow int
+
+	// price is what the model charges, from the model catalog or the
+	// price table, or nil when unknown.
+	price *ModelPrice
+
+	// sanitize is how prompts are cleaned; nil applies the defaults.
+	sanitize *SanitizeConfig
+}
+
+// templateName returns the template to run in place of name: the
+// experiment arm's template when the request is in one that swaps it.
+func (t target) templateName(name string) string {
+	if t.experiment != nil && t.experiment.exp.cfg.Template == name {
+		if v := t.experiment.variant().Template; v != "" {
+			return v
+		}
+	}
+	return name
+}
+
+// prepare points payload at the target's model, applies its token cap,
+// wraps the last user message in the route's prompt wrapper and applies the
+// route's prompt rewrites to it.
+func (t target) prepare(payload *DeepSeekRequestPayload) {
+	payload.Model = t.model
+	payload.Messages = slices.Clone(payload.Messages)
+	for i := range payload.Messages {
+		payload.Messages[i].Content = sanitizeText(payload.Messages[i].Content, t.sanitize)
+	}
+	if t.wrapper != nil || t.hasRewrites(rewritePrompt) {
+		for i := len(payload.Messages) - 1; i >= 0; i-- {
+			if payload.Messages[i].Role == "user" {
+				if t.wrapper != nil {
+					payload.Messages[i].Content = t.wrapper.wrap(payload.Messages[i].Content)
+				}
+				payload.Messages[i].Content = t.rewriteText(rewritePrompt, payload.Messages[i].Content)
+				break
+			}
+		}
+	}
+	if t.maxTokens > 0 && (payload.MaxTokens == 0 || payload.MaxTokens > t.maxTokens) {
+		payload.MaxTokens = t.maxTokens
+	}
+}
+
+// routeError rejects a model or provider the caller may not choose.
+type routeError struct {
+	kind, name string
+}
+
+func (e *routeError) Error() string {
+	return fmt.Sprintf("%s %q is not allowed", e.kind, e.name)
+}
+
+// routeRequest describes a request for routing.
+type routeRequest struct {
+	// Model is the model the caller asked for, if any.
+	Model string
+	// DefaultModel is the endpoint's own model, used when the caller asks
+	// for none, in place of experiments, rules and the default model.
+	DefaultModel string
+	// Messages are the messages to be sent.
+	Messages []Message
+	// Template is the managed template being run, if any.
+	Template string
+	// MaxTokens is the completion budget asked for.
+	MaxTokens int
+	// NeedsTools and NeedsVision are set when the request carries tool
+	// definitions or images.
+	NeedsTools  bool
+	NeedsVision bool
+}
+
+// targetFor returns where the request should be sent. The model is the
+// requested one (or the X-LLM-Model header's), else the first matching route
+// hook's, else the experiment arm's, else the cheapest suitable
+// catalog model under the cost policy, else the first matching routing
+// rule's, else the tenant's or server's default. It is resolved through the
+// model aliases; its provider is the alias's provider, or else the tenant's
+// or server's default provider. The X-LLM-Provider header overrides the
+// provider. Requested models must be in allowed_models, when set, and
+// requested providers in allowed_providers.
+func (s *server) targetFor(c *gin.Context, req routeRequest) (target, error) {
+	tgt := target{provider: s.llm, model: s.cfg.DefaultModel, sanitize: s.sanitizeFor(unversioned(c.FullPath()))}
+	if w, ok := s.cfg.PromptWrappers[unversioned(c.FullPath())]; ok {
+		tgt.wrapper = w
+	} else {
+		tgt.wrapper = s.cfg.PromptWrappers["*"]
+	}
+	tgt.rewrites = s.rewritesFor(unversioned(c.FullPath()))
+
+	if req.Model == "" {
+		req.Model = c.GetHeader("X-LLM-Model")
+	}
+	if req.Model != "" && len(s.cfg.AllowedModels) > 0 && !slices.Contains(s.cfg.AllowedModels, req.Model) {
+		auditNote(c, "rejected: model %s not allowed", req.Model)
+		return tgt, &routeError{"model", req.Model}
+	}
+
+	t := tenantFrom(c)
+	var pinned *provider
+	if name := c.GetHeader("X-LLM-Provider"); name != "" {
+		// A tenant's own provider is not available to other callers.
+		if pinned = s.providerFor(t, name); pinned == nil || !slices.Contains(s.cfg.AllowedProviders, name) {
+			auditNote(c, "rejected: provider %s not allowed", name)
+			return tgt, &routeError{"provider", name}
+		}
+	}
+	if t != nil {
+		tgt.maxTokens = t.cfg.MaxTokens
+		tgt.namespace = t.cfg.Namespace
+		if p := s.providerFor(t, t.cfg.DefaultProvider); p != nil {
+			tgt.provider = p
+		}
+		if t.cfg.DefaultModel != "" {
+			tgt.model = t.cfg.DefaultModel
+		}
+	}
+	tgt.experiment = s.assignExperiment(c, req)
+	if m := workspaceFrom(c); m != nil {
+		tgt.templates = m.workspace.Templates
+	}
+	// A workspace's own version of the template keeps it out of the canary.
+	if tgt.templates[req.Template] == nil {
+		tgt.canary = s.assignCanary(c, req)
+	}
+	if req.Template != "" {
+		version := tgt.templateVersion(req.Template)
+		c.Header("X-Template-Version", version)
+		auditNote(c, "template %s", version)
+	}
+	hooked := ""
+	if req.Model == "" && req.DefaultModel == "" {
+		hooked = s.routeModel(c, req)
+	}
+
+	switch {
+	case req.Model != "":
+		tgt.model = req.Model
+	case req.DefaultModel != "":
+		tgt.model = req.DefaultModel
+	case hooked != "":
+		tgt.model = hooked
+		auditNote(c, "route hook chose %s", hooked)
+	case tgt.experiment != nil && tgt.experiment.variant().Model != "":
+		tgt.model = tgt.experiment.variant().Model
+		auditNote(c, "experiment %s=%s", tgt.experiment.exp.cfg.Name, tgt.experiment.arm)
+	case s.routingPolicy(c) == policyCost && pinned == nil:
+		if m := s.cheapestModel(t, req); m != nil {
+			tgt.model = m.Model
+			tgt.provider = s.providerFor(t, m.Provider)
+			tgt.contextWindow = m.ContextWindow
+			tgt.price = s.cfg.priceOf(m.Provider, m.Model)
+			auditNote(c, "cost policy chose %s", m.Model)
+			auditTarget(c, tgt)
+			return tgt, nil
+		}
+		if rule := s.matchRule(c, req); rule != nil {
+			tgt.model = rule.Model
+			auditNote(c, "routing rule chose %s", rule.Model)
+		}
+	default:
+		if rule := s.matchRule(c, req); rule != nil {
+			tgt.model = rule.Model
+			auditNote(c, "routing rule chose %s", rule.Model)
+		}
+	}
+
+	if alias, ok := s.cfg.ModelAliases[tgt.model]; ok {
+		tgt.model = alias.Model
+		if p := s.providerFor(t, alias.Provider); p != nil {
+			tgt.provider = p
+		}
+	}
+	if pinned != nil {
+		tgt.provider = pinned
+	} else if fb, ok := s.fallbackFor(t, tgt); ok {
+		auditNote(c, "provider %s is down, fell back to %s", tgt.provider.name, tgt.provider.cfg.Fallback)
+		tgt = fb
+	}
+	for _, m := range s.cfg.Models {
+		if m.Model == tgt.model && m.Provider == tgt.provider.name {
+			tgt.contextWindow = m.ContextWindow
+		}
+	}
+	tgt.price = s.cfg.priceOf(tgt.provider.name, tgt.model)
+	auditTarget(c, tgt)
+	return tgt, nil
+}
+
+// providerFor returns the named provider, preferring the tenant's own
+// provider of that name over the shared one. It returns nil for an empty
+// or unknown name.
+func (s *server) providerFor(t *tenant, name string) *provider {
+	if name == "" {
+		return nil
+	}
+	if t != nil {
+		if p, ok := t.providers[name]; ok {
+			return p
+		}
+	}
+	return s.providers[name]
+}
+
+// matchRule returns the first routing rule whose conditions all hold for
+// the request, or nil.
+func (s *server) matchRule(c *gin.Context, req routeRequest) *RoutingRule {
+	if len(s.cfg.RoutingRules) == 0 {
+		return nil
+	}
+
+	tokens := 0
+	lastUser := ""
+	for _, m := range req.Messages {
+		tokens += estimateTokens(m.Content)
+		if m.Role == "user" {
+			lastUser = m.Content
+		}
+	}
+	complexity := c.Query("complexity")
+	if complexity == "" {
+		complexity = c.GetHeader("X-Complexity")
+	}
+
+	language := ""
+	for _, rule := range s.cfg.RoutingRules {
+		if rule.MinPromptTokens > 0 && tokens < rule.MinPromptTokens {
+			continue
+		}
+		if rule.MaxPromptTokens > 0 && tokens > rule.MaxPromptTokens {
+			continue
+		}
+		if rule.Template != "" && rule.Template != req.Template {
+			continue
+		}
+		if rule.Complexity != "" && !strings.EqualFold(rule.Complexity, complexity) {
+			continue
+		}
+		if rule.Language != "" {
+			if language == "" {
+				language = detectLanguage(lastUser)
+			}
+			if !strings.EqualFold(rule.Language, language) {
+				continue
+			}
+		}
+		return rule
+	}
+	return nil
+}
+
+// Routing policies.
+const (
+	policyDefault = "default"
+	policyCost    = "cost"
+)
+
+// routingPolicy returns the policy for the request: the route query
+// parameter or X-Route header when given, else the configured policy.
+func (s *server) routingPolicy(c *gin.Context) string {
+	policy := c.Query("route")
+	if policy == "" {
+		policy = c.GetHeader("X-Route")
+	}
+	if policy == "" {
+		policy = s.cfg.RoutingPolicy
+	}
+	return policy
+}
+
+// cheapestModel returns the catalog model with the lowest estimated cost
+// for the request among those with a large enough context window and the
+// needed capabilities, or nil when none qualifies.
+func (s *server) cheapestModel(t *tenant, req routeRequest) *ModelInfo {
+	promptTokens := 0
+	for _, m := range req.Messages {
+		promptTokens += estimateTokens(m.Content)
+	}
+	completionTokens := req.MaxTokens
+	if completionTokens <= 0 {
+		completionTokens = defaultMaxTokens
+	}
+
+	var best *ModelInfo
+	bestCost := 0.0
+	for _, m := range s.cfg.Models {
+		if m.ContextWindow > 0 && promptTokens+completionTokens > m.ContextWindow {
+			continue
+		}
+		if (req.NeedsTools && !m.Tools) || (req.NeedsVision && !m.Vision) {
+			continue
+		}
+		if p := s.providerFor(t, m.Provider); p == nil || !p.available() {
+			continue
+		}
+		cost := m.cost(promptTokens, completionTokens)
+		if best == nil || cost < bestCost {
+			best, bestCost = m, cost
+		}
+	}
+	return best
+}
+
+// cost estimates the price of a request in the catalog's currency.
+func (m *ModelInfo) cost(promptTokens, completionTokens int) float64 {
+	return (float64(promptTokens)*m.InputPrice + float64(completionTokens)*m.OutputPrice) / 1e6
+}
+
+// cost estimates the price of usage with the target's model, and reports
+// false when the model is not priced.
+func (t target) cost(u UsageInfo) (float64, bool) {
+	if t.price == nil {
+		return 0, false
+	}
+	return t.price.cost(u.PromptTokens, u.CompletionTokens), true
+}
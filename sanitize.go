@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/text/unicode/norm"
+)
+
+// sanitizeText cleans a prompt before it is forwarded: invalid UTF-8 is
+// replaced, control characters other than tab, newline and carriage return
+// are stripped unless kept, and the configured normalizations are applied.
+// A nil config applies the defaults.
+func sanitizeText(text string, cfg *SanitizeConfig) string {
+	if cfg == nil {
+		cfg = &SanitizeConfig{}
+	}
+	text = strings.ToValidUTF8(text, "\uFFFD")
+	if !cfg.KeepControlCharacters {
+		text = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r' {
+				return -1
+			}
+			return r
+		}, text)
+	}
+	if cfg.StripZeroWidth {
+		text = strings.Map(func(r rune) rune {
+			if zeroWidth(r) {
+				return -1
+			}
+			return r
+		}, text)
+	}
+	if cfg.Homoglyphs {
+		text = foldHomoglyphs(norm.NFKC.String(text))
+	}
+	if cfg.NFC {
+		text = norm.NFC.String(text)
+	}
+	return text
+}
+
+// sanitizeFor returns the sanitize settings of route.
+func (s *server) sanitizeFor(route string) *SanitizeConfig {
+	if sc, ok := s.cfg.Sanitize.Routes[route]; ok {
+		return sc
+	}
+	return &s.cfg.Sanitize
+}
+
+// zeroWidth reports whether r is an invisible formatting character.
+func zeroWidth(r rune) bool {
+	switch {
+	case r == '\u00AD', r == '\u180E', r == '\uFEFF':
+		return true
+	case r >= '\u200B' && r <= '\u200F', r >= '\u202A' && r <= '\u202E', r >= '\u2060' && r <= '\u2069':
+		return true
+	case r >= '\uFE00' && r <= '\uFE0F', r >= 0xE0100 && r <= 0xE01EF:
+		return true
+	}
+	return false
+}
+
+// confusables maps Cyrillic and Greek letters to the Latin letters they
+// look like.
+var confusables = map[rune]rune{
+	'а': 'a', 'в': 'b', 'е': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x',
+	'і': 'i', 'ј': 'j', 'ѕ': 's', 'һ': 'h', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'ӏ': 'l',
+	'А': 'A', 'В': 'B', 'Е': 'E', 'К': 'K', 'М': 'M', 'Н': 'H', 'О': 'O', 'Р': 'P', 'С': 'C', 'Т': 'T', 'У': 'Y', 'Х': 'X',
+	'І': 'I', 'Ј': 'J', 'Ѕ': 'S', 'Ԁ': 'D', 'Ԛ': 'Q', 'Ԝ': 'W',
+	'α': 'a', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+	'Α': 'A', 'Β': 'B', 'Ε': 'E', 'Ζ': 'Z', 'Η': 'H', 'Ι': 'I', 'Κ': 'K', 'Μ': 'M', 'Ν': 'N', 'Ο': 'O', 'Ρ': 'P', 'Τ': 'T', 'Υ': 'Y', 'Χ': 'X',
+}
+
+// foldHomoglyphs replaces the confusable letters of words that mix them
+// with Latin letters, such as "pаypal" with a Cyrillic а. Words written
+// wholly in Cyrillic or Greek are left alone.
+func foldHomoglyphs(text string) string {
+	var b strings.Builder
+	word := []rune{}
+	flush := func() {
+		latin, confusable := false, false
+		for _, r := range word {
+			if _, ok := confusables[r]; ok {
+				confusable = true
+			} else if unicode.Is(unicode.Latin, r) {
+				latin = true
+			}
+		}
+		for _, r := range word {
+			if to, ok := confusables[r]; ok && latin && confusable {
+				r = to
+			}
+			b.WriteRune(r)
+		}
+		word = word[:0]
+	}
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsMark(r) {
+			word = append(word, r)
+			continue
+		}
+		flush()
+		b.WriteRune(r)
+	}
+	flush()
+	return b.String()
+}
+
+// validateRequest rejects requests whose query, path or text body is not
+// valid UTF-8, unless sanitize allows it, then checks the body against its
+// schema.
+func (s *server) validateRequest(c *gin.Context) {
+	if !s.sanitizeFor(unversioned(c.FullPath())).AllowInvalidUTF8 && !validUTF8(c) {
+		auditNote(c, "rejected: invalid UTF-8")
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": localize(c, "invalid_utf8")})
+		return
+	}
+	validateBody(c)
+}
+
+// validUTF8 reports whether the query, path parameters and text body of
+// the request are valid UTF-8. Binary bodies are not checked.
+func validUTF8(c *gin.Context) bool {
+	query, err := url.ParseQuery(c.Request.URL.RawQuery)
+	if err != nil {
+		return false
+	}
+	for key, values := range query {
+		if !utf8.ValidString(key) {
+			return false
+		}
+		for _, v := range values {
+			if !utf8.ValidString(v) {
+				return false
+			}
+		}
+	}
+	for _, p := range c.Params {
+		if !utf8.ValidString(p.Value) {
+			return false
+		}
+	}
+
+	if c.Request.Body == nil || c.Request.Body == http.NoBody || !textBody(c.ContentType()) {
+		return true
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	if c.ContentType() == "application/x-www-form-urlencoded" {
+		// The prompt of a form body is URL-escaped.
+		if form, err := url.ParseQuery(string(body)); err == nil {
+			for _, values := range form {
+				for _, v := range values {
+					if !utf8.ValidString(v) {
+						return false
+					}
+				}
+			}
+		}
+	}
+	return utf8.Valid(body)
+}
+
+// textBody reports whether a body of the content type carries text: JSON,
+// text/*, form data or no declared type.
+func textBody(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case contentType == "", mediaType == "application/x-www-form-urlencoded":
+		return true
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+		return true
+	}
+	return false
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/robfig/cron/v3"
+)
+
+// scheduleTimeout bounds one run of a scheduled prompt, fetch included.
+const scheduleTimeout = 5 * time.Minute
+
+// maxScheduleRuns is how many runs are kept per scheduled prompt.
+const maxScheduleRuns = 20
+
+// scheduler runs the configured prompts on their cron schedules.
+type scheduler struct {
+	cron *cron.Cron
+	jobs map[string]*scheduledJob
+}
+
+type scheduledJob struct {
+	cfg    *ScheduleConfig
+	prompt *template.Template
+	entry  cron.EntryID
+}
+
+// scheduleData is what a scheduled prompt is rendered with.
+type scheduleData struct {
+	// Content is the text of the fetched URL, if any.
+	Content string
+	// Date is the run's date, e.g. "2026-10-14".
+	Date string
+}
+
+// newScheduler parses the scheduled prompts of cfg.
+func newScheduler(cfg *Config) (*scheduler, error) {
+	sch := &scheduler{cron: cron.New(), jobs: map[string]*scheduledJob{}}
+	for _, sc := range cfg.Schedules {
+		prompt, err := template.New(sc.Name).Parse(sc.Prompt)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", sc.Name, err)
+		}
+		sch.jobs[sc.Name] = &scheduledJob{cfg: sc, prompt: prompt}
+	}
+	return sch, nil
+}
+
+// start runs the jobs on schedule until ctx is done.
+func (sch *scheduler) start(ctx context.Context, s *server) error {
+	for _, job := range sch.jobs {
+		id, err := sch.cron.AddFunc(job.cfg.Cron, func() { s.runSchedule(ctx, job) })
+		if err != nil {
+			return fmt.Errorf("schedule %q: %w", job.cfg.Name, err)
+		}
+		job.entry = id
+	}
+	sch.cron.Start()
+	go func() {
+		<-ctx.Done()
+		sch.cron.Stop()
+	}()
+	return nil
+}
+
+// runSchedule runs a scheduled prompt once, stores the result and delivers
+// it.
+func (s *server) runSchedule(ctx context.Context, job *scheduledJob) ScheduleRun {
+	ctx, cancel := context.WithTimeout(ctx, scheduleTimeout)
+	defer cancel()
+	ctx = withPriority(withClientID(ctx, "schedule:"+job.cfg.Name), priorityLow)
+
+	run := ScheduleRun{ID: newID(), StartedAt: time.Now().UTC()}
+	answer, model, err := s.executeSchedule(ctx, job)
+	run.Duration = time.Since(run.StartedAt).Milliseconds()
+	run.Model, run.Answer = model, answer
+	if err != nil {
+		log.Printf("Error running schedule %s: %v", job.cfg.Name, err)
+		run.Error = err.Error()
+	}
+
+	if dc := job.cfg.Deliver; dc != nil && (err == nil || dc.Failures) {
+		text := answer
+		if err != nil {
+			text = "The scheduled prompt failed: " + err.Error()
+		}
+		reached, derr := s.deliver(ctx, dc, delivery{
+			Subject: "askllm: " + job.cfg.Name,
+			Text:    text,
+			JSON:    gin.H{"schedule": job.cfg.Name, "run_id": run.ID, "started_at": run.StartedAt, "answer": answer, "error": run.Error},
+		})
+		run.Delivered = reached
+		if derr != nil {
+			log.Printf("Error delivering schedule %s: %v", job.cfg.Name, derr)
+			run.DeliveryError = derr.Error()
+		}
+	}
+
+	if err := s.store.AddScheduleRun(job.cfg.Name, run, maxScheduleRuns); err != nil {
+		log.Printf("Error saving run of schedule %s: %v", job.cfg.Name, err)
+	}
+	return run
+}
+
+// executeSchedule fetches the job's URL, renders its prompt and returns the
+// answer and the model that gave it.
+func (s *server) executeSchedule(ctx context.Context, job *scheduledJob) (answer, model string, err error) {
+	data := scheduleData{Date: time.Now().Format(time.DateOnly)}
+	if job.cfg.URL != "" {
+		if data.Content, err = fetchText(ctx, job.cfg.URL); err != nil {
+			return "", "", err
+		}
+		data.Content = truncateRunes(data.Content, maxFetchBytes/4)
+	}
+	var prompt strings.Builder
+	if err := job.prompt.Execute(&prompt, data); err != nil {
+		return "", "", fmt.Errorf("rendering prompt: %w", err)
+	}
+
+	var messages []Message
+	if job.cfg.System != "" {
+		messages = append(messages, Message{Role: "system", Content: job.cfg.System})
+	}
+	messages = append(messages, Message{Role: "user", Content: prompt.String()})
+	tgt := s.targetForModel(job.cfg.Model)
+	payload := newPayload(messages)
+	if job.cfg.MaxTokens > 0 {
+		payload.MaxTokens = job.cfg.MaxTokens
+	}
+	tgt.prepare(&payload)
+	answer, err = tgt.provider.complete(ctx, payload)
+	return stripReasoning(answer), tgt.provider.name + "/" + tgt.model, err
+}
+
+// targetForModel returns the shared provider and model for a model or
+// alias configured by the operator, or the defaults for "".
+func (s *server) targetForModel(model string) target {
+	tgt := target{provider: s.llm, model: s.cfg.DefaultModel}
+	if model != "" {
+		tgt.model = model
+	}
+	if alias, ok := s.cfg.ModelAliases[tgt.model]; ok {
+		tgt.model = alias.Model
+		if p := s.providerFor(nil, alias.Provider); p != nil {
+			tgt.provider = p
+		}
+	}
+	return tgt
+}
+
+// handleListSchedules lists the scheduled prompts with their next run and
+// latest result.
+func (s *server) handleListSchedules(c *gin.Context) {
+	list := make([]gin.H, 0, len(s.cfg.Schedules))
+	for _, sc := range s.cfg.Schedules {
+		item := gin.H{"name": sc.Name, "cron": sc.Cron}
+		if job := s.scheduler.jobs[sc.Name]; job.entry != 0 {
+			item["next_run"] = s.scheduler.cron.Entry(job.entry).Next
+		}
+		if runs := s.store.ScheduleRuns(sc.Name); len(runs) > 0 {
+			item["last_run"] = runs[0]
+		}
+		list = append(list, item)
+	}
+	c.JSON(http.StatusOK, gin.H{"schedules": list})
+}
+
+// handleScheduleRuns returns the stored runs of a scheduled prompt, newest
+// first.
+func (s *server) handleScheduleRuns(c *gin.Context) {
+	if _, ok := s.scheduler.jobs[c.Param("name")]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found."})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"runs": s.store.ScheduleRuns(c.Param("name"))})
+}
+
+// handleRunSchedule runs a scheduled prompt now and returns the run.
+func (s *server) handleRunSchedule(c *gin.Context) {
+	job, ok := s.scheduler.jobs[c.Param("name")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found."})
+		return
+	}
+	auditNote(c, "ran schedule %s", job.cfg.Name)
+	run := s.runSchedule(context.WithoutCancel(c.Request.Context()), job)
+	c.JSON(http.StatusOK, run)
+}
+
+// validateCron reports whether spec is a valid cron expression or
+// descriptor.
+func validateCron(spec string) error {
+	if _, err := cron.ParseStandard(spec); err != nil {
+		return errors.New("invalid cron expression: " + err.Error())
+	}
+	return nil
+}
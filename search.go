@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Snippets are cut around the first match in a message.
+const (
+	maxSnippets   = 3
+	snippetBefore = 60
+	snippetAfter  = 100
+)
+
+// SearchResult is a session matching a search, with snippets of its
+// matching messages.
+type SearchResult struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Matches   int       `json:"matches"`
+	Snippets  []Snippet `json:"snippets"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Snippet is an excerpt of a matching message.
+type Snippet struct {
+	Message int    `json:"message"` // index in the session's messages
+	Role    string `json:"role"`
+	Text    string `json:"text"`
+}
+
+// searchTerms splits a query into lowercase words.
+func searchTerms(q string) []string {
+	return strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// searchIndex is an inverted index of the words of session messages, so a
+// search reads only the sessions that have a word containing each term
+// rather than every message.
+type searchIndex struct {
+	sessions map[string]map[string]struct{} // word -> session IDs
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{sessions: map[string]map[string]struct{}{}}
+}
+
+// add indexes the words of content under the session id.
+func (ix *searchIndex) add(id, content string) {
+	for _, w := range searchTerms(content) {
+		ids, ok := ix.sessions[w]
+		if !ok {
+			ids = map[string]struct{}{}
+			ix.sessions[w] = ids
+		}
+		ids[id] = struct{}{}
+	}
+}
+
+// remove drops sess from the index.
+func (ix *searchIndex) remove(sess *Session) {
+	for _, m := range sess.Messages {
+		for _, w := range searchTerms(m.Content) {
+			delete(ix.sessions[w], sess.ID)
+			if len(ix.sessions[w]) == 0 {
+				delete(ix.sessions, w)
+			}
+		}
+	}
+}
+
+// candidates returns the IDs of the sessions that have, for every term, a
+// word containing it. Terms are runs of letters and digits, so they only
+// occur inside words; the sessions still need matchMessage to tell
+// whether a single message has them all.
+func (ix *searchIndex) candidates(terms []string) map[string]struct{} {
+	var found map[string]struct{}
+	for _, t := range terms {
+		matching := map[string]struct{}{}
+		for w, ids := range ix.sessions {
+			if !strings.Contains(w, t) {
+				continue
+			}
+			for id := range ids {
+				if _, ok := found[id]; found == nil || ok {
+					matching[id] = struct{}{}
+				}
+			}
+		}
+		if found = matching; len(found) == 0 {
+			break
+		}
+	}
+	return found
+}
+
+// matchMessage reports whether content contains every term and returns a
+// snippet around the first one.
+func matchMessage(content string, terms []string) (string, bool) {
+	// Lowercasing rune by rune keeps the rune offsets of content.
+	lower := strings.Map(unicode.ToLower, content)
+	first := -1
+	for _, t := range terms {
+		i := strings.Index(lower, t)
+		if i < 0 {
+			return "", false
+		}
+		if first < 0 || i < first {
+			first = i
+		}
+	}
+
+	runes := []rune(content)
+	at := utf8.RuneCountInString(lower[:first])
+	start, end := max(at-snippetBefore, 0), min(at+snippetAfter, len(runes))
+	snippet := strings.Join(strings.Fields(string(runes[start:end])), " ")
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(runes) {
+		snippet += "…"
+	}
+	return snippet, true
+}
+
+// handleSearch returns the caller's sessions, or those of the selected
+// workspace, with messages containing every word of q, those with the most
+// matching messages first.
+func (s *server) handleSearch(c *gin.Context) {
+	terms := searchTerms(c.Query("q"))
+	if len(terms) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing search query."})
+		return
+	}
+	limit, err := pageSize(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"results": s.store.SearchSessions(sessionScope(c), terms, limit)})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// secrets resolves provider API keys and client definitions from their
+// configured sources: environment variables, Vault, or AWS.
+type secrets struct {
+	vault *vaultClient
+	aws   *awsSecrets
+}
+
+func newSecrets(ctx context.Context, cfg *Config) (*secrets, error) {
+	sc := &secrets{}
+	if vc := cfg.Vault; vc != nil {
+		token, err := getenvSecret(vc.TokenEnv)
+		if err != nil {
+			return nil, fmt.Errorf("vault: %w", err)
+		}
+		if token == "" {
+			return nil, fmt.Errorf("vault: neither %s nor %s_FILE is set", vc.TokenEnv, vc.TokenEnv)
+		}
+		if sc.vault, err = newVaultClient(vc, token); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.AWS != nil {
+		var err error
+		if sc.aws, err = newAWSSecrets(ctx, cfg.AWS); err != nil {
+			return nil, err
+		}
+	}
+	return sc, nil
+}
+
+// getenvSecret returns the secret held by the environment variable name. When
+// name_FILE is set instead, as with Docker and Kubernetes secrets, the value
+// is read from that file with surrounding whitespace removed.
+func getenvSecret(name string) (string, error) {
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return os.Getenv(name), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading %s_FILE: %w", name, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// dynamic reports whether the key of pc comes from a source that is
+// refreshed at runtime. Secret files count, since mounted secrets are
+// updated in place when rotated.
+func (sc *secrets) dynamic(pc *ProviderConfig) bool {
+	return pc.APIKeyVault != "" || pc.APIKeyAWS != "" || os.Getenv(pc.APIKeyEnv+"_FILE") != ""
+}
+
+// providerKey returns the current API key for pc.
+func (sc *secrets) providerKey(ctx context.Context, pc *ProviderConfig) (string, error) {
+	switch {
+	case pc.APIKeyVault != "":
+		if sc.vault == nil {
+			return "", fmt.Errorf("api_key_vault is set but no vault is configured")
+		}
+		return sc.vault.read(ctx, pc.APIKeyVault)
+	case pc.APIKeyAWS != "":
+		if sc.aws == nil {
+			return "", fmt.Errorf("api_key_aws is set but aws is not configured")
+		}
+		return sc.aws.read(ctx, pc.APIKeyAWS)
+	default:
+		return getenvSecret(pc.APIKeyEnv)
+	}
+}
+
+// clients returns the configured clients followed by those defined in the
+// AWS secret named by clients_aws, a JSON array in the format of "clients".
+func (sc *secrets) clients(ctx context.Context, cfg *Config) ([]*ClientConfig, error) {
+	if cfg.ClientsAWS == "" {
+		return cfg.Clients, nil
+	}
+	if sc.aws == nil {
+		return nil, fmt.Errorf("clients_aws is set but aws is not configured")
+	}
+
+	raw, err := sc.aws.read(ctx, cfg.ClientsAWS)
+	if err != nil {
+		return nil, err
+	}
+	var loaded []*ClientConfig
+	if err := json.Unmarshal([]byte(raw), &loaded); err != nil {
+		return nil, fmt.Errorf("parsing clients from %s: %w", cfg.ClientsAWS, err)
+	}
+	for i, cl := range loaded {
+		if cl.ID == "" {
+			return nil, fmt.Errorf("clients from %s: entry %d has no id", cfg.ClientsAWS, i)
+		}
+	}
+	return append(append([]*ClientConfig(nil), cfg.Clients...), loaded...), nil
+}
+
+// refreshSecrets reloads secrets every interval until ctx is done.
+func (s *server) refreshSecrets(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.reloadSecrets(ctx)
+		}
+	}
+}
+
+// reloadSecrets re-reads provider keys from files, Vault or AWS and client
+// definitions from AWS, renewing the Vault token on the way. A failed read keeps the
+// current value. It returns the names of the providers whose key changed.
+func (s *server) reloadSecrets(ctx context.Context) []string {
+	sc := s.secrets
+	if sc.vault != nil {
+		if err := sc.vault.renewToken(ctx); err != nil {
+			log.Printf("Error renewing Vault token: %v", err)
+		}
+	}
+
+	var changed []string
+	for _, p := range s.allProviders() {
+		// Plain environment variables cannot change at runtime; skipping
+		// them also keeps keys set through the admin API.
+		if !sc.dynamic(p.cfg) {
+			continue
+		}
+		key, err := sc.providerKey(ctx, p.cfg)
+		if err != nil {
+			log.Printf("Error refreshing API key for provider %s: %v", p.name, err)
+			s.alerts.raise(alertKeyRefreshFailed, p.name, fmt.Sprintf("Refreshing the API key of provider %s failed: %v", p.name, err))
+			continue
+		}
+		if key == "" {
+			continue
+		}
+		if p.setKey(key) {
+			log.Printf("API key for provider %s updated", p.name)
+			changed = append(changed, p.name)
+			go s.warmupProvider(context.WithoutCancel(ctx), p)
+		}
+	}
+
+	if s.cfg.ClientsAWS != "" {
+		clients, err := sc.clients(ctx, s.cfg)
+		if err != nil {
+			log.Printf("Error refreshing clients: %v", err)
+			return changed
+		}
+		s.clients.Store(newClientIndex(clients))
+	}
+	return changed
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// maxTitleLength bounds generated session titles, in characters.
+const maxTitleLength = 80
+
+func init() {
+	registerTemplate(newTemplate("title",
+		"You write short titles for conversations. Reply with the title only: at most six words, no quotes, no trailing punctuation.",
+		`Write a title for this conversation.
+
+User: {{.Question}}
+
+Assistant: {{.Answer}}`,
+		256, 0.2))
+}
+
+// chatRequest is the body accepted by POST /chat, as JSON or a form.
+type chatRequest struct {
+	SessionID string `json:"session_id" form:"session_id"`
+	Message   string `json:"message" form:"message"`
+	Model     string `json:"model" form:"model"`
+	Stream    bool   `json:"stream" form:"stream"`
+}
+
+// chatResponse is returned by POST /chat. ID names the stored completion.
+type chatResponse struct {
+	ID        string `json:"id,omitempty"`
+	SessionID string `json:"session_id"`
+	Answer    string `json:"answer"`
+
+	// TTFTMS is the time to the first token, all of the answer arriving
+	// at once when it is not streamed.
+	TTFTMS          int64   `json:"ttft_ms"`
+	TokensPerSecond float64 `json:"tokens_per_second"`
+}
+
+// handleChat appends a user message to a stored session (creating one when
+// no session_id is given), sends the whole conversation to the model and
+// stores the answer. A multipart body may attach text files to the message.
+func (s *server) handleChat(c *gin.Context) {
+	var req chatRequest
+	var err error
+	if formBody(c.ContentType()) {
+		err = c.ShouldBindWith(&req, binding.Form)
+	} else {
+		err = c.ShouldBindJSON(&req)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Please provide a JSON or form body with a non-empty 'message' field."})
+		return
+	}
+	if c.ContentType() == "multipart/form-data" {
+		var ok bool
+		if req.Message, ok = withAttachments(c, req.Message); !ok {
+			return
+		}
+	}
+	if strings.TrimSpace(req.Message) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Please provide a non-empty 'message' field or attach a file."})
+		return
+	}
+
+	var sess *Session
+	if req.SessionID == "" {
+		sess, err = s.store.CreateSession(namespaceFor(c), ownerFor(c))
+	} else {
+		sess, err = s.store.Session(sessionScope(c), req.SessionID)
+	}
+	if errors.Is(err, errSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found."})
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+
+	userMessage := Message{Role: "user", Content: req.Message}
+	tgt, err := s.targetFor(c, routeRequest{Model: req.Model, Messages: append(sess.Messages, userMessage)})
+	if err != nil {
+		respondUpstreamError(c, err)
+		return
+	}
+	messages := s.sessionContext(c.Request.Context(), tgt, sess, userMessage)
+	if note, ok := s.recallMemories(c.Request.Context(), ownerFor(c), req.Message); ok {
+		messages = append([]Message{note}, messages...)
+	}
+	canned, kbNote := s.consultKnowledgeBase(c, req.Message)
+	if kbNote != nil {
+		messages = append([]Message{*kbNote}, messages...)
+	}
+	payload := newPayload(messages)
+	tgt.prepare(&payload)
+	s.fitContext(tgt, &payload)
+	liveSessions.publish(sess.ID, sessionEvent{"message", gin.H{"role": "user", "content": req.Message}})
+	start := time.Now()
+	var answer string
+	var usage UsageInfo
+	var finishReason string
+	var ttft time.Duration
+	streamed := false
+	switch {
+	case canned != "":
+		answer = canned
+		if req.Stream {
+			streamCanned(c, answer)
+			liveSessions.publish(sess.ID, sessionEvent{"token", gin.H{"content": answer}})
+			ttft, streamed = time.Since(start), true
+		}
+	case req.Stream:
+		answer, usage, finishReason, ttft, err = s.streamChat(c, tgt, payload, sess.ID)
+		streamed = ttft > 0
+	default:
+		answer, usage, err = tgt.provider.completeUsage(c.Request.Context(), payload)
+	}
+	elapsed := time.Since(start)
+	if canned == "" {
+		tgt.experiment.observe(elapsed, answer, err)
+	}
+	if err != nil {
+		code, _ := classifyError(err)
+		liveSessions.publish(sess.ID, sessionEvent{"error", gin.H{"code": code}})
+		switch {
+		case c.Request.Context().Err() != nil:
+			log.Printf("Client disconnected, chat stream aborted after %d characters", len(answer))
+		case streamed:
+			log.Printf("Error streaming chat from DeepSeek API: %v", err)
+			c.SSEvent("error", gin.H{"error": localize(c, "stream_interrupted"), "code": code})
+			c.Writer.Flush()
+		default:
+			respondUpstreamError(c, err)
+		}
+		return
+	}
+	if canned == "" {
+		s.shadow.mirror(tgt, payload, answer, time.Since(start))
+	}
+	if !streamed {
+		answer = tgt.rewriteText(rewriteCompletion, answer)
+		liveSessions.publish(sess.ID, sessionEvent{"token", gin.H{"content": answer}})
+	}
+
+	if err := s.store.AppendMessages(sess.ID, tgt.provider.name+"/"+tgt.model, userMessage, Message{Role: "assistant", Content: answer}); err != nil {
+		log.Printf("Error saving session %s: %v", sess.ID, err)
+		liveSessions.publish(sess.ID, sessionEvent{"error", gin.H{"code": codeInternal}})
+		if streamed {
+			c.SSEvent("error", gin.H{"error": "Internal server error.", "code": codeInternal})
+			c.Writer.Flush()
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+
+	if owner := ownerFor(c); s.cfg.UserMemory != nil && owner != "" {
+		go s.rememberFacts(tgt, owner, sess.ID, req.Message, answer)
+	}
+
+	// Title the session once the first exchange is stored.
+	if len(sess.Messages) == 0 {
+		go s.titleSession(tgt, sess.ID, req.Message, answer)
+	}
+
+	resp := chatResponse{SessionID: sess.ID, Answer: answer, TTFTMS: elapsed.Milliseconds(), TokensPerSecond: tokensPerSecond(usage.CompletionTokens, ttft, elapsed)}
+	if streamed {
+		resp.TTFTMS = ttft.Milliseconds()
+	}
+	if cp := s.newCompletion(c, tgt, req.Message); cp != nil {
+		cp.Stream, cp.Usage = streamed, usage
+		if streamed {
+			cp.TTFTMS = resp.TTFTMS
+		}
+		s.announceCompletion(c, cp)
+		s.saveCompletion(c, cp, answer, start)
+		resp.ID = cp.ID
+	}
+	liveSessions.publish(sess.ID, sessionEvent{"done", gin.H{"id": resp.ID}})
+	if streamed {
+		done := streamSummary(tgt, usage, finishReason, ttft, elapsed)
+		done["session_id"], done["id"] = resp.SessionID, resp.ID
+		c.SSEvent("done", done)
+		c.Writer.Flush()
+		return
+	}
+	if canned == "" {
+		if usage.TotalTokens == 0 {
+			usage = estimateUsage(payload.Messages, answer)
+		}
+		setCostHeader(c, tgt, usage)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// streamChat streams the answer of tgt to payload as SSE token events, to
+// the caller and to the viewers of session id. It returns the answer, the
+// usage and finish reason of the stream and the time to its first token,
+// zero if no token was sent.
+func (s *server) streamChat(c *gin.Context, tgt target, payload DeepSeekRequestPayload, id string) (string, UsageInfo, string, time.Duration, error) {
+	ctx := c.Request.Context()
+	start := time.Now()
+	var ttft time.Duration
+	var answer strings.Builder
+	usage, finishReason, err := tgt.provider.completeStream(ctx, payload, func(delta string) error {
+		if ttft == 0 {
+			ttft = time.Since(start)
+			c.Header("Content-Type", "text/event-stream")
+			c.Header("Cache-Control", "no-cache")
+			c.Header("X-Accel-Buffering", "no")
+		}
+		answer.WriteString(delta)
+		c.SSEvent("token", gin.H{"content": delta})
+		c.Writer.Flush()
+		liveSessions.publish(id, sessionEvent{"token", gin.H{"content": delta}})
+		return ctx.Err()
+	})
+	if err == nil && ttft == 0 {
+		err = errEmptyCompletion
+	}
+	return answer.String(), usage, finishReason, ttft, err
+}
+
+// withAttachments appends the text of the files attached to a multipart
+// chat request to message, each wrapped in a file tag with its name. It
+// writes the error response and reports false for binary files: those
+// that are not UTF-8 or contain NUL bytes.
+func withAttachments(c *gin.Context, message string) (string, bool) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read the multipart body."})
+		return "", false
+	}
+	var b strings.Builder
+	b.WriteString(message)
+	for _, fh := range form.File["file"] {
+		data, err := readAttachment(fh)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read the attached file " + fh.Filename + "."})
+			return "", false
+		}
+		if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "The attached file " + fh.Filename + " is not a text file."})
+			return "", false
+		}
+		if b.Len() > 0 {
+			b.WriteString("\n\n")
+		}
+		fmt.Fprintf(&b, "<file name=%q>\n%s\n</file>", fh.Filename, strings.TrimRight(string(data), "\n"))
+	}
+	return b.String(), true
+}
+
+// readAttachment returns the contents of an attached file.
+func readAttachment(fh *multipart.FileHeader) ([]byte, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// handleListSessions returns a page of stored sessions with their titles,
+// optionally only those updated between from and to, answered by model or
+// carrying every label.
+func (s *server) handleListSessions(c *gin.Context) {
+	q := SessionQuery{Model: c.Query("model"), Labels: c.QueryArray("label")}
+	var err error
+	if q.Limit, err = pageSize(c); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if v := c.Query("from"); v != "" {
+		if q.From, err = parseBound(v, false); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be a date or an RFC 3339 time."})
+			return
+		}
+	}
+	if v := c.Query("to"); v != "" {
+		if q.To, err = parseBound(v, true); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be a date or an RFC 3339 time."})
+			return
+		}
+	}
+	if v := c.Query("cursor"); v != "" {
+		parts, err := decodeCursor(v, 2)
+		if err == nil {
+			q.AfterTime, err = time.Parse(time.RFC3339Nano, parts[0])
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor."})
+			return
+		}
+		q.AfterID = parts[1]
+	}
+
+	list, more := s.store.ListSessions(sessionScope(c), q)
+	resp := gin.H{"sessions": list}
+	if more {
+		last := list[len(list)-1]
+		resp["next_cursor"] = encodeCursor(last.UpdatedAt.Format(time.RFC3339Nano), last.ID)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// handleGetSession returns a stored session with all its messages. Its
+// share links are only listed to its creator, at its shares.
+func (s *server) handleGetSession(c *gin.Context) {
+	sess, err := s.store.Session(sessionScope(c), c.Param("id"))
+	if errors.Is(err, errSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found."})
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	sess.Shares = nil
+	c.JSON(http.StatusOK, sess)
+}
+
+// Limits of session labels.
+const (
+	maxLabels      = 20
+	maxLabelLength = 50
+)
+
+// updateSessionRequest changes a stored session.
+type updateSessionRequest struct {
+	Labels []string `json:"labels"`
+}
+
+// handleUpdateSession replaces the labels of a stored session.
+func (s *server) handleUpdateSession(c *gin.Context) {
+	var req updateSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Labels == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body."})
+		return
+	}
+	labels := []string{}
+	for _, l := range req.Labels {
+		l = strings.TrimSpace(l)
+		if l == "" || utf8.RuneCountInString(l) > maxLabelLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Labels must have 1 to %d characters.", maxLabelLength)})
+			return
+		}
+		if !slices.Contains(labels, l) {
+			labels = append(labels, l)
+		}
+	}
+	if len(labels) > maxLabels {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A session can have at most %d labels.", maxLabels)})
+		return
+	}
+
+	sess, err := s.store.SetLabels(sessionScope(c), c.Param("id"), labels)
+	if errors.Is(err, errSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found."})
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving labels of session %s: %v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	sess.Shares = nil
+	c.JSON(http.StatusOK, sess)
+}
+
+// labelCount is a label and the number of sessions carrying it.
+type labelCount struct {
+	Label    string `json:"label"`
+	Sessions int    `json:"sessions"`
+}
+
+// handleListLabels returns the labels in use, most used first.
+func (s *server) handleListLabels(c *gin.Context) {
+	labels := []labelCount{}
+	for l, n := range s.store.LabelCounts(sessionScope(c)) {
+		labels = append(labels, labelCount{Label: l, Sessions: n})
+	}
+	slices.SortFunc(labels, func(a, b labelCount) int {
+		if a.Sessions != b.Sessions {
+			return b.Sessions - a.Sessions
+		}
+		return strings.Compare(a.Label, b.Label)
+	})
+	c.JSON(http.StatusOK, gin.H{"labels": labels})
+}
+
+// titleSession generates a short title from the first exchange of a session
+// with the title model on the session's provider. If the call fails, the
+// start of the question is used.
+func (s *server) titleSession(tgt target, id, question, answer string) {
+	title := fallbackTitle(question)
+
+	payload, err := lookupTemplate("title").Payload(struct{ Question, Answer string }{
+		Question: truncateRunes(question, 2000),
+		Answer:   truncateRunes(stripReasoning(answer), 2000),
+	}, 0)
+	if err == nil {
+		// The title prompt is not the user's; it is not wrapped.
+		tgt.wrapper = nil
+		tgt.prepare(&payload)
+		payload.Model = s.cfg.TitleModel
+		var generated string
+		generated, err = tgt.provider.complete(withPriority(context.Background(), priorityLow), payload)
+		if generated = cleanTitle(stripReasoning(generated)); err == nil && generated != "" {
+			title = generated
+		}
+	}
+	if err != nil {
+		log.Printf("Error generating title for session %s: %v", id, err)
+	}
+
+	if err := s.store.SetTitle(id, title); err != nil {
+		log.Printf("Error saving title for session %s: %v", id, err)
+	}
+}
+
+// cleanTitle trims quotes, trailing punctuation and extra lines from a
+// generated title.
+func cleanTitle(title string) string {
+	title, _, _ = strings.Cut(strings.TrimSpace(title), "\n")
+	title = strings.Trim(title, " \"'`*#.")
+	return truncateRunes(title, maxTitleLength)
+}
+
+// fallbackTitle uses the first words of the question as a title.
+func fallbackTitle(question string) string {
+	words := strings.Fields(question)
+	if len(words) > 8 {
+		words = words[:8]
+	}
+	return truncateRunes(strings.Join(words, " "), maxTitleLength)
+}
+
+// truncateRunes shortens s to at most n characters.
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n])
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+)
+
+// shadowTimeout bounds a mirrored request, which nobody waits for.
+const shadowTimeout = 2 * time.Minute
+
+// shadow mirrors a sample of requests to a second provider and records both
+// answers, one JSON object per line, for offline comparison.
+type shadow struct {
+	cfg      *ShadowConfig
+	provider *provider
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// shadowRecord is one line of the shadow log.
+type shadowRecord struct {
+	Time     time.Time `json:"time"`
+	Messages []Message `json:"messages"`
+
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	Answer   string `json:"answer"`
+	Latency  int64  `json:"latency_ms"`
+
+	ShadowProvider string `json:"shadow_provider"`
+	ShadowModel    string `json:"shadow_model"`
+	ShadowAnswer   string `json:"shadow_answer,omitempty"`
+	ShadowLatency  int64  `json:"shadow_latency_ms"`
+	ShadowError    string `json:"shadow_error,omitempty"`
+}
+
+func newShadow(cfg *ShadowConfig, p *provider) (*shadow, error) {
+	f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open shadow log: %w", err)
+	}
+	return &shadow{cfg: cfg, provider: p, file: f}, nil
+}
+
+// mirror replays a request that tgt answered with answer in latency against
+// the shadow provider, in the background, if it falls in the sample. It is
+// safe on a nil shadow.
+func (sh *shadow) mirror(tgt target, payload DeepSeekRequestPayload, answer string, latency time.Duration) {
+	if sh == nil || rand.Float64()*100 >= sh.cfg.Percent {
+		return
+	}
+
+	rec := shadowRecord{
+		Time:           time.Now().UTC(),
+		Messages:       payload.Messages,
+		Provider:       tgt.provider.name,
+		Model:          payload.Model,
+		Answer:         answer,
+		Latency:        latency.Milliseconds(),
+		ShadowProvider: sh.provider.name,
+		ShadowModel:    payload.Model,
+	}
+	if sh.cfg.Model != "" {
+		payload.Model = sh.cfg.Model
+		rec.ShadowModel = sh.cfg.Model
+	}
+	payload.Stream = false
+
+	go func() {
+		ctx, cancel := context.WithTimeout(withPriority(context.Background(), priorityLow), shadowTimeout)
+		defer cancel()
+
+		start := time.Now()
+		shadowAnswer, err := sh.provider.complete(ctx, payload)
+		rec.ShadowLatency = time.Since(start).Milliseconds()
+		rec.ShadowAnswer = shadowAnswer
+		if err != nil {
+			rec.ShadowError = err.Error()
+		}
+		sh.write(rec)
+	}()
+}
+
+func (sh *shadow) write(rec shadowRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Error encoding shadow record: %v", err)
+		return
+	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, err := sh.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing shadow log: %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed share.html
+var shareHTML string
+
+var sharePage = template.Must(template.New("share").Parse(shareHTML))
+
+// createShareRequest is the optional body of POST /sessions/:id/shares.
+type createShareRequest struct {
+	// ExpiresIn is how long the link works; zero keeps it until revoked.
+	ExpiresIn Duration `json:"expires_in"`
+}
+
+// sharedSession is the read-only view of a shared session.
+type sharedSession struct {
+	Title     string     `json:"title"`
+	Messages  []Message  `json:"messages"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// sharePath is where the session shared with token can be read.
+func sharePath(token string) string {
+	return "/s/" + token
+}
+
+// ownedSession loads the session named in the path for a change only its
+// creator may make. It writes the error response and returns nil if the
+// session is missing or not the caller's.
+func (s *server) ownedSession(c *gin.Context) *Session {
+	sess, err := s.store.Session(sessionScope(c), c.Param("id"))
+	if errors.Is(err, errSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found."})
+		return nil
+	}
+	if err != nil {
+		log.Printf("Error loading session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return nil
+	}
+	if sess.Owner != ownerFor(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the creator of a session can share it."})
+		return nil
+	}
+	return sess
+}
+
+// handleCreateShare creates a public read-only link to a session of the
+// caller, which expires after expires_in if given.
+func (s *server) handleCreateShare(c *gin.Context) {
+	var req createShareRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil || req.ExpiresIn.Duration < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body."})
+			return
+		}
+	}
+	sess := s.ownedSession(c)
+	if sess == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	share := &SessionShare{Token: newID(), CreatedAt: now}
+	if req.ExpiresIn.Duration > 0 {
+		expires := now.Add(req.ExpiresIn.Duration)
+		share.ExpiresAt = &expires
+	}
+	if err := s.store.AddShare(sess.ID, share); err != nil {
+		log.Printf("Error sharing session %s: %v", sess.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	auditNote(c, "shared session %s", sess.ID)
+	c.JSON(http.StatusCreated, gin.H{"token": share.Token, "url": sharePath(share.Token), "created_at": share.CreatedAt, "expires_at": share.ExpiresAt})
+}
+
+// handleListShares lists the public links to a session of the caller.
+func (s *server) handleListShares(c *gin.Context) {
+	sess := s.ownedSession(c)
+	if sess == nil {
+		return
+	}
+	shares := make([]gin.H, len(sess.Shares))
+	now := time.Now()
+	for i, sh := range sess.Shares {
+		shares[i] = gin.H{"token": sh.Token, "url": sharePath(sh.Token), "created_at": sh.CreatedAt, "expires_at": sh.ExpiresAt, "expired": sh.expired(now)}
+	}
+	c.JSON(http.StatusOK, gin.H{"shares": shares})
+}
+
+// handleRevokeShare deletes a public link to a session of the caller.
+func (s *server) handleRevokeShare(c *gin.Context) {
+	sess := s.ownedSession(c)
+	if sess == nil {
+		return
+	}
+	err := s.store.RevokeShare(sess.ID, c.Param("token"))
+	if errors.Is(err, errShareNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found."})
+		return
+	}
+	if err != nil {
+		log.Printf("Error revoking a share of session %s: %v", sess.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	auditNote(c, "revoked a share link of session %s", sess.ID)
+	c.Status(http.StatusNoContent)
+}
+
+// handleShared serves a shared session read-only: as HTML to browsers,
+// else as JSON. Revoked links are not found; expired ones are gone.
+func (s *server) handleShared(c *gin.Context) {
+	sess, share, err := s.store.SharedSession(c.Param("token"), time.Now())
+	switch {
+	case errors.Is(err, errShareNotFound):
+		c.String(http.StatusNotFound, "Share link not found.")
+		return
+	case errors.Is(err, errShareExpired):
+		c.String(http.StatusGone, "This share link has expired.")
+		return
+	case err != nil:
+		log.Printf("Error loading shared session: %v", err)
+		c.String(http.StatusInternalServerError, "Internal server error.")
+		return
+	}
+
+	view := sharedSession{Title: sess.Title, Messages: sess.Messages, CreatedAt: sess.CreatedAt, UpdatedAt: sess.UpdatedAt, ExpiresAt: share.ExpiresAt}
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Robots-Tag", "noindex")
+	if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) != gin.MIMEHTML {
+		c.JSON(http.StatusOK, view)
+		return
+	}
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := sharePage.Execute(c.Writer, view); err != nil {
+		log.Printf("Error rendering shared session %s: %v", sess.ID, err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// shedError rejects a request to relieve an overloaded provider.
+type shedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *shedError) Error() string {
+	return fmt.Sprintf("shedding load, retry after %s", e.RetryAfter)
+}
+
+// overloadRetryAfter returns the Retry-After seconds for an overloaded
+// error: the load shedding's suggestion, or a short wait for a full queue.
+func overloadRetryAfter(err error) string {
+	var se *shedError
+	if errors.As(err, &se) {
+		return strconv.Itoa(int(math.Ceil(se.RetryAfter.Seconds())))
+	}
+	return "5"
+}
+
+// shedLoad rejects ctx's request early when the provider is over the load
+// shedding thresholds: low priority requests once either threshold is
+// crossed, normal ones once it is crossed twice over. High priority
+// requests are never shed.
+func (p *provider) shedLoad(ctx context.Context) error {
+	sc := p.shedding
+	if sc == nil {
+		return nil
+	}
+	var pressure float64
+	if sc.LatencyP95.Duration > 0 {
+		pressure = float64(latencies.recentP95(p.name)) / float64(sc.LatencyP95.Duration)
+	}
+	if sc.QueueDepth > 0 {
+		pressure = max(pressure, float64(p.pool.depth())/float64(sc.QueueDepth))
+	}
+
+	prio := priorityFrom(ctx)
+	switch {
+	case prio == priorityLow && pressure >= 1, prio == priorityNormal && pressure >= 2:
+		shedRequests.WithLabelValues(p.name, prio.String()).Inc()
+		return &shedError{RetryAfter: sc.RetryAfter.Duration}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func signedRequest(secret, body string) *http.Request {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req := httptest.NewRequest(http.MethodPost, "/chat?x=1", strings.NewReader(body))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "\nPOST\n/chat\nx=1\n" + body))
+	req.Header.Set("X-Client-ID", "ci")
+	req.Header.Set("X-Timestamp", ts)
+	req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func TestVerifySignature(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := defaultConfig()
+	cfg.SignatureWindow.Duration = time.Minute
+	s := &server{cfg: cfg, replays: newReplayGuard()}
+	s.clients.Store(newClientIndex([]*ClientConfig{{ID: "ci", HMACSecret: "secret"}}))
+
+	verify := func(req *http.Request) error {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = req
+		_, err := s.verifySignature(c)
+		return err
+	}
+
+	req := signedRequest("secret", `{"message":"hi"}`)
+	if err := verify(req); err != nil {
+		t.Fatalf("valid signature: %v", err)
+	}
+	replay := signedRequest("secret", `{"message":"hi"}`)
+	replay.Header = req.Header.Clone()
+	if err := verify(replay); !errors.Is(err, errSignatureReplayed) {
+		t.Errorf("replayed signature: err = %v, want %v", err, errSignatureReplayed)
+	}
+	if err := verify(signedRequest("other", `{"message":"hi"}`)); !errors.Is(err, errSignatureInvalid) {
+		t.Errorf("wrong secret: err = %v, want %v", err, errSignatureInvalid)
+	}
+	if err := verify(signedRequest("secret", strings.Repeat("x", maxSignedBody+1))); !errors.Is(err, errSignatureBody) {
+		t.Errorf("oversized body: err = %v, want %v", err, errSignatureBody)
+	}
+}
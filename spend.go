@@ -0,0 +1,78 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// spendCheckInterval is how often spend is compared to the thresholds.
+const spendCheckInterval = time.Minute
+
+// watchSpend raises spend_exceeded for every spend threshold of ac the
+// estimated spend of the current day or month has reached, checking every
+// spendCheckInterval until ctx is done.
+func (s *server) watchSpend(ctx context.Context, ac *AlertsConfig) {
+	ticker := time.NewTicker(spendCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		s.checkSpend(ac, time.Now().UTC())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkSpend adds up the cost of this month's usage records, per provider
+// and overall, and alerts about the thresholds reached at now that were
+// not alerted about yet this period.
+func (s *server) checkSpend(ac *AlertsConfig, now time.Time) {
+	day, month := now.Format(time.DateOnly), now.Format("2006-01")
+	records, _ := s.store.QueryUsage(UsageQuery{From: month + "-01", To: day})
+
+	// spent is keyed by period and provider, "" for all of them.
+	spent := map[[2]string]float64{}
+	for _, r := range records {
+		cost := s.cfg.usageCost(r)
+		for _, provider := range []string{"", r.Provider} {
+			spent[[2]string{quotaMonth, provider}] += cost
+			if r.Day == day {
+				spent[[2]string{quotaDay, provider}] += cost
+			}
+		}
+	}
+
+	for _, t := range ac.Spend {
+		amount := spent[[2]string{t.Period, t.Provider}]
+		if amount < t.Amount {
+			continue
+		}
+		period := month
+		if t.Period == quotaDay {
+			period = day
+		}
+		key := t.Period + "/" + cmp.Or(t.Provider, "all") + "/" + strconv.FormatFloat(t.Amount, 'f', -1, 64)
+		first, err := s.store.MarkSpendAlerted(key, period)
+		if err != nil {
+			log.Printf("Error saving spend alert: %v", err)
+		}
+		if !first {
+			continue
+		}
+		scope := "Spend"
+		if t.Provider != "" {
+			scope = "Spend on provider " + t.Provider
+		}
+		when := "this month"
+		if t.Period == quotaDay {
+			when = "today"
+		}
+		s.alerts.raise(alertSpendExceeded, key, fmt.Sprintf("%s %s is an estimated %.2f, over the threshold of %g.", scope, when, amount, t.Amount))
+	}
+}
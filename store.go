@@ -0,0 +1,1475 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session is a stored conversation.
+type Session struct {
+	ID        string    `json:"id"`
+	Namespace string    `json:"namespace,omitempty"`
+	Owner     string    `json:"owner,omitempty"` // client ID of the creator
+	Title     string    `json:"title"`
+	Messages  []Message `json:"messages"`
+
+	// Summary condenses the first Summarized messages, which are then
+	// sent to the model as the summary only.
+	Summary    string `json:"summary,omitempty"`
+	Summarized int    `json:"summarized,omitempty"`
+
+	// Models lists the models, as provider/model, that answered in the
+	// session.
+	Models []string `json:"models,omitempty"`
+
+	// Labels are tags the client set to organize its sessions.
+	Labels []string `json:"labels,omitempty"`
+
+	// Shares are the public read-only links to the session.
+	Shares []*SessionShare `json:"shares,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SessionShare is a public link to a session: anyone with the token can
+// read the session until the link expires or its owner revokes it.
+type SessionShare struct {
+	Token     string     `json:"token"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// expired reports whether the link no longer works at now.
+func (sh *SessionShare) expired(now time.Time) bool {
+	return sh.ExpiresAt != nil && !now.Before(*sh.ExpiresAt)
+}
+
+var (
+	errShareNotFound = errors.New("share not found")
+	errShareExpired  = errors.New("share expired")
+)
+
+// SessionSummary is the listing view of a session.
+type SessionSummary struct {
+	ID           string    `json:"id"`
+	Title        string    `json:"title"`
+	MessageCount int       `json:"message_count"`
+	Models       []string  `json:"models,omitempty"`
+	Labels       []string  `json:"labels,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// SessionQuery selects a page of sessions. Zero fields do not filter.
+type SessionQuery struct {
+	// From and To bound the time of the last update, To exclusive.
+	From, To time.Time
+	// Model keeps sessions answered by a matching model.
+	Model string
+	// Labels keeps sessions with all of these labels.
+	Labels []string
+	// After continues a listing after the session with this update time
+	// and ID.
+	AfterTime time.Time
+	AfterID   string
+	Limit     int
+}
+
+var errSessionNotFound = errors.New("session not found")
+
+// UserMemory is what is remembered about one client across sessions.
+type UserMemory struct {
+	Enabled bool         `json:"enabled"`
+	Facts   []MemoryFact `json:"facts,omitempty"`
+}
+
+// MemoryFact is a fact about a user extracted from a conversation.
+type MemoryFact struct {
+	ID        string    `json:"id"`
+	Text      string    `json:"text"`
+	Embedding []float32 `json:"embedding"`
+	Session   string    `json:"session,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DailyUsage is what an anonymous caller has used on one UTC day.
+type DailyUsage struct {
+	Day      string `json:"day"`
+	Requests int    `json:"requests"`
+	Tokens   int    `json:"tokens"`
+}
+
+// PeriodUsage is what a client has used in one quota period. Notified is
+// the highest threshold, in percent, its owner was told about.
+type PeriodUsage struct {
+	Period   string `json:"period"`
+	Requests int    `json:"requests"`
+	Tokens   int    `json:"tokens"`
+	Notified int    `json:"notified,omitempty"`
+}
+
+// UsageRecord is the usage of one client with one provider and model on
+// one UTC day, or in one hour of it.
+type UsageRecord struct {
+	Day              string `json:"day"`
+	Hour             string `json:"hour,omitempty"` // RFC 3339, hourly records only
+	Client           string `json:"client"`
+	Provider         string `json:"provider"`
+	Model            string `json:"model"`
+	Requests         int    `json:"requests"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+
+	// Cost is estimated from the current prices when records are listed,
+	// and is not stored.
+	Cost float64 `json:"cost,omitempty"`
+}
+
+// UsageEvent is the usage of one upstream request, which the rollup job
+// adds to the hourly and daily usage records.
+type UsageEvent struct {
+	Time             time.Time `json:"time"`
+	Client           string    `json:"client"`
+	Provider         string    `json:"provider"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+}
+
+// storeData is the persisted content of the store.
+type storeData struct {
+	Sessions map[string]*Session `json:"sessions"`
+
+	// AnonymousUsage is keyed by client IP.
+	AnonymousUsage map[string]*DailyUsage `json:"anonymous_usage,omitempty"`
+
+	// Usage is keyed by day, client, provider and model.
+	Usage map[string]*UsageRecord `json:"usage,omitempty"`
+
+	// HourlyUsage is keyed by hour, client, provider and model.
+	HourlyUsage map[string]*UsageRecord `json:"hourly_usage,omitempty"`
+
+	// UsageEvents are the usage of single upstream requests, oldest first.
+	// The first RolledUpEvents of them are counted in the usage records.
+	UsageEvents    []UsageEvent `json:"usage_events,omitempty"`
+	RolledUpEvents int          `json:"rolled_up_events,omitempty"`
+
+	// ClientUsage is keyed by client ID.
+	ClientUsage map[string]*PeriodUsage `json:"client_usage,omitempty"`
+
+	// Memories are keyed by client ID.
+	Memories map[string]*UserMemory `json:"memories,omitempty"`
+
+	// ScheduleRuns are keyed by schedule name, newest first.
+	ScheduleRuns map[string][]ScheduleRun `json:"schedule_runs,omitempty"`
+
+	// Accounts are keyed by user ID.
+	Accounts map[string]*Account `json:"accounts,omitempty"`
+
+	// Workspaces are keyed by ID.
+	Workspaces map[string]*Workspace `json:"workspaces,omitempty"`
+
+	// TemplateVersions are keyed by template name, oldest first.
+	TemplateVersions map[string][]*TemplateVersion `json:"template_versions,omitempty"`
+
+	// ActiveTemplates maps template names to the version in use; templates
+	// missing from it use their configured definition.
+	ActiveTemplates map[string]int `json:"active_templates,omitempty"`
+
+	// Completions are keyed by ID.
+	Completions map[string]*Completion `json:"completions,omitempty"`
+
+	// SpendAlerts map spend thresholds to the last day or month their
+	// alert was sent for.
+	SpendAlerts map[string]string `json:"spend_alerts,omitempty"`
+}
+
+// Completion is a stored answer with the request that produced it, served
+// at GET /completions/:id and its permalink.
+type Completion struct {
+	ID              string    `json:"id"`
+	Namespace       string    `json:"namespace,omitempty"`
+	Owner           string    `json:"owner,omitempty"`
+	Route           string    `json:"route"`
+	Model           string    `json:"model"` // provider/model
+	Prompt          string    `json:"prompt"`
+	Answer          string    `json:"answer"`
+	Usage           UsageInfo `json:"usage"`
+	Stream          bool      `json:"stream,omitempty"`
+	LatencyMS       int64     `json:"latency_ms"`
+	TTFTMS          int64     `json:"ttft_ms,omitempty"`
+	TokensPerSecond float64   `json:"tokens_per_second,omitempty"`
+	Public          bool      `json:"public,omitempty"` // served at its permalink
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+var errCompletionNotFound = errors.New("completion not found")
+
+// TemplateVersion is a definition of a template published through the
+// admin API. Versions are numbered from 1; version 0 is the definition in
+// the configuration, or the built-in one.
+type TemplateVersion struct {
+	Template   string         `json:"template"`
+	Version    int            `json:"version"`
+	Definition TemplateConfig `json:"definition"`
+	Author     string         `json:"author"`
+	Note       string         `json:"note,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+}
+
+var errVersionNotFound = errors.New("template version not found")
+
+// Workspace is a team's shared space for sessions. Members are client IDs
+// mapped to their workspace role. Templates are the workspace's own
+// versions of templates, keyed by name, used in place of the server's for
+// requests made in the workspace.
+type Workspace struct {
+	ID        string                     `json:"id"`
+	Name      string                     `json:"name"`
+	Members   map[string]string          `json:"members"`
+	Templates map[string]*TemplateConfig `json:"templates,omitempty"`
+	CreatedAt time.Time                  `json:"created_at"`
+}
+
+var errWorkspaceNotFound = errors.New("workspace not found")
+
+// Account is a user who signed up. Its ID doubles as the client ID of its
+// requests.
+type Account struct {
+	ID           string        `json:"id"`
+	PasswordHash string        `json:"password_hash"`
+	Role         string        `json:"role,omitempty"`
+	Keys         []*AccountKey `json:"keys,omitempty"`
+	CreatedAt    time.Time     `json:"created_at"`
+}
+
+// AccountKey is a credential of an account: an API key, or a login token
+// when it expires. Only the SHA-256 of the secret is stored.
+type AccountKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name,omitempty"`
+	Hash      string     `json:"hash"`
+	Prefix    string     `json:"prefix"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+var (
+	errAccountExists   = errors.New("account exists")
+	errAccountNotFound = errors.New("account not found")
+	errKeyNotFound     = errors.New("key not found")
+	errTooManyKeys     = errors.New("too many keys")
+)
+
+// ScheduleRun is the result of one run of a scheduled prompt.
+type ScheduleRun struct {
+	ID        string    `json:"id"`
+	StartedAt time.Time `json:"started_at"`
+	Duration  int64     `json:"duration_ms"`
+	Model     string    `json:"model"`
+	Answer    string    `json:"answer,omitempty"`
+	Error     string    `json:"error,omitempty"`
+
+	// Delivered names the destinations the result reached.
+	Delivered     []string `json:"delivered,omitempty"`
+	DeliveryError string   `json:"delivery_error,omitempty"`
+}
+
+// Store keeps sessions in memory and, when a file is configured, persists
+// them as JSON after every change.
+type Store struct {
+	mu   sync.Mutex
+	path string
+	data storeData
+
+	// words indexes the session messages for SearchSessions.
+	words *searchIndex
+}
+
+// openStore loads the store from path. An empty path gives a memory-only store.
+func openStore(path string) (*Store, error) {
+	st := &Store{path: path, data: storeData{Sessions: map[string]*Session{}}, words: newSearchIndex()}
+	if path == "" {
+		return st, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading data file: %w", err)
+	}
+	if err := json.Unmarshal(raw, &st.data); err != nil {
+		return nil, fmt.Errorf("parsing data file %s: %w", path, err)
+	}
+	if st.data.Sessions == nil {
+		st.data.Sessions = map[string]*Session{}
+	}
+	for _, sess := range st.data.Sessions {
+		for _, m := range sess.Messages {
+			st.words.add(sess.ID, m.Content)
+		}
+	}
+	return st, nil
+}
+
+// saveLocked writes the store to disk. The caller must hold st.mu.
+func (st *Store) saveLocked() error {
+	if st.path == "" {
+		return nil
+	}
+	raw, err := json.Marshal(&st.data)
+	if err != nil {
+		return fmt.Errorf("encoding data file: %w", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated store.
+	tmp, err := os.CreateTemp(filepath.Dir(st.path), ".askllm-*.json")
+	if err != nil {
+		return fmt.Errorf("writing data file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing data file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing data file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), st.path); err != nil {
+		return fmt.Errorf("writing data file: %w", err)
+	}
+	return nil
+}
+
+// CreateSession stores a new empty session in namespace, owned by the client
+// owner, and returns a copy of it.
+func (st *Store) CreateSession(namespace, owner string) (*Session, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now().UTC()
+	sess := &Session{ID: newID(), Namespace: namespace, Owner: owner, CreatedAt: now, UpdatedAt: now}
+	st.data.Sessions[sess.ID] = sess
+	if err := st.saveLocked(); err != nil {
+		return nil, err
+	}
+	return sess.clone(), nil
+}
+
+// deleteSessionLocked removes a session and its words from the search
+// index. The caller must hold st.mu.
+func (st *Store) deleteSessionLocked(id string) {
+	if sess, ok := st.data.Sessions[id]; ok {
+		st.words.remove(sess)
+		delete(st.data.Sessions, id)
+	}
+}
+
+// SessionScope selects the sessions a caller may use: those of Namespace
+// and, unless a workspace shares the namespace, of Owner.
+type SessionScope struct {
+	Namespace string
+	Owner     string
+	Shared    bool
+}
+
+func (sc SessionScope) contains(sess *Session) bool {
+	return sess.Namespace == sc.Namespace && (sc.Shared || sess.Owner == sc.Owner)
+}
+
+// Session returns a copy of the session with the given id. Sessions out of
+// scope are not found.
+func (st *Store) Session(scope SessionScope, id string) (*Session, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sess, ok := st.data.Sessions[id]
+	if !ok || !scope.contains(sess) {
+		return nil, errSessionNotFound
+	}
+	return sess.clone(), nil
+}
+
+// AppendMessages adds messages answered by model (provider/model, or empty)
+// to the end of a session.
+func (st *Store) AppendMessages(id, model string, messages ...Message) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sess, ok := st.data.Sessions[id]
+	if !ok {
+		return errSessionNotFound
+	}
+	sess.Messages = append(sess.Messages, messages...)
+	for _, m := range messages {
+		st.words.add(id, m.Content)
+	}
+	if model != "" && !slices.Contains(sess.Models, model) {
+		sess.Models = append(sess.Models, model)
+	}
+	sess.UpdatedAt = time.Now().UTC()
+	return st.saveLocked()
+}
+
+// SetTitle sets the title of a session.
+func (st *Store) SetTitle(id, title string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sess, ok := st.data.Sessions[id]
+	if !ok {
+		return errSessionNotFound
+	}
+	sess.Title = title
+	return st.saveLocked()
+}
+
+// SetLabels replaces the labels of a session in scope and returns the
+// updated session.
+func (st *Store) SetLabels(scope SessionScope, id string, labels []string) (*Session, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sess, ok := st.data.Sessions[id]
+	if !ok || !scope.contains(sess) {
+		return nil, errSessionNotFound
+	}
+	sess.Labels = labels
+	return sess.clone(), st.saveLocked()
+}
+
+// LabelCounts returns how many sessions in scope carry each label.
+func (st *Store) LabelCounts(scope SessionScope) map[string]int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	counts := map[string]int{}
+	for _, sess := range st.data.Sessions {
+		if scope.contains(sess) {
+			for _, l := range sess.Labels {
+				counts[l]++
+			}
+		}
+	}
+	return counts
+}
+
+// SetSummary stores the summary of the first summarized messages of a
+// session.
+func (st *Store) SetSummary(id, summary string, summarized int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sess, ok := st.data.Sessions[id]
+	if !ok {
+		return errSessionNotFound
+	}
+	sess.Summary, sess.Summarized = summary, summarized
+	return st.saveLocked()
+}
+
+// ListSessions returns the sessions in scope matching q, most recently
+// updated first, and whether more follow the returned page.
+func (st *Store) ListSessions(scope SessionScope, q SessionQuery) (list []SessionSummary, more bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	list = []SessionSummary{}
+	for _, sess := range st.data.Sessions {
+		if !scope.contains(sess) ||
+			!q.From.IsZero() && sess.UpdatedAt.Before(q.From) ||
+			!q.To.IsZero() && !sess.UpdatedAt.Before(q.To) {
+			continue
+		}
+		if q.Model != "" && !slices.ContainsFunc(sess.Models, func(m string) bool { return modelMatches(m, q.Model) }) {
+			continue
+		}
+		if !containsAll(sess.Labels, q.Labels) {
+			continue
+		}
+		if q.AfterID != "" && !sessionBefore(q.AfterTime, q.AfterID, sess.UpdatedAt, sess.ID) {
+			continue
+		}
+		list = append(list, SessionSummary{
+			ID:           sess.ID,
+			Title:        sess.Title,
+			MessageCount: len(sess.Messages),
+			Models:       slices.Clone(sess.Models),
+			Labels:       slices.Clone(sess.Labels),
+			CreatedAt:    sess.CreatedAt,
+			UpdatedAt:    sess.UpdatedAt,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return sessionBefore(list[i].UpdatedAt, list[i].ID, list[j].UpdatedAt, list[j].ID)
+	})
+	if q.Limit > 0 && len(list) > q.Limit {
+		return list[:q.Limit], true
+	}
+	return list, false
+}
+
+// containsAll reports whether list contains every element of want.
+func containsAll(list, want []string) bool {
+	for _, w := range want {
+		if !slices.Contains(list, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// sessionBefore reports whether a session updated at t with ID id is listed
+// before one updated at u with ID other: newer first, then by ID.
+func sessionBefore(t time.Time, id string, u time.Time, other string) bool {
+	if !t.Equal(u) {
+		return t.After(u)
+	}
+	return id < other
+}
+
+// SearchSessions returns up to limit sessions in scope with messages
+// containing every term, those with the most matching messages first, then
+// the most recently updated. Only the sessions the word index finds for the
+// terms are read.
+func (st *Store) SearchSessions(scope SessionScope, terms []string, limit int) []SearchResult {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	results := []SearchResult{}
+	for id := range st.words.candidates(terms) {
+		sess, ok := st.data.Sessions[id]
+		if !ok || !scope.contains(sess) {
+			continue
+		}
+		r := SearchResult{ID: sess.ID, Title: sess.Title, UpdatedAt: sess.UpdatedAt, Snippets: []Snippet{}}
+		for i, m := range sess.Messages {
+			snippet, ok := matchMessage(m.Content, terms)
+			if !ok {
+				continue
+			}
+			r.Matches++
+			if len(r.Snippets) < maxSnippets {
+				r.Snippets = append(r.Snippets, Snippet{Message: i, Role: m.Role, Text: snippet})
+			}
+		}
+		if r.Matches > 0 {
+			results = append(results, r)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Matches != results[j].Matches {
+			return results[i].Matches > results[j].Matches
+		}
+		return sessionBefore(results[i].UpdatedAt, results[i].ID, results[j].UpdatedAt, results[j].ID)
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+func (sess *Session) clone() *Session {
+	c := *sess
+	c.Messages = append([]Message(nil), sess.Messages...)
+	c.Models = slices.Clone(sess.Models)
+	c.Labels = slices.Clone(sess.Labels)
+	c.Shares = make([]*SessionShare, len(sess.Shares))
+	for i, sh := range sess.Shares {
+		share := *sh
+		c.Shares[i] = &share
+	}
+	return &c
+}
+
+// AddShare adds a public link to the session with the given id.
+func (st *Store) AddShare(id string, share *SessionShare) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sess, ok := st.data.Sessions[id]
+	if !ok {
+		return errSessionNotFound
+	}
+	sess.Shares = append(sess.Shares, share)
+	return st.saveLocked()
+}
+
+// RevokeShare deletes the public link with token from the session with the
+// given id.
+func (st *Store) RevokeShare(id, token string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sess, ok := st.data.Sessions[id]
+	if !ok {
+		return errSessionNotFound
+	}
+	i := slices.IndexFunc(sess.Shares, func(sh *SessionShare) bool { return sh.Token == token })
+	if i < 0 {
+		return errShareNotFound
+	}
+	sess.Shares = slices.Delete(sess.Shares, i, i+1)
+	return st.saveLocked()
+}
+
+// SharedSession returns a copy of the session a public link points to, and
+// the link, unless it expired at now.
+func (st *Store) SharedSession(token string, now time.Time) (*Session, *SessionShare, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for _, sess := range st.data.Sessions {
+		for _, sh := range sess.Shares {
+			if subtle.ConstantTimeCompare([]byte(sh.Token), []byte(token)) != 1 {
+				continue
+			}
+			if sh.expired(now) {
+				return nil, nil, errShareExpired
+			}
+			share := *sh
+			return sess.clone(), &share, nil
+		}
+	}
+	return nil, nil, errShareNotFound
+}
+
+// DeleteOwnerData deletes everything stored for the client owner and
+// reports how many sessions, memories, completions and usage records (daily,
+// hourly, per request and per quota period) were removed.
+func (st *Store) DeleteOwnerData(owner string) (sessions, memories, completions, usage int, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for id, sess := range st.data.Sessions {
+		if sess.Owner == owner {
+			st.deleteSessionLocked(id)
+			sessions++
+		}
+	}
+	mem, hadMemory := st.data.Memories[owner]
+	if hadMemory {
+		memories = len(mem.Facts)
+		delete(st.data.Memories, owner)
+	}
+	for id, cp := range st.data.Completions {
+		if cp.Owner == owner {
+			delete(st.data.Completions, id)
+			completions++
+		}
+	}
+	for _, records := range []map[string]*UsageRecord{st.data.Usage, st.data.HourlyUsage} {
+		for key, r := range records {
+			if r.Client == owner {
+				delete(records, key)
+				usage++
+			}
+		}
+	}
+	// Events are deleted in place; those left before RolledUpEvents stay
+	// the rolled up ones.
+	events, rolledUp := st.data.UsageEvents[:0], 0
+	for i, e := range st.data.UsageEvents {
+		if e.Client == owner {
+			usage++
+			continue
+		}
+		if i < st.data.RolledUpEvents {
+			rolledUp++
+		}
+		events = append(events, e)
+	}
+	st.data.UsageEvents, st.data.RolledUpEvents = events, rolledUp
+	if _, ok := st.data.ClientUsage[owner]; ok {
+		delete(st.data.ClientUsage, owner)
+		usage++
+	}
+	if sessions == 0 && !hadMemory && completions == 0 && usage == 0 {
+		return 0, 0, 0, 0, nil
+	}
+	return sessions, memories, completions, usage, st.saveLocked()
+}
+
+// AddCompletion stores a completion.
+func (st *Store) AddCompletion(cp *Completion) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.data.Completions == nil {
+		st.data.Completions = map[string]*Completion{}
+	}
+	st.data.Completions[cp.ID] = cp
+	return st.saveLocked()
+}
+
+// Completion returns a copy of the completion with the given id.
+func (st *Store) Completion(id string) (*Completion, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	cp, ok := st.data.Completions[id]
+	if !ok {
+		return nil, errCompletionNotFound
+	}
+	c := *cp
+	return &c, nil
+}
+
+// AddScheduleRun stores a run of the named schedule, keeping the newest
+// limit runs.
+func (st *Store) AddScheduleRun(name string, run ScheduleRun, limit int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.data.ScheduleRuns == nil {
+		st.data.ScheduleRuns = map[string][]ScheduleRun{}
+	}
+	runs := append([]ScheduleRun{run}, st.data.ScheduleRuns[name]...)
+	st.data.ScheduleRuns[name] = runs[:min(len(runs), limit)]
+	return st.saveLocked()
+}
+
+// ScheduleRuns returns the stored runs of the named schedule, newest first.
+func (st *Store) ScheduleRuns(name string) []ScheduleRun {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return slices.Clone(st.data.ScheduleRuns[name])
+}
+
+// Memory returns a copy of what is remembered about owner.
+func (st *Store) Memory(owner string) UserMemory {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	mem, ok := st.data.Memories[owner]
+	if !ok {
+		return UserMemory{}
+	}
+	return UserMemory{Enabled: mem.Enabled, Facts: slices.Clone(mem.Facts)}
+}
+
+// SetMemoryEnabled turns remembering owner on or off. Facts already
+// remembered are kept.
+func (st *Store) SetMemoryEnabled(owner string, enabled bool) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	mem, ok := st.data.Memories[owner]
+	if !ok {
+		if !enabled {
+			return nil
+		}
+		if st.data.Memories == nil {
+			st.data.Memories = map[string]*UserMemory{}
+		}
+		mem = &UserMemory{}
+		st.data.Memories[owner] = mem
+	}
+	mem.Enabled = enabled
+	return st.saveLocked()
+}
+
+// AddMemories remembers facts about owner, if remembering is on, forgetting
+// the oldest beyond limit.
+func (st *Store) AddMemories(owner string, limit int, facts ...MemoryFact) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	mem, ok := st.data.Memories[owner]
+	if !ok || !mem.Enabled {
+		return nil
+	}
+	mem.Facts = append(mem.Facts, facts...)
+	if len(mem.Facts) > limit {
+		mem.Facts = slices.Delete(mem.Facts, 0, len(mem.Facts)-limit)
+	}
+	return st.saveLocked()
+}
+
+// DeleteMemories forgets the facts about owner with the given IDs, or all
+// of them when no ID is given, and reports how many were deleted.
+func (st *Store) DeleteMemories(owner string, ids ...string) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	mem, ok := st.data.Memories[owner]
+	if !ok {
+		return 0, nil
+	}
+	before := len(mem.Facts)
+	if len(ids) == 0 {
+		mem.Facts = nil
+	} else {
+		mem.Facts = slices.DeleteFunc(mem.Facts, func(f MemoryFact) bool { return slices.Contains(ids, f.ID) })
+	}
+	deleted := before - len(mem.Facts)
+	if deleted == 0 {
+		return 0, nil
+	}
+	return deleted, st.saveLocked()
+}
+
+// PurgeSessions deletes the sessions last updated before cutoff and
+// returns how many were deleted.
+func (st *Store) PurgeSessions(cutoff time.Time) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	n := 0
+	for id, sess := range st.data.Sessions {
+		if sess.UpdatedAt.Before(cutoff) {
+			st.deleteSessionLocked(id)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, st.saveLocked()
+}
+
+// PurgeCompletions deletes the completions stored before cutoff and
+// returns how many were deleted.
+func (st *Store) PurgeCompletions(cutoff time.Time) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	n := 0
+	for id, cp := range st.data.Completions {
+		if cp.CreatedAt.Before(cutoff) {
+			delete(st.data.Completions, id)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, st.saveLocked()
+}
+
+// PurgeUsage deletes the usage records of days before cutoff and returns
+// how many were deleted.
+func (st *Store) PurgeUsage(cutoff time.Time) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	day := cutoff.UTC().Format(time.DateOnly)
+	n := 0
+	for key, u := range st.data.AnonymousUsage {
+		if u.Day < day {
+			delete(st.data.AnonymousUsage, key)
+			n++
+		}
+	}
+	for key, r := range st.data.Usage {
+		if r.Day < day {
+			delete(st.data.Usage, key)
+			n++
+		}
+	}
+	for key, r := range st.data.HourlyUsage {
+		if r.Day < day {
+			delete(st.data.HourlyUsage, key)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, st.saveLocked()
+}
+
+// ReserveAnonymousRequest counts a request of ip on day unless ip already
+// made maxRequests requests or used maxTokens tokens that day (zero for no
+// limit). It returns what ip has used, with the request if it was counted.
+func (st *Store) ReserveAnonymousRequest(ip, day string, maxRequests, maxTokens int) (u DailyUsage, ok bool, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	u = DailyUsage{Day: day}
+	if cur, found := st.data.AnonymousUsage[ip]; found && cur.Day == day {
+		u = *cur
+	}
+	if maxRequests > 0 && u.Requests >= maxRequests || maxTokens > 0 && u.Tokens >= maxTokens {
+		return u, false, nil
+	}
+	u.Requests++
+	return u, true, st.addAnonymousUsageLocked(ip, day, 1, 0)
+}
+
+// AddAnonymousUsage adds requests and tokens to what ip has used on day,
+// dropping the usage of earlier days.
+func (st *Store) AddAnonymousUsage(ip, day string, requests, tokens int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.addAnonymousUsageLocked(ip, day, requests, tokens)
+}
+
+// addAnonymousUsageLocked is AddAnonymousUsage for a caller holding st.mu.
+func (st *Store) addAnonymousUsageLocked(ip, day string, requests, tokens int) error {
+	if st.data.AnonymousUsage == nil {
+		st.data.AnonymousUsage = map[string]*DailyUsage{}
+	}
+	for key, u := range st.data.AnonymousUsage {
+		if u.Day != day {
+			delete(st.data.AnonymousUsage, key)
+		}
+	}
+	u, ok := st.data.AnonymousUsage[ip]
+	if !ok {
+		u = &DailyUsage{Day: day}
+		st.data.AnonymousUsage[ip] = u
+	}
+	u.Requests += requests
+	u.Tokens += tokens
+	return st.saveLocked()
+}
+
+// newID returns a random 128-bit identifier in hex.
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// CreateAccount stores a new account.
+func (st *Store) CreateAccount(acc *Account) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.data.Accounts == nil {
+		st.data.Accounts = map[string]*Account{}
+	}
+	if _, ok := st.data.Accounts[acc.ID]; ok {
+		return errAccountExists
+	}
+	st.data.Accounts[acc.ID] = acc
+	return st.saveLocked()
+}
+
+// Account returns the account with the given ID.
+func (st *Store) Account(id string) (*Account, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	acc, ok := st.data.Accounts[id]
+	if !ok {
+		return nil, errAccountNotFound
+	}
+	return acc.clone(), nil
+}
+
+// Accounts returns every account, sorted by ID.
+func (st *Store) Accounts() []*Account {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	list := make([]*Account, 0, len(st.data.Accounts))
+	for _, acc := range st.data.Accounts {
+		list = append(list, acc.clone())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// SetAccountRole changes the role of an account.
+func (st *Store) SetAccountRole(id, role string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	acc, ok := st.data.Accounts[id]
+	if !ok {
+		return errAccountNotFound
+	}
+	acc.Role = role
+	return st.saveLocked()
+}
+
+// DeleteAccount removes an account and its keys.
+func (st *Store) DeleteAccount(id string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.data.Accounts[id]; !ok {
+		return errAccountNotFound
+	}
+	delete(st.data.Accounts, id)
+	return st.saveLocked()
+}
+
+// AccountByKey returns the account holding the unexpired key with the
+// given hash.
+func (st *Store) AccountByKey(hash string, now time.Time) (*Account, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for _, acc := range st.data.Accounts {
+		for _, k := range acc.Keys {
+			if k.Hash == hash && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt)) {
+				return acc.clone(), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// AddAccountKey adds a key to an account, dropping its expired login
+// tokens. API keys, those without an expiry, are limited to maxKeys.
+func (st *Store) AddAccountKey(id string, key *AccountKey, maxKeys int) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	acc, ok := st.data.Accounts[id]
+	if !ok {
+		return errAccountNotFound
+	}
+	now := time.Now()
+	acc.Keys = slices.DeleteFunc(acc.Keys, func(k *AccountKey) bool { return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt) })
+	if key.ExpiresAt == nil && len(acc.apiKeys()) >= maxKeys {
+		return errTooManyKeys
+	}
+	acc.Keys = append(acc.Keys, key)
+	return st.saveLocked()
+}
+
+// DeleteAccountKey removes a key of an account.
+func (st *Store) DeleteAccountKey(id, keyID string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	acc, ok := st.data.Accounts[id]
+	if !ok {
+		return errAccountNotFound
+	}
+	n := len(acc.Keys)
+	acc.Keys = slices.DeleteFunc(acc.Keys, func(k *AccountKey) bool { return k.ID == keyID })
+	if len(acc.Keys) == n {
+		return errKeyNotFound
+	}
+	return st.saveLocked()
+}
+
+// apiKeys returns the keys of acc that are not login tokens.
+func (acc *Account) apiKeys() []*AccountKey {
+	var keys []*AccountKey
+	for _, k := range acc.Keys {
+		if k.ExpiresAt == nil {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (acc *Account) clone() *Account {
+	c := *acc
+	c.Keys = make([]*AccountKey, len(acc.Keys))
+	for i, k := range acc.Keys {
+		kc := *k
+		c.Keys[i] = &kc
+	}
+	return &c
+}
+
+// CreateWorkspace stores a new workspace.
+func (st *Store) CreateWorkspace(ws *Workspace) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.data.Workspaces == nil {
+		st.data.Workspaces = map[string]*Workspace{}
+	}
+	st.data.Workspaces[ws.ID] = ws
+	return st.saveLocked()
+}
+
+// Workspace returns the workspace with the given ID.
+func (st *Store) Workspace(id string) (*Workspace, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	ws, ok := st.data.Workspaces[id]
+	if !ok {
+		return nil, errWorkspaceNotFound
+	}
+	return ws.clone(), nil
+}
+
+// WorkspacesOf returns the workspaces member belongs to, sorted by name.
+func (st *Store) WorkspacesOf(member string) []*Workspace {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	list := []*Workspace{}
+	for _, ws := range st.data.Workspaces {
+		if _, ok := ws.Members[member]; ok {
+			list = append(list, ws.clone())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// SetWorkspaceMember gives member a role in a workspace, or removes them
+// with an empty role, and returns the updated workspace.
+func (st *Store) SetWorkspaceMember(id, member, role string) (*Workspace, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	ws, ok := st.data.Workspaces[id]
+	if !ok {
+		return nil, errWorkspaceNotFound
+	}
+	if role == "" {
+		delete(ws.Members, member)
+	} else {
+		ws.Members[member] = role
+	}
+	return ws.clone(), st.saveLocked()
+}
+
+// SetWorkspaceTemplate stores the workspace's version of the template
+// named by def, or removes the named one with a nil def, and returns the
+// updated workspace.
+func (st *Store) SetWorkspaceTemplate(id, name string, def *TemplateConfig) (*Workspace, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	ws, ok := st.data.Workspaces[id]
+	if !ok {
+		return nil, errWorkspaceNotFound
+	}
+	if def == nil {
+		delete(ws.Templates, name)
+	} else {
+		if ws.Templates == nil {
+			ws.Templates = map[string]*TemplateConfig{}
+		}
+		ws.Templates[name] = def
+	}
+	return ws.clone(), st.saveLocked()
+}
+
+// DeleteWorkspace removes a workspace and its sessions and reports how many
+// sessions were removed.
+func (st *Store) DeleteWorkspace(id, namespace string) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.data.Workspaces[id]; !ok {
+		return 0, errWorkspaceNotFound
+	}
+	delete(st.data.Workspaces, id)
+	n := 0
+	for sid, sess := range st.data.Sessions {
+		if sess.Namespace == namespace {
+			st.deleteSessionLocked(sid)
+			n++
+		}
+	}
+	return n, st.saveLocked()
+}
+
+func (ws *Workspace) clone() *Workspace {
+	c := *ws
+	c.Members = maps.Clone(ws.Members)
+	c.Templates = maps.Clone(ws.Templates)
+	return &c
+}
+
+// AddTemplateVersion stores the next version of a template and, with
+// activate, puts it in use.
+func (st *Store) AddTemplateVersion(v *TemplateVersion, activate bool) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.data.TemplateVersions == nil {
+		st.data.TemplateVersions = map[string][]*TemplateVersion{}
+	}
+	v.Version = len(st.data.TemplateVersions[v.Template]) + 1
+	st.data.TemplateVersions[v.Template] = append(st.data.TemplateVersions[v.Template], v.clone())
+	if activate {
+		if st.data.ActiveTemplates == nil {
+			st.data.ActiveTemplates = map[string]int{}
+		}
+		st.data.ActiveTemplates[v.Template] = v.Version
+	}
+	return st.saveLocked()
+}
+
+// TemplateVersions returns the stored versions of a template, oldest first,
+// and the version in use.
+func (st *Store) TemplateVersions(name string) ([]*TemplateVersion, int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	list := make([]*TemplateVersion, 0, len(st.data.TemplateVersions[name]))
+	for _, v := range st.data.TemplateVersions[name] {
+		list = append(list, v.clone())
+	}
+	return list, st.data.ActiveTemplates[name]
+}
+
+// ActiveTemplateVersions returns the stored version in use of each
+// template that has one.
+func (st *Store) ActiveTemplateVersions() []*TemplateVersion {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var list []*TemplateVersion
+	for name, n := range st.data.ActiveTemplates {
+		if versions := st.data.TemplateVersions[name]; n >= 1 && n <= len(versions) {
+			list = append(list, versions[n-1].clone())
+		}
+	}
+	return list
+}
+
+// ActivateTemplateVersion puts a stored version of a template in use, or
+// with version 0 its configured definition, and returns it (nil for 0).
+func (st *Store) ActivateTemplateVersion(name string, version int) (*TemplateVersion, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	versions := st.data.TemplateVersions[name]
+	if version < 0 || version > len(versions) {
+		return nil, errVersionNotFound
+	}
+	if version == 0 {
+		delete(st.data.ActiveTemplates, name)
+		return nil, st.saveLocked()
+	}
+	if st.data.ActiveTemplates == nil {
+		st.data.ActiveTemplates = map[string]int{}
+	}
+	st.data.ActiveTemplates[name] = version
+	return versions[version-1].clone(), st.saveLocked()
+}
+
+func (v *TemplateVersion) clone() *TemplateVersion {
+	c := *v
+	c.Definition.Examples = slices.Clone(v.Definition.Examples)
+	return &c
+}
+
+// ClientUsage returns what client has used in period.
+func (st *Store) ClientUsage(client, period string) PeriodUsage {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if u, ok := st.data.ClientUsage[client]; ok && u.Period == period {
+		return *u
+	}
+	return PeriodUsage{Period: period}
+}
+
+// ReserveClientRequest counts a request of client in period unless it
+// already made maxRequests requests or used maxTokens tokens in it (zero
+// for no limit). It returns what client has used, with the request if it
+// was counted.
+func (st *Store) ReserveClientRequest(client, period string, maxRequests, maxTokens int) (PeriodUsage, bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	u := PeriodUsage{Period: period}
+	if cur, ok := st.data.ClientUsage[client]; ok && cur.Period == period {
+		u = *cur
+	}
+	if maxRequests > 0 && u.Requests >= maxRequests || maxTokens > 0 && u.Tokens >= maxTokens {
+		return u, false, nil
+	}
+	u, err := st.addClientUsageLocked(client, period, 1, 0)
+	return u, true, err
+}
+
+// AddClientUsage adds requests and tokens to what client has used in
+// period, starting over when the period changed, and returns the total.
+func (st *Store) AddClientUsage(client, period string, requests, tokens int) (PeriodUsage, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.addClientUsageLocked(client, period, requests, tokens)
+}
+
+// addClientUsageLocked is AddClientUsage for a caller holding st.mu.
+func (st *Store) addClientUsageLocked(client, period string, requests, tokens int) (PeriodUsage, error) {
+	if st.data.ClientUsage == nil {
+		st.data.ClientUsage = map[string]*PeriodUsage{}
+	}
+	u, ok := st.data.ClientUsage[client]
+	if !ok || u.Period != period {
+		u = &PeriodUsage{Period: period}
+		st.data.ClientUsage[client] = u
+	}
+	u.Requests += requests
+	u.Tokens += tokens
+	return *u, st.saveLocked()
+}
+
+// MarkQuotaNotified records that the owner of client was told about
+// reaching threshold percent in period. It reports false when they already
+// were, so each threshold is notified once per period.
+func (st *Store) MarkQuotaNotified(client, period string, threshold int) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	u, ok := st.data.ClientUsage[client]
+	if !ok || u.Period != period || u.Notified >= threshold {
+		return false, nil
+	}
+	u.Notified = threshold
+	return true, st.saveLocked()
+}
+
+// AddUsageEvent records the usage of one upstream request, to be rolled
+// up by RollupUsage. The event is only kept in memory until the next save,
+// which RollupUsage makes when it rolls it up, so a busy server does not
+// rewrite the data file for every request.
+func (st *Store) AddUsageEvent(e UsageEvent) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.data.UsageEvents = append(st.data.UsageEvents, e)
+}
+
+// RollupUsage adds the usage events not rolled up yet to the hourly and
+// daily usage records, then deletes the rolled up events older than
+// cutoff. It returns how many events it rolled up and deleted.
+func (st *Store) RollupUsage(cutoff time.Time) (rolled, purged int, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.data.Usage == nil {
+		st.data.Usage = map[string]*UsageRecord{}
+	}
+	if st.data.HourlyUsage == nil {
+		st.data.HourlyUsage = map[string]*UsageRecord{}
+	}
+	for _, e := range st.data.UsageEvents[st.data.RolledUpEvents:] {
+		t := e.Time.UTC()
+		day := t.Format(time.DateOnly)
+		addUsageRecord(st.data.Usage, UsageRecord{Day: day, Client: e.Client, Provider: e.Provider, Model: e.Model}, e)
+		addUsageRecord(st.data.HourlyUsage, UsageRecord{Day: day, Hour: t.Truncate(time.Hour).Format(time.RFC3339), Client: e.Client, Provider: e.Provider, Model: e.Model}, e)
+		rolled++
+	}
+	st.data.RolledUpEvents = len(st.data.UsageEvents)
+
+	for purged < len(st.data.UsageEvents) && st.data.UsageEvents[purged].Time.Before(cutoff) {
+		purged++
+	}
+	st.data.UsageEvents = slices.Delete(st.data.UsageEvents, 0, purged)
+	st.data.RolledUpEvents -= purged
+	if rolled == 0 && purged == 0 {
+		return 0, 0, nil
+	}
+	return rolled, purged, st.saveLocked()
+}
+
+// addUsageRecord counts e in the record of m for the period, client,
+// provider and model of r, which it starts from r if there is none yet.
+func addUsageRecord(m map[string]*UsageRecord, r UsageRecord, e UsageEvent) {
+	key := r.key()
+	rec, ok := m[key]
+	if !ok {
+		rec = &r
+		m[key] = rec
+	}
+	rec.Requests++
+	rec.PromptTokens += e.PromptTokens
+	rec.CompletionTokens += e.CompletionTokens
+}
+
+// HourlyUsage returns the hourly usage records of client from the hour
+// starting at from on.
+func (st *Store) HourlyUsage(client string, from time.Time) []UsageRecord {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	hour := from.UTC().Truncate(time.Hour).Format(time.RFC3339)
+	var list []UsageRecord
+	for _, r := range st.data.HourlyUsage {
+		if r.Client == client && r.Hour >= hour {
+			list = append(list, *r)
+		}
+	}
+	return list
+}
+
+// MarkSpendAlerted records that the alert of the spend threshold key was
+// sent for period. It reports false when it already was, so each threshold
+// is alerted once per period.
+func (st *Store) MarkSpendAlerted(key, period string) (bool, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.data.SpendAlerts[key] == period {
+		return false, nil
+	}
+	if st.data.SpendAlerts == nil {
+		st.data.SpendAlerts = map[string]string{}
+	}
+	st.data.SpendAlerts[key] = period
+	return true, st.saveLocked()
+}
+
+// UsageQuery selects a page of usage records. Zero fields do not filter.
+type UsageQuery struct {
+	// From and To are inclusive UTC dates (YYYY-MM-DD).
+	From, To string
+	Client   string
+	// Model matches the model or provider/model.
+	Model string
+	// After continues a listing after the record with this key.
+	After string
+	Limit int
+}
+
+// key orders usage records by day (or hour), client, provider and model.
+func (r *UsageRecord) key() string {
+	return strings.Join([]string{cmp.Or(r.Hour, r.Day), r.Client, r.Provider, r.Model}, "\x00")
+}
+
+// QueryUsage returns the usage records matching q sorted by day, client,
+// provider and model, and whether more follow the returned page.
+func (st *Store) QueryUsage(q UsageQuery) (list []UsageRecord, more bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	list = []UsageRecord{}
+	for _, r := range st.data.Usage {
+		if q.From != "" && r.Day < q.From || q.To != "" && r.Day > q.To ||
+			q.Client != "" && r.Client != q.Client ||
+			q.Model != "" && !modelMatches(r.Provider+"/"+r.Model, q.Model) ||
+			q.After != "" && r.key() <= q.After {
+			continue
+		}
+		list = append(list, *r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].key() < list[j].key() })
+	if q.Limit > 0 && len(list) > q.Limit {
+		return list[:q.Limit], true
+	}
+	return list, false
+}
+
+// modelMatches reports whether the provider/model qualified is named by
+// filter, either in full or by its model part.
+func modelMatches(qualified, filter string) bool {
+	return qualified == filter || strings.HasSuffix(qualified, "/"+filter)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeleteOwnerDataKeepsRollupPosition(t *testing.T) {
+	st, err := openStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	for _, client := range []string{"alice", "bob", "alice"} {
+		st.AddUsageEvent(UsageEvent{Time: now, Client: client, Provider: "p", Model: "m", PromptTokens: 1})
+	}
+	if _, _, err := st.RollupUsage(now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	st.AddUsageEvent(UsageEvent{Time: now, Client: "bob", Provider: "p", Model: "m", PromptTokens: 1})
+
+	_, _, _, usage, err := st.DeleteOwnerData("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two events and a daily and an hourly record.
+	if usage != 4 {
+		t.Errorf("deleted %d usage records, want 4", usage)
+	}
+
+	rolled, _, err := st.RollupUsage(now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rolled != 1 {
+		t.Errorf("rolled up %d events after the deletion, want bob's new one", rolled)
+	}
+	records, _ := st.QueryUsage(UsageQuery{Client: "bob"})
+	if len(records) != 1 || records[0].Requests != 2 {
+		t.Errorf("bob's usage = %+v, want one record of 2 requests", records)
+	}
+}
+
+func TestUsageEventsAreSavedByRollup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	st, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	st.AddUsageEvent(UsageEvent{Time: now, Client: "alice", Provider: "p", Model: "m", PromptTokens: 1})
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("recording an event wrote the data file: %v", err)
+	}
+
+	if _, _, err := st.RollupUsage(now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, _ := reopened.QueryUsage(UsageQuery{Client: "alice"})
+	if len(records) != 1 || records[0].Requests != 1 {
+		t.Errorf("usage after reopening = %+v, want one record of 1 request", records)
+	}
+}
+
+func TestSessionScope(t *testing.T) {
+	st, err := openStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mine, err := st.CreateSession("", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.CreateSession("", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	shared, err := st.CreateSession("ws/1", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := SessionScope{Owner: "alice"}
+	if _, err := st.Session(alice, mine.ID); err != nil {
+		t.Errorf("own session: %v", err)
+	}
+	if list, _ := st.ListSessions(alice, SessionQuery{}); len(list) != 1 || list[0].ID != mine.ID {
+		t.Errorf("alice lists %+v, want only her session", list)
+	}
+	if _, err := st.Session(SessionScope{Owner: "mallory"}, mine.ID); err != errSessionNotFound {
+		t.Errorf("another client's session: err = %v, want not found", err)
+	}
+	if _, err := st.SetLabels(SessionScope{Owner: "mallory"}, mine.ID, []string{"x"}); err != errSessionNotFound {
+		t.Errorf("labeling another client's session: err = %v, want not found", err)
+	}
+	if _, err := st.Session(SessionScope{Namespace: "ws/1", Owner: "alice", Shared: true}, shared.ID); err != nil {
+		t.Errorf("workspace session of another member: %v", err)
+	}
+	if _, err := st.Session(SessionScope{Owner: "bob", Shared: true}, shared.ID); err != errSessionNotFound {
+		t.Errorf("workspace session from outside: err = %v, want not found", err)
+	}
+}
+
+func TestReserveAnonymousRequestIsAtomic(t *testing.T) {
+	st, err := openStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok, _ := st.ReserveAnonymousRequest("198.51.100.7", "2026-10-15", 10, 0); ok {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := allowed.Load(); n != 10 {
+		t.Errorf("%d of 50 concurrent requests passed a limit of 10", n)
+	}
+
+	if err := st.AddAnonymousUsage("203.0.113.9", "2026-10-15", 0, 500); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := st.ReserveAnonymousRequest("203.0.113.9", "2026-10-15", 0, 500); ok {
+		t.Error("a request passed after the token limit was used up")
+	}
+}
+
+func TestSearchSessionsIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	st, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := SessionScope{Owner: "alice"}
+	sess, err := st.CreateSession("", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.AppendMessages(sess.ID, "", Message{Role: "user", Content: "Why does the Kubernetes pod restart?"}, Message{Role: "assistant", Content: "Check its liveness probe."}); err != nil {
+		t.Fatal(err)
+	}
+	other, err := st.CreateSession("", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.AppendMessages(other.ID, "", Message{Role: "user", Content: "kubernetes pods"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []string{"kube pod", "LIVENESS", "restart why"} {
+		if got := st.SearchSessions(alice, searchTerms(q), 10); len(got) != 1 || got[0].ID != sess.ID {
+			t.Errorf("search %q = %+v, want alice's session", q, got)
+		}
+	}
+	// The terms are in different messages.
+	if got := st.SearchSessions(alice, searchTerms("pod liveness"), 10); len(got) != 0 {
+		t.Errorf("search across messages = %+v, want none", got)
+	}
+
+	reopened, err := openStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.SearchSessions(alice, searchTerms("kube"), 10); len(got) != 1 {
+		t.Errorf("search after reopening = %+v, want alice's session", got)
+	}
+	if _, _, _, _, err := reopened.DeleteOwnerData("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.SearchSessions(alice, searchTerms("kube"), 10); len(got) != 0 {
+		t.Errorf("search after deleting the session = %+v, want none", got)
+	}
+	if _, ok := reopened.words.sessions["liveness"]; ok {
+		t.Error("the deleted session's words are still indexed")
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+// streamAnswer relays the completion for payload to the client as
+// server-sent events: one "token" event per piece of text, then "done" with
+// the streamSummary of the answer.
+//
+// The upstream call runs in the background on a copy of the request
+// context and fills a stream buffer that the client follows. When the
+// client goes away the upstream connection is closed right away, so an
+// abandoned request stops consuming tokens, unless stream_resume_window
+// keeps the generation going that long for the client to reconnect with
+// Last-Event-ID.
+func (s *server) streamAnswer(c *gin.Context, tgt target, payload DeepSeekRequestPayload) {
+	window := s.cfg.StreamResumeWindow.Duration
+	if lastID := c.GetHeader("Last-Event-ID"); lastID != "" && window > 0 {
+		if b, offset, ok := resumableStreams.resume(ownerFor(c), lastID); ok {
+			auditNote(c, "resumed stream %s at token %d", b.id, offset)
+			s.followStream(c, b, offset, true)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.WithoutCancel(c.Request.Context()))
+	b := resumableStreams.start(ownerFor(c), cancel)
+	go s.generateStream(ctx, c.Copy(), b, tgt, payload)
+	s.followStream(c, b, 0, false)
+}
+
+// streamSummary is the accounting of a finished stream sent with its done
+// event, like the usage chunk OpenAI adds with stream_options.include_usage,
+// so streaming clients get it too. cost is left out for models missing from
+// the catalog, finish_reason when the upstream gave none.
+func streamSummary(tgt target, usage UsageInfo, finishReason string, ttft, elapsed time.Duration) gin.H {
+	summary := gin.H{
+		"usage":             usage,
+		"latency_ms":        elapsed.Milliseconds(),
+		"ttft_ms":           ttft.Milliseconds(),
+		"tokens_per_second": tokensPerSecond(usage.CompletionTokens, ttft, elapsed),
+	}
+	if finishReason != "" {
+		summary["finish_reason"] = finishReason
+	}
+	if cost, ok := tgt.cost(usage); ok {
+		summary["cost"] = cost
+	}
+	return summary
+}
+
+// generateStream streams the completion for payload into b. c is a copy
+// of the request's context, safe to use after the handler returned.
+func (s *server) generateStream(ctx context.Context, c *gin.Context, b *streamBuffer, tgt target, payload DeepSeekRequestPayload) {
+	defer b.cancel()
+	start := time.Now()
+	var firstToken time.Time
+	var answer strings.Builder
+
+	usage, finishReason, err := tgt.provider.completeStream(ctx, payload, func(delta string) error {
+		if firstToken.IsZero() {
+			firstToken = time.Now()
+		}
+		answer.WriteString(delta)
+		b.append(delta)
+		return ctx.Err()
+	})
+	elapsed := time.Since(start)
+
+	tgt.experiment.observe(elapsed, answer.String(), err)
+
+	var final gin.H
+	switch {
+	case ctx.Err() != nil || errors.Is(err, context.Canceled):
+		log.Printf("Client disconnected, upstream stream aborted after %d characters", answer.Len())
+	case err != nil:
+		log.Printf("Error streaming from DeepSeek API: %v", err)
+	case answer.Len() == 0:
+		err = errEmptyCompletion
+	default:
+		s.shadow.mirror(tgt, payload, answer.String(), time.Since(start))
+		log.Printf("DeepSeek LLM streamed response: %s", answer.String())
+		ttft := firstToken.Sub(start)
+		final = streamSummary(tgt, usage, finishReason, ttft, elapsed)
+		if cp := s.newCompletion(c, tgt, askedPrompt(c)); cp != nil {
+			cp.Stream, cp.TTFTMS, cp.Usage = true, ttft.Milliseconds(), usage
+			s.shareCompletion(c, cp)
+			s.saveCompletion(c, cp, answer.String(), start)
+			final["id"] = cp.ID
+			if cp.Public {
+				final["permalink"] = permalinkPath(cp.ID)
+			}
+		}
+	}
+	b.finish(final, err)
+}
+
+// followStream sends the tokens of b from offset on to the client as they
+// arrive, then its done or error event, until the client goes away. With
+// stream_resume_window, token events carry IDs to resume from. A stream
+// that fails before its first token is answered like any upstream error,
+// unless the client is resuming it.
+func (s *server) followStream(c *gin.Context, b *streamBuffer, offset int, resumed bool) {
+	window := s.cfg.StreamResumeWindow.Duration
+	defer b.detach(window)
+	ctx := c.Request.Context()
+	started := false
+	begin := func() {
+		if !started {
+			started = true
+			c.Header("Content-Type", "text/event-stream")
+			c.Header("Cache-Control", "no-cache")
+			c.Header("X-Accel-Buffering", "no")
+		}
+	}
+	if resumed {
+		begin()
+	}
+
+	for {
+		tokens, done, changed := b.next(offset)
+		for _, token := range tokens {
+			begin()
+			offset++
+			ev := sse.Event{Event: "token", Data: gin.H{"content": token}}
+			if window > 0 {
+				ev.Id = b.eventID(offset)
+			}
+			c.Render(-1, ev)
+		}
+		if done {
+			s.endStream(c, b, started)
+			return
+		}
+		c.Writer.Flush()
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+// endStream writes the outcome of the finished stream b.
+func (s *server) endStream(c *gin.Context, b *streamBuffer, started bool) {
+	switch {
+	case c.Request.Context().Err() != nil:
+	case b.err != nil && !started:
+		respondUpstreamError(c, b.err)
+	case b.err != nil:
+		code, _ := classifyError(b.err)
+		message := localize(c, "stream_interrupted")
+		if d := degradationFor(code); d != nil && d.cfg.Message != "" {
+			message = d.cfg.Message
+		}
+		c.SSEvent("error", gin.H{"error": message, "code": code})
+		c.Writer.Flush()
+	default:
+		c.SSEvent("done", b.final)
+		c.Writer.Flush()
+	}
+}
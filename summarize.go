@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// summarizeChunkTokens is the largest input sent in a single summarization
+	// call. It leaves room within the model's context window for the template
+	// and the generated summary.
+	summarizeChunkTokens = 6000
+
+	// maxSummarizeBody caps the raw text accepted by /summarize.
+	maxSummarizeBody = 4 << 20
+)
+
+// summaryLengths maps the length parameter to the instruction given to the model.
+var summaryLengths = map[string]map[string]string{
+	"short":  {"bullets": "3 bullet points", "paragraph": "2-3 sentences"},
+	"medium": {"bullets": "5-7 bullet points", "paragraph": "one paragraph of 5-7 sentences"},
+	"long":   {"bullets": "10-15 bullet points", "paragraph": "several paragraphs"},
+}
+
+func init() {
+	registerTemplate(newTemplate("summarize",
+		"You are a precise summarizer. Summarize only what the text says, without adding facts or commentary. Reply with the summary only.",
+		`Summarize the following text in {{.Length}}{{if eq .Style "bullets"}}, formatted as a markdown bullet list{{else}}, written as prose{{end}}.
+
+{{.Text}}`,
+		2048, 0.3))
+
+	registerTemplate(newTemplate("summarize-chunk",
+		"You are a precise summarizer. Summarize only what the text says, without adding facts or commentary. Reply with the summary only.",
+		`The following is part {{.Part}} of {{.Parts}} of a longer text. Summarize it in one dense paragraph, keeping names, numbers and conclusions.
+
+{{.Text}}`,
+		1024, 0.3))
+}
+
+// summaryRequest is the data rendered into the summarize templates.
+type summaryRequest struct {
+	Text   string
+	Length string
+	Style  string
+	Part   int
+	Parts  int
+}
+
+// handleSummarize summarizes the raw request body. Inputs larger than a
+// single chunk are summarized chunk by chunk first and the partial summaries
+// are then combined (map-reduce).
+func (s *server) handleSummarize(c *gin.Context) {
+	length := c.DefaultQuery("length", "medium")
+	style := c.DefaultQuery("style", "paragraph")
+
+	styles, ok := summaryLengths[length]
+	if !ok {
+		c.String(http.StatusBadRequest, "Invalid 'length' parameter. Use short, medium or long.")
+		return
+	}
+	instruction, ok := styles[style]
+	if !ok {
+		c.String(http.StatusBadRequest, "Invalid 'style' parameter. Use bullets or paragraph.")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSummarizeBody))
+	if err != nil {
+		log.Printf("Error reading summarize request body: %v", err)
+		c.String(http.StatusInternalServerError, "Internal server error.")
+		return
+	}
+	text := strings.TrimSpace(string(body))
+	if text == "" {
+		c.String(http.StatusBadRequest, "Please provide the text to summarize in the request body.")
+		return
+	}
+
+	log.Printf("Received summarize request: %d characters, length=%s, style=%s", len(text), length, style)
+
+	tgt, err := s.targetFor(c, routeRequest{
+		Model:    c.Query("model"),
+		Messages: []Message{{Role: "user", Content: text}},
+		Template: "summarize",
+	})
+	if err != nil {
+		respondUpstreamError(c, err)
+		return
+	}
+	start := time.Now()
+	summary, err := s.summarize(c.Request.Context(), tgt, text, instruction, style)
+	tgt.experiment.observe(time.Since(start), summary, err)
+	tgt.canary.observe(time.Since(start), summary, err)
+	if err != nil {
+		respondUpstreamError(c, err)
+		return
+	}
+	summary = tgt.rewriteText(rewriteCompletion, summary)
+	cp := s.newCompletion(c, tgt, text)
+	s.announceCompletion(c, cp)
+	s.saveCompletion(c, cp, summary, start)
+	c.String(http.StatusOK, summary)
+}
+
+// summarize reduces text until it fits in one chunk and then produces the
+// final summary with the requested length and style.
+func (s *server) summarize(ctx context.Context, tgt target, text, length, style string) (string, error) {
+	for estimateTokens(text) > summarizeChunkTokens {
+		chunks := splitChunks(text, summarizeChunkTokens)
+		log.Printf("Summarizing %d chunks", len(chunks))
+
+		partials := make([]string, len(chunks))
+		for i, chunk := range chunks {
+			partial, err := s.runTemplate(ctx, tgt, "summarize-chunk", summaryRequest{Text: chunk, Part: i + 1, Parts: len(chunks)})
+			if err != nil {
+				return "", err
+			}
+			partials[i] = partial
+		}
+		text = strings.Join(partials, "\n\n")
+	}
+
+	return s.runTemplate(ctx, tgt, "summarize", summaryRequest{Text: text, Length: length, Style: style})
+}
+
+// runTemplate renders the named template with data, sends it to tgt and
+// returns the answer without any reasoning block.
+func (s *server) runTemplate(ctx context.Context, tgt target, name string, data any) (string, error) {
+	name = tgt.templateName(name)
+	tmpl := tgt.template(name)
+	if tmpl == nil {
+		return "", fmt.Errorf("template %q is not defined", name)
+	}
+	payload, err := tmpl.Payload(data, tgt.contextWindow)
+	if err != nil {
+		return "", err
+	}
+	tgt.prepare(&payload)
+	answer, err := tgt.provider.complete(ctx, payload)
+	if err != nil {
+		return "", err
+	}
+	return stripReasoning(answer), nil
+}
+
+// splitChunks splits text into pieces of at most maxTokens estimated tokens,
+// preferring paragraph boundaries, then line and sentence boundaries.
+func splitChunks(text string, maxTokens int) []string {
+	maxRunes := maxTokens * 4
+
+	var chunks []string
+	var current strings.Builder
+	flush := func() {
+		if current.Len() > 0 {
+			chunks = append(chunks, strings.TrimSpace(current.String()))
+			current.Reset()
+		}
+	}
+
+	for _, piece := range splitPieces(text, maxRunes) {
+		if current.Len() > 0 && len([]rune(current.String()))+len([]rune(piece)) > maxRunes {
+			flush()
+		}
+		current.WriteString(piece)
+	}
+	flush()
+	return chunks
+}
+
+// chunkSeparators are tried in order when a piece is too long.
+var chunkSeparators = []string{"\n\n", "\n", ". "}
+
+// splitPieces breaks text into pieces no longer than maxRunes, keeping the
+// separators so that joining the pieces restores the text.
+func splitPieces(text string, maxRunes int) []string {
+	return splitPiecesWith(text, maxRunes, chunkSeparators)
+}
+
+func splitPiecesWith(text string, maxRunes int, seps []string) []string {
+	if len([]rune(text)) <= maxRunes {
+		return []string{text}
+	}
+	for i, sep := range seps {
+		parts := strings.SplitAfter(text, sep)
+		if len(parts) < 2 {
+			continue
+		}
+		var pieces []string
+		for _, part := range parts {
+			pieces = append(pieces, splitPiecesWith(part, maxRunes, seps[i+1:])...)
+		}
+		return pieces
+	}
+
+	// No separator left: cut on rune boundaries.
+	runes := []rune(text)
+	var pieces []string
+	for len(runes) > maxRunes {
+		pieces = append(pieces, string(runes[:maxRunes]))
+		runes = runes[maxRunes:]
+	}
+	return append(pieces, string(runes))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Template is a managed prompt: a fixed system prompt and a user message
+// rendered from request data, plus the generation settings it was tuned for.
+type Template struct {
+	Name string
+	// Version is the stored version the template comes from, or 0 when it
+	// is configured or built in.
+	Version     int
+	System      string
+	User        *template.Template
+	MaxTokens   int
+	Temperature float64
+
+	// Wrapper is put around the rendered user message.
+	Wrapper PromptWrapper
+
+	// Examples are few-shot exchanges sent between the system prompt and
+	// the user message, as many as fit ContextBudget and the model's
+	// context window.
+	Examples      []FewShotExample
+	ContextBudget int
+}
+
+// newTemplate parses the user message text and panics on error; it is meant
+// for templates defined at package initialisation.
+func newTemplate(name, system, user string, maxTokens int, temperature float64) *Template {
+	return &Template{
+		Name:        name,
+		System:      system,
+		User:        template.Must(template.New(name).Parse(user)),
+		MaxTokens:   maxTokens,
+		Temperature: temperature,
+	}
+}
+
+// loadTemplates registers the templates defined in the configuration.
+func loadTemplates(defs []*TemplateConfig) error {
+	for i, def := range defs {
+		if def.Name == "" {
+			return fmt.Errorf("templates[%d]: name is empty", i)
+		}
+		t, err := parseTemplate(def)
+		if err != nil {
+			return err
+		}
+		registerTemplate(t)
+	}
+	return nil
+}
+
+// parseTemplate builds the template defined by def.
+func parseTemplate(def *TemplateConfig) (*Template, error) {
+	user, err := template.New(def.Name).Parse(def.User)
+	if err != nil {
+		return nil, fmt.Errorf("template %q: %w", def.Name, err)
+	}
+	return &Template{
+		Name:        def.Name,
+		System:      def.System,
+		User:        user,
+		MaxTokens:   def.MaxTokens,
+		Temperature: def.Temperature,
+		Wrapper:     def.PromptWrapper,
+
+		Examples:      def.Examples,
+		ContextBudget: def.ContextBudget,
+	}, nil
+}
+
+// templates holds the managed templates available to handlers, keyed by
+// name. Templates promoted through the admin API replace entries while
+// requests run, so access goes through templatesMu.
+var (
+	templatesMu sync.RWMutex
+	templates   = map[string]*Template{}
+)
+
+func registerTemplate(t *Template) {
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+	templates[t.Name] = t
+}
+
+// lookupTemplate returns the named template, or nil.
+func lookupTemplate(name string) *Template {
+	templatesMu.RLock()
+	defer templatesMu.RUnlock()
+	return templates[name]
+}
+
+// wrap puts the prefix and suffix around prompt.
+func (w PromptWrapper) wrap(prompt string) string {
+	if w.Prefix != "" {
+		prompt = w.Prefix + "\n\n" + prompt
+	}
+	if w.Suffix != "" {
+		prompt += "\n\n" + w.Suffix
+	}
+	return prompt
+}
+
+// Payload renders the template with data into a request payload for a
+// model with the given context window in tokens (zero when unknown).
+// Few-shot examples are included in order while the prompt fits the
+// context budget and leaves room for the completion; the rest are dropped.
+func (t *Template) Payload(data any, contextWindow int) (DeepSeekRequestPayload, error) {
+	var user strings.Builder
+	if err := t.User.Execute(&user, data); err != nil {
+		return DeepSeekRequestPayload{}, fmt.Errorf("rendering template %q: %w", t.Name, err)
+	}
+	prompt := Message{Role: "user", Content: t.Wrapper.wrap(user.String())}
+
+	payload := newPayload(nil)
+	if t.MaxTokens > 0 {
+		payload.MaxTokens = t.MaxTokens
+	}
+	payload.Temperature = t.Temperature
+
+	budget := t.ContextBudget
+	if contextWindow > 0 && (budget <= 0 || contextWindow-payload.MaxTokens < budget) {
+		budget = contextWindow - payload.MaxTokens
+	}
+	tokens := estimateTokens(t.System) + estimateTokens(prompt.Content)
+
+	if t.System != "" {
+		payload.Messages = append(payload.Messages, Message{Role: "system", Content: t.System})
+	}
+	for i, ex := range t.Examples {
+		tokens += estimateTokens(ex.User) + estimateTokens(ex.Assistant)
+		if budget > 0 && tokens > budget {
+			log.Printf("Template %s: dropped %d of %d few-shot examples to fit %d tokens", t.Name, len(t.Examples)-i, len(t.Examples), budget)
+			break
+		}
+		payload.Messages = append(payload.Messages, Message{Role: "user", Content: ex.User}, Message{Role: "assistant", Content: ex.Assistant})
+	}
+	payload.Messages = append(payload.Messages, prompt)
+	return payload, nil
+}
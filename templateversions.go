@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// configuredTemplates are the templates as built in or configured, version
+// 0, kept for rollbacks to them.
+var configuredTemplates map[string]*Template
+
+// applyTemplateVersions keeps the configured templates and replaces them by
+// the stored versions in use.
+func applyTemplateVersions(store *Store) error {
+	templatesMu.Lock()
+	configuredTemplates = maps.Clone(templates)
+	templatesMu.Unlock()
+
+	for _, v := range store.ActiveTemplateVersions() {
+		t, err := v.template()
+		if err != nil {
+			return err
+		}
+		registerTemplate(t)
+	}
+	return nil
+}
+
+// template builds the template of a stored version.
+func (v *TemplateVersion) template() (*Template, error) {
+	def := v.Definition
+	def.Name = v.Template
+	t, err := parseTemplate(&def)
+	if err != nil {
+		return nil, fmt.Errorf("version %d: %w", v.Version, err)
+	}
+	t.Version = v.Version
+	return t, nil
+}
+
+// template returns the template a request runs for name: the workspace's
+// version, else the canary arm's, else the server's. It is nil when name
+// is not defined.
+func (t target) template(name string) *Template {
+	if def := t.templates[name]; def != nil {
+		tmpl, err := parseTemplate(def)
+		if err == nil {
+			return tmpl
+		}
+		log.Printf("Error loading workspace template %s: %v", name, err)
+	}
+	if tmpl := t.canary.template(name); tmpl != nil {
+		return tmpl
+	}
+	return lookupTemplate(name)
+}
+
+// templateVersion names the version of the template a request runs as
+// "<name>@<version>", "<name>@workspace" for the workspace's version or
+// "<name>@canary" in the canary arm.
+func (t target) templateVersion(name string) string {
+	name = t.templateName(name)
+	if t.templates[name] != nil {
+		return name + "@workspace"
+	}
+	if t.canary.template(name) != nil {
+		return name + "@canary"
+	}
+	if tmpl := lookupTemplate(name); tmpl != nil {
+		return fmt.Sprintf("%s@%d", name, tmpl.Version)
+	}
+	return name
+}
+
+// adminCaller names the caller of an admin route: the client or account,
+// or "admin" for the admin token.
+func adminCaller(c *gin.Context) string {
+	if cl := clientFrom(c); cl != nil {
+		return cl.ID
+	}
+	return "admin"
+}
+
+// handleListTemplates lists the templates with the version in use and the
+// number of stored versions.
+func (s *server) handleListTemplates(c *gin.Context) {
+	templatesMu.RLock()
+	names := slices.Sorted(maps.Keys(templates))
+	templatesMu.RUnlock()
+
+	list := make([]gin.H, 0, len(names))
+	for _, name := range names {
+		versions, _ := s.store.TemplateVersions(name)
+		list = append(list, gin.H{"name": name, "version": lookupTemplate(name).Version, "versions": len(versions)})
+	}
+	c.JSON(http.StatusOK, gin.H{"templates": list})
+}
+
+// handleListTemplateVersions returns the stored versions of a template.
+func (s *server) handleListTemplateVersions(c *gin.Context) {
+	name := c.Param("name")
+	if lookupTemplate(name) == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found."})
+		return
+	}
+	versions, active := s.store.TemplateVersions(name)
+	c.JSON(http.StatusOK, gin.H{"template": name, "active": active, "versions": versions})
+}
+
+// publishTemplateRequest is a new version of a template. It is put in use
+// unless Activate is false.
+type publishTemplateRequest struct {
+	Template TemplateConfig `json:"template"`
+	Note     string         `json:"note"`
+	Activate *bool          `json:"activate"`
+}
+
+// handlePublishTemplate stores a new version of a template.
+func (s *server) handlePublishTemplate(c *gin.Context) {
+	name := c.Param("name")
+	if lookupTemplate(name) == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found."})
+		return
+	}
+	var req publishTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Please provide a JSON body with the new 'template'."})
+		return
+	}
+	req.Template.Name = name
+	if _, err := parseTemplate(&req.Template); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	activate := req.Activate == nil || *req.Activate
+	v, err := s.publishTemplate(c, req.Template, req.Note, activate)
+	if err != nil {
+		log.Printf("Error saving template %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	c.JSON(http.StatusCreated, v)
+}
+
+// publishTemplate stores def as the next version of its template, by the
+// caller, and puts it in use with activate.
+func (s *server) publishTemplate(c *gin.Context, def TemplateConfig, note string, activate bool) (*TemplateVersion, error) {
+	v := &TemplateVersion{Template: def.Name, Definition: def, Author: adminCaller(c), Note: note, CreatedAt: time.Now().UTC()}
+	if err := s.store.AddTemplateVersion(v, activate); err != nil {
+		return nil, err
+	}
+	auditNote(c, "published version %d of template %s", v.Version, v.Template)
+	if activate {
+		t, err := v.template()
+		if err != nil {
+			return nil, err
+		}
+		registerTemplate(t)
+	}
+	return v, nil
+}
+
+// handleRollbackTemplate puts an earlier version of a template in use: the
+// one in the body, or the one before the version in use. Version 0 is the
+// configured template.
+func (s *server) handleRollbackTemplate(c *gin.Context) {
+	name := c.Param("name")
+	current := lookupTemplate(name)
+	if current == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found."})
+		return
+	}
+	var req struct {
+		Version *int `json:"version"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Please provide a JSON body with the 'version' to roll back to."})
+			return
+		}
+	}
+	version := max(current.Version-1, 0)
+	if req.Version != nil {
+		version = *req.Version
+	}
+
+	v, err := s.store.ActivateTemplateVersion(name, version)
+	if errors.Is(err, errVersionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found."})
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving template %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	t := configuredTemplates[name]
+	if v != nil {
+		if t, err = v.template(); err != nil {
+			log.Printf("Error loading template %s: %v", name, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+			return
+		}
+	}
+	registerTemplate(t)
+	auditNote(c, "rolled template %s back from version %d to %d", name, current.Version, version)
+	c.JSON(http.StatusOK, gin.H{"template": name, "active": version})
+}
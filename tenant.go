@@ -0,0 +1,138 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tenantContextKey is the gin context key holding the request's *tenant.
+const tenantContextKey = "askllm.tenant"
+
+// tenant is a team sharing the instance with its own provider credentials,
+// default model, limits and session namespace.
+type tenant struct {
+	cfg       *TenantConfig
+	providers map[string]*provider
+	limiter   *windowLimiter
+}
+
+// identifyTenant resolves the request's tenant from the authenticated
+// client or, when tenant_header is configured, from that header, and
+// enforces the tenant's request rate.
+func (s *server) identifyTenant(c *gin.Context) {
+	id := ""
+	if cl := clientFrom(c); cl != nil && cl.Tenant != "" {
+		id = cl.Tenant
+	} else if s.cfg.TenantHeader != "" {
+		id = c.GetHeader(s.cfg.TenantHeader)
+	}
+	if id == "" {
+		c.Next()
+		return
+	}
+
+	t, ok := s.tenants[id]
+	if !ok {
+		auditNote(c, "rejected: unknown tenant %q", id)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Unknown tenant."})
+		return
+	}
+	if t.limiter != nil {
+		ok, remaining, reset := t.limiter.allow(id)
+		noteRateLimit(c, rateLimit{limit: t.limiter.limit, remaining: remaining, reset: reset, window: t.limiter.window})
+		if !ok {
+			auditNote(c, "rate limited: tenant %s", id)
+			secs := int(math.Ceil(time.Until(reset).Seconds()))
+			c.Header("Retry-After", strconv.Itoa(secs))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": localize(c, "tenant_limit")})
+			return
+		}
+	}
+	c.Set(tenantContextKey, t)
+	c.Next()
+}
+
+// tenantFrom returns the request's tenant, or nil.
+func tenantFrom(c *gin.Context) *tenant {
+	if v, ok := c.Get(tenantContextKey); ok {
+		return v.(*tenant)
+	}
+	return nil
+}
+
+// namespaceFor returns the session namespace of the selected workspace or
+// the request's tenant, or the user's own for signed-up users.
+func namespaceFor(c *gin.Context) string {
+	if m := workspaceFrom(c); m != nil {
+		return m.namespace()
+	}
+	if t := tenantFrom(c); t != nil {
+		return t.cfg.Namespace
+	}
+	if cl := clientFrom(c); cl != nil && cl.account {
+		return "account/" + cl.ID
+	}
+	return ""
+}
+
+// sessionScope returns the sessions the caller may use: those of its
+// namespace it created or, in a workspace, all of them.
+func sessionScope(c *gin.Context) SessionScope {
+	return SessionScope{Namespace: namespaceFor(c), Owner: ownerFor(c), Shared: workspaceFrom(c) != nil}
+}
+
+// allProviders returns the shared providers followed by every tenant's own.
+func (s *server) allProviders() []*provider {
+	var all []*provider
+	for _, p := range s.providers {
+		all = append(all, p)
+	}
+	for _, t := range s.tenants {
+		for _, p := range t.providers {
+			all = append(all, p)
+		}
+	}
+	return all
+}
+
+// mergeProvider returns base with the fields set in override replacing it,
+// so a tenant can change only the credentials of a shared provider.
+func mergeProvider(base, override *ProviderConfig) *ProviderConfig {
+	if base == nil {
+		return override
+	}
+	merged := *base
+	if len(override.BaseURLs) > 0 {
+		merged.BaseURLs = override.BaseURLs
+	}
+	if override.Balance != "" {
+		merged.Balance = override.Balance
+	}
+	if override.APIKeyEnv != "" || override.APIKeyVault != "" || override.APIKeyAWS != "" {
+		merged.APIKeyEnv = override.APIKeyEnv
+		merged.APIKeyVault = override.APIKeyVault
+		merged.APIKeyAWS = override.APIKeyAWS
+	}
+	if override.HealthCheckInterval.Duration > 0 {
+		merged.HealthCheckInterval = override.HealthCheckInterval
+	}
+	if override.Fallback != "" {
+		merged.Fallback = override.Fallback
+	}
+	if override.Proxy != "" {
+		merged.Proxy = override.Proxy
+	}
+	if override.TLS != nil {
+		merged.TLS = override.TLS
+	}
+	if override.MaxConcurrency > 0 {
+		merged.MaxConcurrency = override.MaxConcurrency
+		merged.MaxQueue = override.MaxQueue
+		merged.QueueTimeout = override.QueueTimeout
+	}
+	return &merged
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// traceContextKey is the gin context key holding the request's trace ID.
+const traceContextKey = "askllm.trace"
+
+// traceHeaders are the W3C Trace Context and Baggage headers, always
+// forwarded to upstreams.
+var traceHeaders = []string{"traceparent", "tracestate", "baggage"}
+
+// traceparentPattern matches a version 00 traceparent, capturing the trace
+// ID.
+var traceparentPattern = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+type forwardKey struct{}
+
+// propagateTrace picks up the trace headers and the configured
+// forward_headers of the request, so that its upstream calls carry them and
+// its log lines name its trace. An invalid traceparent is dropped together
+// with its tracestate.
+func (s *server) propagateTrace(c *gin.Context) {
+	forward := http.Header{}
+	for _, name := range append(traceHeaders, s.cfg.ForwardHeaders...) {
+		if v := c.Request.Header.Values(name); len(v) > 0 {
+			forward[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	if tp := forward.Get("Traceparent"); tp != "" {
+		m := traceparentPattern.FindStringSubmatch(strings.TrimSpace(tp))
+		if m == nil || m[1] == strings.Repeat("0", 32) {
+			forward.Del("Traceparent")
+			forward.Del("Tracestate")
+		} else {
+			c.Set(traceContextKey, m[1])
+		}
+	}
+	if len(forward) > 0 {
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), forwardKey{}, forward))
+	}
+	c.Next()
+}
+
+// forwardedHeaders returns the headers ctx's upstream calls carry, or nil.
+func forwardedHeaders(ctx context.Context) http.Header {
+	h, _ := ctx.Value(forwardKey{}).(http.Header)
+	return h
+}
+
+// traceIDFrom returns the request's trace ID, or "".
+func traceIDFrom(c *gin.Context) string {
+	return c.GetString(traceContextKey)
+}
+
+// accessLogFormat is gin's default access log line with the trace ID
+// appended when the request has one.
+func accessLogFormat(param gin.LogFormatterParams) string {
+	var statusColor, methodColor, resetColor string
+	if param.IsOutputColor() {
+		statusColor = param.StatusCodeColor()
+		methodColor = param.MethodColor()
+		resetColor = param.ResetColor()
+	}
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	trace := ""
+	if id, ok := param.Keys[traceContextKey].(string); ok {
+		trace = " | trace " + id
+	}
+	return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v%s\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		statusColor, param.StatusCode, resetColor,
+		param.Latency,
+		param.ClientIP,
+		methodColor, param.Method, resetColor,
+		param.Path,
+		trace,
+		param.ErrorMessage,
+	)
+}
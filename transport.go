@@ -0,0 +1,135 @@
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Connection pool defaults for the http_client settings left zero. The
+// standard library keeps only two idle connections per host, which makes a
+// busy server reconnect and renegotiate TLS on almost every request.
+const (
+	defaultMaxIdleConns        = 256
+	defaultMaxIdleConnsPerHost = 64
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultDialTimeout         = 10 * time.Second
+	defaultKeepAlive           = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultRequestTimeout      = 60 * time.Second
+)
+
+var (
+	sharedMu         sync.Mutex
+	sharedTransports = map[string]*http.Transport{}
+)
+
+// providerTransport returns the transport for a provider's upstream calls.
+// Providers without TLS settings of their own share one transport per
+// proxy, and with it one connection pool.
+func providerTransport(proxy string, tc *TLSConfig, hc *HTTPClientConfig) (*http.Transport, error) {
+	if tc != nil {
+		return newTransport(proxy, tc, hc)
+	}
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	if t, ok := sharedTransports[proxy]; ok {
+		return t, nil
+	}
+	t, err := newTransport(proxy, nil, hc)
+	if err != nil {
+		return nil, err
+	}
+	sharedTransports[proxy] = t
+	return t, nil
+}
+
+// newTransport builds an HTTP transport for upstream calls, with its
+// connection pool tuned by hc (nil for the defaults). Without an explicit
+// proxy URL the standard HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+// variables apply. An explicit proxy may be an http, https or socks5 URL;
+// hosts listed in NO_PROXY still bypass it.
+func newTransport(proxy string, tc *TLSConfig, hc *HTTPClientConfig) (*http.Transport, error) {
+	if hc == nil {
+		hc = &HTTPClientConfig{}
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   cmp.Or(hc.DialTimeout.Duration, defaultDialTimeout),
+		KeepAlive: cmp.Or(hc.KeepAlive.Duration, defaultKeepAlive),
+	}
+	t.DialContext = dialer.DialContext
+	t.MaxIdleConns = cmp.Or(hc.MaxIdleConns, defaultMaxIdleConns)
+	t.MaxIdleConnsPerHost = cmp.Or(hc.MaxIdleConnsPerHost, defaultMaxIdleConnsPerHost)
+	t.MaxConnsPerHost = hc.MaxConnsPerHost
+	t.IdleConnTimeout = cmp.Or(hc.IdleConnTimeout.Duration, defaultIdleConnTimeout)
+	t.TLSHandshakeTimeout = cmp.Or(hc.TLSHandshakeTimeout.Duration, defaultTLSHandshakeTimeout)
+	if tc != nil {
+		tlsConfig, err := tc.clientConfig()
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = tlsConfig
+	}
+
+	if proxy == "" {
+		t.Proxy = http.ProxyFromEnvironment
+		return t, nil
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	proxyFunc := (&httpproxy.Config{HTTPProxy: proxy, HTTPSProxy: proxy, NoProxy: noProxy}).ProxyFunc()
+	t.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}
+	return t, nil
+}
+
+// clientConfig builds the TLS settings for connections to an upstream.
+func (tc *TLSConfig) clientConfig() (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName:         tc.ServerName,
+		InsecureSkipVerify: tc.InsecureSkipVerify,
+	}
+	if tc.CAFile != "" {
+		pem, err := os.ReadFile(tc.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", tc.CAFile)
+		}
+		c.RootCAs = pool
+	}
+	if tc.CertFile != "" || tc.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
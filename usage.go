@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type usageMeterKey struct{}
+
+// usageMeter adds up the tokens spent on behalf of one request, across
+// every upstream call made with its context.
+type usageMeter struct {
+	mu    sync.Mutex
+	usage UsageInfo
+}
+
+// withUsageMeter returns a context whose upstream calls are metered, and
+// the meter. A context that is already metered is returned unchanged.
+func withUsageMeter(ctx context.Context) (context.Context, *usageMeter) {
+	if m := meterFrom(ctx); m != nil {
+		return ctx, m
+	}
+	m := &usageMeter{}
+	return context.WithValue(ctx, usageMeterKey{}, m), m
+}
+
+// meterFrom returns the context's usage meter, or nil.
+func meterFrom(ctx context.Context) *usageMeter {
+	m, _ := ctx.Value(usageMeterKey{}).(*usageMeter)
+	return m
+}
+
+// add records usage. It is safe on a nil meter.
+func (m *usageMeter) add(u UsageInfo) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.usage.PromptTokens += u.PromptTokens
+	m.usage.CompletionTokens += u.CompletionTokens
+	m.usage.TotalTokens += u.TotalTokens
+}
+
+// total returns the usage recorded so far.
+func (m *usageMeter) total() UsageInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usage
+}
+
+// recordUsage counts the usage of p completing payload, estimating it from
+// the text when the upstream reported none, and returns what it counted.
+func recordUsage(ctx context.Context, p *provider, payload DeepSeekRequestPayload, usage *UsageInfo, answer string) UsageInfo {
+	counted := estimateUsage(payload.Messages, answer)
+	if usage != nil && usage.TotalTokens > 0 {
+		counted = *usage
+	}
+	countUsage(ctx, p.name, payload.Model, counted)
+	return counted
+}
+
+// usageStore keeps the usage events rolled up into the records exported
+// at /admin/usage/export, once main has opened it.
+var usageStore *Store
+
+// countUsage adds u to ctx's meter, to the token metrics and to the usage
+// events.
+func countUsage(ctx context.Context, provider, model string, u UsageInfo) {
+	meterFrom(ctx).add(u)
+
+	client := clientIDFrom(ctx)
+	if client == "" {
+		client = "anonymous"
+	}
+	if usageStore != nil {
+		e := UsageEvent{Time: time.Now().UTC(), Client: client, Provider: provider, Model: model, PromptTokens: u.PromptTokens, CompletionTokens: u.CompletionTokens}
+		usageStore.AddUsageEvent(e)
+	}
+	tokensTotal.WithLabelValues(provider, model, client, "prompt").Add(float64(u.PromptTokens))
+	tokensTotal.WithLabelValues(provider, model, client, "completion").Add(float64(u.CompletionTokens))
+	requestTokens.WithLabelValues(provider, model, "prompt").Observe(float64(u.PromptTokens))
+	requestTokens.WithLabelValues(provider, model, "completion").Observe(float64(u.CompletionTokens))
+}
+
+type clientIDKey struct{}
+
+// withClientID returns ctx carrying the authenticated client's ID, so that
+// code below the handlers can attribute usage.
+func withClientID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, clientIDKey{}, id)
+}
+
+// clientIDFrom returns the client ID carried by ctx, or "".
+func clientIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(clientIDKey{}).(string)
+	return id
+}
+
+// estimateUsage approximates the usage of answering messages with answer.
+func estimateUsage(messages []Message, answer string) UsageInfo {
+	var u UsageInfo
+	for _, msg := range messages {
+		u.PromptTokens += estimateTokens(msg.Content)
+	}
+	u.CompletionTokens = estimateTokens(answer)
+	u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	return u
+}
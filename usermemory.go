@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Defaults for long-term user memory.
+const (
+	defaultMemoryTopK     = 5
+	defaultMemoryMinScore = 0.5
+	defaultMemoryMaxFacts = 200
+
+	// memoryDuplicateScore is the similarity above which a new fact is
+	// taken to repeat one already remembered.
+	memoryDuplicateScore = 0.92
+
+	// maxFactsPerExchange bounds what one exchange can add.
+	maxFactsPerExchange = 5
+)
+
+func init() {
+	registerTemplate(newTemplate("memory-extract",
+		"You pick out lasting facts about the user from a conversation: preferences, background, goals and circumstances worth knowing in future conversations. Ignore anything only relevant to the current question.",
+		`User: {{.Question}}
+
+Assistant: {{.Answer}}
+
+List the facts about the user, one per line starting with "- ". Reply NONE if there are none.`,
+		256, 0.1))
+}
+
+// recallMemories returns a system note with what is remembered about the
+// client owner that relates to prompt, or ok false when memory is not in
+// use for them or nothing relevant is remembered.
+func (s *server) recallMemories(ctx context.Context, owner, prompt string) (note Message, ok bool) {
+	mc := s.cfg.UserMemory
+	if mc == nil || owner == "" {
+		return Message{}, false
+	}
+	mem := s.store.Memory(owner)
+	if !mem.Enabled || len(mem.Facts) == 0 {
+		return Message{}, false
+	}
+	vectors, err := s.providers[mc.Provider].embed(ctx, mc.EmbeddingModel, []string{prompt})
+	if err != nil {
+		log.Printf("Error embedding prompt to recall memories of %s: %v", owner, err)
+		return Message{}, false
+	}
+
+	type scored struct {
+		fact  MemoryFact
+		score float64
+	}
+	var matches []scored
+	for _, f := range mem.Facts {
+		if score := cosine(vectors[0], f.Embedding); score >= mc.MinScore {
+			matches = append(matches, scored{f, score})
+		}
+	}
+	if len(matches) == 0 {
+		return Message{}, false
+	}
+	slices.SortFunc(matches, func(a, b scored) int {
+		switch {
+		case a.score > b.score:
+			return -1
+		case a.score < b.score:
+			return 1
+		}
+		return 0
+	})
+	var b strings.Builder
+	b.WriteString("What you remember about the user from earlier conversations:")
+	for _, m := range matches[:min(len(matches), mc.TopK)] {
+		b.WriteString("\n- " + m.fact.Text)
+	}
+	return Message{Role: "system", Content: b.String()}, true
+}
+
+// rememberFacts extracts lasting facts about the client owner from an
+// exchange of session and stores those not already remembered. It runs in
+// the background at low priority.
+func (s *server) rememberFacts(tgt target, owner, session, question, answer string) {
+	mc := s.cfg.UserMemory
+	mem := s.store.Memory(owner)
+	if !mem.Enabled {
+		return
+	}
+	ctx := withPriority(withClientID(context.Background(), owner), priorityLow)
+
+	payload, err := lookupTemplate("memory-extract").Payload(struct{ Question, Answer string }{
+		Question: truncateRunes(question, 4000),
+		Answer:   truncateRunes(stripReasoning(answer), 4000),
+	}, 0)
+	if err != nil {
+		log.Printf("Error extracting memories of %s: %v", owner, err)
+		return
+	}
+	tgt.wrapper = nil
+	tgt.prepare(&payload)
+	if mc.ExtractModel != "" {
+		payload.Model = mc.ExtractModel
+	}
+	reply, err := tgt.provider.complete(ctx, payload)
+	if err != nil {
+		log.Printf("Error extracting memories of %s: %v", owner, err)
+		return
+	}
+	var texts []string
+	for _, line := range strings.Split(stripReasoning(reply), "\n") {
+		if text, ok := strings.CutPrefix(strings.TrimSpace(line), "- "); ok && strings.TrimSpace(text) != "" {
+			texts = append(texts, strings.TrimSpace(text))
+		}
+	}
+	if len(texts) == 0 {
+		return
+	}
+	texts = texts[:min(len(texts), maxFactsPerExchange)]
+
+	vectors, err := s.providers[mc.Provider].embed(ctx, mc.EmbeddingModel, texts)
+	if err != nil {
+		log.Printf("Error embedding memories of %s: %v", owner, err)
+		return
+	}
+	var facts []MemoryFact
+	known := mem.Facts
+	for i, text := range texts {
+		duplicate := slices.ContainsFunc(known, func(f MemoryFact) bool {
+			return cosine(vectors[i], f.Embedding) >= memoryDuplicateScore
+		})
+		if duplicate {
+			continue
+		}
+		fact := MemoryFact{ID: newID(), Text: text, Embedding: vectors[i], Session: session, CreatedAt: time.Now().UTC()}
+		facts = append(facts, fact)
+		known = append(known, fact)
+	}
+	if len(facts) == 0 {
+		return
+	}
+	if err := s.store.AddMemories(owner, mc.MaxFacts, facts...); err != nil {
+		log.Printf("Error saving memories of %s: %v", owner, err)
+	}
+}
+
+// memoryView is a remembered fact as shown to its user.
+type memoryView struct {
+	ID        string    `json:"id"`
+	Text      string    `json:"text"`
+	Session   string    `json:"session,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// requireOwner returns the calling client's ID, or rejects anonymous
+// callers, whose memory could not be told apart.
+func requireOwner(c *gin.Context) (string, bool) {
+	owner := ownerFor(c)
+	if owner == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required: memory is kept per client."})
+		return "", false
+	}
+	return owner, true
+}
+
+// handleGetMemory returns whether memory is on for the caller and what is
+// remembered about them.
+func (s *server) handleGetMemory(c *gin.Context) {
+	owner, ok := requireOwner(c)
+	if !ok {
+		return
+	}
+	mem := s.store.Memory(owner)
+	views := make([]memoryView, 0, len(mem.Facts))
+	for _, f := range mem.Facts {
+		views = append(views, memoryView{ID: f.ID, Text: f.Text, Session: f.Session, CreatedAt: f.CreatedAt})
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": mem.Enabled, "memories": views})
+}
+
+// handleSetMemory turns memory on or off for the caller.
+func (s *server) handleSetMemory(c *gin.Context) {
+	owner, ok := requireOwner(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Enabled == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Please provide a JSON body with a boolean 'enabled' field."})
+		return
+	}
+	if err := s.store.SetMemoryEnabled(owner, *req.Enabled); err != nil {
+		log.Printf("Error saving memory setting of %s: %v", owner, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	auditNote(c, "memory enabled=%t for %s", *req.Enabled, owner)
+	c.JSON(http.StatusOK, gin.H{"enabled": *req.Enabled})
+}
+
+// handleDeleteMemories forgets one remembered fact of the caller, or all of
+// them.
+func (s *server) handleDeleteMemories(c *gin.Context) {
+	owner, ok := requireOwner(c)
+	if !ok {
+		return
+	}
+	var ids []string
+	if id := c.Param("id"); id != "" {
+		ids = append(ids, id)
+	}
+	deleted, err := s.store.DeleteMemories(owner, ids...)
+	if err != nil {
+		log.Printf("Error deleting memories of %s: %v", owner, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	if len(ids) > 0 && deleted == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Memory not found."})
+		return
+	}
+	auditNote(c, "deleted %d memories of %s", deleted, owner)
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+}
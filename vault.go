@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// vaultClient reads secrets from a HashiCorp Vault KV version 2 engine.
+type vaultClient struct {
+	addr   string
+	token  string
+	mount  string
+	client *http.Client
+}
+
+func newVaultClient(vc *VaultConfig, token string) (*vaultClient, error) {
+	transport, err := newTransport("", vc.TLS, nil)
+	if err != nil {
+		return nil, fmt.Errorf("vault: %w", err)
+	}
+	return &vaultClient{
+		addr:   strings.TrimSuffix(vc.Addr, "/"),
+		token:  token,
+		mount:  strings.Trim(vc.Mount, "/"),
+		client: &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}, nil
+}
+
+// call performs a Vault API request and decodes the JSON response into out.
+func (v *vaultClient) call(ctx context.Context, method, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, v.addr+"/v1/"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("vault: reading response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault: %s %s: status %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// read returns one field of a KV v2 secret. ref is "<path>#<field>",
+// relative to the configured mount; the field defaults to "value".
+func (v *vaultClient) read(ctx context.Context, ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok {
+		field = "value"
+	}
+
+	var secret struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if err := v.call(ctx, "GET", v.mount+"/data/"+strings.Trim(path, "/"), &secret); err != nil {
+		return "", err
+	}
+
+	value, ok := secret.Data.Data[field].(string)
+	if !ok || value == "" {
+		return "", fmt.Errorf("vault: secret %s has no string field %q", path, field)
+	}
+	return value, nil
+}
+
+// renewToken extends the lease of the client's own token. Tokens that are
+// not renewable are left alone.
+func (v *vaultClient) renewToken(ctx context.Context) error {
+	var self struct {
+		Data struct {
+			Renewable bool `json:"renewable"`
+		} `json:"data"`
+	}
+	if err := v.call(ctx, "GET", "auth/token/lookup-self", &self); err != nil {
+		return err
+	}
+	if !self.Data.Renewable {
+		return nil
+	}
+	return v.call(ctx, "POST", "auth/token/renew-self", nil)
+}
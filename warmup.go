@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// warmupTimeout bounds one warmup completion.
+const warmupTimeout = 30 * time.Second
+
+// warmupResult is the outcome of a provider's last warmup.
+type warmupResult struct {
+	OK        bool      `json:"ok"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// warmupAll warms up every provider concurrently.
+func (s *server) warmupAll(ctx context.Context) {
+	for _, p := range s.allProviders() {
+		go s.warmupProvider(ctx, p)
+	}
+}
+
+// warmupProvider sends p a one-token completion, which checks its key and
+// leaves a connection open for the first real request, and records the
+// outcome for readiness. It does nothing unless warmup is configured.
+func (s *server) warmupProvider(ctx context.Context, p *provider) {
+	if s.cfg.Warmup == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, warmupTimeout)
+	defer cancel()
+
+	payload := newPayload([]Message{{Role: "user", Content: "ping"}})
+	payload.Model = s.warmupModel()
+	payload.MaxTokens = 1
+	_, err := p.complete(ctx, payload)
+
+	res := &warmupResult{OK: true, CheckedAt: time.Now().UTC()}
+	// An empty answer still proves the key and the connection work.
+	if err != nil && !errors.Is(err, errEmptyCompletion) {
+		code, _ := classifyError(err)
+		res = &warmupResult{Error: code, CheckedAt: res.CheckedAt}
+		log.Printf("Warmup of provider %s failed: %v", p.name, err)
+	}
+	p.warmup.Store(res)
+}
+
+// warmupModel is the model warmup completions ask for.
+func (s *server) warmupModel() string {
+	model := s.cfg.Warmup.Model
+	if model == "" {
+		model = s.cfg.DefaultModel
+	}
+	if alias, ok := s.cfg.ModelAliases[model]; ok {
+		return alias.Model
+	}
+	return model
+}
+
+// handleReady reports whether the server can take traffic: with warmup
+// configured, every provider must have passed its last warmup.
+func (s *server) handleReady(c *gin.Context) {
+	if s.cfg.Warmup == nil {
+		c.JSON(http.StatusOK, gin.H{"ready": true})
+		return
+	}
+
+	ready := true
+	providers := gin.H{}
+	add := func(name string, p *provider) {
+		res := p.warmup.Load()
+		if res == nil {
+			ready = false
+			providers[name] = gin.H{"ok": false, "error": "pending"}
+			return
+		}
+		ready = ready && res.OK
+		providers[name] = res
+	}
+	for name, p := range s.providers {
+		add(name, p)
+	}
+	for id, t := range s.tenants {
+		for name, p := range t.providers {
+			add(id+"/"+name, p)
+		}
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{"ready": ready, "providers": providers})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Roles of workspace members. Owners manage members; editors and owners
+// create and change the workspace's sessions; viewers only read them.
+const (
+	workspaceOwner  = "owner"
+	workspaceEditor = "editor"
+	workspaceViewer = "viewer"
+)
+
+var workspaceRoles = []string{workspaceOwner, workspaceEditor, workspaceViewer}
+
+// workspaceHeader selects the workspace a request works in.
+const workspaceHeader = "X-Workspace"
+
+// workspaceContextKey is the gin context key holding the selected
+// *workspaceMembership.
+const workspaceContextKey = "askllm.workspace"
+
+// workspaceMembership is the caller's membership of the selected workspace.
+type workspaceMembership struct {
+	workspace *Workspace
+	role      string
+}
+
+// namespace returns the session namespace of the workspace.
+func (m *workspaceMembership) namespace() string {
+	return "workspace/" + m.workspace.ID
+}
+
+// workspaceFrom returns the workspace selected for the request, or nil.
+func workspaceFrom(c *gin.Context) *workspaceMembership {
+	if v, ok := c.Get(workspaceContextKey); ok {
+		return v.(*workspaceMembership)
+	}
+	return nil
+}
+
+// selectWorkspace puts the request in the workspace named by the
+// X-Workspace header, if the caller is a member.
+func (s *server) selectWorkspace(c *gin.Context) {
+	id := c.GetHeader(workspaceHeader)
+	if id == "" {
+		c.Next()
+		return
+	}
+	ws, err := s.store.Workspace(id)
+	role := ""
+	if err == nil {
+		role = ws.Members[ownerFor(c)]
+	}
+	if role == "" {
+		auditNote(c, "rejected: not a member of workspace %q", id)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Unknown workspace."})
+		return
+	}
+	c.Set(workspaceContextKey, &workspaceMembership{workspace: ws, role: role})
+	c.Next()
+}
+
+// requireMember loads the workspace in the path and rejects callers that
+// are not members, or whose role is not among allowed, if given.
+func (s *server) requireMember(c *gin.Context, allowed ...string) (*Workspace, bool) {
+	ws, err := s.store.Workspace(c.Param("id"))
+	role := ""
+	if err == nil {
+		role = ws.Members[ownerFor(c)]
+	}
+	if role == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found."})
+		return nil, false
+	}
+	if len(allowed) > 0 && !slices.Contains(allowed, role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Workspace %ss cannot do this.", role)})
+		return nil, false
+	}
+	return ws, true
+}
+
+// createWorkspaceRequest names a new workspace.
+type createWorkspaceRequest struct {
+	Name string `json:"name"`
+}
+
+// handleCreateWorkspace creates a workspace owned by the caller.
+func (s *server) handleCreateWorkspace(c *gin.Context) {
+	var req createWorkspaceRequest
+	name := ""
+	if err := c.ShouldBindJSON(&req); err == nil {
+		name = strings.TrimSpace(req.Name)
+	}
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing workspace name."})
+		return
+	}
+	ws := &Workspace{
+		ID:        newID(),
+		Name:      truncateRunes(name, 100),
+		Members:   map[string]string{ownerFor(c): workspaceOwner},
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := s.store.CreateWorkspace(ws); err != nil {
+		log.Printf("Error saving workspace: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	auditNote(c, "created workspace %s", ws.ID)
+	c.JSON(http.StatusCreated, ws)
+}
+
+// handleListWorkspaces returns the workspaces the caller belongs to.
+func (s *server) handleListWorkspaces(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"workspaces": s.store.WorkspacesOf(ownerFor(c))})
+}
+
+// handleGetWorkspace returns a workspace with its members.
+func (s *server) handleGetWorkspace(c *gin.Context) {
+	if ws, ok := s.requireMember(c); ok {
+		c.JSON(http.StatusOK, ws)
+	}
+}
+
+// setMemberRequest gives a member a role.
+type setMemberRequest struct {
+	Role string `json:"role"`
+}
+
+// handleSetWorkspaceMember adds a member to a workspace or changes their
+// role.
+func (s *server) handleSetWorkspaceMember(c *gin.Context) {
+	ws, ok := s.requireMember(c, workspaceOwner)
+	if !ok {
+		return
+	}
+	var req setMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !slices.Contains(workspaceRoles, req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be owner, editor or viewer."})
+		return
+	}
+	member := c.Param("member")
+	if _, err := s.store.Account(member); err != nil && s.clients.Load().byID[member] == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown user."})
+		return
+	}
+	if ws.Members[member] == workspaceOwner && req.Role != workspaceOwner && owners(ws) == 1 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A workspace needs an owner."})
+		return
+	}
+	s.updateMember(c, ws.ID, member, req.Role)
+}
+
+// handleRemoveWorkspaceMember removes a member from a workspace. Owners
+// can remove anyone; members can leave.
+func (s *server) handleRemoveWorkspaceMember(c *gin.Context) {
+	member := c.Param("member")
+	var allowed []string
+	if member != ownerFor(c) {
+		allowed = []string{workspaceOwner}
+	}
+	ws, ok := s.requireMember(c, allowed...)
+	if !ok {
+		return
+	}
+	if _, ok := ws.Members[member]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not a member."})
+		return
+	}
+	if ws.Members[member] == workspaceOwner && owners(ws) == 1 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A workspace needs an owner."})
+		return
+	}
+	s.updateMember(c, ws.ID, member, "")
+}
+
+func (s *server) updateMember(c *gin.Context, id, member, role string) {
+	ws, err := s.store.SetWorkspaceMember(id, member, role)
+	if err != nil {
+		log.Printf("Error saving workspace %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	auditNote(c, "set role of %s in workspace %s to %q", member, id, role)
+	c.JSON(http.StatusOK, ws)
+}
+
+// owners counts the owners of a workspace.
+func owners(ws *Workspace) int {
+	n := 0
+	for _, role := range ws.Members {
+		if role == workspaceOwner {
+			n++
+		}
+	}
+	return n
+}
+
+// handleDeleteWorkspace deletes a workspace and its sessions.
+func (s *server) handleDeleteWorkspace(c *gin.Context) {
+	ws, ok := s.requireMember(c, workspaceOwner)
+	if !ok {
+		return
+	}
+	m := &workspaceMembership{workspace: ws}
+	sessions, err := s.store.DeleteWorkspace(ws.ID, m.namespace())
+	if errors.Is(err, errWorkspaceNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workspace not found."})
+		return
+	}
+	if err != nil {
+		log.Printf("Error deleting workspace %s: %v", ws.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	auditNote(c, "deleted workspace %s with %d sessions", ws.ID, sessions)
+	c.JSON(http.StatusOK, gin.H{"id": ws.ID, "sessions": sessions})
+}
+
+// handleListWorkspaceTemplates returns the workspace's own versions of
+// templates.
+func (s *server) handleListWorkspaceTemplates(c *gin.Context) {
+	ws, ok := s.requireMember(c)
+	if !ok {
+		return
+	}
+	templates := ws.Templates
+	if templates == nil {
+		templates = map[string]*TemplateConfig{}
+	}
+	c.JSON(http.StatusOK, gin.H{"templates": templates})
+}
+
+// handleSetWorkspaceTemplate stores the workspace's version of a template,
+// which requests made in the workspace run instead of the server's.
+func (s *server) handleSetWorkspaceTemplate(c *gin.Context) {
+	ws, ok := s.requireMember(c, workspaceOwner, workspaceEditor)
+	if !ok {
+		return
+	}
+	name := c.Param("name")
+	if lookupTemplate(name) == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found."})
+		return
+	}
+	var def TemplateConfig
+	if err := c.ShouldBindJSON(&def); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Please provide the template as a JSON body."})
+		return
+	}
+	def.Name = name
+	if _, err := parseTemplate(&def); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := s.store.SetWorkspaceTemplate(ws.ID, name, &def); err != nil {
+		log.Printf("Error saving workspace %s: %v", ws.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	auditNote(c, "set template %s of workspace %s", name, ws.ID)
+	c.JSON(http.StatusOK, &def)
+}
+
+// handleDeleteWorkspaceTemplate drops the workspace's version of a
+// template, so its requests run the server's again.
+func (s *server) handleDeleteWorkspaceTemplate(c *gin.Context) {
+	ws, ok := s.requireMember(c, workspaceOwner, workspaceEditor)
+	if !ok {
+		return
+	}
+	name := c.Param("name")
+	if ws.Templates[name] == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found."})
+		return
+	}
+	if _, err := s.store.SetWorkspaceTemplate(ws.ID, name, nil); err != nil {
+		log.Printf("Error saving workspace %s: %v", ws.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error."})
+		return
+	}
+	auditNote(c, "deleted template %s of workspace %s", name, ws.ID)
+	c.Status(http.StatusNoContent)
+}